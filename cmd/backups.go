@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func newBackupsCommand(env *Env) *cobra.Command {
+	var target string
+
+	backupsCmd := &cobra.Command{
+		Use:   "backups",
+		Short: "Manage the files replaced by installing packages with --force",
+		Long: `Manage the files that installing packages with --force moved out of the
+way of the symlinks. Each installation that replaces files keeps them in a
+backup named after the time it was made, and uninstalling the package puts
+them back, unless something else has taken their place since.`,
+	}
+
+	backupsCmd.PersistentFlags().StringVarP(&target, "target", "t", "", "directory the files were replaced in (default is $PWD)")
+
+	backupsCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the backups and the package that restores each of them",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBackupsList(env, target)
+		},
+	})
+
+	backupsCmd.AddCommand(&cobra.Command{
+		Use:   "restore <backup> [file]...",
+		Short: "Put the files in a backup back into the target directory",
+		Long: `Put the files in the backup back into the target directory, or only the
+given files, which are relative to the target directory. Nothing may be in
+their place, so a package that replaced them must be uninstalled first.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBackupsRestore(env, target, args[0], args[1:])
+		},
+	})
+
+	backupsCmd.AddCommand(&cobra.Command{
+		Use:   "prune",
+		Short: "Delete the backups that no installed package restores",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBackupsPrune(env, target)
+		},
+	})
+
+	return backupsCmd
+}
+
+func runBackupsList(env *Env, target string) error {
+	client, err := env.client(target)
+	if err != nil {
+		return err
+	}
+
+	backups, err := client.Backups()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(env.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, backup := range backups {
+		owner := "(no package)"
+		if backup.Package != nil {
+			owner = backup.Package.Source.String()
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", backup.ID, backup.Name, owner)
+	}
+
+	return nil
+}
+
+func runBackupsRestore(env *Env, target string, id string, names []string) error {
+	client, err := env.client(target)
+	if err != nil {
+		return err
+	}
+
+	restored, err := client.RestoreBackup(id, names...)
+	for _, backup := range restored {
+		fmt.Fprintf(env.Stdout, "restored %s\n", backup.Name)
+	}
+
+	return err
+}
+
+func runBackupsPrune(env *Env, target string) error {
+	client, err := env.client(target)
+	if err != nil {
+		return err
+	}
+
+	removed, err := client.PruneBackups()
+	for _, backup := range removed {
+		fmt.Fprintf(env.Stdout, "removed %s\n", backup)
+	}
+
+	return err
+}
@@ -0,0 +1,516 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	pkg.SandboxHelper()
+
+	// The README examples run the test binary as the stowaway executable
+	if filepath.Base(os.Args[0]) == "stowaway" {
+		Execute()
+	}
+
+	os.Exit(m.Run())
+}
+
+func tmpDir(t *testing.T, paths ...string) filesystem.Path {
+	dir := filesystem.MakePath(t.TempDir())
+
+	for _, path := range paths {
+		full := dir.Join(path)
+		if path[len(path)-1] == '/' {
+			require.NoError(t, full.MkdirAll(0755))
+			continue
+		}
+
+		require.NoError(t, full.Parent().MkdirAll(0755))
+		require.NoError(t, full.WriteFile([]byte{}, 0644))
+	}
+
+	return dir
+}
+
+// testEnv returns an environment for running commands in dir that fails if
+// the user is prompted
+func testEnv(t *testing.T, dir filesystem.Path) (*Env, *bytes.Buffer) {
+	t.Setenv("XDG_STATE_HOME", dir.Join("state").String())
+	t.Setenv("XDG_CONFIG_HOME", dir.Join("config").String())
+	t.Setenv("XDG_CACHE_HOME", dir.Join("cache").String())
+	t.Setenv("XDG_DATA_HOME", dir.Join("data").String())
+
+	output := bytes.NewBuffer([]byte{})
+	env := &Env{
+		Stdout: output,
+		Stderr: output,
+		Dir:    dir,
+		Terminal: func() bool {
+			return true
+		},
+		Confirm: func(message string) (bool, error) {
+			return false, errors.New("unexpected prompt")
+		},
+		Select: func(message string, options []string) ([]int, error) {
+			return nil, errors.New("unexpected prompt")
+		},
+		Choose: func(message string, options []string) (int, error) {
+			return 0, errors.New("unexpected prompt")
+		},
+	}
+
+	return env, output
+}
+
+func run(env *Env, args ...string) error {
+	rootCmd := NewRootCommand(env)
+	rootCmd.SetArgs(args)
+	return rootCmd.ExecuteContext(context.Background())
+}
+
+func TestStowCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/git/.gitconfig", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.NoError(t, run(env, "stow", "../dotfiles/bash", tmp.Join("dotfiles/git").String()))
+
+	state, err := pkg.DefaultStateDir(tmp.Join("home"))
+	require.NoError(t, err)
+
+	link, err := tmp.Join("home/.bashrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, state.Join(stowaway.PackageID(tmp.Join("dotfiles/bash")), "source/.bashrc"), link)
+
+	require.NoError(t, run(env, "packages", "--prefix", "../dotfiles/g"))
+	require.Equal(t, tmp.Join("dotfiles/git").String()+"\n", output.String())
+
+	// Flags do not carry over from one run to the next
+	require.NoError(t, run(env, "stow", "--delete", "../dotfiles/git"))
+	require.NoError(t, run(env, "stow", "../dotfiles/git"))
+
+	output.Reset()
+	require.NoError(t, run(env, "packages", "--target", "."))
+	require.Equal(t, tmp.Join("dotfiles/bash").String()+"\n"+tmp.Join("dotfiles/git").String()+"\n", output.String())
+
+	err = run(env, "stow")
+	require.EqualError(t, err, "provide at least one package path")
+
+	err = run(env, "stow", "--on-hook-failure", "explode", "../dotfiles/bash")
+	require.EqualError(t, err, `invalid failure policy "explode"`)
+}
+
+func TestStowCommandInteractive(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/git/.gitconfig", "home/")
+	env, _ := testEnv(t, tmp.Join("home"))
+
+	env.Select = func(message string, options []string) ([]int, error) {
+		require.Equal(t, []string{"bash", "git"}, options)
+		return []int{1}, nil
+	}
+
+	require.NoError(t, run(env, "stow", "-i", "../dotfiles/bash", "../dotfiles/git"))
+
+	_, err := tmp.Join("home/.bashrc").Readlink()
+	require.True(t, os.IsNotExist(err))
+
+	_, err = tmp.Join("home/.gitconfig").Readlink()
+	require.NoError(t, err)
+}
+
+func TestStowCommandStateDir(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	// Keeping the state in the target directory lays it out like older
+	// versions did
+	require.NoError(t, run(env, "stow", "--state-dir", ".stowaway", "../dotfiles/bash"))
+
+	link, err := tmp.Join("home/.bashrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, tmp.Join("home/.stowaway", stowaway.PackageID(tmp.Join("dotfiles/bash")), "source/.bashrc"), link)
+
+	// The state is moved into the default state directory
+	state, err := pkg.DefaultStateDir(tmp.Join("home"))
+	require.NoError(t, err)
+
+	require.NoError(t, run(env, "packages"))
+	require.Equal(t, fmt.Sprintf("moved the package state from %s to %s\n%s\n", tmp.Join("home/.stowaway"), state, tmp.Join("dotfiles/bash")), output.String())
+
+	link, err = tmp.Join("home/.bashrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, state.Join(stowaway.PackageID(tmp.Join("dotfiles/bash")), "source/.bashrc"), link)
+
+	require.NoError(t, run(env, "stow", "--delete", "../dotfiles/bash"))
+	_, err = tmp.Join("home/.bashrc").Readlink()
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStowCommandTrust(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	manifest := "name = \"bash\"\n[hooks]\nafter_install = [\"echo hello\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	asked := 0
+	env.Confirm = func(message string) (bool, error) {
+		asked++
+		return asked == 1, nil
+	}
+
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.Contains(t, output.String(), "Hook after_install of package bash ("+tmp.Join("dotfiles/bash").String()+") has not been trusted yet. It runs:\n  echo hello\n")
+	require.Contains(t, output.String(), "[bash:after_install] hello\n")
+
+	// Trusted hooks are not asked about again
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.Equal(t, 1, asked)
+
+	manifest = "name = \"bash\"\n[hooks]\nafter_install = [\"echo changed\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	output.Reset()
+	err := run(env, "stow", "../dotfiles/bash")
+	require.ErrorIs(t, err, pkg.ErrStowFailed)
+	require.NotContains(t, err.Error(), "hook output was logged")
+	require.Contains(t, output.String(), "bash: failed: pkg: hook after_install of package bash has changed since it was trusted\n")
+
+	output.Reset()
+	require.NoError(t, run(env, "trust", "../dotfiles/bash"))
+	require.Equal(t, "trusted hook after_install of "+tmp.Join("dotfiles/bash").String()+"\n", output.String())
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.Equal(t, 2, asked)
+
+	// The hooks of the repository configuration must be trusted as well
+	config := "[hooks]\nbefore_stow = [\"echo pulled\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/.stowaway.toml").WriteFile([]byte(config), 0644))
+
+	output.Reset()
+	require.Error(t, run(env, "stow", "../dotfiles/bash"))
+	require.Contains(t, output.String(), "Hook before_stow of configuration "+tmp.Join("dotfiles/.stowaway.toml").String()+" has not been trusted yet. It runs:\n  echo pulled\n")
+
+	output.Reset()
+	require.NoError(t, run(env, "trust", "../dotfiles/bash"))
+	require.Contains(t, output.String(), "trusted hook before_stow of "+tmp.Join("dotfiles/.stowaway.toml").String()+"\n")
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.Contains(t, output.String(), "[stowaway:before_stow] pulled\n")
+	require.Equal(t, 3, asked)
+}
+
+func TestStowCommandTrustNotTerminal(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+	env.Terminal = func() bool {
+		return false
+	}
+
+	manifest := "name = \"bash\"\n[hooks]\nafter_install = [\"echo hello\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	// The user is not prompted and the package is left alone
+	require.ErrorIs(t, run(env, "stow", "../dotfiles/bash"), pkg.ErrStowFailed)
+	require.Contains(t, output.String(), "bash: failed: cannot ask whether to trust hook after_install of package bash: standard input is not a terminal (use stowaway trust or --trust-all)\n")
+
+	exists, err := tmp.Join("home/.bashrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestTrustCommandSource(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "repo/bash/src/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	manifest := []byte("name = \"bash\"\n[hooks]\nafter_install = [\"echo hello\"]\n")
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile(manifest, 0644))
+	require.NoError(t, tmp.Join("repo/bash/stowaway.toml").WriteFile(manifest, 0644))
+
+	// Hooks stay trusted when a new snapshot of the package is installed
+	require.NoError(t, run(env, "trust", "../dotfiles/bash"))
+	require.NoError(t, run(env, "stow", "--store", "../dotfiles/bash"))
+	require.NoError(t, tmp.Join("dotfiles/bash/src/.inputrc").WriteFile(nil, 0644))
+	require.NoError(t, run(env, "stow", "--store", "../dotfiles/bash"))
+	require.Contains(t, output.String(), "[bash:after_install] hello\n")
+	require.NoError(t, run(env, "stow", "--delete", "../dotfiles/bash"))
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = tmp.Join("repo").String()
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	git("init", "--quiet")
+	git("add", "--all")
+	git("commit", "--quiet", "--message", "commit")
+
+	// Remote packages are trusted by their URL, whichever commit is installed
+	url := "file://" + tmp.Join("repo").String() + "#path=bash"
+	output.Reset()
+	require.NoError(t, run(env, "trust", url))
+	require.Equal(t, "trusted hook after_install of "+url+"\n", output.String())
+	require.NoError(t, run(env, "stow", url))
+
+	require.NoError(t, tmp.Join("repo/bash/src/.inputrc").WriteFile(nil, 0644))
+	git("add", "--all")
+	git("commit", "--quiet", "--message", "inputrc")
+	require.NoError(t, run(env, "update"))
+
+	_, err := tmp.Join("home/.inputrc").Readlink()
+	require.NoError(t, err)
+}
+
+func TestStowCommandDryRun(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	manifest := "name = \"bash\"\n[hooks]\nafter_install = [\"touch ran\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	// Hooks are listed without being run or asked about
+	require.NoError(t, run(env, "stow", "--dry-run", "../dotfiles/bash"))
+	require.Equal(t, "would install bash\nwould run hook after_install of bash: touch ran\n", output.String())
+
+	exists, err := tmp.Join("home/ran").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Nothing is logged when no hooks run
+	state, err := pkg.DefaultStateDir(tmp.Join("home"))
+	require.NoError(t, err)
+
+	exists, err = state.Join("logs").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestStowCommandLog(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "home/")
+	env, _ := testEnv(t, tmp.Join("home"))
+
+	manifest := "name = \"bash\"\n[hooks]\nafter_install = [\"echo failing; exit 3\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	state, err := pkg.DefaultStateDir(tmp.Join("home"))
+	require.NoError(t, err)
+
+	stowErr := run(env, "stow", "--trust-all", "--quiet", "../dotfiles/bash")
+	require.ErrorIs(t, stowErr, pkg.ErrStowFailed)
+
+	logs, err := state.Join("logs").ReadDir()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+
+	logFile := state.Join("logs", logs[0].Name())
+	require.Contains(t, stowErr.Error(), "(hook output was logged to "+logFile.String()+")")
+
+	contents, err := os.ReadFile(logFile.String())
+	require.NoError(t, err)
+	require.Equal(t, "[bash:after_install] failing\n", string(contents))
+}
+
+func TestLintCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "dotfiles/bash/README")
+	env, output := testEnv(t, tmp)
+
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte("name = \"bash\"\n"), 0644))
+
+	require.NoError(t, run(env, "lint", "dotfiles/bash"))
+	require.Equal(t, tmp.Join("dotfiles/bash/README").String()+": warning: present in the package root but will not be linked\n", output.String())
+
+	require.ErrorIs(t, run(env, "lint", "--strict", "dotfiles/bash"), errLintFailed)
+}
+
+func TestStatusCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.NoError(t, tmp.Join("home/.bashrc").Remove())
+
+	require.NoError(t, run(env, "status"))
+	require.Equal(t, "bash: installed, 1 link missing\n", output.String())
+
+	// The on_status_drift hook only runs when asked to
+	manifest := "[hooks]\non_status_drift = [\"echo drifted\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	output.Reset()
+	require.NoError(t, run(env, "status"))
+	require.NotContains(t, output.String(), "drifted")
+
+	output.Reset()
+	require.NoError(t, run(env, "status", "--run-hooks", "--trust-all"))
+	require.Contains(t, output.String(), "drifted\n")
+}
+
+func TestUpdateCommand(t *testing.T) {
+	tmp := tmpDir(t, "repo/vim/.vimrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.ErrorIs(t, run(env, "update"), stowaway.ErrNoRemotePackages)
+
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "--all"}, {"commit", "--quiet", "--message", "commit"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = tmp.Join("repo").String()
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	url := "file://" + tmp.Join("repo").String() + "#path=vim"
+	require.NoError(t, run(env, "stow", url))
+	require.NoError(t, run(env, "update"))
+
+	output.Reset()
+	require.NoError(t, run(env, "status"))
+	require.Regexp(t, `^vim: installed at [0-9a-f]{7}\n$`, output.String())
+}
+
+func TestPackCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/vim/.vimrc", "dotfiles/vim/.vimrc.swp", "home/")
+	require.NoError(t, tmp.Join("dotfiles/vim/stowaway.toml").WriteFile([]byte("source = \".\"\nignore = [\"*.swp\"]\n"), 0644))
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.NoError(t, run(env, "pack", "../dotfiles/vim", "--output", "../vim.zip"))
+	require.Regexp(t, `^[0-9a-f]{64}  `+tmp.Join("vim.zip").String()+`\n$`, output.String())
+	require.FileExists(t, tmp.Join("vim.zip.sha256").String())
+
+	require.NoError(t, run(env, "stow", "../vim.zip"))
+	_, err := tmp.Join("home/.vimrc").Readlink()
+	require.NoError(t, err)
+
+	exists, err := tmp.Join("home/.vimrc.swp").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, run(env, "stow", "--delete", "../vim.zip"))
+	exists, err = tmp.Join("home/.vimrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestRollbackCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/vim/.vimrc", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.NoError(t, run(env, "stow", "--store", "../dotfiles/vim"))
+	require.NoError(t, tmp.Join("dotfiles/vim/.gvimrc").WriteFile(nil, 0644))
+	require.NoError(t, run(env, "stow", "--store", "../dotfiles/vim"))
+
+	_, err := tmp.Join("home/.gvimrc").Readlink()
+	require.NoError(t, err)
+
+	require.NoError(t, run(env, "rollback", "--package", "../dotfiles/vim"))
+	exists, err := tmp.Join("home/.gvimrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.ErrorIs(t, run(env, "rollback", "-p", "../dotfiles/vim"), stowaway.ErrNoSnapshot)
+
+	// Nothing is removed while the package is installed
+	output.Reset()
+	require.NoError(t, run(env, "gc"))
+	require.Empty(t, output.String())
+
+	state, err := pkg.DefaultStateDir(tmp.Join("home"))
+	require.NoError(t, err)
+	require.NoError(t, state.RemoveAll())
+	require.NoError(t, run(env, "gc"))
+	require.Regexp(t, `^(removed [0-9a-f]{64}\n){2}$`, output.String())
+}
+
+func TestGenerationsCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/git/.gitconfig", "home/")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.NoError(t, run(env, "stow", "../dotfiles/bash"))
+	require.NoError(t, run(env, "stow", "../dotfiles/git"))
+
+	output.Reset()
+	require.NoError(t, run(env, "generations"))
+	require.Regexp(t, `^1\t.*\tbash\n2\t.*\t(bash, git|git, bash) \(current\)\n$`, output.String())
+
+	require.NoError(t, run(env, "rollback", "--quiet"))
+	exists, err := tmp.Join("home/.gitconfig").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, run(env, "rollback", "2"))
+	_, err = tmp.Join("home/.gitconfig").Readlink()
+	require.NoError(t, err)
+
+	require.ErrorIs(t, run(env, "rollback", "9"), pkg.ErrGenerationNotFound)
+	require.Error(t, run(env, "rollback", "1", "--package", "../dotfiles/bash"))
+}
+
+func TestBackupsCommand(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "home/.bashrc")
+	env, output := testEnv(t, tmp.Join("home"))
+
+	require.Error(t, run(env, "stow", "../dotfiles/bash"))
+	require.NoError(t, run(env, "stow", "--force", "../dotfiles/bash"))
+
+	output.Reset()
+	require.NoError(t, run(env, "backups", "list"))
+	require.Regexp(t, `^\d{8}T\d{6}Z  \.bashrc  `+regexp.QuoteMeta(tmp.Join("dotfiles/bash").String())+`\n$`, output.String())
+	id := strings.Fields(output.String())[0]
+
+	require.ErrorIs(t, run(env, "backups", "restore", id), pkg.ErrBackupConflict)
+
+	// Uninstalling restores the file, so there is nothing left to prune
+	require.NoError(t, run(env, "stow", "-D", "../dotfiles/bash"))
+	info, err := tmp.Join("home/.bashrc").Lstat()
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+
+	output.Reset()
+	require.NoError(t, run(env, "backups", "prune"))
+	require.NoError(t, run(env, "backups", "list", "--target", "."))
+	require.Empty(t, output.String())
+}
+
+func TestStowCommandForce(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/bash/.profile", "home/.bashrc", "home/.profile")
+	env, _ := testEnv(t, tmp.Join("home"))
+
+	err := run(env, "stow", "--force=delete", "../dotfiles/bash")
+	require.EqualError(t, err, `invalid conflict strategy "delete"`)
+
+	// The strategy is not taken from the next argument
+	err = run(env, "stow", "--force", "skip", "../dotfiles/bash")
+	require.EqualError(t, err, `"skip" is a conflict strategy, use --force=skip (or ./skip for a package)`)
+
+	require.NoError(t, run(env, "stow", "--force=skip", "../dotfiles/bash"))
+	info, err := tmp.Join("home/.bashrc").Lstat()
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+
+	// The user is asked about each file
+	var messages []string
+	env.Choose = func(message string, options []string) (int, error) {
+		messages = append(messages, message)
+		require.Equal(t, []string{"skip", "backup", "overwrite", "adopt", "fail"}, options)
+		return 2, nil
+	}
+
+	require.NoError(t, run(env, "stow", "-D", "../dotfiles/bash"))
+	require.NoError(t, run(env, "stow", "--force=ask", "../dotfiles/bash"))
+	require.Len(t, messages, 2)
+	require.Contains(t, messages[0], tmp.Join("home/.bashrc").String())
+
+	_, err = tmp.Join("home/.bashrc").Readlink()
+	require.NoError(t, err)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesbehr/stowaway/stowaway"
+	"github.com/spf13/cobra"
+)
+
+func newGCCommand(env *Env) *cobra.Command {
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove unused entries from the store",
+		Long: `Remove the snapshots and extracted archives from the store that no
+installed package uses, in any target directory.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGC(env)
+		},
+	}
+
+	return gcCmd
+}
+
+func runGC(env *Env) error {
+	client := &stowaway.Client{Dir: env.Dir}
+	removed, err := client.GC()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		fmt.Fprintf(env.Stdout, "removed %s\n", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newGenerationsCommand(env *Env) *cobra.Command {
+	var target string
+
+	generationsCmd := &cobra.Command{
+		Use:   "generations",
+		Short: "List the generations of the target directory",
+		Long: `List the generations of the target directory, oldest first. A generation
+records the packages installed in the target directory each time stow,
+update or rollback succeeds, and rollback can restore any of them.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGenerations(env, target)
+		},
+	}
+
+	generationsCmd.Flags().StringVarP(&target, "target", "t", "", "directory to list the generations of (default is $PWD)")
+
+	return generationsCmd
+}
+
+func runGenerations(env *Env, target string) error {
+	client, err := env.client(target)
+	if err != nil {
+		return err
+	}
+
+	generations, err := client.Generations()
+	if err != nil {
+		return err
+	}
+
+	for i, generation := range generations {
+		names := make([]string, len(generation.Packages))
+		for j, p := range generation.Packages {
+			names[j] = p.Name
+		}
+
+		line := fmt.Sprintf("%d\t%s\t%s", generation.Number, generation.Time.Local().Format("2006-01-02 15:04:05"), strings.Join(names, ", "))
+		if len(names) == 0 {
+			line += "(no packages)"
+		}
+
+		if i == len(generations)-1 {
+			line += " (current)"
+		}
+
+		fmt.Fprintln(env.Stdout, line)
+	}
+
+	return nil
+}
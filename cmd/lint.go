@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/spf13/cobra"
+)
+
+// errLintFailed is returned by the lint command when it finds problems that
+// should cause it to exit with a non-zero status
+var errLintFailed = errors.New("problems were found")
+
+func newLintCommand(env *Env) *cobra.Command {
+	var strict bool
+
+	lintCmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Check packages for problems",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLint(env, strict, args)
+		},
+	}
+
+	lintCmd.Flags().BoolVarP(&strict, "strict", "s", false, "exit with a non-zero status on warnings as well as errors")
+
+	return lintCmd
+}
+
+func runLint(env *Env, strict bool, args []string) error {
+	if len(args) == 0 {
+		return errors.New("provide at least one package path")
+	}
+
+	var roots []filesystem.Path
+	for _, arg := range args {
+		roots = append(roots, env.Abs(arg))
+	}
+
+	failed := false
+	for _, issue := range pkg.Lint(roots...) {
+		fmt.Fprintln(env.Stdout, issue)
+
+		if issue.Severity == pkg.SeverityError || strict {
+			failed = true
+		}
+	}
+
+	if failed {
+		return errLintFailed
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/spf13/cobra"
+)
+
+func newPackCommand(env *Env) *cobra.Command {
+	var output string
+
+	packCmd := &cobra.Command{
+		Use:   "pack <package>",
+		Short: "Create an archive of a package",
+		Long: `Create an archive of a package that can be installed with stow. The format
+is chosen by the extension of the output file, which is .tar.gz, .tgz or
+.zip. Files ignored by the package manifest are left out. The SHA-256
+checksum of the archive is written next to it, in a file with the same name
+followed by .sha256, which stow verifies the archive against.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPack(env, output, args[0])
+		},
+	}
+
+	packCmd.Flags().StringVarP(&output, "output", "o", "", "the archive to create (default <package>.tar.gz)")
+
+	return packCmd
+}
+
+func runPack(env *Env, output, arg string) error {
+	root := env.Abs(arg)
+	if output == "" {
+		output = root.Basename() + ".tar.gz"
+	}
+
+	archive := env.Abs(output)
+	checksum, err := pkg.Pack(root, archive)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(env.Stdout, "%s  %s\n", checksum, archive)
+	return nil
+}
@@ -2,69 +2,78 @@ package cmd
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
-	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
 	"github.com/spf13/cobra"
 )
 
-var prefix string
+type packagesFlags struct {
+	target string
+	prefix string
+	long   bool
+}
 
-var packagesCmd = &cobra.Command{
-	Use:   "packages",
-	Short: "List installed packages",
-	Run: func(cmd *cobra.Command, args []string) {
-		pwd, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
-		}
+func newPackagesCommand(env *Env) *cobra.Command {
+	var flags packagesFlags
 
-		if target == "" {
-			target = pwd
-		} else {
-			target, err = filepath.Abs(target)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
+	packagesCmd := &cobra.Command{
+		Use:   "packages",
+		Short: "List installed packages",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPackages(env, flags)
+		},
+	}
 
-		targetPath := filesystem.MakePath(target)
+	packagesCmd.Flags().StringVarP(&flags.target, "target", "t", "", "directory to list installed packages for (default is $PWD)")
+	packagesCmd.Flags().StringVarP(&flags.prefix, "prefix", "p", "", "only list packages that start with this")
+	packagesCmd.Flags().BoolVarP(&flags.long, "long", "l", false, "also show the name, version, tags and description of each package")
 
-		state := targetPath.Join(".stowaway")
+	return packagesCmd
+}
 
-		files, err := state.ReadDir()
-		if err != nil {
-			log.Fatal(err)
-		}
+func runPackages(env *Env, flags packagesFlags) error {
+	client, err := env.client(flags.target)
+	if err != nil {
+		return err
+	}
+
+	installed, err := client.List()
+	if err != nil {
+		return err
+	}
 
-		if prefix != "" {
-			prefix, err = filepath.Abs(prefix)
-			if err != nil {
-				log.Fatal(err)
-			}
+	prefix := ""
+	if flags.prefix != "" {
+		prefix = env.Abs(flags.prefix).String()
+	}
+
+	w := tabwriter.NewWriter(env.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, p := range installed {
+		if prefix != "" && !strings.HasPrefix(p.Source.String(), prefix) {
+			continue
 		}
 
-		for _, file := range files {
-			if !file.IsDir() {
-				continue
-			}
+		if !flags.long {
+			fmt.Fprintln(w, p.Source)
+			continue
+		}
 
-			source, err := state.Join(file.Name(), "source").Readlink()
-			if err != nil {
-				log.Fatal(err)
-			}
+		status, err := pkg.ReadStatus(p.State)
+		if err != nil {
+			return err
+		}
 
-			if prefix == "" || strings.HasPrefix(source.String(), prefix) {
-				fmt.Println(source)
-			}
+		m := pkg.Manifest{Name: status.Name()}
+		if status.Installed != nil {
+			m = *status.Installed
 		}
-	},
-}
 
-func init() {
-	packagesCmd.Flags().StringVarP(&target, "target", "t", "", "directory to list installed packages for (default is $PWD)")
-	packagesCmd.Flags().StringVarP(&prefix, "prefix", "p", "", "only list packages that start with this")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Source, m.Name, m.Version, strings.Join(m.Tags, ","), m.Description)
+	}
+
+	return nil
 }
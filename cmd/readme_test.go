@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
+	"github.com/stretchr/testify/require"
+)
+
+// consoleCommand is a command from a console code block in the README, along
+// with the output it is expected to print.
+type consoleCommand struct {
+	Line    int
+	Command string
+	Output  []string
+}
+
+func readConsoleCommands(t *testing.T, path string) []consoleCommand {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var commands []consoleCommand
+	inBlock := false
+	line := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		text := scanner.Text()
+		line++
+
+		switch {
+		case text == "```console":
+			inBlock = true
+		case strings.HasPrefix(text, "```"):
+			inBlock = false
+		case !inBlock:
+		case strings.HasPrefix(text, "$ "):
+			commands = append(commands, consoleCommand{Line: line, Command: text[2:]})
+		case text != "" && len(commands) > 0:
+			last := &commands[len(commands)-1]
+			last.Output = append(last.Output, text)
+		}
+	}
+
+	require.NoError(t, scanner.Err())
+	return commands
+}
+
+// TestReadme runs the commands from the console code blocks in the README in
+// order, in a home directory set up like the one the examples were written
+// in, and checks that they print what the README says they do.
+func TestReadme(t *testing.T) {
+	tmp := tmpDir(t, "home/me/.bashrc", "home/me/.bash_logout", "home/me/stowaway/", "bin/")
+	home := tmp.Join("home/me").String()
+
+	out, err := exec.Command("cp", "-R", "-p", "../examples", tmp.Join("home/me/stowaway/examples").String()).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	// Running the test binary as stowaway runs the stowaway command
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	require.NoError(t, tmp.Join("bin/stowaway").Symlink(filesystem.MakePath(exe)))
+
+	// Package state directories are named after a hash of the package path,
+	// which is different in the temporary home directory
+	replacer := []string{"/home/me", home}
+	entries, err := os.ReadDir("../examples")
+	require.NoError(t, err)
+
+	for _, entry := range entries {
+		original := "/home/me/stowaway/examples/" + entry.Name()
+		replacer = append(replacer, stowaway.PackageID(filesystem.MakePath(original)), stowaway.PackageID(filesystem.MakePath(home, "stowaway/examples", entry.Name())))
+	}
+
+	// So is the state directory, which is named after a hash of the target
+	// directory
+	replacer = append(replacer, pkg.TargetID("/home/me"), pkg.TargetID(filesystem.Path(home)))
+
+	replace := strings.NewReplacer(replacer...).Replace
+
+	environ := []string{
+		"HOME=" + home,
+		"PATH=" + tmp.Join("bin").String() + string(os.PathListSeparator) + os.Getenv("PATH"),
+		"XDG_CONFIG_HOME=" + filepath.Join(home, ".config"),
+		"XDG_STATE_HOME=" + filepath.Join(home, ".local/state"),
+	}
+
+	for _, command := range readConsoleCommands(t, "../README.md") {
+		cmd := exec.Command("/bin/sh", "-c", replace(command.Command))
+		cmd.Dir = home
+		cmd.Env = environ
+
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "README.md:%d: %s\n%s", command.Line, command.Command, out)
+
+		var expected []string
+		for _, line := range command.Output {
+			expected = append(expected, replace(line))
+		}
+
+		actual := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		if len(out) == 0 {
+			actual = nil
+		}
+
+		// find lists directory entries in whatever order the filesystem
+		// returns them
+		if strings.HasPrefix(command.Command, "find ") {
+			sort.Strings(expected)
+			sort.Strings(actual)
+		}
+
+		require.Equal(t, expected, actual, "README.md:%d: %s", command.Line, command.Command)
+	}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
+	"github.com/spf13/cobra"
+)
+
+type rollbackFlags struct {
+	stowFlags
+	packages []string
+}
+
+func newRollbackCommand(env *Env) *cobra.Command {
+	var flags rollbackFlags
+
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback [generation]",
+		Short: "Restore the target directory to an earlier generation",
+		Long: `Restore the target directory to the given generation, or to the one before
+the current generation. Packages that are not in the generation are
+uninstalled, and the packages in it are reinstalled from where they were
+installed from. The generations command lists the generations.
+
+With --package, the given packages that were installed with --store are
+reinstalled from the snapshot they were installed from before instead.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRollback(cmd, env, flags, args)
+		},
+	}
+
+	addStowFlags(rollbackCmd, &flags.stowFlags)
+	rollbackCmd.Flags().StringArrayVarP(&flags.packages, "package", "p", nil, "roll back the package to its previous snapshot (can be repeated)")
+
+	return rollbackCmd
+}
+
+func runRollback(cmd *cobra.Command, env *Env, flags rollbackFlags, args []string) error {
+	if flags.options.HookFailure != "" && !flags.options.HookFailure.Valid() {
+		return fmt.Errorf("invalid failure policy %q", flags.options.HookFailure)
+	}
+
+	if flags.options.Conflict != "" && !flags.options.Conflict.Valid() {
+		return fmt.Errorf("invalid conflict strategy %q", flags.options.Conflict)
+	}
+
+	if err := checkForce(cmd, args); err != nil {
+		return err
+	}
+
+	client, err := env.client(flags.target)
+	if err != nil {
+		return err
+	}
+
+	if len(flags.packages) > 0 {
+		if len(args) > 0 {
+			return fmt.Errorf("a generation cannot be given with --package")
+		}
+
+		return stowPackages(cmd, env, flags.stowFlags, client, flags.packages, client.Rollback)
+	}
+
+	number := 0
+	if len(args) > 0 {
+		var err error
+		number, err = strconv.Atoi(args[0])
+		if err != nil || number < 1 {
+			return fmt.Errorf("invalid generation %q", args[0])
+		}
+	}
+
+	restore := func(ctx context.Context, options stowaway.Options, paths ...string) ([]pkg.Result, error) {
+		return client.RestoreGeneration(ctx, options, number)
+	}
+
+	return stowPackages(cmd, env, flags.stowFlags, client, nil, restore)
+}
@@ -1,25 +1,178 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
-var rootCmd = &cobra.Command{
-	Use:   "stowaway",
-	Short: "Symlink farm manager",
+// Env is everything the commands use from the environment they run in, so
+// that they can be run against temporary directories in tests.
+type Env struct {
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Dir is the working directory, which relative paths and the default
+	// target directory are resolved against
+	Dir filesystem.Path
+
+	// Terminal reports whether the user can be prompted, i.e. whether
+	// standard input is a terminal
+	Terminal func() bool
+
+	// Confirm asks the user a yes or no question
+	Confirm func(message string) (bool, error)
+
+	// Select asks the user to choose any number of the options, returning
+	// the indexes of the chosen options
+	Select func(message string, options []string) ([]int, error)
+
+	// Choose asks the user to choose one of the options, returning its index
+	Choose func(message string, options []string) (int, error)
+
+	// stateDir is the state directory given with the --state-dir flag
+	stateDir string
+}
+
+// DefaultEnv returns the environment of the current process, which prompts
+// the user on the terminal.
+func DefaultEnv() (*Env, error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Env{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Dir:    filesystem.MakePath(pwd),
+		Terminal: func() bool {
+			return term.IsTerminal(int(os.Stdin.Fd()))
+		},
+		Confirm: func(message string) (bool, error) {
+			confirmed := false
+			err := survey.AskOne(&survey.Confirm{Message: message}, &confirmed)
+			return confirmed, err
+		},
+		Select: func(message string, options []string) ([]int, error) {
+			var selected []int
+			prompt := &survey.MultiSelect{Message: message, Options: options}
+			err := survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
+			return selected, err
+		},
+		Choose: func(message string, options []string) (int, error) {
+			var chosen int
+			err := survey.AskOne(&survey.Select{Message: message, Options: options}, &chosen)
+			return chosen, err
+		},
+	}, nil
+}
+
+// Abs resolves the path against the working directory.
+func (env *Env) Abs(path string) filesystem.Path {
+	if filepath.IsAbs(path) {
+		return filesystem.MakePath(filepath.Clean(path))
+	}
+
+	return env.Dir.Join(path)
+}
+
+// target returns the target directory given with the --target flag, which
+// defaults to the working directory.
+func (env *Env) target(flag string) filesystem.Path {
+	if flag == "" {
+		return env.Dir
+	}
+
+	return env.Abs(flag)
+}
+
+// client returns a client for the target directory given with the --target
+// flag. The state that older versions kept in the target directory is moved
+// into the state directory first.
+func (env *Env) client(target string) (*stowaway.Client, error) {
+	client := &stowaway.Client{Target: env.target(target), Dir: env.Dir}
+	if env.stateDir != "" {
+		client.State = env.Abs(env.stateDir)
+	}
+
+	migrated, err := client.MigrateState()
+	if err != nil {
+		return nil, err
+	}
+
+	if migrated {
+		fmt.Fprintf(env.Stderr, "moved the package state from %s to %s\n", client.Target.Join(stowaway.StateDirName), client.StateDir())
+	}
+
+	return client, nil
 }
 
-func init() {
-	rootCmd.AddCommand(stowCmd)
-	rootCmd.AddCommand(packagesCmd)
+// NewRootCommand creates the stowaway command and its subcommands. Each call
+// returns commands with their own flags, so commands can be run more than
+// once in the same process.
+func NewRootCommand(env *Env) *cobra.Command {
+	rootCmd := &cobra.Command{
+		Use:           "stowaway",
+		Short:         "Symlink farm manager",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+
+	rootCmd.PersistentFlags().StringVar(&env.stateDir, "state-dir", "", "directory the package state is kept in (default is $XDG_STATE_HOME/stowaway/<target hash>)")
+
+	rootCmd.SetOut(env.Stdout)
+	rootCmd.SetErr(env.Stderr)
+
+	rootCmd.AddCommand(newStowCommand(env))
+	rootCmd.AddCommand(newPackagesCommand(env))
+	rootCmd.AddCommand(newStatusCommand(env))
+	rootCmd.AddCommand(newLintCommand(env))
+	rootCmd.AddCommand(newTrustCommand(env))
+	rootCmd.AddCommand(newUpdateCommand(env))
+	rootCmd.AddCommand(newPackCommand(env))
+	rootCmd.AddCommand(newRollbackCommand(env))
+	rootCmd.AddCommand(newGenerationsCommand(env))
+	rootCmd.AddCommand(newGCCommand(env))
+	rootCmd.AddCommand(newBackupsCommand(env))
+
+	return rootCmd
+}
+
+// Run runs the stowaway command with the arguments, returning the exit
+// status. Interrupting the process cancels the running hook, but lets
+// Stowaway finish any changes it is making to the package state.
+func Run(env *Env, args []string) int {
+	ctx, stop := pkg.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rootCmd := NewRootCommand(env)
+	rootCmd.SetArgs(args)
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(env.Stderr, err)
+		return 1
+	}
+
+	return 0
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	env, err := DefaultEnv()
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+
+	os.Exit(Run(env, os.Args[1:]))
 }
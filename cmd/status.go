@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/spf13/cobra"
+)
+
+type statusFlags struct {
+	target   string
+	runHooks bool
+	trustAll bool
+}
+
+func newStatusCommand(env *Env) *cobra.Command {
+	var flags statusFlags
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Compare installed packages with their source",
+		Long: `Compare installed packages with their source.
+
+With --run-hooks, the on_status_drift hook of each package whose symlinks no
+longer match the package is run with the drifted symlinks. Otherwise status
+only reads the package state and never runs anything.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runStatus(cmd, env, flags)
+		},
+	}
+
+	statusCmd.Flags().BoolVar(&flags.runHooks, "run-hooks", false, "run the on_status_drift hook of each package that has drifted")
+	statusCmd.Flags().BoolVar(&flags.trustAll, "trust-all", false, "trust every on_status_drift hook without asking (with --run-hooks)")
+	statusCmd.Flags().StringVarP(&flags.target, "target", "t", "", "directory to show the status of installed packages for (default is $PWD)")
+
+	return statusCmd
+}
+
+func runStatus(cmd *cobra.Command, env *Env, flags statusFlags) error {
+	client, err := env.client(flags.target)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := client.Status(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		fmt.Fprintf(env.Stdout, "%s: %s\n", status.Name(), status)
+	}
+
+	if !flags.runHooks {
+		return nil
+	}
+
+	trust, approve, err := loadTrust(env, flags.trustAll)
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		drifted := status.Drifted()
+		if len(drifted) == 0 || status.RootMissing {
+			continue
+		}
+
+		loader := pkg.Loader{State: status.State, Source: status.Root, Target: client.Target}
+		p, err := loader.Load()
+		if err != nil {
+			return err
+		}
+
+		hc := pkg.HookContext{
+			Operation:   pkg.OperationStatus,
+			Output:      env.Stdout,
+			Links:       drifted,
+			Trust:       trust,
+			ApproveHook: approve,
+		}
+
+		if err := p.RunHookIfExists(cmd.Context(), pkg.HookOnStatusDrift, hc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
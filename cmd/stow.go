@@ -1,110 +1,281 @@
 package cmd
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"log"
-	"os"
-	"path/filepath"
-
-	"github.com/AlecAivazis/survey/v2"
-	"github.com/jamesbehr/stowaway/filesystem"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
 	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
 	"github.com/spf13/cobra"
 )
 
-var target string
-var interactive bool
-var options pkg.StowOptions
+// describe formats the package metadata into a single line that is shown to
+// the user when selecting packages.
+func describe(m pkg.Manifest) string {
+	s := m.Name
+	if m.Version != "" {
+		s += " " + m.Version
+	}
+
+	if m.Description != "" {
+		s += " - " + m.Description
+	}
+
+	if len(m.Tags) > 0 {
+		s += " [" + strings.Join(m.Tags, ", ") + "]"
+	}
 
-func hash(path string) string {
-	h := md5.Sum([]byte(path))
-	digest := hex.EncodeToString(h[:])
-	return digest[:6]
+	return s
 }
 
-func interactiveFilter(packages []pkg.Package) ([]pkg.Package, error) {
+// interactiveFilter asks the user which of the packages at the given paths
+// to install, returning the chosen paths.
+func interactiveFilter(ctx context.Context, env *Env, client *stowaway.Client, paths []string) ([]string, error) {
+	packages, err := client.Load(ctx, paths...)
+	if err != nil {
+		return nil, err
+	}
+
 	names := make([]string, len(packages))
 	for i, pkg := range packages {
-		names[i] = pkg.Name()
+		names[i] = describe(pkg.Metadata())
 	}
 
-	var selected []int
-	prompt := &survey.MultiSelect{
-		Message: "Choose packages to install",
-		Options: names,
+	selected, err := env.Select("Choose packages to install", names)
+	if err != nil {
+		return nil, err
 	}
 
-	survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
-
-	filtered := make([]pkg.Package, len(selected))
+	filtered := make([]string, len(selected))
 	for i, index := range selected {
-		filtered[i] = packages[index]
+		filtered[i] = paths[index]
 	}
 
 	return filtered, nil
 }
 
-var stowCmd = &cobra.Command{
-	Use:   "stow",
-	Short: "Install a package",
-	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) == 0 {
-			log.Fatal("provide at least one package path")
+func hasWarnings(results []pkg.Result) bool {
+	for _, result := range results {
+		if len(result.Warnings) > 0 {
+			return true
 		}
+	}
 
-		pwd, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
+	return false
+}
+
+// printSummary shows which packages succeeded and which failed
+func printSummary(w io.Writer, results []pkg.Result, delete bool) {
+	succeeded := "installed"
+	if delete {
+		succeeded = "uninstalled"
+	}
+
+	for _, result := range results {
+		switch {
+		case result.Err != nil && result.RolledBack:
+			fmt.Fprintf(w, "%s: failed and rolled back: %s\n", result.Package.Name(), result.Err)
+		case result.Err != nil:
+			fmt.Fprintf(w, "%s: failed: %s\n", result.Package.Name(), result.Err)
+		default:
+			fmt.Fprintf(w, "%s: %s\n", result.Package.Name(), succeeded)
 		}
 
-		if target == "" {
-			target = pwd
-		} else {
-			target, err = filepath.Abs(target)
-			if err != nil {
-				log.Fatal(err)
-			}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(w, "%s: warning: %s\n", result.Package.Name(), warning)
 		}
+	}
+}
 
-		targetPath := filesystem.MakePath(target)
+type stowFlags struct {
+	target      string
+	interactive bool
+	quiet       bool
+	trustAll    bool
+	delete      bool
+	options     stowaway.Options
+}
 
-		var packages []pkg.Package
-		for _, arg := range args {
-			path, err := filepath.Abs(arg)
-			if err != nil {
-				log.Fatal(err)
-			}
+func newStowCommand(env *Env) *cobra.Command {
+	var flags stowFlags
 
-			loader := pkg.Loader{
-				State:  targetPath.Join(".stowaway", hash(path)),
-				Source: filesystem.MakePath(path),
-				Target: targetPath,
-			}
+	stowCmd := &cobra.Command{
+		Use:   "stow",
+		Short: "Install a package",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runStow(cmd, env, flags, args)
+		},
+	}
+
+	addStowFlags(stowCmd, &flags)
+	stowCmd.Flags().BoolVarP(&flags.interactive, "interactive", "i", false, "start an interactive session to filter the packages passed as arguments before installing")
+	stowCmd.Flags().BoolVarP(&flags.delete, "delete", "D", false, "uninstall the packages")
+
+	return stowCmd
+}
 
-			pkg, err := loader.Load()
-			if err != nil {
-				log.Fatal(err)
+// addStowFlags adds the flags of the commands that install packages
+func addStowFlags(cmd *cobra.Command, flags *stowFlags) {
+	cmd.Flags().StringVarP(&flags.target, "target", "t", "", "installation target (default is $PWD)")
+	cmd.Flags().StringVar((*string)(&flags.options.HookFailure), "on-hook-failure", "", "failure policy (fail, warn or rollback) for hooks without one in their manifest")
+	cmd.Flags().BoolVarP(&flags.quiet, "quiet", "q", false, "do not show the output of hooks (it is still logged)")
+	cmd.Flags().BoolVarP(&flags.options.DryRun, "dry-run", "n", false, "show what would be done, including the hooks that would run, without changing anything or running hooks")
+	cmd.Flags().BoolVar(&flags.options.Sandbox, "sandbox", false, "run hooks with read-only access outside the target and package and without network access (Linux only)")
+	cmd.Flags().BoolVar(&flags.options.AllowUnsandboxed, "allow-unsandboxed", false, "run hooks without a sandbox if it cannot be created")
+	cmd.Flags().BoolVar(&flags.trustAll, "trust-all", false, "trust every hook without asking, including hooks that changed")
+	cmd.Flags().BoolVar(&flags.options.Store, "store", false, "install a snapshot of each package copied into the store instead of the package directory")
+	cmd.Flags().StringVarP((*string)(&flags.options.Conflict), "force", "f", "", "strategy (skip, backup, overwrite, adopt or ask) for files in the way of the symlinks, without a rule in their manifest, given as --force=<strategy>; --force alone is backup")
+	cmd.Flags().Lookup("force").NoOptDefVal = string(pkg.ConflictBackup)
+}
+
+// checkForce returns an error when an argument is the name of a conflict
+// strategy that was meant for --force, since the strategy is only read when
+// it is given with an equals sign
+func checkForce(cmd *cobra.Command, args []string) error {
+	if !cmd.Flags().Changed("force") {
+		return nil
+	}
+
+	for _, arg := range args {
+		for _, strategy := range pkg.ConflictStrategies {
+			if arg == string(strategy) {
+				return fmt.Errorf("%q is a conflict strategy, use --force=%s (or ./%s for a package)", arg, arg, arg)
 			}
+		}
+	}
+
+	return nil
+}
+
+func runStow(cmd *cobra.Command, env *Env, flags stowFlags, args []string) error {
+	if len(args) == 0 {
+		return errors.New("provide at least one package path")
+	}
+
+	if err := checkForce(cmd, args); err != nil {
+		return err
+	}
+
+	if flags.options.HookFailure != "" && !flags.options.HookFailure.Valid() {
+		return fmt.Errorf("invalid failure policy %q", flags.options.HookFailure)
+	}
 
-			packages = append(packages, pkg)
+	if flags.options.Conflict != "" && !flags.options.Conflict.Valid() {
+		return fmt.Errorf("invalid conflict strategy %q", flags.options.Conflict)
+	}
+
+	client, err := env.client(flags.target)
+	if err != nil {
+		return err
+	}
+
+	paths := args
+	if flags.interactive {
+		var err error
+		paths, err = interactiveFilter(cmd.Context(), env, client, paths)
+		if err != nil {
+			return err
 		}
+	}
 
-		if interactive {
-			packages, err = interactiveFilter(packages)
-			if err != nil {
-				log.Fatal(err)
-			}
+	stow := client.Install
+	if flags.delete {
+		stow = client.Uninstall
+	}
+
+	return stowPackages(cmd, env, flags, client, paths, stow)
+}
+
+// stowPackages runs stow with the options given by the flags, logging the
+// output of hooks and printing a summary if anything went wrong.
+func stowPackages(cmd *cobra.Command, env *Env, flags stowFlags, client *stowaway.Client, paths []string, stow func(context.Context, stowaway.Options, ...string) ([]pkg.Result, error)) error {
+	options := flags.options
+
+	// The log is only created once a hook writes to it, so dry runs and
+	// packages without hooks do not leave empty logs behind
+	logFile := pkg.NewLog(client.StateDir())
+	defer logFile.Close()
+
+	var err error
+	options.Trust, options.ApproveHook, err = loadTrust(env, flags.trustAll)
+	if err != nil {
+		return err
+	}
+
+	options.AskConflict = func(conflict pkg.UnresolvedConflict) (pkg.ConflictStrategy, error) {
+		return askConflict(env, conflict)
+	}
+
+	options.Output = env.Stdout
+	options.HookOutput = logFile
+	if !flags.quiet {
+		options.HookOutput = io.MultiWriter(env.Stdout, logFile)
+	}
+
+	results, err := stow(cmd.Context(), options, paths...)
+	if err != nil && !errors.Is(err, stowaway.ErrFailed) {
+		return withLog(err, logFile, err)
+	}
+
+	if err != nil || hasWarnings(results) {
+		printSummary(env.Stdout, results, flags.delete)
+	}
+
+	if err != nil {
+		return withLog(err, logFile, resultErrors(results)...)
+	}
+
+	return nil
+}
+
+// resultErrors returns the errors of the packages that failed
+func resultErrors(results []pkg.Result) []error {
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
 		}
+	}
+
+	return errs
+}
 
-		if err = pkg.Stow(options, packages...); err != nil {
-			log.Fatal(err)
+// withLog points to the log in err if any of the causes is a hook that failed
+// and the log was created. Other errors have nothing to do with hook output.
+func withLog(err error, log *pkg.Log, causes ...error) error {
+	if log.Name() == "" {
+		return err
+	}
+
+	for _, cause := range causes {
+		var hookErr *pkg.HookError
+		if errors.As(cause, &hookErr) {
+			return fmt.Errorf("%w (hook output was logged to %s)", err, log.Name())
 		}
-	},
+	}
+
+	return err
 }
 
-func init() {
-	stowCmd.Flags().StringVarP(&target, "target", "t", "", "installation target (default is $PWD)")
-	stowCmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "start an interactive session to filter the packages passed as arguments before installing")
-	stowCmd.Flags().BoolVarP(&options.Delete, "delete", "D", false, "uninstall the packages")
+// askConflict asks the user what to do with a file in the way of a symlink
+func askConflict(env *Env, conflict pkg.UnresolvedConflict) (pkg.ConflictStrategy, error) {
+	var strategies []pkg.ConflictStrategy
+	var options []string
+	for _, strategy := range pkg.ConflictStrategies {
+		if strategy != pkg.ConflictAsk {
+			strategies = append(strategies, strategy)
+			options = append(options, string(strategy))
+		}
+	}
+
+	message := fmt.Sprintf("%s is in the way of a symlink of package %s. What should be done with it?", conflict.Path, conflict.Package)
+	chosen, err := env.Choose(message, options)
+	if err != nil {
+		return "", fmt.Errorf("cannot ask what to do with %s: %w (use --force with another strategy)", conflict.Path, err)
+	}
+
+	return strategies[chosen], nil
 }
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/jamesbehr/stowaway/stowaway"
+	"github.com/spf13/cobra"
+)
+
+// loadTrust loads the user's trust store along with the function that
+// approves hooks that are not in it. Unless trustAll is set, the user is
+// asked about each hook.
+func loadTrust(env *Env, trustAll bool) (*pkg.TrustStore, func(pkg.UntrustedHook) (bool, error), error) {
+	path, err := pkg.TrustStorePath()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := pkg.LoadTrustStore(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if trustAll {
+		return store, func(pkg.UntrustedHook) (bool, error) { return true, nil }, nil
+	}
+
+	return store, func(hook pkg.UntrustedHook) (bool, error) {
+		return askTrust(env, hook)
+	}, nil
+}
+
+// errNotTerminal is returned instead of asking whether to trust a hook when
+// the user cannot be prompted
+var errNotTerminal = errors.New("standard input is not a terminal")
+
+func askTrust(env *Env, hook pkg.UntrustedHook) (bool, error) {
+	if !env.Terminal() {
+		return false, trustError(hook, errNotTerminal)
+	}
+
+	reason := "has not been trusted yet"
+	if hook.Changed {
+		reason = "has changed since it was trusted"
+	}
+
+	owner := hook.Owner()
+	if hook.Package != "" {
+		owner = fmt.Sprintf("%s (%s)", owner, hook.Source)
+	}
+
+	fmt.Fprintf(env.Stdout, "Hook %s of %s %s. It runs:\n", hook.Hook, owner, reason)
+	for _, command := range hook.Commands {
+		fmt.Fprintf(env.Stdout, "  %s\n", command)
+	}
+
+	approved, err := env.Confirm("Trust and run this hook?")
+	if err != nil {
+		return false, trustError(hook, err)
+	}
+
+	return approved, nil
+}
+
+func trustError(hook pkg.UntrustedHook, err error) error {
+	return fmt.Errorf("cannot ask whether to trust hook %s of %s: %w (use stowaway trust or --trust-all)", hook.Hook, hook.Owner(), err)
+}
+
+func newTrustCommand(env *Env) *cobra.Command {
+	return &cobra.Command{
+		Use:   "trust <package>...",
+		Short: "Approve the hooks of packages and their repository configuration so that they can run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runTrust(cmd.Context(), env, args)
+		},
+	}
+}
+
+func runTrust(ctx context.Context, env *Env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("provide at least one package path or URL")
+	}
+
+	store, _, err := loadTrust(env, false)
+	if err != nil {
+		return err
+	}
+
+	client := &stowaway.Client{Dir: env.Dir}
+	for _, arg := range args {
+		hooks, err := client.Hooks(ctx, arg)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(hooks.Digests))
+		for name := range hooks.Digests {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			store.Trust(hooks.Source, name, hooks.Digests[name])
+			fmt.Fprintf(env.Stdout, "trusted hook %s of %s\n", name, hooks.Source)
+		}
+
+		config := hooks.Config
+		if config == nil {
+			continue
+		}
+
+		for _, name := range []string{pkg.HookBeforeStow, pkg.HookAfterStow} {
+			if digest, ok := config.HookDigests()[name]; ok {
+				store.Trust(config.Path.String(), name, digest)
+				fmt.Fprintf(env.Stdout, "trusted hook %s of %s\n", name, config.Path)
+			}
+		}
+	}
+
+	return store.Save()
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newUpdateCommand(env *Env) *cobra.Command {
+	var flags stowFlags
+
+	updateCmd := &cobra.Command{
+		Use:   "update [url]...",
+		Short: "Fetch remote packages and reinstall them",
+		Long: `Fetch the remote packages with the given URLs from their repositories and
+reinstall them. Without any URLs, every remote package installed in the
+target directory is updated.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUpdate(cmd, env, flags, args)
+		},
+	}
+
+	addStowFlags(updateCmd, &flags)
+
+	return updateCmd
+}
+
+func runUpdate(cmd *cobra.Command, env *Env, flags stowFlags, args []string) error {
+	if flags.options.HookFailure != "" && !flags.options.HookFailure.Valid() {
+		return fmt.Errorf("invalid failure policy %q", flags.options.HookFailure)
+	}
+
+	if err := checkForce(cmd, args); err != nil {
+		return err
+	}
+
+	client, err := env.client(flags.target)
+	if err != nil {
+		return err
+	}
+	return stowPackages(cmd, env, flags, client, args, client.Update)
+}
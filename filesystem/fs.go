@@ -0,0 +1,302 @@
+package filesystem
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FS is a filesystem that packages can be installed on. Each method behaves
+// like the function of the same name in the os package, including the errors
+// it returns, so that code using an FS works the same way on any of them.
+type FS interface {
+	Lstat(name string) (fs.FileInfo, error)
+	Stat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+	Symlink(oldname, newname string) error
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+
+	// ReadDir returns the entries of the directory sorted by name
+	ReadDir(name string) ([]fs.DirEntry, error)
+
+	Open(name string) (fs.File, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// MkdirAllFS is implemented by an FS that can create a directory along with
+// its parents itself. MkdirAll uses it when it is available.
+type MkdirAllFS interface {
+	FS
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// RemoveAllFS is implemented by an FS that can remove a directory along with
+// its contents itself. RemoveAll uses it when it is available.
+type RemoveAllFS interface {
+	FS
+	RemoveAll(name string) error
+}
+
+// EvalSymlinksFS is implemented by an FS that can resolve symlinks in a path
+// itself. EvalSymlinks uses it when it is available.
+type EvalSymlinksFS interface {
+	FS
+	EvalSymlinks(name string) (string, error)
+}
+
+type osFS struct{}
+
+// OS is the FS of the operating system, which Path operates on.
+var OS FS = osFS{}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error)    { return os.Lstat(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)     { return os.Stat(name) }
+func (osFS) Readlink(name string) (string, error)      { return os.Readlink(name) }
+func (osFS) Symlink(oldname, newname string) error     { return os.Symlink(oldname, newname) }
+func (osFS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+func (osFS) Remove(name string) error                  { return os.Remove(name) }
+func (osFS) Rename(oldpath, newpath string) error      { return os.Rename(oldpath, newpath) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (osFS) EvalSymlinks(name string) (string, error)     { return filepath.EvalSymlinks(name) }
+
+// MkdirAll creates the directory name on fsys along with any missing parents,
+// like os.MkdirAll.
+func MkdirAll(fsys FS, name string, perm fs.FileMode) error {
+	if fsys, ok := fsys.(MkdirAllFS); ok {
+		return fsys.MkdirAll(name, perm)
+	}
+
+	info, err := fsys.Stat(name)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+
+		return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+	}
+
+	if parent := filepath.Dir(name); parent != name {
+		if err := MkdirAll(fsys, parent, perm); err != nil {
+			return err
+		}
+	}
+
+	if err := fsys.Mkdir(name, perm); err != nil {
+		// The directory may have been created in the meantime
+		if info, lerr := fsys.Lstat(name); lerr == nil && info.IsDir() {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// RemoveAll removes name from fsys along with anything it contains, like
+// os.RemoveAll. It is not an error if name does not exist.
+func RemoveAll(fsys FS, name string) error {
+	if fsys, ok := fsys.(RemoveAllFS); ok {
+		return fsys.RemoveAll(name)
+	}
+
+	info, err := fsys.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if info.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := RemoveAll(fsys, filepath.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fsys.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Exists reports whether name exists on fsys, without following a symlink at
+// name.
+func Exists(fsys FS, name string) (bool, error) {
+	_, err := fsys.Lstat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Walk calls f for root on fsys and everything inside it, like
+// filepath.Walk, with the paths relative to root. A symlink at root is
+// followed, but no others are.
+func Walk(fsys FS, root string, f filepath.WalkFunc) error {
+	return fs.WalkDir(dirFS{fsys: fsys, root: root}, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return f(path, nil, err)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return f(path, info, err)
+	})
+}
+
+// maxLinks is the number of symlinks EvalSymlinks follows before giving up
+const maxLinks = 255
+
+// EvalSymlinks returns name on fsys after resolving any symlinks in it, like
+// filepath.EvalSymlinks. Every part of name must exist.
+func EvalSymlinks(fsys FS, name string) (string, error) {
+	if fsys, ok := fsys.(EvalSymlinksFS); ok {
+		return fsys.EvalSymlinks(name)
+	}
+
+	volume := filepath.VolumeName(name)
+	rest := filepath.Clean(name[len(volume):])
+
+	resolved := "."
+	if filepath.IsAbs(rest) {
+		resolved = volume + string(filepath.Separator)
+	}
+
+	links := 0
+	for rest != "" {
+		var part string
+		part, rest = rest, ""
+		if i := strings.IndexRune(part, filepath.Separator); i != -1 {
+			part, rest = part[:i], part[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// The symlinks leading here have been resolved already, so
+			// going up is lexical
+			if filepath.Base(resolved) == ".." || resolved == "." {
+				resolved = filepath.Join(resolved, "..")
+			} else {
+				resolved = filepath.Dir(resolved)
+			}
+
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := fsys.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", &fs.PathError{Op: "EvalSymlinks", Path: name, Err: errLoop}
+		}
+
+		target, err := fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+
+		if filepath.IsAbs(target) {
+			volume = filepath.VolumeName(target)
+			resolved = volume + string(filepath.Separator)
+			target = target[len(volume):]
+		}
+
+		// The target is not cleaned, since going up from a symlink in it
+		// must follow the symlink first
+		if rest != "" {
+			target += string(filepath.Separator) + rest
+		}
+
+		rest = target
+	}
+
+	return resolved, nil
+}
+
+// dirFS is the directory root on an FS as an fs.FS, so that it can be walked
+// with fs.WalkDir. Like os.DirFS, it follows the root if it is a symlink.
+type dirFS struct {
+	fsys FS
+	root string
+}
+
+func (d dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return filepath.Join(d.root, filepath.FromSlash(path.Clean(name))), nil
+}
+
+func (d dirFS) Open(name string) (fs.File, error) {
+	full, err := d.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fsys.Open(full)
+}
+
+func (d dirFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := d.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fsys.Stat(full)
+}
+
+func (d dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := d.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fsys.ReadDir(full)
+}
@@ -0,0 +1,279 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errNotLink is returned when removing something that is not a symlink
+var errNotLink = errors.New("not a symlink")
+
+func validName(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return nil
+}
+
+type dirLinker struct {
+	fsys FS
+	root string
+}
+
+// DirLinker returns a Linker that creates symlinks on disk inside the
+// directory root.
+func DirLinker(root string) Linker {
+	return DirLinkerFS(OS, root)
+}
+
+// DirLinkerFS returns a Linker that creates symlinks inside the directory
+// root on fsys.
+func DirLinkerFS(fsys FS, root string) Linker {
+	return dirLinker{fsys: fsys, root: filepath.Clean(root)}
+}
+
+func (l dirLinker) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l dirLinker) CreateLink(target, linkName string) error {
+	if err := validName("symlink", linkName); err != nil {
+		return err
+	}
+
+	// Find the highest parent directory that is missing, so that the
+	// directories created for the symlink can be removed if it fails
+	dir, created := path.Dir(linkName), ""
+	for parent := dir; parent != "."; parent = path.Dir(parent) {
+		if _, err := l.fsys.Lstat(l.path(parent)); !os.IsNotExist(err) {
+			break
+		}
+
+		created = parent
+	}
+
+	linkPath := l.path(linkName)
+	err := MkdirAll(l.fsys, filepath.Dir(linkPath), 0755)
+	if err == nil {
+		err = l.fsys.Symlink(target, linkPath)
+	}
+
+	if err != nil && created != "" {
+		l.removeEmptyDirs(dir, created)
+	}
+
+	return err
+}
+
+func (l dirLinker) ReadLink(name string) (string, error) {
+	if err := validName("readlink", name); err != nil {
+		return "", err
+	}
+
+	return l.fsys.Readlink(l.path(name))
+}
+
+func (l dirLinker) RemoveLink(name string) error {
+	if err := validName("remove", name); err != nil {
+		return err
+	}
+
+	linkPath := l.path(name)
+	info, err := l.fsys.Lstat(linkPath)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return &fs.PathError{Op: "remove", Path: linkPath, Err: errNotLink}
+	}
+
+	if err := l.fsys.Remove(linkPath); err != nil {
+		return err
+	}
+
+	// Remove the parent directories that are now empty, up to the root
+	return l.removeEmptyDirs(path.Dir(name), "")
+}
+
+// removeEmptyDirs removes dir and then each of its parents while they are
+// empty, stopping after top or at the root.
+func (l dirLinker) removeEmptyDirs(dir, top string) error {
+	for ; dir != "."; dir = path.Dir(dir) {
+		entries, err := l.fsys.ReadDir(l.path(dir))
+		switch {
+		case os.IsNotExist(err):
+			// It was never created
+		case err != nil || len(entries) > 0:
+			return nil
+		default:
+			if err := l.fsys.Remove(l.path(dir)); err != nil {
+				return err
+			}
+		}
+
+		if dir == top {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (l dirLinker) Sub(dir string) (Linker, error) {
+	if dir == "." {
+		return l, nil
+	}
+
+	if err := validName("sub", dir); err != nil {
+		return nil, err
+	}
+
+	return dirLinker{fsys: l.fsys, root: l.path(dir)}, nil
+}
+
+func (l dirLinker) Root() string {
+	return l.root
+}
+
+// MemLinker is a Linker that keeps its symlinks in memory, for use in tests.
+// Directories exist as long as they contain a symlink, so empty parent
+// directories disappear when their last symlink is removed.
+type MemLinker struct {
+	root   string
+	prefix string
+	state  *memLinks
+}
+
+type memLinks struct {
+	mu    sync.Mutex
+	links map[string]string
+}
+
+// NewMemLinker returns an empty MemLinker whose root is reported as root.
+func NewMemLinker(root string) *MemLinker {
+	return &MemLinker{
+		root:  filepath.Clean(root),
+		state: &memLinks{links: map[string]string{}},
+	}
+}
+
+func (l *MemLinker) name(name string) string {
+	return path.Join(l.prefix, name)
+}
+
+// isDir reports whether the name is a parent directory of any symlink
+func (l *MemLinker) isDir(name string) bool {
+	for link := range l.state.links {
+		if strings.HasPrefix(link, name+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *MemLinker) CreateLink(target, linkName string) error {
+	if err := validName("symlink", linkName); err != nil {
+		return err
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	name := l.name(linkName)
+	if _, ok := l.state.links[name]; ok || l.isDir(name) {
+		return &fs.PathError{Op: "symlink", Path: linkName, Err: fs.ErrExist}
+	}
+
+	// Parent directories cannot be symlinks
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := l.state.links[dir]; ok {
+			return &fs.PathError{Op: "symlink", Path: linkName, Err: errNotDir}
+		}
+	}
+
+	l.state.links[name] = target
+	return nil
+}
+
+func (l *MemLinker) ReadLink(name string) (string, error) {
+	if err := validName("readlink", name); err != nil {
+		return "", err
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	target, ok := l.state.links[l.name(name)]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return target, nil
+}
+
+func (l *MemLinker) RemoveLink(name string) error {
+	if err := validName("remove", name); err != nil {
+		return err
+	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	full := l.name(name)
+	if _, ok := l.state.links[full]; !ok {
+		if l.isDir(full) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errNotLink}
+		}
+
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+
+	delete(l.state.links, full)
+	return nil
+}
+
+func (l *MemLinker) Sub(dir string) (Linker, error) {
+	if dir == "." {
+		return l, nil
+	}
+
+	if err := validName("sub", dir); err != nil {
+		return nil, err
+	}
+
+	return &MemLinker{
+		root:   filepath.Join(l.root, filepath.FromSlash(dir)),
+		prefix: l.name(dir),
+		state:  l.state,
+	}, nil
+}
+
+func (l *MemLinker) Root() string {
+	return l.root
+}
+
+// Links returns every symlink inside the linker's root, by their slash
+// separated path relative to the root.
+func (l *MemLinker) Links() map[string]string {
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+
+	links := map[string]string{}
+	for name, target := range l.state.links {
+		if l.prefix == "" {
+			links[name] = target
+		} else if strings.HasPrefix(name, l.prefix+"/") {
+			links[strings.TrimPrefix(name, l.prefix+"/")] = target
+		}
+	}
+
+	return links
+}
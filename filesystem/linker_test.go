@@ -0,0 +1,91 @@
+package filesystem
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testLinker(t *testing.T, linker Linker) {
+	require.NoError(t, linker.CreateLink("/src/.bashrc", ".bashrc"))
+	require.NoError(t, linker.CreateLink("/src/.config/nvim/init.vim", ".config/nvim/init.vim"))
+	require.NoError(t, linker.CreateLink("/src/.config/git", ".config/git"))
+
+	target, err := linker.ReadLink(".config/nvim/init.vim")
+	require.NoError(t, err)
+	require.Equal(t, "/src/.config/nvim/init.vim", target)
+
+	_, err = linker.ReadLink(".missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.ErrorIs(t, linker.CreateLink("/other", ".bashrc"), fs.ErrExist)
+	require.ErrorIs(t, linker.CreateLink("/other", "../escape"), fs.ErrInvalid)
+	require.ErrorIs(t, linker.RemoveLink(".missing"), fs.ErrNotExist)
+	require.Error(t, linker.RemoveLink(".config"))
+
+	sub, err := linker.Sub(".config")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(linker.Root(), ".config"), sub.Root())
+
+	target, err = sub.ReadLink("git")
+	require.NoError(t, err)
+	require.Equal(t, "/src/.config/git", target)
+
+	// Removing the last link in a directory removes the directory, but not
+	// the root
+	require.NoError(t, sub.RemoveLink("nvim/init.vim"))
+	require.NoError(t, linker.CreateLink("/src/.config/nvim", ".config/nvim"))
+	require.NoError(t, linker.RemoveLink(".config/nvim"))
+	require.NoError(t, linker.RemoveLink(".config/git"))
+	require.NoError(t, linker.CreateLink("/src/.config", ".config"))
+
+	same, err := linker.Sub(".")
+	require.NoError(t, err)
+	require.Equal(t, linker.Root(), same.Root())
+}
+
+func TestDirLinker(t *testing.T) {
+	root := t.TempDir()
+	testLinker(t, DirLinker(root))
+
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// Only symlinks are removed
+	require.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0755))
+	require.Error(t, DirLinker(root).RemoveLink("dir"))
+}
+
+func TestDirLinkerFS(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.Mkdir("/home", 0755))
+	testLinker(t, DirLinkerFS(fsys, "/home"))
+
+	// Sub linkers stay on the same FS
+	sub, err := DirLinkerFS(fsys, "/home").Sub("user")
+	require.NoError(t, err)
+	require.NoError(t, sub.CreateLink("/src/.bashrc", ".bashrc"))
+
+	target, err := fsys.Readlink("/home/user/.bashrc")
+	require.NoError(t, err)
+	require.Equal(t, "/src/.bashrc", target)
+
+	_, err = os.Lstat("/home/user/.bashrc")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMemLinker(t *testing.T) {
+	linker := NewMemLinker("/home/user")
+	testLinker(t, linker)
+
+	require.Equal(t, map[string]string{
+		".bashrc": "/src/.bashrc",
+		".config": "/src/.config",
+	}, linker.Links())
+
+	require.Error(t, linker.CreateLink("/other", ".config/git"))
+}
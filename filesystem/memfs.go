@@ -0,0 +1,510 @@
+package filesystem
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The errors returned by MemFS are the same ones the operating system
+// returns, so that errors.Is and os.IsNotExist work the same way on both.
+var (
+	errNotExist = syscall.ENOENT
+	errExist    = syscall.EEXIST
+	errNotDir   = syscall.ENOTDIR
+	errIsDir    = syscall.EISDIR
+	errNotEmpty = syscall.ENOTEMPTY
+	errLoop     = syscall.ELOOP
+	errAccess   = syscall.EACCES
+	errInvalid  = syscall.EINVAL
+)
+
+// maxSymlinks is the number of symlinks that are followed when resolving a
+// path before giving up, like Linux does
+const maxSymlinks = 40
+
+type memNode struct {
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte
+	target   string
+	children map[string]*memNode
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&fs.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+
+	return memInfo{name: name, size: size, mode: n.mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+type memFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: errIsDir}
+	}
+
+	return f.Reader.Read(p)
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// MemFS is an FS that keeps everything in memory, for tests that need many
+// filesystems or need operations to fail. It has files, directories and
+// symlinks, and checks the owner permission bits like the operating system
+// does for a user that is not root. All paths are resolved against "/".
+type MemFS struct {
+	mu   sync.Mutex
+	root *memNode
+
+	// Fault is called before every operation with the name of the operation,
+	// as used in the errors returned by the os package, and the path it
+	// operates on. If it returns an error the operation fails with that
+	// error without changing anything.
+	Fault func(op, name string) error
+}
+
+// NewMemFS returns a MemFS that only contains the root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		root: &memNode{
+			mode:     fs.ModeDir | 0755,
+			modTime:  time.Now(),
+			children: map[string]*memNode{},
+		},
+	}
+}
+
+func (m *MemFS) fault(op, name string) error {
+	if m.Fault == nil {
+		return nil
+	}
+
+	if err := m.Fault(op, name); err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func splitPath(name string) []string {
+	name = filepath.ToSlash(filepath.Clean(name))
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// resolve finds the node at name, following symlinks in every component but
+// the last one, and the last one too if follow is set. It returns the
+// directory the last component is in and its name, even if it does not
+// exist, so that it can be created. If name refers to the root directory, dir
+// is nil.
+func (m *MemFS) resolve(name string, follow bool) (dir *memNode, base string, node *memNode, err error) {
+	stack := []*memNode{m.root}
+	rest := splitPath(name)
+	links := 0
+
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		parent := stack[len(stack)-1]
+
+		if parent.mode&0100 == 0 {
+			return nil, "", nil, errAccess
+		}
+
+		if part == ".." {
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+
+			if len(rest) == 0 {
+				return nil, "", stack[len(stack)-1], nil
+			}
+
+			continue
+		}
+
+		child := parent.children[part]
+		last := len(rest) == 0
+
+		if child != nil && child.mode&fs.ModeSymlink != 0 && (!last || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, "", nil, errLoop
+			}
+
+			if filepath.IsAbs(child.target) {
+				stack = stack[:1]
+			}
+
+			rest = append(splitPath(child.target), rest...)
+			if len(rest) == 0 {
+				return nil, "", stack[len(stack)-1], nil
+			}
+
+			continue
+		}
+
+		if last {
+			return parent, part, child, nil
+		}
+
+		if child == nil {
+			return nil, "", nil, errNotExist
+		}
+
+		if !child.mode.IsDir() {
+			return nil, "", nil, errNotDir
+		}
+
+		stack = append(stack, child)
+	}
+
+	return nil, "", m.root, nil
+}
+
+// lookup returns the node at name, which must exist, along with the name
+// it is reported under
+func (m *MemFS) lookup(name string, follow bool) (string, *memNode, error) {
+	_, _, node, err := m.resolve(name, follow)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if node == nil {
+		return "", nil, errNotExist
+	}
+
+	return filepath.Base(name), node, nil
+}
+
+// create adds a node named name, which must not exist yet
+func (m *MemFS) create(name string, follow bool, node *memNode) error {
+	dir, base, existing, err := m.resolve(name, follow)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return errExist
+	}
+
+	if dir.mode&0200 == 0 {
+		return errAccess
+	}
+
+	node.modTime = time.Now()
+	dir.children[base] = node
+	dir.modTime = node.modTime
+	return nil
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.stat("lstat", name, false)
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	return m.stat("stat", name, true)
+}
+
+func (m *MemFS) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault(op, name); err != nil {
+		return nil, err
+	}
+
+	base, node, err := m.lookup(name, follow)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return node.info(base), nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("readlink", name); err != nil {
+		return "", err
+	}
+
+	_, node, err := m.lookup(name, false)
+	if err == nil && node.mode&fs.ModeSymlink == 0 {
+		err = errInvalid
+	}
+
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return node.target, nil
+}
+
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("symlink", newname); err != nil {
+		return err
+	}
+
+	node := &memNode{mode: fs.ModeSymlink | 0777, target: oldname}
+	if err := m.create(newname, false, node); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+
+	return nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("mkdir", name); err != nil {
+		return err
+	}
+
+	node := &memNode{mode: fs.ModeDir | perm.Perm(), children: map[string]*memNode{}}
+	if err := m.create(name, false, node); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("remove", name); err != nil {
+		return err
+	}
+
+	dir, base, node, err := m.resolve(name, false)
+	switch {
+	case err != nil:
+	case node == nil:
+		err = errNotExist
+	case dir == nil:
+		err = errInvalid
+	case len(node.children) > 0:
+		err = errNotEmpty
+	case dir.mode&0200 == 0:
+		err = errAccess
+	}
+
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("rename", oldpath); err != nil {
+		return err
+	}
+
+	oldDir, oldBase, node, err := m.resolve(oldpath, false)
+	if err == nil && node == nil {
+		err = errNotExist
+	}
+
+	var newDir *memNode
+	var newBase string
+	var existing *memNode
+	if err == nil {
+		newDir, newBase, existing, err = m.resolve(newpath, false)
+	}
+
+	switch {
+	case err != nil:
+	case oldDir == nil || newDir == nil:
+		err = errInvalid
+	case oldDir.mode&0200 == 0 || newDir.mode&0200 == 0:
+		err = errAccess
+	case node == existing:
+	case node.mode.IsDir() && m.contains(node, newDir):
+		// A directory cannot be moved inside itself
+		err = errInvalid
+	case existing != nil && existing.mode.IsDir():
+		// Like os.Rename, directories are never replaced
+		err = errExist
+	case existing != nil && node.mode.IsDir():
+		err = errNotDir
+	default:
+		delete(oldDir.children, oldBase)
+		newDir.children[newBase] = node
+		oldDir.modTime = time.Now()
+		newDir.modTime = oldDir.modTime
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	return nil
+}
+
+// contains reports whether dir is node or inside it
+func (m *MemFS) contains(node, dir *memNode) bool {
+	if node == dir {
+		return true
+	}
+
+	for _, child := range node.children {
+		if child.mode.IsDir() && m.contains(child, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("readdir", name); err != nil {
+		return nil, err
+	}
+
+	_, node, err := m.lookup(name, true)
+	switch {
+	case err != nil:
+	case !node.mode.IsDir():
+		err = errNotDir
+	case node.mode&0400 == 0:
+		err = errAccess
+	}
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(node.children))
+	for childName, child := range node.children {
+		entries = append(entries, fs.FileInfoToDirEntry(child.info(childName)))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("open", name); err != nil {
+		return nil, err
+	}
+
+	base, node, err := m.lookup(name, true)
+	if err == nil && node.mode&0400 == 0 {
+		err = errAccess
+	}
+
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	// The file keeps the contents it had when it was opened
+	return &memFile{Reader: bytes.NewReader(node.data), info: node.info(base)}, nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("open", name); err != nil {
+		return err
+	}
+
+	contents := append([]byte{}, data...)
+	dir, _, node, err := m.resolve(name, true)
+	switch {
+	case err != nil:
+	case node == nil:
+		err = m.create(name, true, &memNode{mode: perm.Perm(), data: contents})
+	case dir == nil || node.mode.IsDir():
+		err = errIsDir
+	case node.mode&0200 == 0:
+		err = errAccess
+	default:
+		node.data = contents
+		node.modTime = time.Now()
+	}
+
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Chmod changes the permission bits of name, following symlinks.
+func (m *MemFS) Chmod(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.fault("chmod", name); err != nil {
+		return err
+	}
+
+	_, node, err := m.lookup(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+
+	node.mode = node.mode.Type() | perm.Perm()
+	return nil
+}
@@ -0,0 +1,224 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testFS checks that the FS behaves like the operating system, with every
+// path inside the existing directory root.
+func testFS(t *testing.T, fsys FS, root string) {
+	path := func(name string) string {
+		return filepath.Join(root, name)
+	}
+
+	require.NoError(t, MkdirAll(fsys, path("a/b"), 0755))
+	require.NoError(t, fsys.WriteFile(path("a/b/file"), []byte("contents"), 0644))
+	require.NoError(t, fsys.Symlink("b", path("a/rel")))
+	require.NoError(t, fsys.Symlink(path("a/b/file"), path("abs")))
+	require.NoError(t, fsys.Symlink("missing", path("broken")))
+	require.NoError(t, fsys.Symlink("loop", path("loop")))
+
+	// Symlinks are followed by Stat, but not by Lstat
+	info, err := fsys.Stat(path("abs"))
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	require.Equal(t, "abs", info.Name())
+	require.Equal(t, int64(8), info.Size())
+
+	info, err = fsys.Lstat(path("abs"))
+	require.NoError(t, err)
+	require.Equal(t, fs.ModeSymlink, info.Mode().Type())
+
+	info, err = fsys.Stat(path("a/rel/file"))
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+
+	_, err = fsys.Stat(path("broken"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsys.Lstat(path("broken"))
+	require.NoError(t, err)
+
+	_, err = fsys.Stat(path("loop"))
+	require.ErrorIs(t, err, syscall.ELOOP)
+
+	_, err = fsys.Stat(path("a/b/file/child"))
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+
+	target, err := fsys.Readlink(path("a/rel"))
+	require.NoError(t, err)
+	require.Equal(t, "b", target)
+
+	_, err = fsys.Readlink(path("a/b/file"))
+	require.ErrorIs(t, err, syscall.EINVAL)
+
+	// Reading and writing
+	f, err := fsys.Open(path("a/rel/file"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Equal(t, "contents", string(data))
+
+	require.NoError(t, fsys.WriteFile(path("abs"), []byte("changed"), 0644))
+	_, err = fsys.Open(path("a/b/file"))
+	require.NoError(t, err)
+
+	require.NoError(t, fsys.WriteFile(path("broken"), []byte("created"), 0644))
+	info, err = fsys.Stat(path("missing"))
+	require.NoError(t, err)
+	require.Equal(t, int64(7), info.Size())
+
+	require.ErrorIs(t, fsys.WriteFile(path("a"), nil, 0644), syscall.EISDIR)
+
+	// Creating things that exist fails
+	require.ErrorIs(t, fsys.Mkdir(path("a"), 0755), fs.ErrExist)
+	require.ErrorIs(t, fsys.Symlink("x", path("broken")), fs.ErrExist)
+	require.ErrorIs(t, fsys.Mkdir(path("x/y"), 0755), fs.ErrNotExist)
+	require.ErrorIs(t, MkdirAll(fsys, path("abs/x"), 0755), syscall.ENOTDIR)
+
+	entries, err := fsys.ReadDir(path("a"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "b", entries[0].Name())
+	require.True(t, entries[0].IsDir())
+	require.Equal(t, "rel", entries[1].Name())
+	require.Equal(t, fs.ModeSymlink, entries[1].Type())
+
+	// Resolving symlinks goes up from where a symlink points
+	resolvedRoot, err := EvalSymlinks(fsys, root)
+	require.NoError(t, err)
+
+	resolved, err := EvalSymlinks(fsys, root+"/a/rel/../rel/file")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(resolvedRoot, "a/b/file"), resolved)
+
+	resolved, err = EvalSymlinks(fsys, path("abs"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(resolvedRoot, "a/b/file"), resolved)
+
+	_, err = EvalSymlinks(fsys, path("a/nothing"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = EvalSymlinks(fsys, path("loop"))
+	require.Error(t, err)
+
+	// Removing
+	require.ErrorIs(t, fsys.Remove(path("a")), syscall.ENOTEMPTY)
+	require.ErrorIs(t, fsys.Remove(path("nothing")), fs.ErrNotExist)
+	require.NoError(t, fsys.Remove(path("a/rel")))
+	_, err = fsys.Stat(path("a/b/file"))
+	require.NoError(t, err)
+
+	require.NoError(t, RemoveAll(fsys, path("a")))
+	require.NoError(t, RemoveAll(fsys, path("a")))
+	_, err = fsys.Lstat(path("a"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Renaming replaces files but not directories
+	require.NoError(t, MkdirAll(fsys, path("from/dir"), 0755))
+	require.NoError(t, fsys.WriteFile(path("from/file"), []byte("moved"), 0644))
+	require.NoError(t, fsys.Rename(path("from"), path("to")))
+	require.ErrorIs(t, fsys.Rename(path("to"), path("to/dir/inside")), syscall.EINVAL)
+	require.ErrorIs(t, fsys.Rename(path("to/file"), path("to/dir")), fs.ErrExist)
+	require.ErrorIs(t, fsys.Rename(path("nothing"), path("to/nothing")), fs.ErrNotExist)
+	require.NoError(t, fsys.WriteFile(path("replaced"), nil, 0644))
+	require.NoError(t, fsys.Rename(path("to/file"), path("replaced")))
+	info, err = fsys.Stat(path("replaced"))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), info.Size())
+	require.NoError(t, RemoveAll(fsys, path("to")))
+
+	// Walking follows the root symlink but no others
+	require.NoError(t, MkdirAll(fsys, path("walk/dir"), 0755))
+	require.NoError(t, fsys.WriteFile(path("walk/dir/file"), nil, 0644))
+	require.NoError(t, fsys.Symlink(path("walk/dir"), path("walk/link")))
+	require.NoError(t, fsys.Symlink(path("walk"), path("walked")))
+
+	var walked []string
+	err = Walk(fsys, path("walked"), func(name string, info os.FileInfo, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{".", "dir", "dir/file", "link"}, walked)
+}
+
+// testPermissions checks that the owner permission bits are enforced, which
+// the operating system does not do for root
+func testPermissions(t *testing.T, fsys FS, chmod func(string, fs.FileMode) error, root string) {
+	dir := filepath.Join(root, "locked")
+	require.NoError(t, fsys.Mkdir(dir, 0755))
+	require.NoError(t, fsys.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	require.NoError(t, chmod(dir, 0555))
+	require.ErrorIs(t, fsys.WriteFile(filepath.Join(dir, "new"), nil, 0644), fs.ErrPermission)
+	require.ErrorIs(t, fsys.Remove(filepath.Join(dir, "file")), fs.ErrPermission)
+
+	require.NoError(t, chmod(dir, 0311))
+	_, err := fsys.ReadDir(dir)
+	require.ErrorIs(t, err, fs.ErrPermission)
+
+	require.NoError(t, chmod(dir, 0600))
+	_, err = fsys.Stat(filepath.Join(dir, "file"))
+	require.ErrorIs(t, err, fs.ErrPermission)
+
+	require.NoError(t, chmod(dir, 0755))
+	require.NoError(t, chmod(filepath.Join(dir, "file"), 0200))
+	_, err = fsys.Open(filepath.Join(dir, "file"))
+	require.ErrorIs(t, err, fs.ErrPermission)
+}
+
+func TestOS(t *testing.T) {
+	root := t.TempDir()
+	testFS(t, OS, root)
+
+	// The functions that fall back on the methods of FS agree with the ones
+	// of the os package
+	testFS(t, struct{ FS }{OS}, t.TempDir())
+
+	if os.Getuid() != 0 {
+		testPermissions(t, OS, os.Chmod, root)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.Mkdir("/tmp", 0755))
+	testFS(t, fsys, "/tmp")
+	testPermissions(t, fsys, fsys.Chmod, "/tmp")
+}
+
+func TestMemFSFault(t *testing.T) {
+	fsys := NewMemFS()
+	injected := errors.New("injected")
+
+	var ops []string
+	fsys.Fault = func(op, name string) error {
+		ops = append(ops, op+" "+name)
+		if op == "mkdir" && name == "/a/b" {
+			return injected
+		}
+
+		return nil
+	}
+
+	err := MkdirAll(fsys, "/a/b/c", 0755)
+	require.ErrorIs(t, err, injected)
+	require.Equal(t, []string{"stat /a/b/c", "stat /a/b", "stat /a", "stat /", "mkdir /a", "mkdir /a/b", "lstat /a/b"}, ops)
+
+	// Nothing is changed by the failed operation
+	fsys.Fault = nil
+	_, err = fsys.Stat("/a/b")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = fsys.Stat("/a")
+	require.NoError(t, err)
+}
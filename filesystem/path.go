@@ -61,6 +61,10 @@ func (p Path) Remove() error {
 	return os.Remove(string(p))
 }
 
+func (p Path) Rename(newpath Path) error {
+	return os.Rename(string(p), string(newpath))
+}
+
 func (p Path) WriteFile(data []byte, perm os.FileMode) error {
 	return os.WriteFile(string(p), data, perm)
 }
@@ -87,32 +91,20 @@ func (p Path) ReadDir() ([]fs.DirEntry, error) {
 }
 
 func (p Path) Walk(f filepath.WalkFunc) error {
-	fsys := os.DirFS(string(p))
-	return fs.WalkDir(fsys, ".", func(path string, entry fs.DirEntry, err error) error {
-		if err != nil {
-			return f(path, nil, err)
-		}
+	return Walk(OS, string(p), f)
+}
 
-		info, err := entry.Info()
-		if err != nil {
-			return err
-		}
+func (p Path) Stat() (fs.FileInfo, error) {
+	return os.Stat(string(p))
+}
 
-		return f(path, info, err)
-	})
+// Lstat is like Stat, but does not follow a symlink at p.
+func (p Path) Lstat() (fs.FileInfo, error) {
+	return os.Lstat(string(p))
 }
 
 func (p Path) Exists() (bool, error) {
-	_, err := os.Lstat(string(p))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-
-		return false, err
-	}
-
-	return true, nil
+	return Exists(OS, string(p))
 }
 
 func (p Path) Empty() (bool, error) {
@@ -1,7 +1,13 @@
 package main
 
-import "github.com/jamesbehr/stowaway/cmd"
+import (
+	"github.com/jamesbehr/stowaway/cmd"
+	"github.com/jamesbehr/stowaway/pkg"
+)
 
 func main() {
+	// Sandboxed hooks are started through this executable
+	pkg.SandboxHelper()
+
 	cmd.Execute()
 }
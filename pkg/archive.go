@@ -0,0 +1,819 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+var (
+	// ErrInvalidArchive is returned when a package archive cannot be
+	// extracted, e.g. because it has files outside of the package
+	ErrInvalidArchive = errors.New("pkg: invalid archive")
+
+	// ErrChecksumMismatch is returned when the checksum of a package archive
+	// is not the expected one
+	ErrChecksumMismatch = errors.New("pkg: checksum mismatch")
+
+	// ErrEscapingSymlink is returned by Pack and Store.Snapshot for a package
+	// with a symlink that points outside of it, which would point somewhere
+	// else once the package is extracted or copied
+	ErrEscapingSymlink = errors.New("pkg: symlink points outside of the package")
+
+	// ErrInvalidSignature is returned when a package archive must be signed
+	// and its signature is missing or not made by an allowed signer
+	ErrInvalidSignature = errors.New("pkg: invalid signature")
+)
+
+// signatureNamespace is the namespace archive checksums are signed in with
+// ssh-keygen -Y sign, so that signatures made for other purposes with the
+// same key are not accepted
+const signatureNamespace = "stowaway"
+
+// archiveExtensions are the file extensions of the supported archive formats
+var archiveExtensions = []string{".tar.gz", ".tgz", ".zip"}
+
+// rootRecord is the PAX record of the global header of a .tar.gz archive
+// created by Pack that names the directory with the package root. Zip
+// archives have it in their comment, followed by = and the directory.
+const rootRecord = "STOWAWAY.root"
+
+// packTime is the modification time of every file in an archive created by
+// Pack, so that packing the same files always creates the same archive
+var packTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Archive is a package in a .tar.gz, .tgz or .zip file. It is given as the
+// path of the file, optionally followed by the expected SHA-256 checksum of
+// the file, e.g. dotfiles.tar.gz#sha256=<hex>.
+//
+// The archive contains the package root, either at the top of the archive or
+// as its only directory, which is how Pack creates it. A lone directory is
+// only the package root if the archive records it as its root, like the
+// archives created by Pack, or if it has a package manifest. Otherwise the
+// top of the archive is the package root, so that an archive of a package
+// with only a .config directory is not rooted in .config.
+type Archive struct {
+	// Path is the path of the archive file
+	Path string
+
+	// Checksum is the expected SHA-256 checksum of the archive in
+	// hexadecimal. If it is empty, the checksum is read from the file with
+	// the same name as the archive followed by .sha256, if there is one.
+	Checksum string
+
+	// AllowedSigners is an allowed signers file in the format used by
+	// ssh-keygen -Y verify. If it is set, the .sha256 file of the archive
+	// must be signed by one of the signers, in a file with the same name
+	// followed by .sig, and the archive must have the signed checksum.
+	AllowedSigners filesystem.Path
+}
+
+// IsArchive reports whether the package path is an archive rather than a
+// package directory.
+func IsArchive(path string) bool {
+	name := strings.SplitN(path, "#", 2)[0]
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseArchive parses a package archive path.
+func ParseArchive(s string) (*Archive, error) {
+	if !IsArchive(s) {
+		return nil, fmt.Errorf("%w %q: not a .tar.gz, .tgz or .zip file", ErrInvalidArchive, s)
+	}
+
+	parts := strings.SplitN(s, "#", 2)
+	archive := &Archive{Path: parts[0]}
+	if len(parts) == 1 {
+		return archive, nil
+	}
+
+	params, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %s", ErrInvalidArchive, s, err)
+	}
+
+	for key := range params {
+		if key != "sha256" {
+			return nil, fmt.Errorf("%w %q: unknown parameter %q", ErrInvalidArchive, s, key)
+		}
+	}
+
+	archive.Checksum = strings.ToLower(params.Get("sha256"))
+	if _, err := hex.DecodeString(archive.Checksum); err != nil || len(archive.Checksum) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w %q: invalid checksum %q", ErrInvalidArchive, s, archive.Checksum)
+	}
+
+	return archive, nil
+}
+
+// String returns the package archive path.
+func (a *Archive) String() string {
+	if a.Checksum == "" {
+		return a.Path
+	}
+
+	return a.Path + "#sha256=" + a.Checksum
+}
+
+// Verify computes the SHA-256 checksum of the archive and compares it with
+// the expected one, if there is one. It returns the checksum in hexadecimal.
+func (a *Archive) Verify() (string, error) {
+	expected, err := a.expected()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return a.compare(hex.EncodeToString(h.Sum(nil)), expected)
+}
+
+// expected returns the checksum the archive is expected to have, or "" if
+// any checksum is accepted. If the archive must be signed, this is the
+// checksum in its .sha256 file, once its signature has been verified.
+func (a *Archive) expected() (string, error) {
+	sidecar := a.Path + ".sha256"
+	data, err := os.ReadFile(sidecar)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// The file is in the format written by sha256sum
+	signed := ""
+	if fields := strings.Fields(string(data)); len(fields) > 0 {
+		signed = strings.ToLower(fields[0])
+	}
+
+	if a.AllowedSigners == "" {
+		if a.Checksum != "" {
+			return a.Checksum, nil
+		}
+
+		return signed, nil
+	}
+
+	if signed == "" {
+		return "", fmt.Errorf("%w: %s has no checksum file to verify the signature of", ErrInvalidSignature, a.Path)
+	}
+
+	if err := verifySignature(a.AllowedSigners, filesystem.Path(sidecar), data); err != nil {
+		return "", err
+	}
+
+	if a.Checksum != "" && a.Checksum != signed {
+		return "", fmt.Errorf("%w: the signed checksum of %s is %s, expected %s", ErrChecksumMismatch, a.Path, signed, a.Checksum)
+	}
+
+	return signed, nil
+}
+
+// compare returns the checksum of the archive if it is the expected one
+func (a *Archive) compare(checksum, expected string) (string, error) {
+	if expected != "" && expected != checksum {
+		return "", fmt.Errorf("%w: %s has checksum %s, expected %s", ErrChecksumMismatch, a.Path, checksum, expected)
+	}
+
+	return checksum, nil
+}
+
+// verifySignature verifies the signature of the file with ssh-keygen,
+// against the allowed signers file. The signature is in the file with the
+// same name followed by .sig.
+func verifySignature(allowedSigners, file filesystem.Path, data []byte) error {
+	signature := file.String() + ".sig"
+	if _, err := os.Stat(signature); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s is not signed", ErrInvalidSignature, file)
+		}
+
+		return err
+	}
+
+	// Find who may have made the signature, then check that one of them did
+	out, err := exec.Command("ssh-keygen", "-Y", "find-principals", "-f", allowedSigners.String(), "-s", signature).Output()
+	if err != nil {
+		return fmt.Errorf("%w: %s is not signed by an allowed signer", ErrInvalidSignature, file)
+	}
+
+	for _, principal := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		cmd := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSigners.String(), "-I", principal, "-n", signatureNamespace, "-s", signature)
+		cmd.Stdin = bytes.NewReader(data)
+		if cmd.Run() == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s is not signed by an allowed signer", ErrInvalidSignature, file)
+}
+
+// Extract verifies the archive and extracts it into the store, unless it was
+// extracted before. It returns the package root in the store and the
+// checksum of the archive, which names its store entry.
+//
+// The archive is only read once, computing its checksum while it is
+// extracted, so that the files in the store are always the ones that were
+// verified even if the archive changes in the meantime. The extracted files
+// only become a store entry if the checksum is the expected one.
+func (a *Archive) Extract(store Store) (filesystem.Path, string, error) {
+	checksum, err := a.expected()
+	if err != nil {
+		return "", "", err
+	}
+
+	exists := false
+	if checksum != "" {
+		exists, err = store.Entry(checksum).Exists()
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if !exists {
+		_, checksum, err = store.AddNamed(func(dir filesystem.Path) (string, error) {
+			return a.extract(dir, checksum)
+		})
+
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	root, err := store.Root(checksum)
+	if err != nil {
+		return "", "", err
+	}
+
+	return root, checksum, nil
+}
+
+// name returns the name of the directory an archive without a root directory
+// is extracted into, which is the name of the archive without its extension
+func (a *Archive) name() string {
+	name := filepath.Base(a.Path)
+	for _, ext := range archiveExtensions {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	if !fs.ValidPath(name) || name == "." {
+		return "package"
+	}
+
+	return name
+}
+
+// extractor creates the files of an archive in a directory. It refuses to
+// create anything outside of the directory.
+type extractor struct {
+	archive string
+	dir     filesystem.Path
+
+	// symlinks are the symlinks that have been created, which no other file
+	// may be created in or replace
+	symlinks map[string]bool
+
+	// root is the directory the archive records as its package root, see
+	// rootRecord
+	root string
+}
+
+func (e *extractor) invalid(name, reason string) error {
+	return fmt.Errorf("%w %s: %s %s", ErrInvalidArchive, e.archive, name, reason)
+}
+
+// path returns where the file with the slash separated name in the archive
+// is extracted to
+func (e *extractor) path(name string) (filesystem.Path, string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "./"))
+	if !fs.ValidPath(clean) || strings.HasPrefix(name, "/") {
+		return "", "", e.invalid(name, "is outside of the package")
+	}
+
+	for dir := clean; dir != "."; dir = path.Dir(dir) {
+		if e.symlinks[dir] {
+			return "", "", e.invalid(name, "is inside a symlink")
+		}
+	}
+
+	return e.dir.Join(filepath.FromSlash(clean)), clean, nil
+}
+
+func (e *extractor) mkdir(name string) error {
+	dir, _, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	return dir.MkdirAll(0755)
+}
+
+func (e *extractor) file(name string, mode fs.FileMode, r io.Reader) error {
+	file, _, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if err := file.Parent().MkdirAll(0755); err != nil {
+		return err
+	}
+
+	// Only the permission bits of the owner matter, since the files are
+	// linked into the target directory for the user. Files in the store are
+	// read-only, see Store.
+	perm := fs.FileMode(0444)
+	if mode&0100 != 0 {
+		perm = 0555
+	}
+
+	return file.WriteFile(data, perm)
+}
+
+// escapes reports whether the symlink with the slash separated name, relative
+// to the package, points outside of the package. Only clean relative targets
+// that do not climb out of the package with .. stay inside. As long as no
+// file is inside a symlink, every directory the target climbs out of is a
+// real directory of the package.
+func escapes(name, target string) bool {
+	depth := strings.Count(name, "/")
+	up := 0
+	for rest := target; rest == ".." || strings.HasPrefix(rest, "../"); rest = strings.TrimPrefix(rest[2:], "/") {
+		up++
+	}
+
+	return path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) || path.Clean(target) != target || up > depth
+}
+
+// symlink creates a symlink, which must be relative and stay inside the
+// package
+func (e *extractor) symlink(name, target string) error {
+	link, clean, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	if escapes(clean, target) {
+		return e.invalid(name, fmt.Sprintf("links to %s outside of the package", target))
+	}
+
+	if err := link.Parent().MkdirAll(0755); err != nil {
+		return err
+	}
+
+	e.symlinks[clean] = true
+	return link.Symlink(filesystem.Path(filepath.FromSlash(target)))
+}
+
+// extract extracts the archive into dir and returns its checksum, which must
+// be the expected one if there is one. A checksum mismatch is reported
+// rather than any error extracting the archive, since the archive is not the
+// expected one either way.
+func (a *Archive) extract(dir filesystem.Path, expected string) (string, error) {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	r := io.TeeReader(f, h)
+
+	// The archive is extracted next to where the package root ends up, since
+	// it is only known once the whole archive has been read
+	files := dir.Join(".extract")
+	if err := files.MkdirAll(0755); err != nil {
+		return "", err
+	}
+
+	e := &extractor{archive: a.Path, dir: files, symlinks: map[string]bool{}}
+	if strings.HasSuffix(a.Path, ".zip") {
+		err = e.zip(r)
+	} else {
+		err = e.tar(r)
+	}
+
+	// Anything after the end of the archive is part of the checksum too
+	if _, copyErr := io.Copy(io.Discard, r); copyErr != nil && err == nil {
+		err = copyErr
+	}
+
+	checksum, mismatch := a.compare(hex.EncodeToString(h.Sum(nil)), expected)
+	if mismatch != nil {
+		return "", mismatch
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return checksum, e.moveRoot(dir, a.name())
+}
+
+// moveRoot moves the package root of the extracted archive into dir, so that
+// it is the only directory in the store entry. An archive without a root
+// directory is moved into a directory with the given name.
+func (e *extractor) moveRoot(dir filesystem.Path, name string) error {
+	entries, err := e.dir.ReadDir()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 1 && entries[0].IsDir() {
+		root := e.dir.Join(entries[0].Name())
+		manifest, err := root.Join("stowaway.toml").Exists()
+		if err != nil {
+			return err
+		}
+
+		if manifest || entries[0].Name() == e.root {
+			if err := root.Rename(dir.Join(entries[0].Name())); err != nil {
+				return err
+			}
+
+			return e.dir.Remove()
+		}
+	}
+
+	return e.dir.Rename(dir.Join(name))
+}
+
+// tar extracts the .tar.gz archive read from r
+func (e *extractor) tar(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w %s: %s", ErrInvalidArchive, e.archive, err)
+	}
+
+	return e.tarStream(gz)
+}
+
+// tarStream extracts the uncompressed tar archive read from r
+func (e *extractor) tarStream(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w %s: %s", ErrInvalidArchive, e.archive, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(header.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.file(header.Name, header.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = e.symlink(header.Name, header.Linkname)
+		case tar.TypeXGlobalHeader:
+			// Global headers only hold metadata
+			if root, ok := header.PAXRecords[rootRecord]; ok {
+				e.root = root
+			}
+		default:
+			err = e.invalid(header.Name, "is not a file, directory or symlink")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// zip extracts the .zip archive read from r. Since the central directory is
+// at the end of a zip file, the whole archive is read into memory first.
+func (e *extractor) zip(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("%w %s: %s", ErrInvalidArchive, e.archive, err)
+	}
+
+	if root := strings.TrimPrefix(zr.Comment, rootRecord+"="); root != zr.Comment {
+		e.root = root
+	}
+
+	for _, file := range zr.File {
+		if err := e.zipFile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *extractor) zipFile(file *zip.File) error {
+	mode := file.Mode()
+	if mode.IsDir() {
+		return e.mkdir(file.Name)
+	}
+
+	if mode.Type() != 0 && mode.Type() != fs.ModeSymlink {
+		return e.invalid(file.Name, "is not a file, directory or symlink")
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("%w %s: %s", ErrInvalidArchive, e.archive, err)
+	}
+
+	defer f.Close()
+
+	// The target of a symlink is its contents
+	if mode.Type() == fs.ModeSymlink {
+		target, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("%w %s: %s", ErrInvalidArchive, e.archive, err)
+		}
+
+		return e.symlink(file.Name, string(target))
+	}
+
+	return e.file(file.Name, mode, f)
+}
+
+// packFile is a file in the package root that Pack adds to the archive
+type packFile struct {
+	// name is the slash separated path in the archive
+	name   string
+	path   filesystem.Path
+	info   fs.FileInfo
+	target string
+}
+
+// packFiles returns the files in the package root that Pack adds to the
+// archive, sorted by name. It fails with ErrEscapingSymlink if a symlink
+// points outside of the package.
+func packFiles(root filesystem.Path) ([]packFile, error) {
+	loader := Loader{Source: root}
+	m, err := loader.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	source := ""
+	if m != nil {
+		source = path.Clean(filepath.ToSlash(m.Source))
+	}
+
+	prefix := root.Basename()
+
+	var files []packFile
+	err = root.Walk(func(name string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Name() == ".git" {
+			return skipIgnored(info)
+		}
+
+		// Ignore patterns are relative to the package source
+		rel := name
+		if source != "." {
+			rel = strings.TrimPrefix(name, source+"/")
+		}
+
+		if rel != name || source == "." {
+			if name != "." && m.Ignored(rel) {
+				return skipIgnored(info)
+			}
+		}
+
+		file := packFile{name: path.Join(prefix, name), path: root.Join(name), info: info}
+		if info.IsDir() {
+			file.name += "/"
+		}
+
+		if info.Mode().Type() == fs.ModeSymlink {
+			target, err := file.path.Readlink()
+			if err != nil {
+				return err
+			}
+
+			file.target = filepath.ToSlash(target.String())
+			if escapes(name, file.target) {
+				return fmt.Errorf("%w: %s links to %s", ErrEscapingSymlink, file.path, target)
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		files = append(files, file)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+
+	return files, nil
+}
+
+// mode returns the permissions the file is packed with, which only keep
+// whether the owner can execute it
+func (f packFile) mode() int64 {
+	if f.info.IsDir() || f.info.Mode()&0100 != 0 {
+		return 0755
+	}
+
+	return 0644
+}
+
+func (f packFile) read() ([]byte, error) {
+	r, err := f.path.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// Pack creates an archive of the package at root, in the format given by
+// the extension of the output file. The package root becomes the only
+// directory in the archive, which the archive records as its root. The files ignored by the package manifest are
+// left out, as are .git directories. Packages with symlinks that point
+// outside of them cannot be packed. Packing the same files always creates
+// the same archive.
+//
+// The SHA-256 checksum of the archive is written next to it, in a file with
+// the name of the archive followed by .sha256, and returned.
+func Pack(root, output filesystem.Path) (string, error) {
+	if !IsArchive(output.String()) {
+		return "", fmt.Errorf("%w %q: not a .tar.gz, .tgz or .zip file", ErrInvalidArchive, output)
+	}
+
+	files, err := packFiles(root)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if strings.HasSuffix(output.String(), ".zip") {
+		err = packZip(&buf, root.Basename(), files)
+	} else {
+		err = packTar(&buf, root.Basename(), files)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(buf.Bytes())
+	checksum := hex.EncodeToString(h[:])
+
+	if err := output.WriteFile(buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+
+	sidecar := filesystem.Path(output.String() + ".sha256")
+	if err := sidecar.WriteFile([]byte(checksum+"  "+output.Basename()+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	return checksum, nil
+}
+
+func packTar(w io.Writer, root string, files []packFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	global := &tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{rootRecord: root},
+	}
+
+	if err := tw.WriteHeader(global); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.name,
+			Mode:    file.mode(),
+			ModTime: packTime,
+			Format:  tar.FormatPAX,
+		}
+
+		var data []byte
+		switch {
+		case file.info.IsDir():
+			header.Typeflag = tar.TypeDir
+		case file.target != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = file.target
+			header.Mode = 0777
+		default:
+			var err error
+			data, err = file.read()
+			if err != nil {
+				return err
+			}
+
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(data))
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func packZip(w io.Writer, root string, files []packFile) error {
+	zw := zip.NewWriter(w)
+	if err := zw.SetComment(rootRecord + "=" + root); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		header := &zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: packTime}
+
+		data := []byte(file.target)
+		switch {
+		case file.info.IsDir():
+			header.Method = zip.Store
+			header.SetMode(fs.ModeDir | 0755)
+		case file.target != "":
+			header.SetMode(fs.ModeSymlink | 0777)
+		default:
+			var err error
+			data, err = file.read()
+			if err != nil {
+				return err
+			}
+
+			header.SetMode(fs.FileMode(file.mode()))
+		}
+
+		f, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
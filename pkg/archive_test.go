@@ -0,0 +1,312 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArchive(t *testing.T) {
+	checksum := strings.Repeat("ab", 32)
+
+	testCases := []struct {
+		Path     string
+		Expected Archive
+		Err      string
+	}{
+		{Path: "dotfiles.tar.gz", Expected: Archive{Path: "dotfiles.tar.gz"}},
+		{Path: "/srv/vim.zip#sha256=" + checksum, Expected: Archive{Path: "/srv/vim.zip", Checksum: checksum}},
+		{Path: "vim.tgz#sha256=" + strings.ToUpper(checksum), Expected: Archive{Path: "vim.tgz", Checksum: checksum}},
+		{Path: "vim", Err: "not a .tar.gz"},
+		{Path: "vim.zip#sha256=abc", Err: `invalid checksum "abc"`},
+		{Path: "vim.zip#md5=abc", Err: `unknown parameter "md5"`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Path, func(t *testing.T) {
+			archive, err := ParseArchive(testCase.Path)
+			if testCase.Err != "" {
+				require.ErrorIs(t, err, ErrInvalidArchive)
+				require.Contains(t, err.Error(), testCase.Err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.Expected, *archive)
+		})
+	}
+}
+
+func TestPack(t *testing.T) {
+	for _, ext := range []string{".tar.gz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			tmp := tmpDir(t, "pack", []string{"out/"})
+			root := tmp.Join("vim")
+
+			writeFile(t, root, "src/.vimrc", "set nocompatible", 0644)
+			writeManifest(t, root, "stowaway.toml", &Manifest{Name: "vim", Source: "src", Ignore: []string{"*.swp", "cache"}})
+			writeFile(t, root, "src/.vim/.vimrc.swp", "", 0644)
+			writeFile(t, root, "src/.vim/cache/file", "", 0644)
+			writeFile(t, root, "hooks/after_install", "#!/bin/sh", 0755)
+			writeFile(t, root, ".git/HEAD", "", 0644)
+			writeFile(t, root, "README.md.swp", "", 0644)
+			require.NoError(t, root.Join("src/.gvimrc").Symlink(".vimrc"))
+
+			output := tmp.Join("out", "vim"+ext)
+			checksum, err := Pack(root, output)
+			require.NoError(t, err)
+
+			// Packing again creates the same archive
+			again, err := Pack(root, tmp.Join("out", "again"+ext))
+			require.NoError(t, err)
+			require.Equal(t, checksum, again)
+
+			sidecar, err := os.ReadFile(output.String() + ".sha256")
+			require.NoError(t, err)
+			require.Equal(t, checksum+"  vim"+ext+"\n", string(sidecar))
+
+			store := Store{Dir: tmp.Join("store")}
+			archive := &Archive{Path: output.String()}
+			extracted, name, err := archive.Extract(store)
+			require.NoError(t, err)
+			require.Equal(t, checksum, name)
+			require.Equal(t, store.Entry(name).Join("vim"), extracted)
+
+			contents, err := os.ReadFile(extracted.Join("src/.vimrc").String())
+			require.NoError(t, err)
+			require.Equal(t, "set nocompatible", string(contents))
+
+			info, err := extracted.Join("hooks/after_install").Stat()
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0555), info.Mode().Perm())
+
+			info, err = extracted.Join("src/.vimrc").Stat()
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0444), info.Mode().Perm())
+
+			target, err := extracted.Join("src/.gvimrc").Readlink()
+			require.NoError(t, err)
+			require.Equal(t, filesystem.Path(".vimrc"), target)
+
+			// Ignore patterns only apply to the package source
+			assertMissing(t, extracted, []string{"src/.vim/.vimrc.swp", "src/.vim/cache", ".git"})
+			require.FileExists(t, extracted.Join("README.md.swp").String())
+
+			p, err := Loader{State: tmp.Join("state"), Source: extracted, Target: tmp.Join("home")}.Load()
+			require.NoError(t, err)
+			require.Equal(t, "vim", p.Name())
+		})
+	}
+}
+
+func TestPackEscapingSymlink(t *testing.T) {
+	for _, target := range []string{"/etc/passwd", "../../outside", "src/../.."} {
+		tmp := tmpDir(t, "escape", []string{"out/"})
+		root := tmp.Join("vim")
+
+		writeFile(t, root, "src/.vimrc", "", 0644)
+		require.NoError(t, root.Join("src/link").Symlink(filesystem.Path(target)))
+
+		_, err := Pack(root, tmp.Join("out/vim.tar.gz"))
+		require.ErrorIs(t, err, ErrEscapingSymlink, target)
+	}
+}
+
+func TestArchiveVerify(t *testing.T) {
+	tmp := tmpDir(t, "verify", []string{"vim/.vimrc"})
+	output := tmp.Join("vim.tar.gz")
+
+	checksum, err := Pack(tmp.Join("vim"), output)
+	require.NoError(t, err)
+
+	archive, err := ParseArchive(output.String() + "#sha256=" + checksum)
+	require.NoError(t, err)
+	_, err = archive.Verify()
+	require.NoError(t, err)
+
+	archive.Checksum = strings.Repeat("0", 64)
+	_, err = archive.Verify()
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// The checksum file is used when no checksum is given
+	require.NoError(t, filesystem.Path(output.String()+".sha256").WriteFile([]byte(strings.Repeat("0", 64)+"  vim.tar.gz\n"), 0644))
+	archive.Checksum = ""
+	_, _, err = archive.Extract(Store{Dir: tmp.Join("store")})
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// Nothing is left in the store
+	empty, err := tmp.Join("store").Empty()
+	require.NoError(t, err)
+	require.True(t, empty)
+}
+
+func TestArchiveSignature(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	tmp := tmpDir(t, "signature", []string{"vim/.vimrc"})
+	defer tmp.RemoveAll()
+
+	output := tmp.Join("vim.tar.gz")
+	checksum, err := Pack(tmp.Join("vim"), output)
+	require.NoError(t, err)
+
+	keygen := func(args ...string) {
+		out, err := exec.Command("ssh-keygen", args...).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	keygen("-q", "-t", "ed25519", "-N", "", "-C", "", "-f", tmp.Join("key").String())
+	keygen("-q", "-t", "ed25519", "-N", "", "-C", "", "-f", tmp.Join("other").String())
+
+	key, err := os.ReadFile(tmp.Join("key.pub").String())
+	require.NoError(t, err)
+	writeFile(t, tmp, "allowed_signers", "release@example.com "+string(key), 0644)
+
+	store := Store{Dir: tmp.Join("store")}
+	archive := &Archive{Path: output.String(), AllowedSigners: tmp.Join("allowed_signers")}
+	_, _, err = archive.Extract(store)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+	require.Contains(t, err.Error(), "is not signed")
+
+	// Signatures by keys that are not allowed are refused
+	sign := func(key string) {
+		tmp.Join("vim.tar.gz.sha256.sig").Remove()
+		keygen("-Y", "sign", "-q", "-f", tmp.Join(key).String(), "-n", "stowaway", output.String()+".sha256")
+	}
+
+	sign("other")
+	_, _, err = archive.Extract(store)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+
+	sign("key")
+	_, name, err := archive.Extract(store)
+	require.NoError(t, err)
+	require.Equal(t, checksum, name)
+
+	// The checksum file cannot be changed without signing it again
+	writeFile(t, tmp, "vim.tar.gz.sha256", strings.Repeat("0", 64)+"  vim.tar.gz\n", 0644)
+	_, _, err = archive.Extract(store)
+	require.ErrorIs(t, err, ErrInvalidSignature)
+
+	// A checksum that is given must be the signed one
+	writeFile(t, tmp, "vim.tar.gz.sha256", checksum+"  vim.tar.gz\n", 0644)
+	archive.Checksum = strings.Repeat("0", 64)
+	_, _, err = archive.Extract(store)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+// writeTar writes a .tar.gz archive with the given entries
+func writeTar(t *testing.T, path filesystem.Path, headers ...*tar.Header) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, header := range headers {
+		require.NoError(t, tw.WriteHeader(header))
+		if header.Size > 0 {
+			_, err := tw.Write(make([]byte, header.Size))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	require.NoError(t, path.WriteFile(buf.Bytes(), 0644))
+}
+
+func TestExtractInvalid(t *testing.T) {
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}
+	}
+
+	symlink := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}
+	}
+
+	testCases := []struct {
+		Name    string
+		Headers []*tar.Header
+		Err     string
+	}{
+		{Name: "parent", Headers: []*tar.Header{file("../escaped")}, Err: "outside of the package"},
+		{Name: "absolute", Headers: []*tar.Header{file("/etc/escaped")}, Err: "outside of the package"},
+		{Name: "absolute symlink", Headers: []*tar.Header{symlink("vim/link", "/etc")}, Err: "links to /etc"},
+		{Name: "symlink parent", Headers: []*tar.Header{symlink("vim/link", "../..")}, Err: "links to ../.."},
+		{Name: "unclean symlink", Headers: []*tar.Header{symlink("vim/up", ".."), symlink("vim/link", "up/..")}, Err: "links to up/.."},
+		{Name: "through symlink", Headers: []*tar.Header{symlink("vim/link", "."), file("vim/link/file")}, Err: "inside a symlink"},
+		{Name: "hard link", Headers: []*tar.Header{file("vim/file"), {Name: "vim/hard", Typeflag: tar.TypeLink, Linkname: "vim/file"}}, Err: "not a file"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			tmp := tmpDir(t, "invalid", nil)
+			writeTar(t, tmp.Join("vim.tar.gz"), testCase.Headers...)
+
+			archive := &Archive{Path: tmp.Join("vim.tar.gz").String()}
+			_, _, err := archive.Extract(Store{Dir: tmp.Join("store")})
+			require.ErrorIs(t, err, ErrInvalidArchive)
+			require.Contains(t, err.Error(), testCase.Err)
+
+			// Nothing is left in the store
+			empty, err := tmp.Join("store").Empty()
+			require.NoError(t, err)
+			require.True(t, empty)
+		})
+	}
+
+	// Symlinks may point anywhere inside the package
+	tmp := tmpDir(t, "valid", nil)
+	writeTar(t, tmp.Join("vim.tar.gz"), file("vim/src/file"), symlink("vim/src/.vimrc", "../shared/vimrc"), symlink("vim/src/dir/up", "../.."))
+
+	archive := &Archive{Path: tmp.Join("vim.tar.gz").String()}
+	_, _, err := archive.Extract(Store{Dir: tmp.Join("store")})
+	require.NoError(t, err)
+}
+
+func TestExtractRoot(t *testing.T) {
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}
+	}
+
+	testCases := []struct {
+		Name    string
+		Headers []*tar.Header
+		Root    string
+	}{
+		{Name: "top", Headers: []*tar.Header{file(".bashrc"), file(".profile")}, Root: "dotfiles"},
+		{Name: "only directory", Headers: []*tar.Header{file(".config/nvim/init.vim")}, Root: "dotfiles"},
+		{Name: "manifest", Headers: []*tar.Header{file("vim/stowaway.toml"), file("vim/.vimrc")}, Root: "vim"},
+		{Name: "recorded", Headers: []*tar.Header{{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{rootRecord: "vim"}}, file("vim/.vimrc")}, Root: "vim"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			tmp := tmpDir(t, "root", nil)
+			writeTar(t, tmp.Join("dotfiles.tar.gz"), testCase.Headers...)
+
+			store := Store{Dir: tmp.Join("store")}
+			archive := &Archive{Path: tmp.Join("dotfiles.tar.gz").String()}
+			root, name, err := archive.Extract(store)
+			require.NoError(t, err)
+			require.Equal(t, store.Entry(name).Join(testCase.Root), root)
+
+			// The package root is the only directory of the entry
+			entries, err := store.Entry(name).ReadDir()
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+
+			again, err := store.Root(name)
+			require.NoError(t, err)
+			require.Equal(t, root, again)
+		})
+	}
+}
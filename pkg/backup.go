@@ -0,0 +1,233 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// backupsFile is the name of the file in the package state directory that
+// records the files the package replaced in the target directory.
+const backupsFile = "backups.toml"
+
+// backupTime is the format of the time at the start of each backup ID
+const backupTime = "20060102T150405Z"
+
+var (
+	// ErrBackupNotFound is returned when a backup does not exist
+	ErrBackupNotFound = errors.New("pkg: backup not found")
+
+	// ErrBackupConflict is returned when a backup cannot be restored because
+	// something else has taken its place in the target directory
+	ErrBackupConflict = errors.New("pkg: file exists in the target directory")
+)
+
+// Backup is a file that was moved out of the target directory to make way
+// for a symlink. It is kept in the backups directory until it is restored.
+type Backup struct {
+	// ID names the directory in the backups directory that holds the file.
+	// It starts with the time the backup was made, and every installation
+	// that replaces files gets its own.
+	ID string `toml:"id"`
+
+	// Name is the path of the file relative to the target directory
+	Name string `toml:"name"`
+}
+
+// Path returns where the backup is kept in the backups directory.
+func (b Backup) Path(dir filesystem.Path) filesystem.Path {
+	return dir.Join(b.ID, filepath.FromSlash(b.Name))
+}
+
+func (b Backup) String() string {
+	return b.ID + ":" + b.Name
+}
+
+type backupsState struct {
+	Backups []Backup `toml:"backups"`
+}
+
+// ReadBackups returns the backups recorded in the package state directory,
+// which are restored when the package is uninstalled.
+func ReadBackups(state filesystem.Path) ([]Backup, error) {
+	return readBackups(filesystem.OS, state)
+}
+
+func readBackups(fsys filesystem.FS, state filesystem.Path) ([]Backup, error) {
+	path := state.Join(backupsFile)
+	exists, err := filesystem.Exists(fsys, path.String())
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	f, err := fsys.Open(path.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var s backupsState
+	if err := toml.NewDecoder(f).Decode(&s); err != nil {
+		return nil, fmt.Errorf("backups %s: %w", path, err)
+	}
+
+	return s.Backups, nil
+}
+
+// WriteBackups records the backups in the package state directory.
+func WriteBackups(state filesystem.Path, backups []Backup) error {
+	return writeBackups(filesystem.OS, state, backups)
+}
+
+func writeBackups(fsys filesystem.FS, state filesystem.Path, backups []Backup) error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(backupsState{Backups: backups}); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(state.Join(backupsFile).String(), w.Bytes(), 0644)
+}
+
+// newBackupID returns an ID for the backups made at the given time that is
+// not used by any backup in the directory yet.
+func newBackupID(fsys filesystem.FS, dir filesystem.Path, t time.Time) (string, error) {
+	base := t.UTC().Format(backupTime)
+	for n := 0; ; n++ {
+		id := base
+		if n > 0 {
+			id += "." + strconv.Itoa(n)
+		}
+
+		exists, err := filesystem.Exists(fsys, dir.Join(id).String())
+		if err != nil || !exists {
+			return id, err
+		}
+	}
+}
+
+// move moves the file in the target directory into the backup.
+func (b Backup) move(fsys filesystem.FS, dir, target filesystem.Path) error {
+	path := b.Path(dir)
+	if err := filesystem.MkdirAll(fsys, path.Parent().String(), 0700); err != nil {
+		return err
+	}
+
+	return moveFile(fsys, target.Join(filepath.FromSlash(b.Name)), path)
+}
+
+// RestoreBackup moves the backed up file back into the target directory. It
+// fails with ErrBackupConflict if anything is in its place.
+func RestoreBackup(dir, target filesystem.Path, backup Backup) error {
+	return restoreBackup(filesystem.OS, dir, target, backup)
+}
+
+func restoreBackup(fsys filesystem.FS, dir, target filesystem.Path, backup Backup) error {
+	path := backup.Path(dir)
+	exists, err := filesystem.Exists(fsys, path.String())
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, backup)
+	}
+
+	restored := target.Join(filepath.FromSlash(backup.Name))
+	exists, err = filesystem.Exists(fsys, restored.String())
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("%w: %s", ErrBackupConflict, restored)
+	}
+
+	if err := filesystem.MkdirAll(fsys, restored.Parent().String(), 0755); err != nil {
+		return err
+	}
+
+	if err := moveFile(fsys, path, restored); err != nil {
+		return err
+	}
+
+	return removeEmptyParents(fsys, dir, path)
+}
+
+// RemoveBackup deletes the backed up file.
+func RemoveBackup(dir filesystem.Path, backup Backup) error {
+	path := backup.Path(dir)
+	if err := filesystem.OS.Remove(path.String()); err != nil {
+		return err
+	}
+
+	return removeEmptyParents(filesystem.OS, dir, path)
+}
+
+// removeEmptyParents removes the parent directories of path that are left
+// empty, up to but not including dir.
+func removeEmptyParents(fsys filesystem.FS, dir, path filesystem.Path) error {
+	for parent := path.Parent(); parent != dir && parent != parent.Parent(); parent = parent.Parent() {
+		entries, err := fsys.ReadDir(parent.String())
+		if err != nil || len(entries) > 0 {
+			return err
+		}
+
+		if err := fsys.Remove(parent.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListBackups returns every backup in the backups directory, oldest first.
+// There are no backups if the directory does not exist.
+func ListBackups(dir filesystem.Path) ([]Backup, error) {
+	return listBackups(filesystem.OS, dir)
+}
+
+func listBackups(fsys filesystem.FS, dir filesystem.Path) ([]Backup, error) {
+	exists, err := filesystem.Exists(fsys, dir.String())
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	entries, err := fsys.ReadDir(dir.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		id := entry.Name()
+		err := filesystem.Walk(fsys, dir.Join(id).String(), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				backups = append(backups, Backup{ID: id, Name: filepath.ToSlash(path)})
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return backups, nil
+}
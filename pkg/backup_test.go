@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func readFile(t *testing.T, path filesystem.Path) string {
+	return osFS.readFile(t, path)
+}
+
+func (f testFS) readFile(t *testing.T, path filesystem.Path) string {
+	file, err := f.Open(path.String())
+	require.NoError(t, err)
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+
+	return string(data)
+}
+
+func TestInstallBackup(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "backup", []string{"bash/.bashrc", "bash/.config/git/config", "state/"})
+		home := tmp.Join("home")
+		tfs.writeFile(t, home, ".bashrc", "original", 0644)
+		tfs.writeFile(t, home, ".config/git/config", "original", 0644)
+		tfs.writeFile(t, home, ".profile", "untouched", 0644)
+
+		loader := Loader{State: tmp.Join("state/bash"), Source: tmp.Join("bash"), Target: home, FS: tfs.FS}
+		p, err := loader.Load()
+		require.NoError(t, err)
+
+		// By default the files are left alone
+		require.ErrorIs(t, p.Install(), fs.ErrExist)
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".bashrc")))
+		tfs.assertMissing(t, tmp, []string{"state/bash", "state/backups"})
+
+		loader.Conflict = ConflictBackup
+		p, err = loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Install())
+
+		tfs.assertLinks(t, tmp, Links{
+			"home/.bashrc":            "state/bash/source/.bashrc",
+			"home/.config/git/config": "state/bash/source/.config/git/config",
+		})
+
+		backups, err := readBackups(tfs, loader.State)
+		require.NoError(t, err)
+		require.Len(t, backups, 2)
+		require.Equal(t, backups[0].ID, backups[1].ID)
+		require.Equal(t, []string{".bashrc", ".config/git/config"}, []string{backups[0].Name, backups[1].Name})
+
+		listed, err := listBackups(tfs, tmp.Join("state/backups"))
+		require.NoError(t, err)
+		require.Equal(t, backups, listed)
+		require.Equal(t, "original", tfs.readFile(t, backups[0].Path(tmp.Join("state/backups"))))
+
+		// Uninstalling puts the files back
+		require.NoError(t, p.Uninstall())
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".bashrc")))
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".config/git/config")))
+		require.Equal(t, "untouched", tfs.readFile(t, home.Join(".profile")))
+
+		listed, err = listBackups(tfs, tmp.Join("state/backups"))
+		require.NoError(t, err)
+		require.Empty(t, listed)
+
+		// A file that something else has taken the place of stays in its
+		// backup
+		require.NoError(t, p.Install())
+		require.NoError(t, p.Uninstall())
+		require.NoError(t, p.Install())
+		require.NoError(t, tfs.Remove(home.Join(".bashrc").String()))
+		require.NoError(t, tfs.WriteFile(home.Join(".bashrc").String(), []byte("new"), 0644))
+		require.NoError(t, p.Uninstall())
+		require.Equal(t, "new", tfs.readFile(t, home.Join(".bashrc")))
+
+		listed, err = listBackups(tfs, tmp.Join("state/backups"))
+		require.NoError(t, err)
+		require.Len(t, listed, 1)
+
+		err = restoreBackup(tfs, tmp.Join("state/backups"), home, listed[0])
+		require.ErrorIs(t, err, ErrBackupConflict)
+
+		require.NoError(t, tfs.Remove(home.Join(".bashrc").String()))
+		require.NoError(t, restoreBackup(tfs, tmp.Join("state/backups"), home, listed[0]))
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".bashrc")))
+		tfs.assertMissing(t, tmp, []string{"state/backups/" + listed[0].ID})
+
+		err = restoreBackup(tfs, tmp.Join("state/backups"), home, listed[0])
+		require.ErrorIs(t, err, ErrBackupNotFound)
+	})
+}
+
+func TestInstallBackupDirectory(t *testing.T) {
+	tmp := tmpDir(t, "backup", []string{"bash/.vim", "home/.vim/vimrc", "state/"})
+
+	loader := Loader{State: tmp.Join("state/bash"), Source: tmp.Join("bash"), Target: tmp.Join("home"), Conflict: ConflictBackup}
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	// Directories are never replaced
+	require.ErrorIs(t, p.Install(), fs.ErrExist)
+	require.FileExists(t, tmp.Join("home/.vim/vimrc").String())
+	assertMissing(t, tmp, []string{"state/bash", "state/backups"})
+}
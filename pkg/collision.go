@@ -0,0 +1,265 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+// ErrCollision is wrapped by CollisionError
+var ErrCollision = errors.New("pkg: symlink belongs to another package")
+
+// CollisionError is returned when installing a package would create a
+// symlink that another installed package with the same priority created.
+type CollisionError struct {
+	// Name is the path of the symlink relative to the target directory
+	Name string
+
+	Package string
+
+	// Other is the name of the installed package the symlink belongs to
+	Other string
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("pkg: package %s and package %s both link %s (give one of them a higher priority to shadow the other)", e.Package, e.Other, e.Name)
+}
+
+func (e *CollisionError) Unwrap() error {
+	return ErrCollision
+}
+
+// siblingPackage is another package installed in the same state directory,
+// or one of its other target sections
+type siblingPackage struct {
+	localPackage
+	name     string
+	priority int
+}
+
+// siblings returns the other packages installed next to the package, along
+// with the symlinks recorded in their links directories, keyed by their
+// absolute paths. The packages for each symlink are sorted from the highest
+// priority to the lowest.
+func (pkg localPackage) siblings() (map[filesystem.Path][]siblingPackage, error) {
+	fsys := pkg.fs()
+	exists, err := filesystem.Exists(fsys, pkg.States.String())
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	states, err := listStates(fsys, pkg.States)
+	if err != nil {
+		return nil, err
+	}
+
+	siblings := map[filesystem.Path][]siblingPackage{}
+	for _, state := range states {
+		if state == pkg.State {
+			continue
+		}
+
+		var name string
+		var priority int
+
+		installed, err := decodeManifest(fsys, state.Join(installedManifest))
+		if err != nil {
+			return nil, err
+		}
+
+		if installed != nil {
+			name, priority = installed.Name, installed.Priority
+		} else {
+			// Simple packages are named after their source, which is their
+			// package root
+			source, err := fsys.Readlink(state.Join("source").String())
+			if err != nil {
+				return nil, err
+			}
+
+			name = filepath.Base(source)
+		}
+
+		states, err := targetStates(fsys, state)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, targetState := range states {
+			link, err := fsys.Readlink(targetState.Join("target").String())
+			if err != nil {
+				return nil, err
+			}
+
+			target := filesystem.Path(link)
+
+			sibling := siblingPackage{
+				localPackage: localPackage{
+					State:      targetState,
+					Target:     target,
+					SourceLink: targetState.Join("source"),
+					TargetLink: targetState.Join("target"),
+					Links:      targetState.Join("links"),
+					FS:         fsys,
+					Linker:     pkg.linker(target),
+				},
+				name:     name,
+				priority: priority,
+			}
+
+			names, err := sibling.linkNames()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, name := range names {
+				link := target.Join(name)
+				siblings[link] = append(siblings[link], sibling)
+			}
+		}
+	}
+
+	for _, packages := range siblings {
+		sort.SliceStable(packages, func(i, j int) bool {
+			return packages[i].priority > packages[j].priority
+		})
+	}
+
+	return siblings, nil
+}
+
+// linkNames returns the paths relative to the target directory of the
+// symlinks recorded in the links directory.
+func (pkg localPackage) linkNames() ([]string, error) {
+	var names []string
+	fsys := pkg.fs()
+	err := filesystem.Walk(fsys, pkg.Links.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		target, err := fsys.Readlink(pkg.Links.Join(path).String())
+		if err != nil {
+			return err
+		}
+
+		name, err := pkg.linkName(filesystem.Path(target))
+		if err != nil {
+			return err
+		}
+
+		names = append(names, name)
+		return nil
+	})
+
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return names, err
+}
+
+// priority returns the priority of the package being installed
+func (pkg localPackage) priority() int {
+	if pkg.Manifest == nil {
+		return 0
+	}
+
+	return pkg.Manifest.Priority
+}
+
+// collisions finds the symlinks of the package that the sibling packages
+// have created, before anything is installed. It returns the packages that
+// the package shadows, whose symlinks are replaced, and the symlinks that are
+// shadowed by packages with a higher priority, which are not created. Both
+// are keyed by the slash separated path of the symlink relative to the
+// target directory. Packages with the same priority cannot both be
+// installed.
+func (pkg localPackage) collisions(siblings map[filesystem.Path][]siblingPackage) (map[string]siblingPackage, map[string]bool, error) {
+	if len(siblings) == 0 {
+		return nil, nil, nil
+	}
+
+	links, err := pkg.sourceLinks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replaced := map[string]siblingPackage{}
+	shadowed := map[string]bool{}
+	for _, link := range links {
+		others := siblings[link]
+		if len(others) == 0 {
+			continue
+		}
+
+		rel, err := filepath.Rel(pkg.Target.String(), link.String())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The package with the highest priority has the symlink
+		name := filepath.ToSlash(rel)
+		top := others[0]
+		switch {
+		case pkg.priority() > top.priority:
+			replaced[name] = top
+		case pkg.priority() < top.priority:
+			shadowed[name] = true
+		default:
+			return nil, nil, &CollisionError{Name: name, Package: pkg.Name(), Other: top.name}
+		}
+	}
+
+	return replaced, shadowed, nil
+}
+
+// unshadow recreates the symlinks that the package shadowed, after they were
+// removed when uninstalling it. Each symlink goes to the package with the
+// highest priority that has it in its links directory.
+func (pkg localPackage) unshadow(links []filesystem.Path) error {
+	siblings, err := pkg.siblings()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		others := siblings[link]
+		if len(others) == 0 {
+			continue
+		}
+
+		top := others[0]
+		rel, err := filepath.Rel(top.Target.String(), link.String())
+		if err != nil {
+			return err
+		}
+
+		err = top.Linker.CreateLink(top.SourceLink.Join(rel).String(), rel)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isShadowed reports whether the named symlink in the target directory was
+// created by another package installed next to the package.
+func (pkg localPackage) isShadowed(name string) bool {
+	source, err := pkg.Linker.ReadLink(name)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(source, pkg.States.String()+string(filepath.Separator)) && !pkg.owns(source)
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallCollisions(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "collisions", []string{"base/.profile", "base/.inputrc", "home/", "state/"})
+
+		for name, priority := range map[string]int{"shell": 0, "work": 10, "laptop": 5} {
+			tfs.writeFile(t, tmp, name+"/src/.profile", "", 0644)
+			tfs.writeManifest(t, tmp, name+"/stowaway.toml", &Manifest{Name: name, Priority: priority})
+		}
+
+		load := func(name string) Package {
+			loader := Loader{State: tmp.Join("state", name), Source: tmp.Join(name), Target: tmp.Join("home"), FS: tfs.FS}
+			p, err := loader.Load()
+			require.NoError(t, err)
+			return p
+		}
+
+		owner := func() string {
+			link, err := tfs.Readlink(tmp.Join("home/.profile").String())
+			require.NoError(t, err)
+			return filesystem.Path(link).Parent().Parent().Basename()
+		}
+
+		base := load("base")
+		require.NoError(t, base.Install())
+
+		// Packages with the same priority cannot both have the symlink
+		err := load("shell").Install()
+		require.ErrorIs(t, err, ErrCollision)
+		require.Equal(t, &CollisionError{Name: ".profile", Package: "shell", Other: "base"}, err)
+		tfs.assertMissing(t, tmp, []string{"state/shell"})
+		require.Equal(t, "base", owner())
+
+		// A package with a higher priority shadows the others, whatever
+		// order they are installed in
+		work := load("work")
+		require.NoError(t, work.Install())
+		require.Equal(t, "work", owner())
+
+		laptop := load("laptop")
+		require.NoError(t, laptop.Install())
+		require.Equal(t, "work", owner())
+
+		status, err := readStatus(tfs, tmp.Join("state/base"))
+		require.NoError(t, err)
+		require.Equal(t, []filesystem.Path{tmp.Join("home/.profile")}, status.Shadowed)
+		require.Empty(t, status.Drifted())
+		require.Equal(t, "installed, 1 link shadowed", status.String())
+
+		// Uninstalling the package with the highest priority gives the
+		// symlink to the next one
+		require.NoError(t, work.Uninstall())
+		require.Equal(t, "laptop", owner())
+
+		require.NoError(t, base.Uninstall())
+		require.Equal(t, "laptop", owner())
+
+		require.NoError(t, laptop.Uninstall())
+		tfs.assertMissing(t, tmp, []string{"home/.profile", "home/.inputrc"})
+	})
+}
@@ -0,0 +1,275 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+const (
+	// HookBeforeStow is run once before any package is installed or
+	// uninstalled
+	HookBeforeStow = "before_stow"
+
+	// HookAfterStow is run once after every package has been installed or
+	// uninstalled
+	HookAfterStow = "after_stow"
+)
+
+// ErrInvalidConfig is returned when a configuration file cannot be decoded
+var ErrInvalidConfig = errors.New("pkg: invalid configuration")
+
+// RepositoryConfigName is the name of the configuration file that is read
+// from the directory containing the packages.
+const RepositoryConfigName = ".stowaway.toml"
+
+// Config is a Stowaway configuration file, which is either the user's
+// configuration file or the configuration file of a repository of packages.
+type Config struct {
+	// Path is the location the configuration was loaded from
+	Path filesystem.Path `toml:"-"`
+
+	// User is true for the user's own configuration file. Its hooks are
+	// always trusted, while the hooks of repository configuration files must
+	// be approved like package hooks.
+	User bool `toml:"-"`
+
+	Hooks GlobalHooks `toml:"hooks,omitempty"`
+}
+
+// GlobalHooks are hooks that are run once for a whole stow operation, rather
+// than once for each package. Like inline hooks in package manifests, each
+// hook is a list of commands that are run with /bin/sh -c.
+type GlobalHooks struct {
+	BeforeStow []string `toml:"before_stow,omitempty"`
+	AfterStow  []string `toml:"after_stow,omitempty"`
+}
+
+func (h GlobalHooks) Commands(name string) []string {
+	switch name {
+	case HookBeforeStow:
+		return h.BeforeStow
+	case HookAfterStow:
+		return h.AfterStow
+	}
+
+	return nil
+}
+
+// UserConfigPath returns the location of the user's configuration file,
+// which is $XDG_CONFIG_HOME/stowaway/config.toml.
+func UserConfigPath() (filesystem.Path, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filesystem.MakePath(dir, "stowaway", "config.toml"), nil
+}
+
+// AllowedSignersPath returns the location of the user's allowed signers
+// file, which is $XDG_CONFIG_HOME/stowaway/allowed_signers. When it exists,
+// package archives must be signed by one of the signers in it.
+func AllowedSignersPath() (filesystem.Path, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filesystem.MakePath(dir, "stowaway", "allowed_signers"), nil
+}
+
+// LoadConfig reads the configuration file at path. It returns nil if the file
+// does not exist.
+func LoadConfig(path filesystem.Path) (*Config, error) {
+	exists, err := path.Exists()
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	f, err := path.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	config := Config{Path: path}
+	if err := toml.NewDecoder(f).DisallowUnknownFields().Decode(&config); err != nil {
+		return nil, newDecodeError(path, err, ErrInvalidConfig)
+	}
+
+	return &config, nil
+}
+
+// LoadConfigs loads the user's configuration file followed by the
+// configuration file of each distinct directory containing one of the
+// package roots. Configuration files that do not exist are skipped.
+func LoadConfigs(roots ...filesystem.Path) ([]*Config, error) {
+	user, err := UserConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []filesystem.Path{user}
+	seen := map[filesystem.Path]bool{user: true}
+	for _, root := range roots {
+		path := root.Parent().Join(RepositoryConfigName)
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	var configs []*Config
+	for _, path := range paths {
+		config, err := LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if config != nil {
+			config.User = path == user
+			configs = append(configs, config)
+		}
+	}
+
+	return configs, nil
+}
+
+// GlobalHookInput is the JSON document that global hooks receive on their
+// standard input.
+type GlobalHookInput struct {
+	Hook      string `json:"hook"`
+	Operation string `json:"operation"`
+
+	// Packages are the names of the packages affected by the operation. For
+	// the after_stow hook, packages that failed are not included.
+	Packages []string `json:"packages"`
+}
+
+// RunGlobalHook runs the commands for the named hook from each of the
+// configuration files in order, stopping at the first command that fails.
+// Commands are run in the directory containing their configuration file.
+// In a dry run, the commands are written to the output instead.
+func RunGlobalHook(ctx context.Context, configs []*Config, name string, hc HookContext) error {
+	packages := hc.Packages
+	if packages == nil {
+		packages = []string{}
+	}
+
+	input, err := json.Marshal(GlobalHookInput{
+		Hook:      name,
+		Operation: hc.Operation,
+		Packages:  packages,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	env := append(os.Environ(),
+		fmt.Sprintf("STOWAWAY_HOOK=%s", name),
+		fmt.Sprintf("STOWAWAY_OPERATION=%s", hc.Operation),
+		fmt.Sprintf("STOWAWAY_PACKAGES=%s", strings.Join(packages, " ")),
+	)
+
+	output := hc.Output
+	if output == nil {
+		output = io.Discard
+	}
+
+	w := newPrefixWriter(output, fmt.Sprintf("[stowaway:%s] ", name))
+	defer w.Flush()
+
+	for _, config := range configs {
+		commands := config.Hooks.Commands(name)
+		if hc.DryRun {
+			for _, command := range commands {
+				fmt.Fprintf(output, "would run global hook %s: %s\n", name, command)
+			}
+
+			continue
+		}
+
+		if len(commands) > 0 && !config.User {
+			if err := config.checkTrust(name, hc); err != nil {
+				return err
+			}
+		}
+
+		for _, command := range commands {
+			cmd := exec.Command("/bin/sh", "-c", command, name)
+			cmd.Dir = filepath.Dir(config.Path.String())
+			cmd.Env = env
+			cmd.Stdin = bytes.NewReader(input)
+			cmd.Stdout = w
+			cmd.Stderr = w
+
+			if err := runCommand(ctx, cmd); err != nil {
+				return newHookError("", name, command, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hookDigest returns the SHA-256 digest of the commands for the named hook,
+// or "" if the configuration has no such hook.
+func (c *Config) hookDigest(name string) string {
+	commands := c.Hooks.Commands(name)
+	if len(commands) == 0 {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, command := range commands {
+		fmt.Fprintf(h, "command\x00%s\x00", command)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HookDigests returns the digest of each hook of the configuration, by hook
+// name.
+func (c *Config) HookDigests() map[string]string {
+	digests := map[string]string{}
+	for _, name := range []string{HookBeforeStow, HookAfterStow} {
+		if digest := c.hookDigest(name); digest != "" {
+			digests[name] = digest
+		}
+	}
+
+	return digests
+}
+
+// checkTrust returns an UntrustedHookError if the named hook of the
+// configuration is neither in the trust store nor approved by the
+// ApproveHook function in the hook context. The hooks are identified by the
+// path of the configuration file.
+func (c *Config) checkTrust(name string, hc HookContext) error {
+	return hc.checkTrust(UntrustedHook{
+		Root:     c.Path,
+		Source:   c.Path.String(),
+		Hook:     name,
+		Digest:   c.hookDigest(name),
+		Commands: c.Hooks.Commands(name),
+	})
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigs(t *testing.T) {
+	tmp := tmpDir(t, "configs", []string{"dotfiles/bash/", "dotfiles/vim/", "other/git/"})
+	defer tmp.RemoveAll()
+
+	t.Setenv("XDG_CONFIG_HOME", tmp.Join("config").String())
+
+	writeFile(t, tmp, "config/stowaway/config.toml", "[hooks]\nafter_stow = [\"fc-cache\"]\n", 0644)
+	writeFile(t, tmp, "dotfiles/.stowaway.toml", "[hooks]\nbefore_stow = [\"git pull\"]\n", 0644)
+
+	configs, err := LoadConfigs(tmp.Join("dotfiles/bash"), tmp.Join("dotfiles/vim"), tmp.Join("other/git"))
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+
+	require.Equal(t, tmp.Join("config/stowaway/config.toml"), configs[0].Path)
+	require.Equal(t, []string{"fc-cache"}, configs[0].Hooks.AfterStow)
+
+	require.Equal(t, tmp.Join("dotfiles/.stowaway.toml"), configs[1].Path)
+	require.Equal(t, []string{"git pull"}, configs[1].Hooks.BeforeStow)
+
+	writeFile(t, tmp, "dotfiles/.stowaway.toml", "[hooks]\nbefore = [\"git pull\"]\n", 0644)
+	_, err = LoadConfigs(tmp.Join("dotfiles/bash"))
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.NotErrorIs(t, err, ErrInvalidManifest)
+	require.Contains(t, err.Error(), "dotfiles/.stowaway.toml:2:1: pkg: invalid configuration: unknown keys hooks.before")
+}
+
+func TestRunGlobalHook(t *testing.T) {
+	tmp := tmpDir(t, "global_hooks", []string{"user/", "repo/"})
+	defer tmp.RemoveAll()
+
+	configs := []*Config{
+		{
+			Path: tmp.Join("user/config.toml"),
+			Hooks: GlobalHooks{
+				AfterStow: []string{"echo user $STOWAWAY_PACKAGES >> ../log"},
+			},
+		},
+		{
+			Path: tmp.Join("repo/.stowaway.toml"),
+			Hooks: GlobalHooks{
+				AfterStow: []string{"echo repo $0 $STOWAWAY_OPERATION >> ../log", "cat > ../input.json"},
+			},
+		},
+	}
+
+	output := bytes.NewBuffer([]byte{})
+	hc := HookContext{
+		Operation: OperationInstall,
+		Packages:  []string{"bash", "vim"},
+		Output:    output,
+	}
+
+	require.NoError(t, RunGlobalHook(context.Background(), configs, HookBeforeStow, hc))
+	require.NoError(t, RunGlobalHook(context.Background(), configs, HookAfterStow, hc))
+
+	contents, err := os.ReadFile(tmp.Join("log").String())
+	require.NoError(t, err)
+	require.Equal(t, "user bash vim\nrepo after_stow install\n", string(contents))
+
+	contents, err = os.ReadFile(tmp.Join("input.json").String())
+	require.NoError(t, err)
+
+	var input GlobalHookInput
+	require.NoError(t, json.Unmarshal(contents, &input))
+	require.Equal(t, GlobalHookInput{Hook: HookAfterStow, Operation: OperationInstall, Packages: []string{"bash", "vim"}}, input)
+
+	configs[0].Hooks.BeforeStow = []string{"echo failing; exit 2"}
+	err = RunGlobalHook(context.Background(), configs, HookBeforeStow, hc)
+	require.EqualError(t, err, "pkg: global hook before_stow exited with code 2")
+	require.Equal(t, "[stowaway:before_stow] failing\n", output.String())
+
+	// In a dry run, the commands are only listed
+	output.Reset()
+	hc.DryRun = true
+	require.NoError(t, RunGlobalHook(context.Background(), configs, HookBeforeStow, hc))
+	require.Equal(t, "would run global hook before_stow: echo failing; exit 2\n", output.String())
+}
+
+func TestRunGlobalHookTrust(t *testing.T) {
+	tmp := tmpDir(t, "global_hooks_trust", []string{"user/", "repo/"})
+	defer tmp.RemoveAll()
+
+	configs := []*Config{
+		{
+			Path:  tmp.Join("user/config.toml"),
+			User:  true,
+			Hooks: GlobalHooks{BeforeStow: []string{"echo user >> ../log"}},
+		},
+		{
+			Path:  tmp.Join("repo/.stowaway.toml"),
+			Hooks: GlobalHooks{BeforeStow: []string{"echo repo >> ../log"}},
+		},
+	}
+
+	store, err := LoadTrustStore(tmp.Join("trust.toml"))
+	require.NoError(t, err)
+
+	// The user's own hooks run without being trusted
+	hc := HookContext{Operation: OperationInstall, Trust: store}
+	err = RunGlobalHook(context.Background(), configs, HookBeforeStow, hc)
+	require.EqualError(t, err, "pkg: hook before_stow of configuration "+tmp.Join("repo/.stowaway.toml").String()+" is not trusted")
+	require.Equal(t, "user\n", readFile(t, tmp.Join("log")))
+
+	var asked []UntrustedHook
+	hc.ApproveHook = func(hook UntrustedHook) (bool, error) {
+		asked = append(asked, hook)
+		return true, nil
+	}
+
+	require.NoError(t, RunGlobalHook(context.Background(), configs, HookBeforeStow, hc))
+	require.NoError(t, RunGlobalHook(context.Background(), configs, HookBeforeStow, hc))
+	require.Len(t, asked, 1)
+	require.Equal(t, []string{"echo repo >> ../log"}, asked[0].Commands)
+	require.Equal(t, "user\nuser\nrepo\nuser\nrepo\n", readFile(t, tmp.Join("log")))
+
+	store, err = LoadTrustStore(tmp.Join("trust.toml"))
+	require.NoError(t, err)
+
+	configs[1].Hooks.BeforeStow = []string{"echo changed >> ../log"}
+	err = RunGlobalHook(context.Background(), configs, HookBeforeStow, HookContext{Trust: store})
+	require.EqualError(t, err, "pkg: hook before_stow of configuration "+tmp.Join("repo/.stowaway.toml").String()+" has changed since it was trusted")
+}
+
+func TestStowGlobalHooks(t *testing.T) {
+	tmp := tmpDir(t, "stow_global_hooks", []string{})
+	defer tmp.RemoveAll()
+
+	configs := []*Config{
+		{
+			Path: tmp.Join("config.toml"),
+			Hooks: GlobalHooks{
+				BeforeStow: []string{"echo before $STOWAWAY_PACKAGES >> log"},
+				AfterStow:  []string{"echo after $STOWAWAY_PACKAGES >> log"},
+			},
+		},
+	}
+
+	pkgs := []Package{
+		&MockPackage{PackageName: "a", FailHooks: map[string]bool{HookBeforeInstall: true}},
+		&MockPackage{PackageName: "b"},
+	}
+
+	_, err := Stow(context.Background(), StowOptions{Configs: configs}, pkgs...)
+	require.ErrorIs(t, err, ErrStowFailed)
+
+	contents, err := os.ReadFile(tmp.Join("log").String())
+	require.NoError(t, err)
+	require.Equal(t, "before a b\nafter b\n", string(contents))
+
+	configs[0].Hooks.BeforeStow = []string{"exit 1"}
+
+	installed := false
+	pkgs = []Package{
+		&MockPackage{PackageName: "a", InstallCalled: func(string, bool) { installed = true }},
+	}
+
+	_, err = Stow(context.Background(), StowOptions{Configs: configs}, pkgs...)
+	require.Error(t, err)
+	require.False(t, installed)
+}
@@ -0,0 +1,309 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ErrCannotAdopt is returned when a file cannot be adopted because the
+// package is not installed from a package directory of its own, e.g. because
+// it comes from a remote repository, an archive or the store
+var ErrCannotAdopt = errors.New("pkg: cannot adopt files into a package that is not installed from its directory")
+
+// conflictsFile is the name of the file in the package state directory that
+// records how each file that was in the way of a symlink was dealt with.
+const conflictsFile = "conflicts.toml"
+
+// ConflictStrategy decides what happens to a file in the target directory
+// that is in the place of one of the package's symlinks. Directories are
+// always left alone, and installing the package fails.
+type ConflictStrategy string
+
+const (
+	// ConflictFail leaves the file alone and fails to install the package
+	ConflictFail ConflictStrategy = "fail"
+
+	// ConflictSkip leaves the file alone and does not create the symlink
+	ConflictSkip ConflictStrategy = "skip"
+
+	// ConflictBackup moves the file into a backup before creating the
+	// symlink. The file is put back when the package is uninstalled.
+	ConflictBackup ConflictStrategy = "backup"
+
+	// ConflictOverwrite deletes the file before creating the symlink
+	ConflictOverwrite ConflictStrategy = "overwrite"
+
+	// ConflictAdopt moves the file into the package source, replacing the
+	// package's own file, before creating the symlink. A copy of the file is
+	// put back when the package is uninstalled.
+	ConflictAdopt ConflictStrategy = "adopt"
+
+	// ConflictAsk asks the user which of the other strategies to use
+	ConflictAsk ConflictStrategy = "ask"
+)
+
+// ConflictStrategies are the valid strategies, in the order they are offered
+// to the user when asking.
+var ConflictStrategies = []ConflictStrategy{ConflictSkip, ConflictBackup, ConflictOverwrite, ConflictAdopt, ConflictFail, ConflictAsk}
+
+func (s ConflictStrategy) Valid() bool {
+	for _, strategy := range ConflictStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConflictRule sets the strategy for conflicts with the files in the package
+// source that match a glob pattern, which is matched like the pattern of a
+// LinkHook.
+type ConflictRule struct {
+	Match    string           `toml:"match" json:"match"`
+	Strategy ConflictStrategy `toml:"strategy" json:"strategy"`
+}
+
+// ConflictStrategy returns the strategy of the first conflict rule that
+// matches the file at the slash separated path relative to the package
+// source, if any does.
+func (m *Manifest) ConflictStrategy(rel string) (ConflictStrategy, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	for _, rule := range m.Conflicts {
+		if matchPath(rule.Match, rel) {
+			return rule.Strategy, true
+		}
+	}
+
+	return "", false
+}
+
+// UnresolvedConflict is a file in the place of a symlink that the user is
+// asked about, because its strategy is ConflictAsk.
+type UnresolvedConflict struct {
+	Package string
+
+	// Path is the absolute path of the file in the target directory
+	Path filesystem.Path
+}
+
+// Conflict records how a file that was in the place of a symlink was dealt
+// with when the package was installed.
+type Conflict struct {
+	// Name is the path of the file relative to the target directory
+	Name     string           `toml:"name"`
+	Strategy ConflictStrategy `toml:"strategy"`
+}
+
+type conflictsState struct {
+	Conflicts []Conflict `toml:"conflicts"`
+}
+
+// ReadConflicts returns the conflicts recorded in the package state
+// directory.
+func ReadConflicts(state filesystem.Path) ([]Conflict, error) {
+	return readConflicts(filesystem.OS, state)
+}
+
+func readConflicts(fsys filesystem.FS, state filesystem.Path) ([]Conflict, error) {
+	path := state.Join(conflictsFile)
+	exists, err := filesystem.Exists(fsys, path.String())
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	f, err := fsys.Open(path.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var s conflictsState
+	if err := toml.NewDecoder(f).Decode(&s); err != nil {
+		return nil, fmt.Errorf("conflicts %s: %w", path, err)
+	}
+
+	return s.Conflicts, nil
+}
+
+func writeConflicts(fsys filesystem.FS, state filesystem.Path, conflicts []Conflict) error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(conflictsState{Conflicts: conflicts}); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(state.Join(conflictsFile).String(), w.Bytes(), 0644)
+}
+
+// conflictResolver deals with the files in the way of the symlinks while a
+// package is installed.
+type conflictResolver struct {
+	pkg       localPackage
+	backupID  string
+	backups   []Backup
+	conflicts []Conflict
+}
+
+// strategy returns the strategy for the file at the slash separated path,
+// asking the user if needed.
+func (r *conflictResolver) strategy(name string) (ConflictStrategy, error) {
+	pkg := r.pkg
+
+	strategy, ok := pkg.Manifest.ConflictStrategy(name)
+	if !ok {
+		strategy = pkg.Conflict
+	}
+
+	if strategy != ConflictAsk {
+		return strategy, nil
+	}
+
+	if pkg.AskConflict == nil {
+		return ConflictFail, nil
+	}
+
+	conflict := UnresolvedConflict{Package: pkg.Name(), Path: pkg.Target.Join(filepath.FromSlash(name))}
+	return pkg.AskConflict(conflict)
+}
+
+// resolve deals with the file at path that is in the place of a symlink,
+// which could not be created because of linkErr. It returns whether the
+// symlink should be created now. Each conflict is recorded before anything
+// is changed, so that uninstalling the package undoes the change if the
+// installation fails from here on.
+func (r *conflictResolver) resolve(path string, linkErr error) (bool, error) {
+	pkg := r.pkg
+	fsys := pkg.fs()
+	name := filepath.ToSlash(path)
+	file := pkg.Target.Join(path)
+
+	info, err := fsys.Lstat(file.String())
+	if err != nil || info.IsDir() {
+		return false, linkErr
+	}
+
+	strategy, err := r.strategy(name)
+	if err != nil {
+		return false, err
+	}
+
+	switch strategy {
+	case ConflictSkip, ConflictBackup, ConflictOverwrite, ConflictAdopt:
+	default:
+		return false, linkErr
+	}
+
+	if strategy == ConflictAdopt && !pkg.canAdopt() {
+		return false, fmt.Errorf("%w: %s", ErrCannotAdopt, file)
+	}
+
+	r.conflicts = append(r.conflicts, Conflict{Name: name, Strategy: strategy})
+	if err := writeConflicts(fsys, pkg.State, r.conflicts); err != nil {
+		return false, err
+	}
+
+	switch strategy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictBackup:
+		if r.backupID == "" {
+			r.backupID, err = newBackupID(fsys, pkg.Backups, time.Now())
+			if err != nil {
+				return false, err
+			}
+		}
+
+		backup := Backup{ID: r.backupID, Name: name}
+		r.backups = append(r.backups, backup)
+		if err := writeBackups(fsys, pkg.State, r.backups); err != nil {
+			return false, err
+		}
+
+		return true, backup.move(fsys, pkg.Backups, pkg.Target)
+	case ConflictOverwrite:
+		return true, fsys.Remove(file.String())
+	default:
+		return true, moveFile(fsys, file, pkg.Source.Join(path))
+	}
+}
+
+// canAdopt reports whether files can be moved into the package source. This
+// is only the case when the source is the package directory itself, and not
+// a snapshot in the store or a copy of a remote package or an archive in the
+// cache, where the file would be lost when the copy is replaced.
+func (pkg localPackage) canAdopt() bool {
+	origin := pkg.Origin
+	return origin == nil || (origin.Snapshot == "" && origin.Commit == "" && origin.Checksum == "")
+}
+
+// moveFile renames the file or symlink, or copies it and removes the
+// original if it cannot be renamed, e.g. because it is on another
+// filesystem. The copy replaces dst only once it is complete.
+func moveFile(fsys filesystem.FS, src, dst filesystem.Path) error {
+	if err := fsys.Rename(src.String(), dst.String()); err == nil {
+		return nil
+	}
+
+	tmp := dst.Parent().Join(".stowaway-" + dst.Basename())
+	if err := filesystem.RemoveAll(fsys, tmp.String()); err != nil {
+		return err
+	}
+
+	if err := copyFile(fsys, src, tmp); err != nil {
+		filesystem.RemoveAll(fsys, tmp.String())
+		return err
+	}
+
+	if err := fsys.Rename(tmp.String(), dst.String()); err != nil {
+		filesystem.RemoveAll(fsys, tmp.String())
+		return err
+	}
+
+	return fsys.Remove(src.String())
+}
+
+// copyFile copies a file or symlink, keeping the permissions of the file.
+func copyFile(fsys filesystem.FS, src, dst filesystem.Path) error {
+	info, err := fsys.Lstat(src.String())
+	if err != nil {
+		return err
+	}
+
+	if err := filesystem.MkdirAll(fsys, dst.Parent().String(), 0755); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		target, err := fsys.Readlink(src.String())
+		if err != nil {
+			return err
+		}
+
+		return fsys.Symlink(target, dst.String())
+	}
+
+	f, err := fsys.Open(src.String())
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(dst.String(), data, info.Mode().Perm())
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallConflicts(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "conflicts", []string{"state/"})
+		root, home := tmp.Join("bash"), tmp.Join("home")
+
+		for _, name := range []string{".bashrc", ".profile", ".inputrc", ".bash_logout"} {
+			tfs.writeFile(t, root, "src/"+name, "package", 0644)
+			tfs.writeFile(t, home, name, "original", 0644)
+		}
+
+		tfs.writeManifest(t, root, "stowaway.toml", &Manifest{
+			Name: "bash",
+			Conflicts: []ConflictRule{
+				{Match: ".profile", Strategy: ConflictSkip},
+				{Match: ".inputrc", Strategy: ConflictAdopt},
+				{Match: ".bash_*", Strategy: ConflictAsk},
+			},
+		})
+
+		var asked []UnresolvedConflict
+		loader := Loader{
+			FS:       tfs.FS,
+			State:    tmp.Join("state/bash"),
+			Source:   root,
+			Target:   home,
+			Conflict: ConflictOverwrite,
+			AskConflict: func(conflict UnresolvedConflict) (ConflictStrategy, error) {
+				asked = append(asked, conflict)
+				return ConflictBackup, nil
+			},
+		}
+
+		p, err := loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Install())
+
+		require.Equal(t, []UnresolvedConflict{{Package: "bash", Path: home.Join(".bash_logout")}}, asked)
+
+		conflicts, err := readConflicts(tfs, loader.State)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Conflict{
+			{Name: ".bashrc", Strategy: ConflictOverwrite},
+			{Name: ".profile", Strategy: ConflictSkip},
+			{Name: ".inputrc", Strategy: ConflictAdopt},
+			{Name: ".bash_logout", Strategy: ConflictBackup},
+		}, conflicts)
+
+		links, err := p.TargetLinks()
+		require.NoError(t, err)
+		require.Equal(t, []filesystem.Path{home.Join(".bash_logout"), home.Join(".bashrc"), home.Join(".inputrc")}, links)
+
+		// Skipped files are left alone, and adopted files are moved into the
+		// package
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".profile")))
+		require.Equal(t, "original", tfs.readFile(t, root.Join("src/.inputrc")))
+		require.Equal(t, "package", tfs.readFile(t, home.Join(".bashrc")))
+
+		// Skipped files are not reported as drift
+		status, err := readStatus(tfs, loader.State)
+		require.NoError(t, err)
+		require.Empty(t, status.Drifted())
+
+		// Uninstalling puts back the files that were backed up and a copy of
+		// the ones that were adopted
+		require.NoError(t, p.Uninstall())
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".bash_logout")))
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".inputrc")))
+		require.Equal(t, "original", tfs.readFile(t, home.Join(".profile")))
+		tfs.assertMissing(t, home, []string{".bashrc"})
+	})
+}
+
+func TestInstallConflictFailures(t *testing.T) {
+	tmp := tmpDir(t, "conflicts", []string{"bash/.bashrc", "bash/.profile", "home/.bashrc", "home/.profile", "state/"})
+
+	// Without a way to ask, asking fails like the default strategy
+	loader := Loader{State: tmp.Join("state/bash"), Source: tmp.Join("bash"), Target: tmp.Join("home"), Conflict: ConflictAsk}
+	p, err := loader.Load()
+	require.NoError(t, err)
+	require.ErrorIs(t, p.Install(), fs.ErrExist)
+
+	// Failing after a file was adopted puts a copy of it back
+	require.NoError(t, tmp.Join("home/.bashrc").WriteFile([]byte("original"), 0644))
+
+	asked := errors.New("cannot ask")
+	loader.AskConflict = func(conflict UnresolvedConflict) (ConflictStrategy, error) {
+		if conflict.Path.Basename() == ".profile" {
+			return "", asked
+		}
+
+		return ConflictAdopt, nil
+	}
+
+	p, err = loader.Load()
+	require.NoError(t, err)
+	require.ErrorIs(t, p.Install(), asked)
+	require.Equal(t, "original", readFile(t, tmp.Join("home/.bashrc")))
+	assertMissing(t, tmp, []string{"state/bash"})
+
+	// Files are not adopted into a copy of a remote package
+	loader.Origin = &Origin{URL: "https://example.com/dotfiles.git#bash", Commit: "abc123"}
+	p, err = loader.Load()
+	require.NoError(t, err)
+	require.ErrorIs(t, p.Install(), ErrCannotAdopt)
+	require.Equal(t, "original", readFile(t, tmp.Join("home/.bashrc")))
+	assertMissing(t, tmp, []string{"state/bash"})
+}
@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ErrGenerationNotFound is returned when a generation does not exist
+var ErrGenerationNotFound = errors.New("pkg: generation not found")
+
+// Generation records the packages installed in a target directory after an
+// operation succeeded, so that the target directory can be restored to it
+// later.
+type Generation struct {
+	// Number increases by one with each generation
+	Number int `toml:"number"`
+
+	// Time is when the generation was recorded
+	Time time.Time `toml:"time"`
+
+	// Packages are the packages that were installed, sorted by their state
+	Packages []GenerationPackage `toml:"packages"`
+}
+
+// GenerationPackage is a package installed in a generation.
+type GenerationPackage struct {
+	Name string `toml:"name"`
+
+	// State is the name of the package state directory
+	State string `toml:"state"`
+
+	// Root is the package root the package was installed from
+	Root string `toml:"root"`
+
+	// Origin is the remote package, archive or snapshot the package came
+	// from, if any
+	Origin *Origin `toml:"origin,omitempty"`
+
+	// Links are the symlinks the package created, relative to the target
+	// directory. Symlinks that target sections created outside of it are
+	// absolute.
+	Links []string `toml:"links"`
+}
+
+// NewGeneration describes the packages installed in the given package state
+// directories as a generation, which has no number yet. It only uses what the
+// state directories recorded, so packages whose source has changed since
+// they were installed do not get in the way.
+func NewGeneration(target filesystem.Path, states []filesystem.Path) (Generation, error) {
+	generation := Generation{Time: time.Now().UTC().Truncate(time.Second)}
+
+	for _, state := range states {
+		installed, err := readGenerationPackage(target, state)
+		if err != nil {
+			return generation, err
+		}
+
+		generation.Packages = append(generation.Packages, installed)
+	}
+
+	sort.Slice(generation.Packages, func(i, j int) bool {
+		return generation.Packages[i].State < generation.Packages[j].State
+	})
+
+	return generation, nil
+}
+
+// readGenerationPackage describes the package installed in the state
+// directory from its root link, manifest, origin and links directories.
+func readGenerationPackage(target, state filesystem.Path) (GenerationPackage, error) {
+	installed := GenerationPackage{State: state.Basename(), Links: []string{}}
+
+	root, err := state.Join("root").Readlink()
+	if err != nil {
+		// Packages installed by older versions only have a source link,
+		// which is the package root for simple packages
+		root, err = state.Join("source").Readlink()
+		if err != nil {
+			return installed, err
+		}
+	}
+
+	installed.Root = root.String()
+	installed.Name = root.Basename()
+
+	manifest, err := decodeManifest(filesystem.OS, state.Join(installedManifest))
+	if err != nil {
+		return installed, err
+	}
+
+	if manifest != nil {
+		installed.Name = manifest.Name
+	}
+
+	installed.Origin, err = decodeOrigin(filesystem.OS, state.Join(originFile))
+	if err != nil {
+		return installed, err
+	}
+
+	links, err := recordedLinks(state)
+	if err != nil {
+		return installed, err
+	}
+
+	for _, link := range links {
+		rel, err := filepath.Rel(target.String(), link.String())
+		if err != nil {
+			return installed, err
+		}
+
+		if !isLocal(rel) {
+			rel = link.String()
+		}
+
+		installed.Links = append(installed.Links, filepath.ToSlash(rel))
+	}
+
+	return installed, nil
+}
+
+// recordedLinks returns the absolute paths of the symlinks recorded in the
+// links directories of the package installed in the state directory, for
+// each of its target sections.
+func recordedLinks(state filesystem.Path) ([]filesystem.Path, error) {
+	states, err := TargetStates(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []filesystem.Path
+	for _, state := range states {
+		target, err := state.Join("target").Readlink()
+		if err != nil {
+			return nil, err
+		}
+
+		part := localPackage{
+			State:      state,
+			Target:     target,
+			TargetLink: state.Join("target"),
+			Links:      state.Join("links"),
+		}
+
+		names, err := part.linkNames()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			links = append(links, target.Join(name))
+		}
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i] < links[j]
+	})
+
+	return links, nil
+}
+
+// GenerationPath returns the file that the generation with the given number
+// is saved in.
+func GenerationPath(dir filesystem.Path, number int) filesystem.Path {
+	return dir.Join(strconv.Itoa(number) + ".toml")
+}
+
+// WriteGeneration saves the generation in the directory.
+func WriteGeneration(dir filesystem.Path, generation Generation) error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(generation); err != nil {
+		return err
+	}
+
+	if err := dir.MkdirAll(0755); err != nil {
+		return err
+	}
+
+	return GenerationPath(dir, generation.Number).WriteFile(w.Bytes(), 0644)
+}
+
+// ReadGeneration reads a generation saved by WriteGeneration.
+func ReadGeneration(path filesystem.Path) (Generation, error) {
+	var generation Generation
+
+	f, err := path.Open()
+	if err != nil {
+		return generation, err
+	}
+
+	defer f.Close()
+
+	if err := toml.NewDecoder(f).Decode(&generation); err != nil {
+		return generation, fmt.Errorf("generation %s: %w", path, err)
+	}
+
+	return generation, nil
+}
+
+// ReadGenerations reads every generation saved in the directory, oldest
+// first. There are no generations if the directory does not exist.
+func ReadGenerations(dir filesystem.Path) ([]Generation, error) {
+	exists, err := dir.Exists()
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	entries, err := dir.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []Generation
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".toml")); err != nil || entry.IsDir() {
+			continue
+		}
+
+		generation, err := ReadGeneration(dir.Join(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		generations = append(generations, generation)
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Number < generations[j].Number
+	})
+
+	return generations, nil
+}
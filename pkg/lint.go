@@ -0,0 +1,304 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+
+	return "warning"
+}
+
+// Issue is a problem found while linting a package.
+type Issue struct {
+	// Package is the root of the package the issue was found in
+	Package filesystem.Path
+
+	// Path is the file the issue relates to, relative to the package root.
+	// It is empty for issues that concern the whole package.
+	Path string
+
+	Severity Severity
+	Message  string
+}
+
+func (i Issue) String() string {
+	path := i.Package.String()
+	if i.Path != "" {
+		path = i.Package.Join(i.Path).String()
+	}
+
+	return fmt.Sprintf("%s: %s: %s", path, i.Severity, i.Message)
+}
+
+var knownHooks = map[string]bool{
+	HookBeforeUninstallAll: true,
+	HookAfterUninstallAll:  true,
+	HookBeforeUninstall:    true,
+	HookAfterUninstall:     true,
+	HookBeforeInstall:      true,
+	HookAfterInstall:       true,
+	HookBeforeInstallAll:   true,
+	HookAfterInstallAll:    true,
+	HookOnChange:           true,
+	HookBeforeLink:         true,
+	HookAfterLink:          true,
+	HookOnStatusDrift:      true,
+}
+
+// Lint checks each of the packages rooted at the given paths for problems
+// that would cause them to fail to install or to behave unexpectedly. This
+// includes clashes between packages that would create the same symlink in the
+// target directory, unless one of them has a higher priority than the others
+// and shadows them.
+func Lint(roots ...filesystem.Path) []Issue {
+	var issues []Issue
+	owners := map[string][]filesystem.Path{}
+	priorities := map[filesystem.Path]int{}
+
+	for _, root := range roots {
+		files, priority, pkgIssues := lintPackage(root)
+		issues = append(issues, pkgIssues...)
+		priorities[root] = priority
+
+		for _, file := range files {
+			owners[file] = append(owners[file], root)
+		}
+	}
+
+	// Only the packages with the highest priority clash
+	for file, pkgs := range owners {
+		top := priorities[pkgs[0]]
+		for _, root := range pkgs {
+			if priorities[root] > top {
+				top = priorities[root]
+			}
+		}
+
+		var clashing []filesystem.Path
+		for _, root := range pkgs {
+			if priorities[root] == top {
+				clashing = append(clashing, root)
+			}
+		}
+
+		owners[file] = clashing
+	}
+
+	var clashes []string
+	for file, pkgs := range owners {
+		if len(pkgs) > 1 {
+			clashes = append(clashes, file)
+		}
+	}
+
+	sort.Strings(clashes)
+
+	for _, file := range clashes {
+		pkgs := owners[file]
+		others := make([]string, len(pkgs))
+		for i, root := range pkgs {
+			others[i] = root.String()
+		}
+
+		for _, root := range pkgs {
+			issues = append(issues, Issue{
+				Package:  root,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("target %s is provided by multiple packages: %s", file, strings.Join(others, ", ")),
+			})
+		}
+	}
+
+	return issues
+}
+
+// lintPackage returns the paths of the symlinks the package would create
+// relative to the target directory and the priority of the package, along
+// with any issues found.
+func lintPackage(root filesystem.Path) ([]string, int, []Issue) {
+	var issues []Issue
+	report := func(path string, severity Severity, format string, args ...interface{}) {
+		issues = append(issues, Issue{
+			Package:  root,
+			Path:     path,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	loader := Loader{Source: root}
+	m, err := loader.LoadManifest()
+	if err != nil {
+		report("", SeverityError, "%s", err)
+		return nil, 0, issues
+	}
+
+	sections, priority := []TargetSection{{Source: "."}}, 0
+	if m != nil {
+		sections, priority = []TargetSection{{Source: m.Source}}, m.Priority
+		issues = append(issues, lintHooks(root, m.Hooks.Dir)...)
+		issues = append(issues, lintIgnored(root, m)...)
+	}
+
+	if len(m.targets()) > 0 {
+		sections = m.Targets
+	}
+
+	var files []string
+	for _, section := range sections {
+		// The symlinks of target sections are named after their target as
+		// it is written, since the target directory is not known
+		for _, file := range lintSource(root, root.Join(section.Source), m, report) {
+			if section.Target != "" {
+				file = filepath.Join(section.Target, file)
+			}
+
+			files = append(files, file)
+		}
+	}
+
+	return files, priority, issues
+}
+
+// lintSource returns the paths of the symlinks the package would create for
+// the files in a source directory, relative to their target directory.
+func lintSource(root, source filesystem.Path, m *Manifest, report func(string, Severity, string, ...interface{})) []string {
+	var files []string
+	err := source.Walk(func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(root.String(), source.Join(path).String())
+
+		if err != nil {
+			report(rel, SeverityError, "%s", err)
+			return nil
+		}
+
+		if path != "." && m.Ignored(path) {
+			return skipIgnored(info)
+		}
+
+		if path == "." || !shouldSymlink(info.Mode()) {
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			f, err := source.Join(path).Open()
+			if err != nil {
+				report(rel, SeverityError, "file is not readable: %s", err)
+			} else {
+				f.Close()
+			}
+		}
+
+		files = append(files, path)
+		return nil
+	})
+
+	if err != nil {
+		report("", SeverityError, "%s", err)
+	}
+
+	return files
+}
+
+func lintHooks(root filesystem.Path, dir string) []Issue {
+	entries, err := root.Join(dir).ReadDir()
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return []Issue{{Package: root, Path: dir, Severity: SeverityError, Message: err.Error()}}
+	}
+
+	var issues []Issue
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if !knownHooks[entry.Name()] {
+			issues = append(issues, Issue{Package: root, Path: path, Severity: SeverityWarning, Message: "not a known hook and will never run"})
+			continue
+		}
+
+		info, err := root.Join(path).Stat()
+		if err != nil {
+			issues = append(issues, Issue{Package: root, Path: path, Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			issues = append(issues, Issue{Package: root, Path: path, Severity: SeverityError, Message: "hook is not an executable file"})
+		}
+	}
+
+	return issues
+}
+
+// lintIgnored reports files in the root of packages with a manifest that are
+// neither the manifest, a source directory nor the hooks directory. These
+// files are ignored by Stowaway, which may not be what the author intended.
+func lintIgnored(root filesystem.Path, m *Manifest) []Issue {
+	entries, err := root.ReadDir()
+	if err != nil {
+		return []Issue{{Package: root, Severity: SeverityError, Message: err.Error()}}
+	}
+
+	sources := []string{m.Source}
+	if len(m.Targets) > 0 {
+		sources = nil
+		for _, section := range m.Targets {
+			sources = append(sources, section.Source)
+		}
+	}
+
+	used := map[string]bool{
+		"stowaway.toml":       true,
+		topLevel(m.Hooks.Dir): true,
+	}
+
+	for _, source := range sources {
+		// Every file is used if a source is the package root
+		if topLevel(source) == "." {
+			return nil
+		}
+
+		used[topLevel(source)] = true
+	}
+
+	var issues []Issue
+	for _, entry := range entries {
+		if used[entry.Name()] {
+			continue
+		}
+
+		issues = append(issues, Issue{
+			Package:  root,
+			Path:     entry.Name(),
+			Severity: SeverityWarning,
+			Message:  "present in the package root but will not be linked",
+		})
+	}
+
+	return issues
+}
+
+// topLevel returns the first element of a relative path
+func topLevel(path string) string {
+	return strings.SplitN(filepath.ToSlash(filepath.Clean(path)), "/", 2)[0]
+}
@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	tmp := tmpDir(t, "lint", []string{
+		"bash/.bashrc",
+		"advanced/src/.bashrc",
+		"advanced/src/.inputrc",
+		"advanced/README.md",
+		"vim/.vimrc",
+		"work/src/.inputrc",
+	})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "advanced/stowaway.toml", &Manifest{})
+	writeFile(t, tmp, "advanced/hooks/after_install", "#!/bin/sh", 0644)
+	writeFile(t, tmp, "advanced/hooks/after_everything", "#!/bin/sh", 0755)
+	writeFile(t, tmp, "broken/stowaway.toml", "source = \"../bash\"", 0644)
+
+	// A package with a higher priority shadows the others instead of
+	// clashing with them
+	writeManifest(t, tmp, "work/stowaway.toml", &Manifest{Name: "work", Priority: 1})
+
+	issues := Lint(tmp.Join("bash"), tmp.Join("advanced"), tmp.Join("vim"), tmp.Join("broken"), tmp.Join("work"))
+
+	messages := []string{}
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+
+	bash := tmp.Join("bash").String()
+	advanced := tmp.Join("advanced").String()
+	broken := tmp.Join("broken").String()
+
+	require.ElementsMatch(t, []string{
+		advanced + "/hooks/after_everything: warning: not a known hook and will never run",
+		advanced + "/hooks/after_install: error: hook is not an executable file",
+		advanced + "/README.md: warning: present in the package root but will not be linked",
+		broken + ": error: " + broken + "/stowaway.toml: pkg: invalid manifest: source \"../bash\" must be inside the package root",
+		bash + ": error: target .bashrc is provided by multiple packages: " + bash + ", " + advanced,
+		advanced + ": error: target .bashrc is provided by multiple packages: " + bash + ", " + advanced,
+	}, messages)
+}
+
+func TestLintTargets(t *testing.T) {
+	tmp := tmpDir(t, "lint", []string{
+		"multi/home/.bashrc",
+		"multi/config/git/config",
+		"multi/notes.txt",
+	})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "multi/stowaway.toml", &Manifest{
+		Targets: []TargetSection{
+			{Source: "home", Target: "~"},
+			{Source: "config", Target: "~/.config"},
+		},
+	})
+
+	issues := Lint(tmp.Join("multi"))
+
+	messages := []string{}
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+
+	multi := tmp.Join("multi").String()
+
+	require.Equal(t, []string{
+		multi + "/notes.txt: warning: present in the package root but will not be linked",
+	}, messages)
+}
@@ -1,12 +1,19 @@
 package pkg
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/jamesbehr/stowaway/filesystem"
 	"github.com/pelletier/go-toml/v2"
@@ -21,29 +28,153 @@ type Package interface {
 	Installed() (bool, error)
 	Install() error
 	Uninstall() error
-	RunHookIfExists(name string) error
+	RunHookIfExists(ctx context.Context, name string, hc HookContext) error
 	Name() string
+	Metadata() Manifest
+
+	// TargetLinks returns the absolute paths of the symlinks in the target
+	// directory that belong to the package. If the package is not installed,
+	// these are the symlinks that would be created by installing it.
+	TargetLinks() ([]filesystem.Path, error)
+
+	// SourceLinks returns the absolute paths of the symlinks in the target
+	// directory that installing the package would create, whether or not it
+	// is installed.
+	SourceLinks() ([]filesystem.Path, error)
 }
 
-type Manifest struct {
-	Name   string `toml:"name,omitempty"`
-	Source string `toml:"source,omitempty"`
-	Hooks  string `toml:"hooks,omitempty"`
+// LinkHookInstaller is implemented by packages that can run the before_link
+// and after_link hooks while they are installed. Stow runs the hooks for
+// other packages for every symlink before and after installing the package.
+type LinkHookInstaller interface {
+	// InstallWithLinkHook installs the package like Install, calling
+	// linkHook with HookBeforeLink just before each symlink is created in
+	// the target directory, and with HookAfterLink right after. If linkHook
+	// fails, installing the package fails with its error.
+	InstallWithLinkHook(linkHook func(hook string, link filesystem.Path) error) error
 }
 
 type Loader struct {
-	State, Source, Target filesystem.Path
+	Source, Target filesystem.Path
+
+	// State is the package state directory. It defaults to the directory
+	// named after the package in the DefaultStateDir of Target.
+	State filesystem.Path
+
+	// FS holds the package source and state. It defaults to filesystem.OS.
+	// Hooks always run on the operating system's filesystem.
+	FS filesystem.FS
+
+	// Linker creates the symlinks in the target directory. It defaults to a
+	// filesystem.DirLinker rooted at Target on FS.
+	Linker filesystem.Linker
+
+	// Origin is recorded in the package state when the package is
+	// installed, if the package was fetched from a remote repository or
+	// extracted from an archive
+	Origin *Origin
+
+	// Conflict is the strategy for files in the target directory that are
+	// in the way of the package's symlinks, unless the manifest has a
+	// conflict rule for them. It defaults to ConflictFail. AskConflict is
+	// asked for the strategy to use for the files whose strategy is
+	// ConflictAsk, which fail if it is nil.
+	Conflict    ConflictStrategy
+	AskConflict func(UnresolvedConflict) (ConflictStrategy, error)
+
+	// Backups is the directory the files replaced with ConflictBackup are
+	// kept in. It defaults to the backups directory next to State.
+	Backups filesystem.Path
+
+	// Uninstall is set when the package is loaded to be uninstalled. An
+	// installed package whose manifest has become invalid is then loaded
+	// with the manifest recorded when it was installed.
+	Uninstall bool
 }
 
+// BackupsDirName is the name of the directory next to the package state
+// directories that replaced files are kept in
+const BackupsDirName = "backups"
+
 func (l Loader) DefaultManifest() Manifest {
 	return Manifest{
 		Name:   l.Source.Basename(),
 		Source: "src",
-		Hooks:  "hooks",
+		Hooks:  Hooks{Dir: "hooks"},
+	}
+}
+
+// fs returns the FS the package is loaded from
+func (l Loader) fs() filesystem.FS {
+	if l.FS != nil {
+		return l.FS
+	}
+
+	return filesystem.OS
+}
+
+// LoadManifest reads and validates the manifest in the package source. It
+// returns a nil manifest if the package has no manifest.
+func (l Loader) LoadManifest() (*Manifest, error) {
+	manifest := l.Source.Join("stowaway.toml")
+	exists, err := filesystem.Exists(l.fs(), manifest.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	f, err := l.fs().Open(manifest.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	m := l.DefaultManifest()
+	defaults := m.Hooks
+
+	err = toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(&m)
+	if err == nil {
+		err = decodeInlineHooks(data, defaults, &m.Hooks)
+	}
+
+	if err != nil {
+		return nil, newManifestError(manifest, err)
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, newManifestError(manifest, err)
+	}
+
+	if err := m.validateDirs(l.fs(), l.Source); err != nil {
+		if errors.Is(err, ErrInvalidManifest) {
+			return nil, newManifestError(manifest, err)
+		}
+
+		return nil, err
 	}
+
+	return &m, nil
 }
 
 func (l Loader) Load() (Package, error) {
+	if l.State == "" {
+		dir, err := DefaultStateDir(l.Target)
+		if err != nil {
+			return nil, err
+		}
+
+		l.State = dir.Join(PackageID(l.Source))
+	}
+
 	pkg := &localPackage{
 		State:       l.State,
 		Source:      l.Source,
@@ -51,32 +182,60 @@ func (l Loader) Load() (Package, error) {
 		Target:      l.Target,
 		SourceLink:  l.State.Join("source"),
 		TargetLink:  l.State.Join("target"),
+		RootLink:    l.State.Join("root"),
 		Links:       l.State.Join("links"),
+		FS:          l.fs(),
+		Linker:      l.Linker,
+		Origin:      l.Origin,
+		Conflict:    l.Conflict,
+		AskConflict: l.AskConflict,
+		Backups:     l.Backups,
+		States:      l.State.Parent(),
+	}
+
+	if pkg.Linker == nil {
+		pkg.Linker = filesystem.DirLinkerFS(pkg.FS, l.Target.String())
+	}
+
+	if pkg.Backups == "" {
+		pkg.Backups = l.State.Parent().Join(BackupsDirName)
+	}
+
+	m, err := l.LoadManifest()
+	if l.Uninstall && errors.Is(err, ErrInvalidManifest) {
+		m, err = pkg.installedManifest(err)
 	}
 
-	manifest := pkg.Source.Join("stowaway.toml")
-	exists, err := manifest.Exists()
 	if err != nil {
 		return nil, err
 	}
 
-	if exists {
-		f, err := manifest.Open()
-		if err != nil {
-			return nil, err
-		}
+	if m != nil {
+		pkg.Manifest = m
+		pkg.Source = pkg.Source.Join(m.Source)
+	}
 
-		defer f.Close()
+	// The first target section takes the place of the source, and the
+	// others are installed alongside it. A target that cannot be expanded
+	// only matters when installing, since an installed package is
+	// uninstalled from the targets recorded in its state.
+	for i, section := range m.targets() {
+		target, err := ExpandTarget(section.Target, l.Target)
+		if err != nil {
+			if pkg.TargetErr == nil {
+				pkg.TargetErr = err
+			}
 
-		m := l.DefaultManifest()
+			continue
+		}
 
-		err = toml.NewDecoder(f).Decode(&m)
-		if err != nil {
-			return nil, err
+		source := pkg.PackageRoot.Join(section.Source)
+		if i == 0 {
+			*pkg = pkg.part(l.State, source, target)
+			continue
 		}
 
-		pkg.Manifest = &m
-		pkg.Source = pkg.Source.Join(m.Source)
+		pkg.Targets = append(pkg.Targets, pkg.part(targetState(l.State, section.name()), source, target))
 	}
 
 	return pkg, nil
@@ -105,11 +264,43 @@ type localPackage struct {
 	// TargetLink is the path of the symlink in State that points to Target
 	TargetLink filesystem.Path
 
+	// RootLink is the path of the symlink in State that points to PackageRoot
+	RootLink filesystem.Path
+
 	// Links is the path in State that contains a number of symlinks. Each
 	// symlink in this directory points to another symlink that was created in
 	// the target directory.
 	Links filesystem.Path
 
+	// FS holds the package source and state, and the files in the way of the
+	// symlinks in the target directory
+	FS filesystem.FS
+
+	// Linker creates and removes the symlinks in the target directory
+	Linker filesystem.Linker
+
+	// Origin is the remote package or archive the package came from, if any
+	Origin *Origin
+
+	// Conflict and AskConflict decide what happens to files in the way of
+	// the symlinks. Files are backed up into Backups. See Loader.
+	Conflict    ConflictStrategy
+	AskConflict func(UnresolvedConflict) (ConflictStrategy, error)
+	Backups     filesystem.Path
+
+	// States is the directory containing the state directory of every
+	// installed package
+	States filesystem.Path
+
+	// Targets are the packages for the target sections of the manifest
+	// after the first, which is the package itself. Each one has its state
+	// directory inside State.
+	Targets []localPackage
+
+	// TargetErr is the error expanding the target of one of the target
+	// sections, which installing the package fails with
+	TargetErr error
+
 	// Manifiest is the parsed manifest for this package. If it is nil, then
 	// the package had no manifiest and is thus a simple package. Simple
 	// packages have no hooks and every file inside the package root will get a
@@ -117,10 +308,30 @@ type localPackage struct {
 	Manifest *Manifest
 }
 
+// fs returns the FS the package is on, which is the operating system's for
+// packages that were not given one
+func (pkg localPackage) fs() filesystem.FS {
+	if pkg.FS != nil {
+		return pkg.FS
+	}
+
+	return filesystem.OS
+}
+
 func shouldSymlink(mode fs.FileMode) bool {
 	return mode.IsRegular() || mode == fs.ModeSymlink
 }
 
+// skipIgnored is returned from a walk function for a file that the manifest
+// ignores, so that ignored directories are skipped entirely
+func skipIgnored(info fs.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
+
 func (pkg localPackage) Name() string {
 	if pkg.Manifest == nil {
 		return pkg.Source.Basename()
@@ -129,235 +340,1319 @@ func (pkg localPackage) Name() string {
 	return pkg.Manifest.Name
 }
 
-func (pkg localPackage) RunHookIfExists(name string) error {
-	// Simple packages cannot have hooks
+func (pkg localPackage) Metadata() Manifest {
 	if pkg.Manifest == nil {
-		return nil
+		return Manifest{Name: pkg.Name()}
 	}
 
-	executable := pkg.PackageRoot.Join(pkg.Manifest.Hooks, name)
-	exists, err := executable.Exists()
-	if err != nil {
-		return err
+	return *pkg.Manifest
+}
+
+// HookContext describes the operation that a hook is being run as part of.
+type HookContext struct {
+	// Operation is OperationInstall, OperationUninstall or OperationStatus
+	Operation string
+
+	// DryRun is true if no changes will be made to the target directory.
+	// The commands of the hook are written to Output instead of being run.
+	DryRun bool
+
+	// Output receives the combined stdout and stderr of the hook, with each
+	// line prefixed with [package:hook]. If it is nil, the output is
+	// discarded.
+	Output io.Writer
+
+	// Packages are the names of every package in the operation
+	Packages []string
+
+	// Links are the symlinks that were created or are about to be removed by
+	// the operation. For hooks that run before a package is installed, they
+	// are the symlinks that will be created, and for hooks that run after a
+	// package is uninstalled, they are the symlinks that were removed.
+	Links []filesystem.Path
+
+	// PreviousLinks are the symlinks the package had before it was installed
+	// again. It is only set for the on_change hook.
+	PreviousLinks []filesystem.Path
+
+	// Link is the symlink being created. It is only set for the before_link
+	// and after_link hooks.
+	Link filesystem.Path
+
+	// Sandbox runs the hook with read-only access to everything except the
+	// target directory, the package root and the package state, and without
+	// network access. It is only supported on Linux.
+	Sandbox bool
+
+	// AllowUnsandboxed runs the hook without a sandbox if it cannot be
+	// created, instead of failing with a SandboxError.
+	AllowUnsandboxed bool
+
+	// Trust is the store of hooks the user has approved. If it is set, hooks
+	// that are not in the store are only run if ApproveHook approves them,
+	// and fail with an UntrustedHookError otherwise.
+	Trust *TrustStore
+
+	// ApproveHook is called for hooks that are not in Trust, e.g. to ask the
+	// user. Hooks it approves are added to Trust and saved.
+	ApproveHook func(UntrustedHook) (bool, error)
+}
+
+// HookInput is the JSON document that hooks receive on their standard input.
+type HookInput struct {
+	Hook      string      `json:"hook"`
+	Operation string      `json:"operation"`
+	Package   HookPackage `json:"package"`
+	Packages  []string    `json:"packages"`
+	Links     []string    `json:"links"`
+
+	// PreviousLinks is only set for the on_change hook
+	PreviousLinks []string `json:"previous_links,omitempty"`
+
+	// Link is only set for the before_link and after_link hooks
+	Link string `json:"link,omitempty"`
+}
+
+// HookPackage describes the package a hook belongs to in HookInput.
+type HookPackage struct {
+	Name     string   `json:"name"`
+	Root     string   `json:"root"`
+	Source   string   `json:"source"`
+	Target   string   `json:"target"`
+	State    string   `json:"state"`
+	Manifest Manifest `json:"manifest"`
+}
+
+func (pkg localPackage) hookInput(name string, hc HookContext) ([]byte, error) {
+	input := HookInput{
+		Hook:      name,
+		Operation: hc.Operation,
+		Package: HookPackage{
+			Name:     pkg.Name(),
+			Root:     pkg.PackageRoot.String(),
+			Source:   pkg.Source.String(),
+			Target:   pkg.Target.String(),
+			State:    pkg.State.String(),
+			Manifest: pkg.Metadata(),
+		},
+		Packages: hc.Packages,
+		Links:    make([]string, len(hc.Links)),
+		Link:     hc.Link.String(),
 	}
 
-	if !exists {
-		return nil
+	if input.Packages == nil {
+		input.Packages = []string{}
+	}
+
+	for i, link := range hc.Links {
+		input.Links[i] = link.String()
+	}
+
+	for _, link := range hc.PreviousLinks {
+		input.PreviousLinks = append(input.PreviousLinks, link.String())
 	}
 
-	cmd := exec.Command(executable.String(), pkg.State.String())
+	return json.Marshal(input)
+}
+
+const (
+	OperationInstall   = "install"
+	OperationUninstall = "uninstall"
+	OperationStatus    = "status"
+)
+
+// hookEnv returns the environment hooks are run with. By default the
+// environment of the current process is inherited.
+func (pkg localPackage) hookEnv(name string, hc HookContext) []string {
+	var env []string
+	if !pkg.Manifest.Hooks.CleanEnv {
+		env = os.Environ()
+	}
 
-	cmd.Env = []string{
+	env = append(env,
 		fmt.Sprintf("STOWAWAY_SOURCE=%s", pkg.Source.String()),
 		fmt.Sprintf("STOWAWAY_TARGET=%s", pkg.Target.String()),
 		fmt.Sprintf("STOWAWAY_PACKAGE_ROOT=%s", pkg.PackageRoot.String()),
+		fmt.Sprintf("STOWAWAY_PACKAGE_NAME=%s", pkg.Name()),
+		fmt.Sprintf("STOWAWAY_STATE=%s", pkg.State.String()),
+		fmt.Sprintf("STOWAWAY_OPERATION=%s", hc.Operation),
+		fmt.Sprintf("STOWAWAY_HOOK=%s", name),
+	)
+
+	if hc.Link != "" {
+		env = append(env,
+			fmt.Sprintf("STOWAWAY_LINK=%s", hc.Link.String()),
+			fmt.Sprintf("STOWAWAY_LINK_SOURCE=%s", pkg.linkSource(hc.Link).String()),
+		)
 	}
-	return cmd.Run()
-}
 
-func (pkg localPackage) Installed() (bool, error) {
-	exists, err := pkg.State.Exists()
-	if err != nil {
-		return false, err
+	// Sort the keys so that the environment is deterministic
+	keys := make([]string, 0, len(pkg.Manifest.Hooks.Env))
+	for key := range pkg.Manifest.Hooks.Env {
+		keys = append(keys, key)
 	}
 
-	return exists, err
-}
+	sort.Strings(keys)
 
-func (pkg localPackage) Install() error {
-	exists, err := pkg.State.Exists()
-	if err != nil {
-		return err
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", key, pkg.Manifest.Hooks.Env[key]))
 	}
 
-	if exists {
-		return ErrPackageInstalled
-	}
+	return env
+}
 
-	if err := pkg.Links.MkdirAll(0700); err != nil {
-		return err
+// RunHookIfExists runs the named hook. The executable with the hook's name in
+// the hooks directory is run first if it exists, followed by each of the
+// commands declared inline for the hook in the manifest. It stops at the
+// first command that fails. The hook is cancelled when the context is done or
+// the hook's timeout from the manifest expires.
+func (pkg localPackage) RunHookIfExists(ctx context.Context, name string, hc HookContext) error {
+	// Simple packages cannot have hooks
+	if pkg.Manifest == nil {
+		return nil
 	}
 
-	if err := pkg.SourceLink.Symlink(pkg.Source); err != nil {
+	// Each command is described by the hook executable's path or the inline
+	// command, for use in error messages
+	var cmds []*exec.Cmd
+	var descriptions []string
+
+	executable := pkg.PackageRoot.Join(pkg.Manifest.Hooks.Dir, name)
+	exists, err := executable.Exists()
+	if err != nil {
 		return err
 	}
 
-	if err := pkg.TargetLink.Symlink(pkg.Target); err != nil {
-		return err
+	if exists {
+		cmds = append(cmds, exec.Command(executable.String(), pkg.State.String()))
+		descriptions = append(descriptions, executable.String())
 	}
 
-	linkCount := 0
-	return pkg.SourceLink.Walk(func(path string, info os.FileInfo, err error) error {
+	commands := pkg.Manifest.Hooks.Commands(name)
+	if hc.Link != "" {
+		_, rel, err := pkg.linkPart(hc.Link)
 		if err != nil {
 			return err
 		}
 
-		// Skip the current directory
-		if path == "." {
-			return nil
-		}
+		commands = pkg.Manifest.Hooks.LinkCommands(name, filepath.ToSlash(rel))
+	}
 
-		if !shouldSymlink(info.Mode()) {
-			return nil
-		}
+	// The hook name and state directory become $0 and $1 in the command
+	for _, command := range commands {
+		cmds = append(cmds, exec.Command("/bin/sh", "-c", command, name, pkg.State.String()))
+		descriptions = append(descriptions, command)
+	}
 
-		target := pkg.TargetLink.Join(path)
-		link := pkg.Links.Join(strconv.Itoa(linkCount))
-		linkCount++
+	output := hc.Output
+	if output == nil {
+		output = io.Discard
+	}
 
-		// Every symlink that is created in the target directory gets an entry
-		// in the links directory. The entry is itself a symlink pointing to
-		// the target link, which allows Stowaway to keep track of all the
-		// symlinks it has created.
-		if err := link.Symlink(target); err != nil {
-			return err
+	if hc.DryRun {
+		for _, description := range descriptions {
+			fmt.Fprintf(output, "would run hook %s of %s: %s\n", name, pkg.Name(), description)
 		}
 
-		if err := target.Parent().MkdirAll(0755); err != nil {
-			return err
-		}
+		return nil
+	}
 
-		source := pkg.SourceLink.Join(path)
-		if err := target.Symlink(source); err != nil {
-			return err
-		}
+	w := newPrefixWriter(output, fmt.Sprintf("[%s:%s] ", pkg.Name(), name))
+	defer w.Flush()
 
-		return nil
-	})
-}
+	if timeout := pkg.Manifest.Hooks.TimeoutFor(name); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-func (pkg localPackage) Uninstall() error {
-	exists, err := pkg.State.Exists()
+	input, err := pkg.hookInput(name, hc)
 	if err != nil {
 		return err
 	}
 
-	if !exists {
-		return ErrPackageNotInstalled
-	}
-
-	err = pkg.Links.Walk(func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	if len(cmds) > 0 {
+		if err := pkg.checkTrust(name, descriptions, hc); err != nil {
 			return err
 		}
+	}
 
-		if path == "." {
-			return nil
+	var writable []string
+	if hc.Sandbox && len(cmds) > 0 {
+		writable, err = pkg.sandboxPaths()
+		if err == nil {
+			err = checkSandbox()
 		}
 
-		link := pkg.Links.Join(path)
-		target, err := link.Readlink()
 		if err != nil {
-			return err
+			if !hc.AllowUnsandboxed {
+				return &SandboxError{Package: pkg.Name(), Hook: name, Err: err}
+			}
+
+			fmt.Fprintf(w, "running without a sandbox: %s\n", err)
+			writable = nil
 		}
+	}
 
-		if err := target.Remove(); err != nil {
-			return err
+	env := pkg.hookEnv(name, hc)
+	for i, cmd := range cmds {
+		if writable != nil {
+			if err := sandboxCommand(cmd, writable); err != nil {
+				return &SandboxError{Package: pkg.Name(), Hook: name, Err: err}
+			}
 		}
 
-		if err := link.Remove(); err != nil {
-			return err
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = w
+		cmd.Stderr = w
+
+		if err := runCommand(ctx, cmd); err != nil {
+			return newHookError(pkg.Name(), name, descriptions[i], err)
 		}
+	}
 
-		// Remove empty parent directories
-		for _, parent := range target.Parents() {
-			empty, err := parent.Empty()
-			if err != nil {
-				break
-			}
+	return nil
+}
 
-			if empty {
-				if err := parent.Remove(); err != nil {
-					return err
-				}
-			}
+// sandboxPaths returns the paths that sandboxed hooks can write to, with
+// any symlinks resolved.
+func (pkg localPackage) sandboxPaths() ([]string, error) {
+	writable := []filesystem.Path{pkg.Target, pkg.PackageRoot, pkg.State}
+	for _, part := range pkg.Targets {
+		writable = append(writable, part.Target)
+	}
 
-		}
+	var paths []string
+	for _, path := range writable {
 
-		return nil
-	})
+		resolved, err := filepath.EvalSymlinks(path.String())
+		if os.IsNotExist(err) {
+			// The package state does not exist before installing
+			continue
+		}
 
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
+		if err != nil {
+			return nil, err
 		}
+
+		paths = append(paths, resolved)
 	}
 
-	return pkg.State.RemoveAll()
+	return paths, nil
 }
 
-type StowOptions struct {
-	Delete bool
+// linkSource returns the file in the package source that the symlink in the
+// target directory points to.
+func (pkg localPackage) linkSource(link filesystem.Path) filesystem.Path {
+	part, rel, err := pkg.linkPart(link)
+	if err != nil {
+		return link
+	}
+
+	return part.Source.Join(rel)
 }
 
-const (
-	HookBeforeUninstallAll = "before_uninstall_all"
-	HookAfterUninstallAll  = "after_uninstall_all"
-	HookBeforeUninstall    = "before_uninstall"
-	HookAfterUninstall     = "after_uninstall"
-	HookBeforeInstall      = "before_install"
-	HookAfterInstall       = "after_install"
-	HookBeforeInstallAll   = "before_install_all"
-	HookAfterInstallAll    = "after_install_all"
-)
+func (pkg localPackage) TargetLinks() ([]filesystem.Path, error) {
+	installed, err := pkg.Installed()
+	if err != nil {
+		return nil, err
+	}
 
-func Stow(options StowOptions, pkgs ...Package) error {
-	for _, pkg := range pkgs {
-		hook := HookBeforeInstallAll
-		if options.Delete {
-			hook = HookBeforeUninstallAll
-		}
+	if !installed {
+		return pkg.SourceLinks()
+	}
 
-		if err := pkg.RunHookIfExists(hook); err != nil {
-			return err
-		}
+	parts, err := pkg.installedParts()
+	if err != nil {
+		return nil, err
 	}
 
-	for _, pkg := range pkgs {
-		installed, err := pkg.Installed()
+	var links []filesystem.Path
+	for _, part := range parts {
+		names, err := part.linkNames()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if installed {
-			if err := pkg.RunHookIfExists(HookBeforeUninstall); err != nil {
-				return err
-			}
+		for _, name := range names {
+			links = append(links, part.Target.Join(name))
+		}
+	}
 
-			if err := pkg.Uninstall(); err != nil {
-				return err
-			}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i] < links[j]
+	})
 
-			if err := pkg.RunHookIfExists(HookAfterUninstall); err != nil {
-				return err
-			}
+	return links, nil
+}
+
+func (pkg localPackage) SourceLinks() ([]filesystem.Path, error) {
+	if pkg.TargetErr != nil {
+		return nil, pkg.TargetErr
+	}
+
+	var links []filesystem.Path
+	for _, part := range pkg.parts() {
+		partLinks, err := part.sourceLinks()
+		if err != nil {
+			return nil, err
 		}
 
-		if !options.Delete {
-			if err := pkg.RunHookIfExists(HookBeforeInstall); err != nil {
-				return err
-			}
+		links = append(links, partLinks...)
+	}
 
-			if err := pkg.Install(); err != nil {
-				return err
-			}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i] < links[j]
+	})
 
-			if err := pkg.RunHookIfExists(HookAfterInstall); err != nil {
-				return err
-			}
+	return links, nil
+}
+
+// sourceLinks returns the symlinks that installing the package would create
+// in its own target directory, leaving out those of its other target
+// sections.
+func (pkg localPackage) sourceLinks() ([]filesystem.Path, error) {
+	var links []filesystem.Path
+	err := filesystem.Walk(pkg.fs(), pkg.Source.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-	}
 
-	for _, pkg := range pkgs {
-		hook := HookAfterInstallAll
-		if options.Delete {
-			hook = HookAfterUninstallAll
+		if path != "." && pkg.Manifest.Ignored(path) {
+			return skipIgnored(info)
 		}
 
-		if err := pkg.RunHookIfExists(hook); err != nil {
-			return err
+		if path != "." && shouldSymlink(info.Mode()) {
+			links = append(links, pkg.Target.Join(path))
 		}
-	}
 
-	return nil
+		return nil
+	})
+
+	return links, err
+}
+
+func (pkg localPackage) Installed() (bool, error) {
+	exists, err := filesystem.Exists(pkg.fs(), pkg.State.String())
+	if err != nil {
+		return false, err
+	}
+
+	return exists, err
+}
+
+// installedManifest returns the manifest recorded in the state of the
+// package when it was installed, which is nil for simple packages. It
+// returns err if the package is not installed.
+func (pkg localPackage) installedManifest(err error) (*Manifest, error) {
+	installed, installedErr := pkg.Installed()
+	if installedErr != nil {
+		return nil, installedErr
+	}
+
+	if !installed {
+		return nil, err
+	}
+
+	return decodeManifest(pkg.fs(), pkg.State.Join(installedManifest))
+}
+
+// Install creates the package state and the symlinks in the target
+// directory. If any of the symlinks cannot be created, everything that was
+// created is removed again and any files that were replaced are restored,
+// leaving the package uninstalled.
+func (pkg localPackage) Install() error {
+	return pkg.InstallWithLinkHook(nil)
+}
+
+func (pkg localPackage) InstallWithLinkHook(linkHook func(hook string, link filesystem.Path) error) error {
+	exists, err := filesystem.Exists(pkg.fs(), pkg.State.String())
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrPackageInstalled
+	}
+
+	if pkg.TargetErr != nil {
+		return pkg.TargetErr
+	}
+
+	siblings, err := pkg.siblings()
+	if err != nil {
+		return err
+	}
+
+	// Every target section is checked before anything is installed
+	parts := pkg.parts()
+	replaced := make([]map[string]siblingPackage, len(parts))
+	shadowed := make([]map[string]bool, len(parts))
+	for i, part := range parts {
+		replaced[i], shadowed[i], err = part.collisions(siblings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := pkg.installParts(parts, replaced, shadowed, linkHook); err != nil {
+		// There is nothing to clean up if the state could not be created
+		if uninstallErr := pkg.Uninstall(); uninstallErr != nil && uninstallErr != ErrPackageNotInstalled {
+			return fmt.Errorf("%w (cleaning up failed: %s)", err, uninstallErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// installParts installs each target section of the package, followed by the
+// rest of the package state.
+func (pkg localPackage) installParts(parts []localPackage, replaced []map[string]siblingPackage, shadowed []map[string]bool, linkHook func(string, filesystem.Path) error) error {
+	for i, part := range parts {
+		if err := part.install(replaced[i], shadowed[i], linkHook); err != nil {
+			return err
+		}
+	}
+
+	// Keep a copy of the manifest that was installed, so that the installed
+	// version can be compared against the package source later on
+	if pkg.Manifest != nil {
+		if err := encodeManifest(pkg.fs(), pkg.State.Join(installedManifest), pkg.Manifest); err != nil {
+			return err
+		}
+	}
+
+	if pkg.Origin != nil {
+		if err := encodeOrigin(pkg.fs(), pkg.State.Join(originFile), pkg.Origin); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// install creates the state and the symlinks of a target section. The
+// symlinks of the replaced packages are removed first. Shadowed symlinks are
+// only recorded in the links directory. linkHook, if set, is called around
+// each symlink, see LinkHookInstaller.
+func (pkg localPackage) install(replaced map[string]siblingPackage, shadowed map[string]bool, linkHook func(string, filesystem.Path) error) error {
+	fsys := pkg.fs()
+	if err := filesystem.MkdirAll(fsys, pkg.Links.String(), 0700); err != nil {
+		return err
+	}
+
+	if err := fsys.Symlink(pkg.Source.String(), pkg.SourceLink.String()); err != nil {
+		return err
+	}
+
+	if err := fsys.Symlink(pkg.Target.String(), pkg.TargetLink.String()); err != nil {
+		return err
+	}
+
+	if err := fsys.Symlink(pkg.PackageRoot.String(), pkg.RootLink.String()); err != nil {
+		return err
+	}
+
+	linkCount := 0
+	resolver := &conflictResolver{pkg: pkg}
+
+	return filesystem.Walk(fsys, pkg.SourceLink.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Skip the current directory
+		if path == "." {
+			return nil
+		}
+
+		if pkg.Manifest.Ignored(path) {
+			return skipIgnored(info)
+		}
+
+		if !shouldSymlink(info.Mode()) {
+			return nil
+		}
+
+		target := pkg.TargetLink.Join(path)
+		link := pkg.Links.Join(strconv.Itoa(linkCount))
+		linkCount++
+
+		// Every symlink that is created in the target directory gets an entry
+		// in the links directory. The entry is itself a symlink pointing to
+		// the target link, which allows Stowaway to keep track of all the
+		// symlinks it has created.
+		if err := fsys.Symlink(target.String(), link.String()); err != nil {
+			return err
+		}
+
+		// The entry of a shadowed symlink is kept, so that the symlink can be
+		// created once the package shadowing it is uninstalled
+		name := filepath.ToSlash(path)
+		if shadowed[name] {
+			return nil
+		}
+
+		if other, ok := replaced[name]; ok {
+			current, err := pkg.Linker.ReadLink(name)
+			if err == nil && other.owns(current) {
+				if err := pkg.Linker.RemoveLink(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		if linkHook != nil {
+			if err := linkHook(HookBeforeLink, pkg.Target.Join(path)); err != nil {
+				return err
+			}
+		}
+
+		source := pkg.SourceLink.Join(path)
+		err = pkg.Linker.CreateLink(source.String(), path)
+		if errors.Is(err, fs.ErrExist) {
+			create, resolveErr := resolver.resolve(path, err)
+			if resolveErr != nil {
+				return resolveErr
+			}
+
+			// A file that is skipped keeps its place, so it does not need
+			// an entry in the links directory
+			if !create {
+				linkCount--
+				return fsys.Remove(link.String())
+			}
+
+			err = pkg.Linker.CreateLink(source.String(), path)
+		}
+
+		if err != nil || linkHook == nil {
+			return err
+		}
+
+		return linkHook(HookAfterLink, pkg.Target.Join(path))
+	})
+}
+
+// restoreConflicts puts the files that installing the package replaced back
+// into the target directory. Files that were backed up are restored from the
+// backups directory, and adopted files are copied from the package source.
+// A file is not restored if something else has taken its place, or if it
+// was already restored.
+func (pkg localPackage) restoreConflicts() error {
+	fsys := pkg.fs()
+	backups, err := readBackups(fsys, pkg.State)
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		err := restoreBackup(fsys, pkg.Backups, pkg.Target, backup)
+		if err != nil && !errors.Is(err, ErrBackupConflict) && !errors.Is(err, ErrBackupNotFound) {
+			return err
+		}
+	}
+
+	conflicts, err := readConflicts(fsys, pkg.State)
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.Strategy != ConflictAdopt {
+			continue
+		}
+
+		path := pkg.Target.Join(filepath.FromSlash(conflict.Name))
+		exists, err := filesystem.Exists(fsys, path.String())
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			continue
+		}
+
+		err = copyFile(fsys, pkg.SourceLink.Join(filepath.FromSlash(conflict.Name)), path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ownsLink reports whether the named file in the target directory is a
+// symlink pointing into the package source through the source link in the
+// package state.
+func (pkg localPackage) ownsLink(name string) bool {
+	source, err := pkg.Linker.ReadLink(name)
+	if err != nil {
+		return false
+	}
+
+	return pkg.owns(source)
+}
+
+// owns reports whether a symlink pointing to source points into the package
+// source through the source link in the package state.
+func (pkg localPackage) owns(source string) bool {
+	return strings.HasPrefix(source, pkg.SourceLink.String()+string(filepath.Separator))
+}
+
+// linkName returns the name relative to the target directory of the symlink
+// that an entry in the links directory points to.
+func (pkg localPackage) linkName(target filesystem.Path) (string, error) {
+	rel, err := filepath.Rel(pkg.TargetLink.String(), target.String())
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+func (pkg localPackage) Uninstall() error {
+	exists, err := filesystem.Exists(pkg.fs(), pkg.State.String())
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrPackageNotInstalled
+	}
+
+	parts, err := pkg.installedParts()
+	if err != nil {
+		return err
+	}
+
+	var removed []filesystem.Path
+	for _, part := range parts {
+		names, err := part.removeLinks()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			removed = append(removed, part.Target.Join(name))
+		}
+
+		if err := part.restoreConflicts(); err != nil {
+			return err
+		}
+	}
+
+	// The symlinks that other packages have as well go to the package with
+	// the highest priority among them
+	if err := pkg.unshadow(removed); err != nil {
+		return err
+	}
+
+	return filesystem.RemoveAll(pkg.fs(), pkg.State.String())
+}
+
+// removeLinks removes the symlinks of a single target section of the package
+// and their entries in the links directory. It returns the names of the
+// symlinks that were removed.
+func (pkg localPackage) removeLinks() ([]string, error) {
+	var removed []string
+	fsys := pkg.fs()
+	err := filesystem.Walk(fsys, pkg.Links.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		link := pkg.Links.Join(path)
+		target, err := fsys.Readlink(link.String())
+		if err != nil {
+			return err
+		}
+
+		name, err := pkg.linkName(filesystem.Path(target))
+		if err != nil {
+			return err
+		}
+
+		// Only remove the target if it is a symlink created by this package.
+		// It may be missing or belong to someone else if the package was
+		// modified or the installation was interrupted. Removing it also
+		// removes any parent directories that are left empty.
+		if pkg.ownsLink(name) {
+			if err := pkg.Linker.RemoveLink(name); err != nil {
+				return err
+			}
+
+			removed = append(removed, name)
+		}
+
+		return fsys.Remove(link.String())
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+type StowOptions struct {
+	Delete bool
+
+	// DryRun skips making any changes to the target directory. Hooks are
+	// not run either.
+	DryRun bool
+
+	// Output receives a description of each change made and each hook run
+	// during a dry run. If it is nil, the output is discarded.
+	Output io.Writer
+
+	// HookOutput receives the output of every hook that is run. If it is nil,
+	// the output is discarded.
+	HookOutput io.Writer
+
+	// HookFailure is the failure policy for hooks that do not have one set in
+	// their package's manifest. It defaults to PolicyFail.
+	HookFailure Policy
+
+	// Configs are the configuration files whose global hooks are run before
+	// and after the packages are installed or uninstalled
+	Configs []*Config
+
+	// Sandbox and AllowUnsandboxed are passed on to every package hook. See
+	// HookContext.
+	Sandbox          bool
+	AllowUnsandboxed bool
+
+	// Trust and ApproveHook decide which package hooks are allowed to run.
+	// See HookContext.
+	Trust       *TrustStore
+	ApproveHook func(UntrustedHook) (bool, error)
+}
+
+const (
+	HookBeforeUninstallAll = "before_uninstall_all"
+	HookAfterUninstallAll  = "after_uninstall_all"
+	HookBeforeUninstall    = "before_uninstall"
+	HookAfterUninstall     = "after_uninstall"
+	HookBeforeInstall      = "before_install"
+	HookAfterInstall       = "after_install"
+	HookBeforeInstallAll   = "before_install_all"
+	HookAfterInstallAll    = "after_install_all"
+
+	// HookOnChange is run after a package that was already installed is
+	// installed again, if the set of symlinks it created has changed
+	HookOnChange = "on_change"
+
+	// HookBeforeLink and HookAfterLink are run just before and right after
+	// the symlink of each file in the package is created. Link hooks
+	// declared in the manifest only run for files that match their pattern.
+	HookBeforeLink = "before_link"
+	HookAfterLink  = "after_link"
+
+	// HookOnStatusDrift is run by the status command with --run-hooks when
+	// the symlinks in the target directory no longer match the package
+	HookOnStatusDrift = "on_status_drift"
+)
+
+// Result is the outcome of installing or uninstalling a single package with
+// Stow.
+type Result struct {
+	Package Package
+
+	// Err is the error that caused the package to fail, or nil if it
+	// succeeded.
+	Err error
+
+	// Warnings are the errors from hooks whose failure policy is PolicyWarn
+	Warnings []error
+
+	// RolledBack is true if the package was returned to the state it was in
+	// before Stow was called, because of a hook with the PolicyRollback
+	// failure policy.
+	RolledBack bool
+
+	// wasInstalled is whether the package was installed before Stow was
+	// called, and installed whether it is installed now, or would be in a
+	// dry run. changed is true once Stow has installed or uninstalled it.
+	wasInstalled bool
+	installed    bool
+	changed      bool
+
+	// links are the symlinks the package has once Stow installed it, or the
+	// ones that were removed when it was uninstalled
+	links []filesystem.Path
+}
+
+// ErrStowFailed is returned by Stow when at least one package failed
+var ErrStowFailed = errors.New("pkg: some packages failed")
+
+type stowRun struct {
+	ctx     context.Context
+	options StowOptions
+	hc      HookContext
+	output  io.Writer
+}
+
+// runHook runs the hook for the package and applies its failure policy. It
+// returns false if the package failed and no further steps should be taken
+// for it. Errors caused by the context being cancelled are always returned.
+func (r *stowRun) runHook(result *Result, hook string, links []filesystem.Path) (bool, error) {
+	hc := r.hc
+	hc.Links = links
+	return r.runHookWith(result, hook, hc)
+}
+
+// runLinkHook runs the before_link or after_link hook once for each of the
+// links, stopping at the first link the package fails for. It is used for
+// dry runs and for packages that are not a LinkHookInstaller.
+func (r *stowRun) runLinkHook(result *Result, hook string, links []filesystem.Path) (bool, error) {
+	for _, link := range links {
+		hc := r.hc
+		hc.Links = links
+		hc.Link = link
+
+		if ok, err := r.runHookWith(result, hook, hc); !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// installWithLinkHook installs the package, running the before_link and
+// after_link hooks for each symlink as it is created. Hooks that fail with
+// PolicyWarn only add a warning. Any other failure stops the installation,
+// which removes what was installed so far, before the policy is applied, so
+// it returns false like runHook.
+func (r *stowRun) installWithLinkHook(result *Result, installer LinkHookInstaller, links []filesystem.Path) (bool, error) {
+	pkg := result.Package
+
+	var hookErr error
+	var failed string
+	err := installer.InstallWithLinkHook(func(hook string, link filesystem.Path) error {
+		hc := r.hc
+		hc.Links = links
+		hc.Link = link
+
+		err := pkg.RunHookIfExists(r.ctx, hook, hc)
+		if err != nil && r.ctx.Err() == nil && r.policy(pkg, hook) == PolicyWarn {
+			result.Warnings = append(result.Warnings, err)
+			return nil
+		}
+
+		if err != nil {
+			hookErr, failed = err, hook
+		}
+
+		return err
+	})
+
+	if err == nil {
+		return true, nil
+	}
+
+	if hookErr == nil || !errors.Is(err, hookErr) {
+		result.Err = err
+		return false, nil
+	}
+
+	return r.hookFailed(result, failed, err)
+}
+
+func (r *stowRun) runHookWith(result *Result, hook string, hc HookContext) (bool, error) {
+	err := result.Package.RunHookIfExists(r.ctx, hook, hc)
+	if err == nil {
+		return true, nil
+	}
+
+	return r.hookFailed(result, hook, err)
+}
+
+// hookFailed applies the failure policy of the hook that failed with err,
+// like runHook.
+func (r *stowRun) hookFailed(result *Result, hook string, err error) (bool, error) {
+	pkg := result.Package
+
+	if ctxErr := r.ctx.Err(); ctxErr != nil {
+		return false, err
+	}
+
+	switch r.policy(pkg, hook) {
+	case PolicyWarn:
+		result.Warnings = append(result.Warnings, err)
+		return true, nil
+	case PolicyRollback:
+		result.Err = err
+		if rollbackErr := r.rollback(result, hook); rollbackErr != nil {
+			result.Err = fmt.Errorf("%w (rolling back failed: %s)", err, rollbackErr)
+		}
+
+		return false, nil
+	}
+
+	result.Err = err
+	return false, nil
+}
+
+func (r *stowRun) policy(pkg Package, hook string) Policy {
+	if policy, ok := pkg.Metadata().Hooks.OnFailure[hook]; ok {
+		return policy
+	}
+
+	if r.options.HookFailure != "" {
+		return r.options.HookFailure
+	}
+
+	return PolicyFail
+}
+
+// rollback returns the package to the state it was in before Stow was
+// called, after the hook failed: a package that was installed is installed
+// again, and one that was not is uninstalled. Hooks that fail before any
+// change is made have nothing to undo.
+// restore installs a package again when its restow was cancelled after it was
+// uninstalled.
+func (r *stowRun) restore(result *Result) {
+	if r.options.Delete || !result.wasInstalled || result.installed {
+		return
+	}
+
+	if err := r.rollback(result, ""); err != nil {
+		result.Err = fmt.Errorf("%w (rolling back failed: %s)", r.ctx.Err(), err)
+	}
+}
+
+func (r *stowRun) rollback(result *Result, hook string) error {
+	pkg := result.Package
+
+	if !result.changed {
+		return nil
+	}
+
+	if result.installed {
+		if r.options.DryRun {
+			fmt.Fprintf(r.output, "would roll back %s by uninstalling it\n", pkg.Name())
+		} else if err := pkg.Uninstall(); err != nil {
+			return err
+		}
+
+		result.installed = false
+	}
+
+	if result.wasInstalled {
+		if r.options.DryRun {
+			fmt.Fprintf(r.output, "would roll back %s by installing it\n", pkg.Name())
+		} else if err := pkg.Install(); err != nil {
+			return err
+		}
+
+		result.installed = true
+	}
+
+	result.changed = false
+	result.RolledBack = true
+	return nil
+}
+
+// checkTrust checks that every hook Stow will run for the package is trusted
+// before anything is changed. The package fails if one of them is not.
+func (r *stowRun) checkTrust(result *Result) {
+	checker, ok := result.Package.(TrustChecker)
+	if !ok || r.options.DryRun {
+		return
+	}
+
+	installed, err := result.Package.Installed()
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	var hooks []string
+	if r.options.Delete {
+		hooks = append(hooks, HookBeforeUninstallAll)
+	} else {
+		hooks = append(hooks, HookBeforeInstallAll)
+	}
+
+	if installed {
+		hooks = append(hooks, HookBeforeUninstall, HookAfterUninstall)
+	}
+
+	if r.options.Delete {
+		hooks = append(hooks, HookAfterUninstallAll)
+	} else {
+		hooks = append(hooks, HookBeforeInstall, HookBeforeLink, HookAfterLink, HookAfterInstall)
+		if installed {
+			hooks = append(hooks, HookOnChange)
+		}
+
+		hooks = append(hooks, HookAfterInstallAll)
+	}
+
+	result.Err = checker.CheckTrust(hooks, r.hc)
+}
+
+// runHookAll runs one of the hooks that run for every package before all
+// packages have been installed or uninstalled.
+func (r *stowRun) runHookAll(result *Result, hook string) error {
+	links, err := result.Package.TargetLinks()
+	if err != nil {
+		result.Err = err
+		return nil
+	}
+
+	_, err = r.runHook(result, hook, links)
+	return err
+}
+
+// stow uninstalls the package if it is installed and then installs it again,
+// unless the packages are being deleted.
+func (r *stowRun) stow(result *Result) error {
+	pkg := result.Package
+
+	installed, err := pkg.Installed()
+	if err != nil {
+		result.Err = err
+		return nil
+	}
+
+	result.wasInstalled, result.installed = installed, installed
+
+	// The links are read before uninstalling, so that hooks that run after
+	// uninstalling know which links were removed
+	var previous []filesystem.Path
+	if installed {
+		links, err := pkg.TargetLinks()
+		if err != nil {
+			result.Err = err
+			return nil
+		}
+
+		previous = links
+
+		if ok, err := r.runHook(result, HookBeforeUninstall, links); !ok {
+			return err
+		}
+
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+
+		if r.options.DryRun {
+			fmt.Fprintf(r.output, "would uninstall %s\n", pkg.Name())
+		} else if err := pkg.Uninstall(); err != nil {
+			result.Err = err
+			return nil
+		}
+
+		result.installed, result.changed = false, true
+		result.links = links
+
+		if ok, err := r.runHook(result, HookAfterUninstall, links); !ok {
+			return err
+		}
+	}
+
+	if r.options.Delete {
+		return nil
+	}
+
+	links, err := pkg.SourceLinks()
+	if err != nil {
+		result.Err = err
+		return nil
+	}
+
+	if ok, err := r.runHook(result, HookBeforeInstall, links); !ok {
+		return err
+	}
+
+	installer, linkHooks := pkg.(LinkHookInstaller)
+	linkHooks = linkHooks && !r.options.DryRun
+
+	if !linkHooks {
+		if ok, err := r.runLinkHook(result, HookBeforeLink, links); !ok {
+			return err
+		}
+	}
+
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	if r.options.DryRun {
+		fmt.Fprintf(r.output, "would install %s\n", pkg.Name())
+	} else if linkHooks {
+		if ok, err := r.installWithLinkHook(result, installer, links); !ok {
+			return err
+		}
+	} else if err := pkg.Install(); err != nil {
+		result.Err = err
+		return nil
+	}
+
+	result.installed, result.changed = true, true
+
+	links, err = pkg.TargetLinks()
+	if err != nil {
+		result.Err = err
+		return nil
+	}
+
+	result.links = links
+
+	if !linkHooks {
+		if ok, err := r.runLinkHook(result, HookAfterLink, links); !ok {
+			return err
+		}
+	}
+
+	if ok, err := r.runHook(result, HookAfterInstall, links); !ok {
+		return err
+	}
+
+	if !installed || equalLinks(previous, links) {
+		return nil
+	}
+
+	hc := r.hc
+	hc.Links = links
+	hc.PreviousLinks = previous
+
+	_, err = r.runHookWith(result, HookOnChange, hc)
+	return err
+}
+
+func equalLinks(a, b []filesystem.Path) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stow installs or uninstalls the packages, running their hooks. When the
+// context is cancelled, the running hook is cancelled and no further steps
+// are taken. Packages are never left partially installed, and a package that
+// was cancelled while being restowed is installed again.
+//
+// The before_stow and after_stow global hooks from the configuration files
+// in the options are run once, before and after every package.
+//
+// A package that fails does not stop the other packages from being
+// installed. What happens when a hook fails depends on its failure policy.
+// The result for each package is returned, along with ErrStowFailed if any of
+// them failed.
+func Stow(ctx context.Context, options StowOptions, pkgs ...Package) ([]Result, error) {
+	r := &stowRun{
+		ctx:     ctx,
+		options: options,
+		output:  options.Output,
+		hc: HookContext{
+			Operation:        OperationInstall,
+			DryRun:           options.DryRun,
+			Output:           options.HookOutput,
+			Sandbox:          options.Sandbox,
+			AllowUnsandboxed: options.AllowUnsandboxed,
+			Trust:            options.Trust,
+			ApproveHook:      options.ApproveHook,
+		},
+	}
+
+	if r.output == nil {
+		r.output = io.Discard
+	}
+
+	// Hooks are listed alongside the other changes instead of being run
+	if options.DryRun {
+		r.hc.Output = r.output
+	}
+
+	before, after := HookBeforeInstallAll, HookAfterInstallAll
+	if options.Delete {
+		r.hc.Operation = OperationUninstall
+		before, after = HookBeforeUninstallAll, HookAfterUninstallAll
+	}
+
+	results := make([]Result, len(pkgs))
+	for i, pkg := range pkgs {
+		results[i].Package = pkg
+		r.hc.Packages = append(r.hc.Packages, pkg.Name())
+	}
+
+	// Nothing has been changed yet, so a failing global hook stops everything
+	if err := RunGlobalHook(ctx, options.Configs, HookBeforeStow, r.hc); err != nil {
+		return results, err
+	}
+
+	for i := range results {
+		r.checkTrust(&results[i])
+	}
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+
+		if err := r.runHookAll(&results[i], before); err != nil {
+			return results, err
+		}
+	}
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+
+		if err := r.stow(&results[i]); err != nil {
+			r.restore(&results[i])
+			return results, err
+		}
+	}
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+
+		if _, err := r.runHook(&results[i], after, results[i].links); err != nil {
+			return results, err
+		}
+	}
+
+	hc := r.hc
+	hc.Packages = nil
+
+	failed := false
+	for _, result := range results {
+		if result.Err != nil {
+			failed = true
+		} else {
+			hc.Packages = append(hc.Packages, result.Package.Name())
+		}
+	}
+
+	if err := RunGlobalHook(ctx, options.Configs, HookAfterStow, hc); err != nil {
+		return results, err
+	}
+
+	if failed {
+		return results, ErrStowFailed
+	}
+
+	return results, nil
 }
@@ -2,50 +2,114 @@ package pkg
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jamesbehr/stowaway/filesystem"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/stretchr/testify/require"
 )
 
+func TestMain(m *testing.M) {
+	// Sandboxed hooks are started through the test binary
+	SandboxHelper()
+
+	os.Exit(m.Run())
+}
+
+// memTmpDirs numbers the directories tmpDir creates on in-memory filesystems
+var memTmpDirs int
+
+// testFS creates and checks the files of a test on an FS
+type testFS struct {
+	filesystem.FS
+}
+
+// osFS is the operating system's filesystem, which the helpers below that
+// are not methods of testFS use
+var osFS = testFS{filesystem.OS}
+
+// tmpDir creates a temporary directory containing the given files and
+// directories (with a trailing slash) on the operating system's filesystem.
 func tmpDir(t *testing.T, testName string, paths []string) filesystem.Path {
+	return osFS.tmpDir(t, testName, paths)
+}
+
+// tmpDir creates a temporary directory containing the given files and
+// directories (with a trailing slash). On an in-memory filesystem the
+// directory is only created there.
+func (f testFS) tmpDir(t *testing.T, testName string, paths []string) filesystem.Path {
 	pattern := "stowaway_" + testName
-	dir, err := os.MkdirTemp(os.TempDir(), pattern)
-	if err != nil {
-		t.Fatalf("TempDir %s: %s", pattern, err)
+
+	var dir string
+	if f.FS == filesystem.OS {
+		var err error
+		dir, err = os.MkdirTemp(os.TempDir(), pattern)
+		if err != nil {
+			t.Fatalf("TempDir %s: %s", pattern, err)
+		}
+
+		t.Cleanup(func() {
+			os.RemoveAll(dir)
+		})
+	} else {
+		memTmpDirs++
+		dir = filepath.Join(os.TempDir(), pattern+strconv.Itoa(memTmpDirs))
+	}
+
+	root := filesystem.MakePath(dir)
+	if err := filesystem.MkdirAll(f, dir, 0755); err != nil {
+		t.Fatalf("MkdirAll %s: %s", dir, err)
 	}
 
 	for _, name := range paths {
-		path := filepath.Join(dir, name)
+		path := root.Join(name)
 
 		if strings.HasSuffix(name, "/") {
-			if err := os.MkdirAll(path, 0755); err != nil {
-				os.RemoveAll(dir)
-				t.Fatalf("MkdirAll %s: %s", dir, err)
+			if err := filesystem.MkdirAll(f, path.String(), 0755); err != nil {
+				t.Fatalf("MkdirAll %s: %s", path, err)
 			}
 		} else {
-			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-				os.RemoveAll(dir)
-				t.Fatalf("MkdirAll %s: %s", dir, err)
+			if err := filesystem.MkdirAll(f, path.Parent().String(), 0755); err != nil {
+				t.Fatalf("MkdirAll %s: %s", path, err)
 			}
 
-			if err := os.WriteFile(path, []byte{}, 0755); err != nil {
-				os.RemoveAll(dir)
+			if err := f.WriteFile(path.String(), []byte{}, 0755); err != nil {
 				t.Fatalf("WriteFile %s: %s", path, err)
 			}
 		}
 	}
 
-	return filesystem.MakePath(dir)
+	return root
+}
+
+// forEachFS runs the test on the operating system's filesystem and on an
+// in-memory one
+func forEachFS(t *testing.T, f func(t *testing.T, tfs testFS)) {
+	t.Run("os", func(t *testing.T) {
+		f(t, osFS)
+	})
+
+	t.Run("mem", func(t *testing.T) {
+		f(t, testFS{filesystem.NewMemFS()})
+	})
 }
 
 func assertLink(t *testing.T, path string, target string) {
-	link, err := os.Readlink(path)
+	osFS.assertLink(t, path, target)
+}
+
+func (f testFS) assertLink(t *testing.T, path string, target string) {
+	link, err := f.Readlink(path)
 	if err != nil {
 		t.Fatalf("Readlink %s: %s", path, err)
 	}
@@ -56,6 +120,10 @@ func assertLink(t *testing.T, path string, target string) {
 type Links map[string]string
 
 func assertLinks(t *testing.T, root filesystem.Path, links Links) {
+	osFS.assertLinks(t, root, links)
+}
+
+func (f testFS) assertLinks(t *testing.T, root filesystem.Path, links Links) {
 	for source, target := range links {
 		if !filepath.IsAbs(source) {
 			source = root.Join(source).String()
@@ -65,30 +133,32 @@ func assertLinks(t *testing.T, root filesystem.Path, links Links) {
 			target = root.Join(target).String()
 		}
 
-		assertLink(t, source, target)
+		f.assertLink(t, source, target)
 	}
 }
 
 func assertMissing(t *testing.T, root filesystem.Path, files []string) {
+	osFS.assertMissing(t, root, files)
+}
+
+func (f testFS) assertMissing(t *testing.T, root filesystem.Path, files []string) {
 	for _, file := range files {
 		if !filepath.IsAbs(file) {
 			file = root.Join(file).String()
 		}
 
-		_, err := os.Lstat(file)
+		exists, err := filesystem.Exists(f, file)
 		if err != nil {
-			if os.IsNotExist(err) {
-				continue
-			}
-
 			t.Fatalf("Stat %s: %s", file, err)
 		}
 
-		t.Fatalf("file %s exists", file)
+		if exists {
+			t.Fatalf("file %s exists", file)
+		}
 	}
 }
 
-func createLinks(t *testing.T, root filesystem.Path, links Links) {
+func (f testFS) createLinks(t *testing.T, root filesystem.Path, links Links) {
 	for source, target := range links {
 		if !filepath.IsAbs(source) {
 			source = root.Join(source).String()
@@ -98,164 +168,956 @@ func createLinks(t *testing.T, root filesystem.Path, links Links) {
 			target = root.Join(target).String()
 		}
 
-		if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		if err := filesystem.MkdirAll(f, filepath.Dir(source), 0755); err != nil {
 			t.Fatalf("MkdirAll %s: %s", source, err)
 		}
 
-		if err := os.Symlink(target, source); err != nil {
+		if err := f.Symlink(target, source); err != nil {
 			t.Fatalf("Symlink %s -> %s: %s", source, target, err)
 		}
 	}
 }
 
 func writeManifest(t *testing.T, root filesystem.Path, name string, manifest *Manifest) {
+	osFS.writeManifest(t, root, name, manifest)
+}
+
+func (f testFS) writeManifest(t *testing.T, root filesystem.Path, name string, manifest *Manifest) {
 	w := bytes.NewBuffer([]byte{})
 	err := toml.NewEncoder(w).Encode(manifest)
 	if err != nil {
 		t.Fatalf("toml.Encode %s: %s", name, err)
 	}
 
-	err = root.Join(name).WriteFile(w.Bytes(), 0755)
-	if err != nil {
-		t.Fatalf("WriteFile %s: %s", name, err)
-	}
-}
+	err = f.WriteFile(root.Join(name).String(), w.Bytes(), 0755)
+	if err != nil {
+		t.Fatalf("WriteFile %s: %s", name, err)
+	}
+}
+
+func writeFile(t *testing.T, root filesystem.Path, name string, contents string, perm os.FileMode) {
+	osFS.writeFile(t, root, name, contents, perm)
+}
+
+func (f testFS) writeFile(t *testing.T, root filesystem.Path, name string, contents string, perm os.FileMode) {
+	path := root.Join(name)
+
+	if err := filesystem.MkdirAll(f, path.Parent().String(), 0755); err != nil {
+		t.Fatalf("MkdirAll %s: %s", name, err)
+	}
+
+	err := f.WriteFile(path.String(), []byte(contents), perm)
+	if err != nil {
+		t.Fatalf("WriteFile %s: %s", name, err)
+	}
+}
+
+func TestRunHook(t *testing.T) {
+	tmp := tmpDir(t, "hooks", []string{"bash/", "data/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	script := "#!/bin/sh\nprintenv > $1/env"
+
+	writeFile(t, tmp, "bash/hooks/broken", "not executable", 0655)
+	writeFile(t, tmp, "bash/hooks/working", script, 0755)
+
+	t.Setenv("STOWAWAY_TEST_INHERITED", "yes")
+
+	hc := HookContext{Operation: OperationInstall}
+	require.NoError(t, p.RunHookIfExists(context.Background(), "missing", hc))
+	require.NoError(t, p.RunHookIfExists(context.Background(), "working", hc))
+	require.Error(t, p.RunHookIfExists(context.Background(), "broken", hc))
+
+	env := readEnv(t, tmp.Join("data/env"))
+
+	require.Equal(t, tmp.Join("bash/src").String(), env["STOWAWAY_SOURCE"])
+	require.Equal(t, tmp.Join("bash").String(), env["STOWAWAY_PACKAGE_ROOT"])
+	require.Equal(t, tmp.Join("home/user").String(), env["STOWAWAY_TARGET"])
+	require.Equal(t, "bash", env["STOWAWAY_PACKAGE_NAME"])
+	require.Equal(t, tmp.Join("data").String(), env["STOWAWAY_STATE"])
+	require.Equal(t, "install", env["STOWAWAY_OPERATION"])
+	require.Equal(t, "working", env["STOWAWAY_HOOK"])
+	require.Equal(t, "yes", env["STOWAWAY_TEST_INHERITED"])
+	require.Equal(t, os.Getenv("PATH"), env["PATH"])
+}
+
+func readEnv(t *testing.T, path filesystem.Path) map[string]string {
+	contents, err := os.ReadFile(path.String())
+	if err != nil {
+		t.Fatalf("ReadFile %s: %s", path, err)
+	}
+
+	env := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) == 2 {
+			env[fields[0]] = fields[1]
+		}
+	}
+
+	return env
+}
+
+func TestRunHookInput(t *testing.T) {
+	tmp := tmpDir(t, "hook_input", []string{"bash/src/.bashrc", "bash/src/.bin/test", "home/user/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Version: "1.0",
+		Hooks:   Hooks{AfterInstall: []string{"cat > $STOWAWAY_TARGET/input.json"}},
+	})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	links, err := p.TargetLinks()
+	require.NoError(t, err)
+	require.Equal(t, []filesystem.Path{tmp.Join("home/user/.bashrc"), tmp.Join("home/user/.bin/test")}, links)
+
+	require.NoError(t, p.Install())
+
+	installedLinks, err := p.TargetLinks()
+	require.NoError(t, err)
+	require.Equal(t, links, installedLinks)
+
+	hc := HookContext{
+		Operation: OperationInstall,
+		Packages:  []string{"bash", "vim"},
+		Links:     links,
+	}
+
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc))
+
+	contents, err := os.ReadFile(tmp.Join("home/user/input.json").String())
+	require.NoError(t, err)
+
+	var input HookInput
+	require.NoError(t, json.Unmarshal(contents, &input))
+
+	require.Equal(t, HookAfterInstall, input.Hook)
+	require.Equal(t, OperationInstall, input.Operation)
+	require.Equal(t, "bash", input.Package.Name)
+	require.Equal(t, "1.0", input.Package.Manifest.Version)
+	require.Equal(t, tmp.Join("bash").String(), input.Package.Root)
+	require.Equal(t, tmp.Join("bash/src").String(), input.Package.Source)
+	require.Equal(t, tmp.Join("home/user").String(), input.Package.Target)
+	require.Equal(t, tmp.Join("data").String(), input.Package.State)
+	require.Equal(t, []string{"bash", "vim"}, input.Packages)
+	require.Equal(t, []string{tmp.Join("home/user/.bashrc").String(), tmp.Join("home/user/.bin/test").String()}, input.Links)
+}
+
+func TestRunHookCleanEnv(t *testing.T) {
+	tmp := tmpDir(t, "clean_env", []string{"bash/", "data/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			Env:      map[string]string{"EXTRA": "value", "STOWAWAY_TEST_INHERITED": "overridden"},
+			CleanEnv: true,
+		},
+	})
+
+	writeFile(t, tmp, "bash/hooks/after_install", "#!/bin/sh\n/usr/bin/env > $1/env", 0755)
+
+	t.Setenv("STOWAWAY_TEST_INHERITED", "yes")
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, HookContext{Operation: OperationUninstall}))
+
+	env := readEnv(t, tmp.Join("data/env"))
+
+	require.Equal(t, "value", env["EXTRA"])
+	require.Equal(t, "overridden", env["STOWAWAY_TEST_INHERITED"])
+	require.Equal(t, "uninstall", env["STOWAWAY_OPERATION"])
+
+	// In a dry run, the hook is only listed
+	require.NoError(t, tmp.Join("data/env").Remove())
+
+	output := bytes.NewBuffer([]byte{})
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, HookContext{DryRun: true, Output: output}))
+	require.Equal(t, "would run hook after_install of "+p.Name()+": "+tmp.Join("bash/hooks/after_install").String()+"\n", output.String())
+	assertMissing(t, tmp, []string{"data/env"})
+	require.NotContains(t, env, "HOME")
+}
+
+func TestRunInlineHook(t *testing.T) {
+	tmp := tmpDir(t, "inline_hooks", []string{"bash/", "data/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			AfterInstall: []string{
+				"echo inline 1 >> $1/order",
+				"echo inline 2 $0 >> $1/order",
+			},
+			AfterUninstall: []string{"exit 3", "echo unreachable >> $1/order"},
+		},
+	})
+
+	writeFile(t, tmp, "bash/hooks/after_install", "#!/bin/sh\necho file >> $1/order", 0755)
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	output := bytes.NewBuffer([]byte{})
+	hc := HookContext{Operation: OperationInstall, Output: output}
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc))
+
+	err = p.RunHookIfExists(context.Background(), HookAfterUninstall, hc)
+	var hookErr *HookError
+	require.ErrorAs(t, err, &hookErr)
+	require.Equal(t, "bash", hookErr.Package)
+	require.Equal(t, HookAfterUninstall, hookErr.Hook)
+	require.Equal(t, "exit 3", hookErr.Command)
+	require.Equal(t, 3, hookErr.ExitCode)
+	require.Equal(t, "pkg: hook after_uninstall of package bash exited with code 3", err.Error())
+
+	contents, err := os.ReadFile(tmp.Join("data/order").String())
+	require.NoError(t, err)
+	require.Equal(t, "file\ninline 1\ninline 2 after_install\n", string(contents))
+
+	writeFile(t, tmp, "bash/hooks/before_install", "#!/bin/sh\necho out\necho err >&2\nprintf partial", 0755)
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookBeforeInstall, hc))
+	require.Equal(t, "[bash:before_install] out\n[bash:before_install] err\n[bash:before_install] partial\n", output.String())
+}
+
+func TestLinkHookMatches(t *testing.T) {
+	require.True(t, LinkHook{Match: "*.zsh"}.Matches("aliases.zsh"))
+	require.True(t, LinkHook{Match: "*.zsh"}.Matches(".config/zsh/aliases.zsh"))
+	require.False(t, LinkHook{Match: "*.zsh"}.Matches("aliases.bash"))
+	require.True(t, LinkHook{Match: ".config/*/init.vim"}.Matches(".config/nvim/init.vim"))
+	require.False(t, LinkHook{Match: ".config/*/init.vim"}.Matches("init.vim"))
+}
+
+func TestStowLinkHooks(t *testing.T) {
+	tmp := tmpDir(t, "link_hooks", []string{"bash/src/.bashrc", "bash/src/.profile", "home/user/"})
+	defer tmp.RemoveAll()
+
+	order := tmp.Join("order").String()
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			Link: []LinkHook{
+				{
+					Match:      "*rc",
+					BeforeLink: []string{"test ! -L $STOWAWAY_LINK && echo before $(basename $STOWAWAY_LINK) >> " + order},
+					AfterLink:  []string{"test -L $STOWAWAY_LINK && echo after $(basename $STOWAWAY_LINK_SOURCE) >> " + order},
+				},
+			},
+			OnChange: []string{"echo changed >> " + order},
+		},
+	})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	stow := func() {
+		p, err := loader.Load()
+		require.NoError(t, err)
+
+		_, err = Stow(context.Background(), StowOptions{}, p)
+		require.NoError(t, err)
+	}
+
+	stow()
+
+	contents, err := os.ReadFile(order)
+	require.NoError(t, err)
+	require.Equal(t, "before .bashrc\nafter .bashrc\n", string(contents))
+
+	// Installing again with the same links is not a change
+	require.NoError(t, os.Remove(order))
+	stow()
+
+	contents, err = os.ReadFile(order)
+	require.NoError(t, err)
+	require.Equal(t, "before .bashrc\nafter .bashrc\n", string(contents))
+
+	require.NoError(t, os.Remove(order))
+	writeFile(t, tmp, "bash/src/.inputrc", "", 0644)
+	stow()
+
+	contents, err = os.ReadFile(order)
+	require.NoError(t, err)
+	// Each file is linked between its own hooks
+	require.Equal(t, "before .bashrc\nafter .bashrc\nbefore .inputrc\nafter .inputrc\nchanged\n", string(contents))
+
+	// A failing link hook stops the installation part way through, and the
+	// package is rolled back to what was installed before
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			Link:      []LinkHook{{Match: ".inputrc", BeforeLink: []string{"false"}}},
+			OnFailure: map[string]Policy{HookBeforeLink: PolicyRollback},
+		},
+	})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	results, err := Stow(context.Background(), StowOptions{}, p)
+	require.ErrorIs(t, err, ErrStowFailed)
+	require.True(t, results[0].RolledBack)
+
+	var hookErr *HookError
+	require.ErrorAs(t, results[0].Err, &hookErr)
+	require.Equal(t, HookBeforeLink, hookErr.Hook)
+
+	assertLink(t, tmp.Join("home/user/.bashrc").String(), tmp.Join("data/source/.bashrc").String())
+	assertLink(t, tmp.Join("home/user/.inputrc").String(), tmp.Join("data/source/.inputrc").String())
+}
+
+func TestRunHookSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sandboxing is only supported on Linux")
+	}
+
+	if err := checkSandbox(); err != nil {
+		t.Skipf("sandbox not available: %s", err)
+	}
+
+	tmp := tmpDir(t, "sandbox", []string{"bash/src/", "home/user/", "outside/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			AfterInstall: []string{
+				"touch $STOWAWAY_TARGET/target $STOWAWAY_PACKAGE_ROOT/root",
+				"! touch " + tmp.Join("outside/file").String() + " 2> /dev/null",
+				"grep -qv lo: /proc/net/dev && test $(grep -c : /proc/net/dev) -eq 1",
+			},
+		},
+	})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	output := bytes.NewBuffer([]byte{})
+	hc := HookContext{Operation: OperationInstall, Output: output, Sandbox: true}
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc), output.String())
+
+	assertMissing(t, tmp, []string{"outside/file"})
+	exists, err := tmp.Join("home/user/target").Exists()
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	// Without the sandbox the hook can write anywhere
+	hc.Sandbox = false
+	require.Error(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc))
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	tmp := tmpDir(t, "timeout", []string{"bash/", "data/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			Timeout:       Duration(time.Minute),
+			Timeouts:      map[string]Duration{HookAfterInstall: Duration(100 * time.Millisecond)},
+			AfterInstall:  []string{"sleep 10"},
+			BeforeInstall: []string{"true"},
+		},
+	})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	hc := HookContext{Operation: OperationInstall}
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookBeforeInstall, hc))
+
+	start := time.Now()
+	err = p.RunHookIfExists(context.Background(), HookAfterInstall, hc)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, "pkg: hook after_install of package bash timed out", err.Error())
+	require.Less(t, time.Since(start), killDelay)
+}
+
+func TestRunHookCancel(t *testing.T) {
+	tmp := tmpDir(t, "cancel", []string{"bash/", "data/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			AfterInstall: []string{"trap 'echo terminated > $1/signal; exit 1' TERM; sleep 10 & touch $1/started; wait"},
+		},
+	})
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// Wait for the trap to be installed before cancelling
+		for {
+			if exists, _ := tmp.Join("data/started").Exists(); exists {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		cancel()
+	}()
+
+	err = p.RunHookIfExists(ctx, HookAfterInstall, HookContext{Operation: OperationInstall})
+	require.ErrorIs(t, err, context.Canceled)
+
+	contents, err := os.ReadFile(tmp.Join("data/signal").String())
+	require.NoError(t, err)
+	require.Equal(t, "terminated\n", string(contents))
+
+	// Hooks are not started once the context is done
+	err = p.RunHookIfExists(ctx, HookAfterInstall, HookContext{Operation: OperationInstall})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCreateLog(t *testing.T) {
+	tmp := tmpDir(t, "logs", []string{})
+	defer tmp.RemoveAll()
+
+	for i := 0; i < maxLogs+5; i++ {
+		writeFile(t, tmp, fmt.Sprintf("logs/0000-%02d.log", i), "", 0644)
+	}
+
+	f, err := CreateLog(tmp)
+	require.NoError(t, err)
+	defer f.Close()
+
+	logs, err := tmp.Join("logs").ReadDir()
+	require.NoError(t, err)
+	require.Len(t, logs, maxLogs)
+	require.Equal(t, "0000-06.log", logs[0].Name())
+	require.Equal(t, f.Name(), tmp.Join("logs", logs[maxLogs-1].Name()).String())
+}
+
+func TestLog(t *testing.T) {
+	tmp := tmpDir(t, "log", []string{})
+	defer tmp.RemoveAll()
+
+	log := NewLog(tmp)
+	require.Equal(t, "", log.Name())
+	require.NoError(t, log.Close())
+
+	exists, err := tmp.Join("logs").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// The log file is created by the first write
+	_, err = fmt.Fprintln(log, "hello")
+	require.NoError(t, err)
+	_, err = fmt.Fprintln(log, "world")
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	logs, err := tmp.Join("logs").ReadDir()
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, tmp.Join("logs", logs[0].Name()).String(), log.Name())
+
+	contents, err := os.ReadFile(log.Name())
+	require.NoError(t, err)
+	require.Equal(t, "hello\nworld\n", string(contents))
+}
+
+func TestLoadHooksDirectory(t *testing.T) {
+	tmp := tmpDir(t, "hooks_dir", []string{"bash/src/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{Source: tmp.Join("bash")}
+
+	writeFile(t, tmp, "bash/stowaway.toml", "hooks = \"scripts\"\n", 0644)
+	m, err := loader.LoadManifest()
+	require.NoError(t, err)
+	require.Equal(t, "scripts", m.Hooks.Dir)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "[hooks]\nafter_install = [\"make\"]\n", 0644)
+	m, err = loader.LoadManifest()
+	require.NoError(t, err)
+	require.Equal(t, "hooks", m.Hooks.Dir)
+	require.Equal(t, []string{"make"}, m.Hooks.AfterInstall)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "[[hooks.link]]\nmatch = \"*.zsh\"\nafter_link = [\"zcompile $STOWAWAY_LINK\"]\n", 0644)
+	m, err = loader.LoadManifest()
+	require.NoError(t, err)
+	require.Equal(t, []LinkHook{{Match: "*.zsh", AfterLink: []string{"zcompile $STOWAWAY_LINK"}}}, m.Hooks.Link)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "[[hooks.link]]\nmatch = \"[\"\n", 0644)
+	_, err = loader.LoadManifest()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+
+	// Inline tables work like [hooks] tables
+	writeFile(t, tmp, "bash/stowaway.toml", "hooks = { dir = \"scripts\", timeout = \"5s\", after_install = [\"make\"] }\n", 0644)
+	m, err = loader.LoadManifest()
+	require.NoError(t, err)
+	require.Equal(t, "scripts", m.Hooks.Dir)
+	require.Equal(t, 5*time.Second, m.Hooks.TimeoutFor(HookAfterInstall))
+	require.Equal(t, []string{"make"}, m.Hooks.AfterInstall)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nhooks = { after_install = [\"make\"] }\n", 0644)
+	m, err = loader.LoadManifest()
+	require.NoError(t, err)
+	require.Equal(t, "hooks", m.Hooks.Dir)
+	require.Equal(t, []string{"make"}, m.Hooks.AfterInstall)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nhooks = { dir = \"scripts\", befor_install = [\"make\"] }\n", 0644)
+	_, err = loader.LoadManifest()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+	require.Contains(t, err.Error(), "stowaway.toml:2:")
+	require.Contains(t, err.Error(), "unknown keys hooks.befor_install")
+
+	writeFile(t, tmp, "bash/stowaway.toml", "hooks = { timeout = 5 }\n", 0644)
+	_, err = loader.LoadManifest()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+}
+
+func TestLoadManifestSymlinkedDirs(t *testing.T) {
+	tmp := tmpDir(t, "symlinked_dirs", []string{"bash/dotfiles/", "bash/scripts/", "outside/"})
+	defer tmp.RemoveAll()
+
+	loader := Loader{Source: tmp.Join("bash")}
+
+	// Symlinks that stay inside the package root are fine
+	require.NoError(t, tmp.Join("bash/src").Symlink(filesystem.Path("dotfiles")))
+	require.NoError(t, tmp.Join("bash/hooks").Symlink(filesystem.Path("scripts")))
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\n", 0644)
+	_, err := loader.LoadManifest()
+	require.NoError(t, err)
+
+	require.NoError(t, tmp.Join("bash/escape").Symlink(filesystem.Path("../outside")))
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nsource = \"escape\"\n", 0644)
+	_, err = loader.LoadManifest()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+	require.Contains(t, err.Error(), `source "escape" must be inside the package root`)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nhooks = \"escape/hooks\"\n", 0644)
+	_, err = loader.LoadManifest()
+	require.NoError(t, err)
+
+	require.NoError(t, tmp.Join("outside/hooks").MkdirAll(0755))
+	_, err = loader.LoadManifest()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+	require.Contains(t, err.Error(), `hooks "escape/hooks" must be inside the package root`)
+}
+
+type InstallTestCase struct {
+	Name          string
+	Filesystem    []string
+	Manifest      *Manifest
+	ExpectedLinks Links
+}
+
+func TestInstall(t *testing.T) {
+	testCases := []InstallTestCase{
+		{
+			Name: "simple package",
+			Filesystem: []string{
+				"bash/.bashrc",
+				"bash/.bin/test",
+				"home/user/",
+			},
+			ExpectedLinks: Links{
+				"data/source":         "bash",
+				"data/target":         "home/user",
+				"data/links/0":        "data/target/.bashrc",
+				"home/user/.bashrc":   "data/source/.bashrc",
+				"home/user/.bin/test": "data/source/.bin/test",
+			},
+		},
+		{
+			Name: "package with default manifest",
+			Filesystem: []string{
+				"bash/src/.bashrc",
+				"bash/src/.bin/test",
+				"home/user/",
+			},
+			Manifest: &Manifest{},
+			ExpectedLinks: Links{
+				"data/source":         "bash/src",
+				"data/target":         "home/user",
+				"data/root":           "bash",
+				"data/links/0":        "data/target/.bashrc",
+				"home/user/.bashrc":   "data/source/.bashrc",
+				"home/user/.bin/test": "data/source/.bin/test",
+			},
+		},
+		{
+			Name: "package with manifest with source",
+			Filesystem: []string{
+				"bash/files/.bashrc",
+				"bash/files/.bin/test",
+				"home/user/",
+			},
+			Manifest: &Manifest{
+				Source: "files",
+			},
+			ExpectedLinks: Links{
+				"data/source":         "bash/files",
+				"data/target":         "home/user",
+				"data/links/0":        "data/target/.bashrc",
+				"home/user/.bashrc":   "data/source/.bashrc",
+				"home/user/.bin/test": "data/source/.bin/test",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			forEachFS(t, func(t *testing.T, tfs testFS) {
+				tmp := tfs.tmpDir(t, "install", testCase.Filesystem)
+
+				if testCase.Manifest != nil {
+					tfs.writeManifest(t, tmp, "bash/stowaway.toml", testCase.Manifest)
+				}
+
+				loader := Loader{
+					FS:     tfs.FS,
+					State:  tmp.Join("data"),
+					Target: tmp.Join("home/user"),
+					Source: tmp.Join("bash"),
+				}
+
+				p, err := loader.Load()
+				require.NoError(t, err)
+
+				err = p.Install()
+				require.NoError(t, err)
+
+				tfs.assertLinks(t, tmp, testCase.ExpectedLinks)
+			})
+		})
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Manifest Manifest
+		Valid    bool
+	}{
+		{Name: "minimal", Manifest: Manifest{Name: "bash"}, Valid: true},
+		{
+			Name: "full metadata",
+			Manifest: Manifest{
+				Name:        "bash",
+				Description: "Bash configuration",
+				Version:     "1.2.0",
+				Homepage:    "https://example.com/dotfiles",
+				Tags:        []string{"shell", "bash"},
+				Maintainer:  "Jane Doe <jane@example.com>",
+			},
+			Valid: true,
+		},
+		{Name: "plain maintainer", Manifest: Manifest{Name: "bash", Maintainer: "Jane Doe"}, Valid: true},
+		{Name: "empty name", Manifest: Manifest{Name: " "}},
+		{Name: "version with space", Manifest: Manifest{Name: "bash", Version: "1 2"}},
+		{Name: "relative homepage", Manifest: Manifest{Name: "bash", Homepage: "example.com"}},
+		{Name: "ftp homepage", Manifest: Manifest{Name: "bash", Homepage: "ftp://example.com"}},
+		{Name: "empty tag", Manifest: Manifest{Name: "bash", Tags: []string{""}}},
+		{Name: "duplicate tag", Manifest: Manifest{Name: "bash", Tags: []string{"a", "a"}}},
+		{Name: "bad maintainer address", Manifest: Manifest{Name: "bash", Maintainer: "Jane <jane@>"}},
+		{Name: "source outside root", Manifest: Manifest{Name: "bash", Source: "../.."}},
+		{Name: "absolute hooks", Manifest: Manifest{Name: "bash", Hooks: Hooks{Dir: "/usr/bin"}}},
+		{Name: "nested source", Manifest: Manifest{Name: "bash", Source: "files/../src"}, Valid: true},
+		{Name: "conflict rule", Manifest: Manifest{Name: "bash", Conflicts: []ConflictRule{{Match: "*.conf", Strategy: ConflictAdopt}}}, Valid: true},
+		{Name: "unknown conflict strategy", Manifest: Manifest{Name: "bash", Conflicts: []ConflictRule{{Match: "*.conf", Strategy: "delete"}}}},
+		{Name: "invalid conflict pattern", Manifest: Manifest{Name: "bash", Conflicts: []ConflictRule{{Match: "[", Strategy: ConflictSkip}}}},
+		{Name: "targets", Manifest: Manifest{Name: "bash", Targets: []TargetSection{{Source: "home", Target: "~"}, {Source: "config", Target: "$XDG_CONFIG_HOME"}}}, Valid: true},
+		{Name: "target source outside root", Manifest: Manifest{Name: "bash", Targets: []TargetSection{{Source: "../etc", Target: "/etc"}}}},
+		{Name: "nested target source", Manifest: Manifest{Name: "bash", Targets: []TargetSection{{Source: "files/etc", Target: "/etc"}}}},
+		{Name: "named nested target source", Manifest: Manifest{Name: "bash", Targets: []TargetSection{{Name: "etc", Source: "files/etc", Target: "/etc"}}}, Valid: true},
+		{Name: "duplicate target", Manifest: Manifest{Name: "bash", Targets: []TargetSection{{Source: "home"}, {Name: "home", Source: "config"}}}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.Manifest.Validate()
+			if testCase.Valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrInvalidManifest)
+			}
+		})
+	}
+}
+
+func TestLoadInvalidManifest(t *testing.T) {
+	tmp := tmpDir(t, "invalid", []string{"bash/src/", "home/user/"})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{Homepage: "not a url"})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	_, err := loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+}
+
+func TestLoadStrictManifest(t *testing.T) {
+	tmp := tmpDir(t, "strict", []string{"bash/src/", "home/user/"})
+	defer tmp.RemoveAll()
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nsoruce = \"files\"\n", 0644)
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	_, err := loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+
+	var manifestErr *ManifestError
+	require.ErrorAs(t, err, &manifestErr)
+	require.Equal(t, 2, manifestErr.Line)
+	require.Equal(t, 1, manifestErr.Column)
+	require.Contains(t, err.Error(), "unknown keys soruce")
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nsource = 1\n", 0644)
+
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+
+	writeFile(t, tmp, "bash/stowaway.toml", "name = \"bash\"\nsource = \n", 0644)
+
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+	require.ErrorAs(t, err, &manifestErr)
+	require.Equal(t, 2, manifestErr.Line)
+}
+
+func TestReadStatus(t *testing.T) {
+	tmp := tmpDir(t, "status", []string{"bash/src/.bashrc", "home/user/"})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{Version: "1.2"})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+	require.NoError(t, p.Install())
+
+	status, err := ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, "bash", status.Name())
+	require.Equal(t, tmp.Join("bash"), status.Root)
+	require.Equal(t, "installed 1.2", status.String())
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{Version: "1.3"})
+
+	status, err = ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, "installed 1.2, source now 1.3", status.String())
+	require.Empty(t, status.Drifted())
+
+	require.NoError(t, tmp.Join("home/user/.bashrc").Remove())
+	writeFile(t, tmp, "bash/src/.profile", "", 0644)
+
+	status, err = ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, "installed 1.2, source now 1.3, 1 link missing, 1 file not linked", status.String())
+	require.Equal(t, []filesystem.Path{tmp.Join("home/user/.bashrc"), tmp.Join("home/user/.profile")}, status.Drifted())
+
+	require.NoError(t, tmp.Join("home/user/.bashrc").Symlink(tmp.Join("data/source/.bashrc")))
+	require.NoError(t, tmp.Join("bash/src/.bashrc").Remove())
 
-func writeFile(t *testing.T, root filesystem.Path, name string, contents string, perm os.FileMode) {
-	path := root.Join(name)
+	status, err = ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, []filesystem.Path{tmp.Join("home/user/.bashrc")}, status.Broken)
 
-	if err := path.Parent().MkdirAll(0755); err != nil {
-		t.Fatalf("MkdirAll %s: %s", name, err)
-	}
+	require.NoError(t, tmp.Join("bash").RemoveAll())
 
-	err := path.WriteFile([]byte(contents), perm)
-	if err != nil {
-		t.Fatalf("WriteFile %s: %s", name, err)
-	}
+	status, err = ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, "installed 1.2, source missing", status.String())
 }
 
-func TestRunHook(t *testing.T) {
-	tmp := tmpDir(t, "hooks", []string{"bash/", "data/"})
+func TestReadStatusInvalidManifest(t *testing.T) {
+	tmp := tmpDir(t, "status", []string{"bash/src/.bashrc", "home/user/"})
 	defer tmp.RemoveAll()
 
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{Version: "1.2"})
+
 	loader := Loader{
 		State:  tmp.Join("data"),
 		Target: tmp.Join("home/user"),
 		Source: tmp.Join("bash"),
 	}
 
-	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{})
-
 	p, err := loader.Load()
 	require.NoError(t, err)
+	require.NoError(t, p.Install())
 
-	script := "#!/bin/sh\nprintenv > $1/env"
+	writeFile(t, tmp, "bash/stowaway.toml", "version = \"1.3\"\nbad = 1\n", 0644)
 
-	writeFile(t, tmp, "bash/hooks/broken", "not executable", 0655)
-	writeFile(t, tmp, "bash/hooks/working", script, 0755)
+	status, err := ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.ErrorIs(t, status.ManifestErr, ErrInvalidManifest)
+	require.Regexp(t, `^installed 1\.2, cannot load manifest: .*pkg: invalid manifest`, status.String())
+	require.Empty(t, status.Drifted())
+
+	// The package can still be uninstalled with the manifest it was
+	// installed with
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
 
-	require.NoError(t, p.RunHookIfExists("missing"))
-	require.NoError(t, p.RunHookIfExists("working"))
-	require.Error(t, p.RunHookIfExists("broken"))
+	loader.Uninstall = true
+	p, err = loader.Load()
+	require.NoError(t, err)
+	require.Equal(t, "bash", p.Name())
+	require.NoError(t, p.Uninstall())
+	assertMissing(t, tmp, []string{"home/user/.bashrc", "data"})
 
-	contents, err := os.ReadFile(tmp.Join("data/env").String())
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrInvalidManifest)
+}
 
-	env := map[string]string{}
-	for _, line := range strings.Split(string(contents), "\n") {
-		fields := strings.SplitN(line, "=", 2)
-		if len(fields) == 2 {
-			env[fields[0]] = fields[1]
-		}
+func TestInstallRollback(t *testing.T) {
+	tmp := tmpDir(t, "rollback", []string{
+		"bash/.bashrc",
+		"bash/.profile",
+		"home/user/.profile",
+	})
+	defer tmp.RemoveAll()
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
 	}
 
-	require.Equal(t, tmp.Join("bash/src").String(), env["STOWAWAY_SOURCE"])
-	require.Equal(t, tmp.Join("bash").String(), env["STOWAWAY_PACKAGE_ROOT"])
-	require.Equal(t, tmp.Join("home/user").String(), env["STOWAWAY_TARGET"])
-}
+	p, err := loader.Load()
+	require.NoError(t, err)
 
-type InstallTestCase struct {
-	Name          string
-	Filesystem    []string
-	Manifest      *Manifest
-	ExpectedLinks Links
+	err = p.Install()
+	require.Error(t, err)
+
+	assertMissing(t, tmp, []string{"data", "home/user/.bashrc"})
+
+	// The conflicting file was left alone
+	info, err := os.Lstat(tmp.Join("home/user/.profile").String())
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
 }
 
-func TestInstall(t *testing.T) {
-	testCases := []InstallTestCase{
-		{
-			Name: "simple package",
-			Filesystem: []string{
-				"bash/.bashrc",
-				"bash/.bin/test",
-				"home/user/",
-			},
-			ExpectedLinks: Links{
-				"data/source":         "bash",
-				"data/target":         "home/user",
-				"data/links/0":        "data/target/.bashrc",
-				"home/user/.bashrc":   "data/source/.bashrc",
-				"home/user/.bin/test": "data/source/.bin/test",
-			},
-		},
-		{
-			Name: "package with default manifest",
-			Filesystem: []string{
-				"bash/src/.bashrc",
-				"bash/src/.bin/test",
-				"home/user/",
-			},
-			Manifest: &Manifest{},
-			ExpectedLinks: Links{
-				"data/source":         "bash/src",
-				"data/target":         "home/user",
-				"data/links/0":        "data/target/.bashrc",
-				"home/user/.bashrc":   "data/source/.bashrc",
-				"home/user/.bin/test": "data/source/.bin/test",
-			},
-		},
-		{
-			Name: "package with manifest with source",
-			Filesystem: []string{
-				"bash/files/.bashrc",
-				"bash/files/.bin/test",
-				"home/user/",
-			},
-			Manifest: &Manifest{
-				Source: "files",
-			},
-			ExpectedLinks: Links{
-				"data/source":         "bash/files",
-				"data/target":         "home/user",
-				"data/links/0":        "data/target/.bashrc",
-				"home/user/.bashrc":   "data/source/.bashrc",
-				"home/user/.bin/test": "data/source/.bin/test",
-			},
-		},
+// TestInstallFaults makes each filesystem operation done while installing a
+// package fail in turn, and checks that the installation is rolled back.
+func TestInstallFaults(t *testing.T) {
+	fsys := filesystem.NewMemFS()
+	tmp := testFS{fsys}.tmpDir(t, "faults", []string{
+		"bash/.bashrc",
+		"bash/.config/nvim/init.vim",
+		"home/user/",
+	})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+		FS:     fsys,
 	}
 
-	for _, testCase := range testCases {
-		t.Run(testCase.Name, func(t *testing.T) {
-			tmp := tmpDir(t, "install", testCase.Filesystem)
-			defer tmp.RemoveAll()
+	p, err := loader.Load()
+	require.NoError(t, err)
 
-			if testCase.Manifest != nil {
-				writeManifest(t, tmp, "bash/stowaway.toml", testCase.Manifest)
-			}
+	operations := 0
+	fsys.Fault = func(op, name string) error {
+		operations++
+		return nil
+	}
 
-			loader := Loader{
-				State:  tmp.Join("data"),
-				Target: tmp.Join("home/user"),
-				Source: tmp.Join("bash"),
+	require.NoError(t, p.Install())
+	fsys.Fault = nil
+	require.NoError(t, p.Uninstall())
+
+	injected := errors.New("injected")
+	for i := 1; i <= operations; i++ {
+		n, failed := 0, ""
+		fsys.Fault = func(op, name string) error {
+			n++
+			if n == i {
+				failed = op + " " + name
+				return injected
 			}
 
-			p, err := loader.Load()
-			require.NoError(t, err)
+			return nil
+		}
 
-			err = p.Install()
-			require.NoError(t, err)
+		err := p.Install()
+		fsys.Fault = nil
 
-			assertLinks(t, tmp, testCase.ExpectedLinks)
-		})
+		// Some failures are recovered from, e.g. MkdirAll ignores a failed
+		// Stat if the directory can still be created
+		if err == nil {
+			require.NoError(t, p.Uninstall())
+			continue
+		}
+
+		require.ErrorIs(t, err, injected, failed)
+		require.NotContains(t, err.Error(), "cleaning up failed", failed)
+		for _, name := range []string{"data", "home/user/.bashrc", "home/user/.config"} {
+			exists, err := filesystem.Exists(fsys, tmp.Join(name).String())
+			require.NoError(t, err)
+			require.False(t, exists, "%s exists after %s failed", name, failed)
+		}
 	}
 }
 
@@ -339,43 +1201,116 @@ func TestUninstall(t *testing.T) {
 
 	for _, testCase := range testCases {
 		t.Run(testCase.Name, func(t *testing.T) {
-			tmp := tmpDir(t, "uninstall", testCase.Filesystem)
-			defer tmp.RemoveAll()
+			forEachFS(t, func(t *testing.T, tfs testFS) {
+				tmp := tfs.tmpDir(t, "uninstall", testCase.Filesystem)
 
-			if testCase.Manifest != nil {
-				writeManifest(t, tmp, "bash/stowaway.toml", testCase.Manifest)
-			}
+				if testCase.Manifest != nil {
+					tfs.writeManifest(t, tmp, "bash/stowaway.toml", testCase.Manifest)
+				}
 
-			createLinks(t, tmp, testCase.Links)
+				tfs.createLinks(t, tmp, testCase.Links)
 
-			loader := Loader{
-				State:  tmp.Join("data"),
-				Target: tmp.Join("home/user"),
-				Source: tmp.Join("bash"),
-			}
+				loader := Loader{
+					FS:     tfs.FS,
+					State:  tmp.Join("data"),
+					Target: tmp.Join("home/user"),
+					Source: tmp.Join("bash"),
+				}
 
-			p, err := loader.Load()
-			require.NoError(t, err)
+				p, err := loader.Load()
+				require.NoError(t, err)
 
-			err = p.Uninstall()
-			require.NoError(t, err)
+				err = p.Uninstall()
+				require.NoError(t, err)
 
-			assertMissing(t, tmp, testCase.ExpectedMissing)
+				tfs.assertMissing(t, tmp, testCase.ExpectedMissing)
+			})
 		})
 	}
 }
 
+func TestInstallMemLinker(t *testing.T) {
+	// The package is installed without touching the disk or the current FS
+	tmp := filesystem.MakePath(os.TempDir(), "stowaway_memlinker")
+	fsys := filesystem.NewMemFS()
+	require.NoError(t, filesystem.MkdirAll(fsys, tmp.Join("bash/.bin").String(), 0755))
+	require.NoError(t, filesystem.MkdirAll(fsys, tmp.Join("home/user").String(), 0755))
+	require.NoError(t, fsys.WriteFile(tmp.Join("bash/.bashrc").String(), nil, 0644))
+	require.NoError(t, fsys.WriteFile(tmp.Join("bash/.bin/test").String(), nil, 0755))
+
+	linker := filesystem.NewMemLinker(tmp.Join("home/user").String())
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+		FS:     fsys,
+		Linker: linker,
+	}
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+	require.NoError(t, p.Install())
+
+	require.Equal(t, map[string]string{
+		".bashrc":   tmp.Join("data/source/.bashrc").String(),
+		".bin/test": tmp.Join("data/source/.bin/test").String(),
+	}, linker.Links())
+
+	// Nothing is created in the target directory itself
+	entries, err := fsys.ReadDir(tmp.Join("home/user").String())
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	source, err := fsys.Readlink(tmp.Join("data/source").String())
+	require.NoError(t, err)
+	require.Equal(t, tmp.Join("bash").String(), source)
+
+	exists, err := filesystem.Exists(filesystem.OS, tmp.String())
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Links that no longer belong to the package are left alone
+	require.NoError(t, linker.RemoveLink(".bashrc"))
+	require.NoError(t, linker.CreateLink("/elsewhere", ".bashrc"))
+
+	p, err = loader.Load()
+	require.NoError(t, err)
+	require.NoError(t, p.Uninstall())
+
+	require.Equal(t, map[string]string{".bashrc": "/elsewhere"}, linker.Links())
+
+	exists, err = filesystem.Exists(fsys, tmp.Join("data").String())
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
 type MockPackage struct {
 	IsInstalled   bool
 	InstallCalled func(string, bool)
 	HookCalled    func(string, string)
 	PackageName   string
+	FailHooks     map[string]bool
+	Policies      map[string]Policy
+	LinkPaths     []filesystem.Path
+	HookContexts  map[string]HookContext
+}
+
+func (m *MockPackage) SourceLinks() ([]filesystem.Path, error) {
+	return m.LinkPaths, nil
+}
+
+func (m *MockPackage) TargetLinks() ([]filesystem.Path, error) {
+	return m.LinkPaths, nil
 }
 
 func (m *MockPackage) Name() string {
 	return m.PackageName
 }
 
+func (m *MockPackage) Metadata() Manifest {
+	return Manifest{Name: m.PackageName, Hooks: Hooks{OnFailure: m.Policies}}
+}
+
 func (m *MockPackage) Install() error {
 	if m.InstallCalled != nil {
 		m.InstallCalled(m.PackageName, false)
@@ -396,11 +1331,19 @@ func (m *MockPackage) Installed() (bool, error) {
 	return m.IsInstalled, nil
 }
 
-func (m *MockPackage) RunHookIfExists(name string) error {
+func (m *MockPackage) RunHookIfExists(ctx context.Context, name string, hc HookContext) error {
+	if m.HookContexts != nil {
+		m.HookContexts[name] = hc
+	}
+
 	if m.HookCalled != nil {
 		m.HookCalled(m.PackageName, name)
 	}
 
+	if m.FailHooks[name] {
+		return fmt.Errorf("%s failed", name)
+	}
+
 	return nil
 }
 
@@ -439,7 +1382,7 @@ func TestStow(t *testing.T) {
 				Delete: testCase.Delete,
 			}
 
-			err := Stow(options, &mock)
+			_, err := Stow(context.Background(), options, &mock)
 			require.NoError(t, err)
 
 			require.Equal(t, testCase.ExpectUninstall, uninstallCalled)
@@ -447,6 +1390,57 @@ func TestStow(t *testing.T) {
 		})
 	}
 
+	t.Run("dry run", func(t *testing.T) {
+		var operations []string
+		mock := MockPackage{
+			PackageName: "a",
+			IsInstalled: true,
+			InstallCalled: func(name string, uninstall bool) {
+				t.Fatal("package was changed during a dry run")
+			},
+			HookCalled: func(name, hook string) {
+				operations = append(operations, hook)
+			},
+		}
+
+		output := bytes.NewBuffer([]byte{})
+		_, err := Stow(context.Background(), StowOptions{DryRun: true, Output: output}, &mock)
+		require.NoError(t, err)
+
+		require.Equal(t, "would uninstall a\nwould install a\n", output.String())
+		require.Len(t, operations, 6)
+	})
+
+	t.Run("cancelled restow", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		actions := []string{}
+		mock := MockPackage{
+			PackageName: "a",
+			IsInstalled: true,
+			InstallCalled: func(name string, uninstall bool) {
+				action := "install"
+				if uninstall {
+					action = "uninstall"
+				}
+
+				actions = append(actions, action)
+			},
+			HookCalled: func(name, hook string) {
+				if hook == HookAfterUninstall {
+					cancel()
+				}
+			},
+		}
+
+		results, err := Stow(ctx, StowOptions{}, &mock)
+		require.ErrorIs(t, err, context.Canceled)
+
+		require.Equal(t, []string{"uninstall", "install"}, actions)
+		require.True(t, results[0].RolledBack)
+	})
+
 	t.Run("uninstall hooks", func(t *testing.T) {
 		actions := []string{}
 		ins := func(pkgName string, uninstall bool) {
@@ -472,7 +1466,7 @@ func TestStow(t *testing.T) {
 			Delete: true,
 		}
 
-		err := Stow(options, pkgs...)
+		_, err := Stow(context.Background(), options, pkgs...)
 		require.NoError(t, err)
 
 		require.Equal(t, []string{
@@ -516,7 +1510,7 @@ func TestStow(t *testing.T) {
 			Delete: false,
 		}
 
-		err := Stow(options, pkgs...)
+		_, err := Stow(context.Background(), options, pkgs...)
 		require.NoError(t, err)
 
 		require.Equal(t, []string{
@@ -544,4 +1538,136 @@ func TestStow(t *testing.T) {
 			"c:after_install_all",
 		}, actions)
 	})
+
+	t.Run("hook context", func(t *testing.T) {
+		links := []filesystem.Path{"/home/user/.bashrc"}
+		a := &MockPackage{PackageName: "a", IsInstalled: true, LinkPaths: links, HookContexts: map[string]HookContext{}}
+		b := &MockPackage{PackageName: "b"}
+
+		_, err := Stow(context.Background(), StowOptions{Delete: true, DryRun: true}, a, b)
+		require.NoError(t, err)
+
+		for _, hook := range []string{HookBeforeUninstallAll, HookBeforeUninstall, HookAfterUninstall, HookAfterUninstallAll} {
+			hc := a.HookContexts[hook]
+			require.Equal(t, OperationUninstall, hc.Operation, hook)
+			require.True(t, hc.DryRun, hook)
+			require.Equal(t, []string{"a", "b"}, hc.Packages, hook)
+			require.Equal(t, links, hc.Links, hook)
+		}
+	})
+
+	t.Run("failure policies", func(t *testing.T) {
+		actions := []string{}
+		ins := func(pkgName string, uninstall bool) {
+			action := "install"
+			if uninstall {
+				action = "uninstall"
+			}
+
+			actions = append(actions, fmt.Sprintf("%s:%s", pkgName, action))
+		}
+
+		pkgs := []Package{
+			&MockPackage{PackageName: "a", InstallCalled: ins, FailHooks: map[string]bool{HookBeforeInstall: true}},
+			&MockPackage{
+				PackageName:   "b",
+				InstallCalled: ins,
+				FailHooks:     map[string]bool{HookAfterInstall: true},
+				Policies:      map[string]Policy{HookAfterInstall: PolicyRollback},
+			},
+			&MockPackage{PackageName: "c", InstallCalled: ins, FailHooks: map[string]bool{HookAfterInstallAll: true}},
+			&MockPackage{PackageName: "d", InstallCalled: ins},
+		}
+
+		results, err := Stow(context.Background(), StowOptions{HookFailure: PolicyWarn}, pkgs...)
+		require.ErrorIs(t, err, ErrStowFailed)
+
+		require.Equal(t, []string{
+			"a:install",
+			"b:install",
+			"b:uninstall",
+			"c:install",
+			"d:install",
+		}, actions)
+
+		require.Len(t, results, 4)
+
+		// The manifest has no policy for before_install, so the default
+		// from the options is used
+		require.NoError(t, results[0].Err)
+		require.Len(t, results[0].Warnings, 1)
+
+		require.EqualError(t, results[1].Err, "after_install failed")
+		require.True(t, results[1].RolledBack)
+
+		require.NoError(t, results[2].Err)
+		require.Len(t, results[2].Warnings, 1)
+
+		require.NoError(t, results[3].Err)
+		require.Empty(t, results[3].Warnings)
+	})
+
+	t.Run("rolling back a restowed package", func(t *testing.T) {
+		actions := []string{}
+		ins := func(pkgName string, uninstall bool) {
+			action := "install"
+			if uninstall {
+				action = "uninstall"
+			}
+
+			actions = append(actions, fmt.Sprintf("%s:%s", pkgName, action))
+		}
+
+		rollback := map[string]Policy{HookBeforeInstall: PolicyRollback, HookAfterInstall: PolicyRollback, HookBeforeUninstall: PolicyRollback}
+		pkgs := []Package{
+			&MockPackage{PackageName: "a", IsInstalled: true, InstallCalled: ins, FailHooks: map[string]bool{HookBeforeInstall: true}, Policies: rollback},
+			&MockPackage{PackageName: "b", IsInstalled: true, InstallCalled: ins, FailHooks: map[string]bool{HookAfterInstall: true}, Policies: rollback},
+			&MockPackage{PackageName: "c", IsInstalled: true, InstallCalled: ins, FailHooks: map[string]bool{HookBeforeUninstall: true}, Policies: rollback},
+		}
+
+		results, err := Stow(context.Background(), StowOptions{}, pkgs...)
+		require.ErrorIs(t, err, ErrStowFailed)
+
+		// Packages that were installed before are installed again, and
+		// nothing is done for hooks that failed before any change
+		require.Equal(t, []string{
+			"a:uninstall",
+			"a:install",
+			"b:uninstall",
+			"b:install",
+			"b:uninstall",
+			"b:install",
+		}, actions)
+
+		require.True(t, results[0].RolledBack)
+		require.True(t, results[1].RolledBack)
+		require.False(t, results[2].RolledBack)
+		require.EqualError(t, results[2].Err, "before_uninstall failed")
+	})
+
+	t.Run("failing package does not stop others", func(t *testing.T) {
+		actions := []string{}
+		hook := func(pkgName, name string) {
+			actions = append(actions, fmt.Sprintf("%s:%s", pkgName, name))
+		}
+
+		pkgs := []Package{
+			&MockPackage{PackageName: "a", HookCalled: hook, FailHooks: map[string]bool{HookBeforeInstallAll: true}},
+			&MockPackage{PackageName: "b", HookCalled: hook},
+		}
+
+		results, err := Stow(context.Background(), StowOptions{}, pkgs...)
+		require.ErrorIs(t, err, ErrStowFailed)
+		require.EqualError(t, results[0].Err, "before_install_all failed")
+		require.False(t, results[0].RolledBack)
+		require.NoError(t, results[1].Err)
+
+		require.Equal(t, []string{
+			"a:before_install_all",
+			"b:before_install_all",
+			"b:before_install",
+			"b:after_install",
+			"b:after_install_all",
+		}, actions)
+	})
 }
@@ -0,0 +1,556 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+var ErrInvalidManifest = errors.New("pkg: invalid manifest")
+
+// ManifestError is returned when a manifest or a configuration file cannot be
+// loaded. Err wraps ErrInvalidManifest or ErrInvalidConfig. Line and Column
+// are 1-indexed and are zero when the error is not tied to a location in the
+// file.
+type ManifestError struct {
+	Path         filesystem.Path
+	Line, Column int
+	Err          error
+}
+
+func (e *ManifestError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Err)
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", e.Path, e.Line, e.Column, e.Err)
+}
+
+func (e *ManifestError) Unwrap() error {
+	return e.Err
+}
+
+// newManifestError converts errors returned by the TOML decoder or by
+// Validate into a ManifestError, with the position of the problem in the
+// manifest where it is known.
+func newManifestError(path filesystem.Path, err error) error {
+	return newDecodeError(path, err, ErrInvalidManifest)
+}
+
+// newDecodeError converts errors returned by the TOML decoder into a
+// ManifestError that wraps invalid, with the position of the problem in the
+// file where it is known. Errors that already wrap invalid are kept as they
+// are.
+func newDecodeError(path filesystem.Path, err error, invalid error) error {
+	var decodeErr *toml.DecodeError
+	var strictErr *toml.StrictMissingError
+
+	switch {
+	case errors.As(err, &strictErr):
+		keys := make([]string, len(strictErr.Errors))
+		for i, e := range strictErr.Errors {
+			keys[i] = strings.Join(e.Key(), ".")
+		}
+
+		line, column := strictErr.Errors[0].Position()
+		return &ManifestError{
+			Path:   path,
+			Line:   line,
+			Column: column,
+			Err:    fmt.Errorf("%w: unknown keys %s", invalid, strings.Join(keys, ", ")),
+		}
+	case errors.As(err, &decodeErr):
+		line, column := decodeErr.Position()
+		return &ManifestError{
+			Path:   path,
+			Line:   line,
+			Column: column,
+			Err:    fmt.Errorf("%w: %s", invalid, strings.TrimPrefix(decodeErr.Error(), "toml: ")),
+		}
+	case errors.Is(err, invalid):
+		return &ManifestError{Path: path, Err: err}
+	}
+
+	// Some decoding errors, such as type mismatches, carry no position
+	return &ManifestError{
+		Path: path,
+		Err:  fmt.Errorf("%w: %s", invalid, strings.TrimPrefix(err.Error(), "toml: ")),
+	}
+}
+
+type Manifest struct {
+	Name        string   `toml:"name,omitempty" json:"name,omitempty"`
+	Description string   `toml:"description,omitempty" json:"description,omitempty"`
+	Version     string   `toml:"version,omitempty" json:"version,omitempty"`
+	Homepage    string   `toml:"homepage,omitempty" json:"homepage,omitempty"`
+	Tags        []string `toml:"tags,omitempty" json:"tags,omitempty"`
+	Maintainer  string   `toml:"maintainer,omitempty" json:"maintainer,omitempty"`
+	Source      string   `toml:"source,omitempty" json:"source,omitempty"`
+	Ignore      []string `toml:"ignore,omitempty" json:"ignore,omitempty"`
+	Hooks       Hooks    `toml:"hooks,omitempty" json:"hooks,omitempty"`
+
+	// Priority decides which package has a symlink that more than one
+	// installed package has. The package with the highest priority shadows
+	// the others, whose symlinks are created when it is uninstalled.
+	Priority int `toml:"priority,omitempty" json:"priority,omitempty"`
+
+	// Conflicts set the strategy for the files in the target directory that
+	// are in the way of the symlinks. The first rule that matches applies.
+	Conflicts []ConflictRule `toml:"conflicts,omitempty" json:"conflicts,omitempty"`
+
+	// Targets link the files in more than one directory of the package
+	// root, each into a target directory of its own. When there are any,
+	// Source is not used.
+	Targets []TargetSection `toml:"targets,omitempty" json:"targets,omitempty"`
+}
+
+// Hooks configures the directory containing hook executables and any hooks
+// declared inline in the manifest. Inline hooks are lists of shell commands
+// that are each run with /bin/sh -c.
+//
+// Hooks inherit the environment of the Stowaway process unless CleanEnv is
+// set, in which case they only receive the STOWAWAY_* variables and Env.
+//
+// For backwards compatibility the hooks key can also be set to a string, which
+// is treated as the hooks directory.
+type Hooks struct {
+	Dir                string              `toml:"dir,omitempty" json:"dir,omitempty"`
+	Env                map[string]string   `toml:"env,omitempty" json:"env,omitempty"`
+	CleanEnv           bool                `toml:"clean_env,omitempty" json:"clean_env,omitempty"`
+	Timeout            Duration            `toml:"timeout,omitempty" json:"timeout,omitempty"`
+	Timeouts           map[string]Duration `toml:"timeouts,omitempty" json:"timeouts,omitempty"`
+	OnFailure          map[string]Policy   `toml:"on_failure,omitempty" json:"on_failure,omitempty"`
+	BeforeUninstallAll []string            `toml:"before_uninstall_all,omitempty" json:"before_uninstall_all,omitempty"`
+	AfterUninstallAll  []string            `toml:"after_uninstall_all,omitempty" json:"after_uninstall_all,omitempty"`
+	BeforeUninstall    []string            `toml:"before_uninstall,omitempty" json:"before_uninstall,omitempty"`
+	AfterUninstall     []string            `toml:"after_uninstall,omitempty" json:"after_uninstall,omitempty"`
+	BeforeInstall      []string            `toml:"before_install,omitempty" json:"before_install,omitempty"`
+	AfterInstall       []string            `toml:"after_install,omitempty" json:"after_install,omitempty"`
+	BeforeInstallAll   []string            `toml:"before_install_all,omitempty" json:"before_install_all,omitempty"`
+	AfterInstallAll    []string            `toml:"after_install_all,omitempty" json:"after_install_all,omitempty"`
+	OnChange           []string            `toml:"on_change,omitempty" json:"on_change,omitempty"`
+	OnStatusDrift      []string            `toml:"on_status_drift,omitempty" json:"on_status_drift,omitempty"`
+	Link               []LinkHook          `toml:"link,omitempty" json:"link,omitempty"`
+}
+
+// LinkHook declares commands that are run before and after linking each file
+// in the package source that matches a glob pattern. The pattern uses the
+// syntax of path.Match and is matched against the file's path relative to
+// the source directory. Patterns without a slash are matched against the
+// file's name instead, so "*.zsh" matches every zsh file in the package.
+type LinkHook struct {
+	Match      string   `toml:"match" json:"match"`
+	BeforeLink []string `toml:"before_link,omitempty" json:"before_link,omitempty"`
+	AfterLink  []string `toml:"after_link,omitempty" json:"after_link,omitempty"`
+}
+
+// Matches reports whether the hook applies to the file at the slash
+// separated path relative to the package source.
+func (h LinkHook) Matches(rel string) bool {
+	return matchPath(h.Match, rel)
+}
+
+// matchPath reports whether the slash separated path matches the pattern,
+// which uses the syntax of path.Match. Patterns without a slash are matched
+// against the file name only.
+func matchPath(pattern, rel string) bool {
+	name := rel
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(rel)
+	}
+
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// Ignored reports whether the file or directory at the slash separated path
+// relative to the package source matches one of the ignore patterns. Ignored
+// files are not linked, and nothing inside an ignored directory is linked.
+// Nothing is ignored for packages without a manifest.
+func (m *Manifest) Ignored(rel string) bool {
+	if m == nil {
+		return false
+	}
+
+	for _, pattern := range m.Ignore {
+		if matchPath(pattern, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalText sets the hooks directory from hooks = "dir". The TOML decoder
+// also passes inline tables to it, without their text, so those are left for
+// decodeInlineHooks.
+func (h *Hooks) UnmarshalText(text []byte) error {
+	if len(text) > 0 {
+		h.Dir = string(text)
+	}
+
+	return nil
+}
+
+// decodeInlineHooks decodes hooks = { ... } from the manifest data into h,
+// starting from the defaults. [hooks] tables decode to the same hooks, so h is
+// set whenever the hooks are a table. Only errors about the hooks are
+// reported, since the rest of the manifest has been decoded already.
+func decodeInlineHooks(data []byte, defaults Hooks, h *Hooks) error {
+	var raw struct {
+		Hooks interface{} `toml:"hooks"`
+	}
+
+	if err := toml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.Hooks.(map[string]interface{}); !ok {
+		return nil
+	}
+
+	// The hooks type has the same fields without UnmarshalText
+	type hooks Hooks
+	table := struct {
+		Hooks hooks `toml:"hooks"`
+	}{Hooks: hooks(defaults)}
+
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(&table)
+
+	var strictErr *toml.StrictMissingError
+	if errors.As(err, &strictErr) {
+		var errs []toml.DecodeError
+		for _, e := range strictErr.Errors {
+			if key := e.Key(); len(key) > 0 && key[0] == "hooks" {
+				errs = append(errs, e)
+			}
+		}
+
+		err = nil
+		if len(errs) > 0 {
+			err = &toml.StrictMissingError{Errors: errs}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	*h = Hooks(table.Hooks)
+	return nil
+}
+
+// UnmarshalJSON is needed because UnmarshalText would otherwise be used for
+// JSON objects as well as strings.
+func (h *Hooks) UnmarshalJSON(data []byte) error {
+	var dir string
+	if err := json.Unmarshal(data, &dir); err == nil {
+		h.Dir = dir
+		return nil
+	}
+
+	type hooks Hooks
+	return json.Unmarshal(data, (*hooks)(h))
+}
+
+// TimeoutFor returns how long the named hook may run for before it is
+// cancelled. Zero means the hook may run forever.
+func (h Hooks) TimeoutFor(name string) time.Duration {
+	if timeout, ok := h.Timeouts[name]; ok {
+		return time.Duration(timeout)
+	}
+
+	return time.Duration(h.Timeout)
+}
+
+// Policy decides what happens to a package when one of its hooks fails.
+type Policy string
+
+const (
+	// PolicyFail stops any further steps for the package and marks it as
+	// failed. Other packages are unaffected.
+	PolicyFail Policy = "fail"
+
+	// PolicyWarn reports the error as a warning and carries on as if the hook
+	// succeeded.
+	PolicyWarn Policy = "warn"
+
+	// PolicyRollback is like PolicyFail, but also returns the package to the
+	// state it was in before it was installed, uninstalled or reinstalled.
+	PolicyRollback Policy = "rollback"
+)
+
+func (p Policy) Valid() bool {
+	return p == PolicyFail || p == PolicyWarn || p == PolicyRollback
+}
+
+// Duration is a time.Duration that is written in manifests as a string such
+// as "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Commands returns the inline commands declared for the named hook.
+func (h Hooks) Commands(name string) []string {
+	switch name {
+	case HookBeforeUninstallAll:
+		return h.BeforeUninstallAll
+	case HookAfterUninstallAll:
+		return h.AfterUninstallAll
+	case HookBeforeUninstall:
+		return h.BeforeUninstall
+	case HookAfterUninstall:
+		return h.AfterUninstall
+	case HookBeforeInstall:
+		return h.BeforeInstall
+	case HookAfterInstall:
+		return h.AfterInstall
+	case HookBeforeInstallAll:
+		return h.BeforeInstallAll
+	case HookAfterInstallAll:
+		return h.AfterInstallAll
+	case HookOnChange:
+		return h.OnChange
+	case HookOnStatusDrift:
+		return h.OnStatusDrift
+	}
+
+	return nil
+}
+
+// LinkCommands returns the commands for the named link hook from every
+// LinkHook that matches the file at the slash separated path relative to the
+// package source.
+func (h Hooks) LinkCommands(name, rel string) []string {
+	var commands []string
+	for _, link := range h.Link {
+		if link.Matches(rel) {
+			commands = append(commands, link.commands(name)...)
+		}
+	}
+
+	return commands
+}
+
+func (h LinkHook) commands(name string) []string {
+	switch name {
+	case HookBeforeLink:
+		return h.BeforeLink
+	case HookAfterLink:
+		return h.AfterLink
+	}
+
+	return nil
+}
+
+// isLocal reports whether the path is relative and does not escape the
+// directory it is relative to.
+func isLocal(path string) bool {
+	if filepath.IsAbs(path) {
+		return false
+	}
+
+	path = filepath.Clean(path)
+	return path != ".." && !strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// validateDirs checks that the source and hooks directories are still inside
+// the package root once symlinks are resolved, which Validate cannot see.
+// Directories that do not exist are left alone. Errors about the directories
+// wrap ErrInvalidManifest.
+func (m Manifest) validateDirs(fsys filesystem.FS, root filesystem.Path) error {
+	resolvedRoot, err := filesystem.EvalSymlinks(fsys, root.String())
+	if err != nil {
+		return err
+	}
+
+	dirs := []struct{ kind, dir string }{
+		{"source", m.Source},
+		{"hooks", m.Hooks.Dir},
+	}
+
+	for _, section := range m.Targets {
+		dirs = append(dirs, struct{ kind, dir string }{"target source", section.Source})
+	}
+
+	for _, d := range dirs {
+		resolved, err := filesystem.EvalSymlinks(fsys, root.Join(d.dir).String())
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(resolvedRoot, resolved)
+		if err != nil || !isLocal(rel) {
+			return fmt.Errorf("%w: %s %q must be inside the package root, but it resolves to %s", ErrInvalidManifest, d.kind, d.dir, resolved)
+		}
+	}
+
+	return nil
+}
+
+func containsSpace(s string) bool {
+	return strings.IndexFunc(s, unicode.IsSpace) != -1
+}
+
+// Validate checks that the fields of the manifest are well formed and that the
+// source and hooks directories are inside the package root. Every error it
+// returns wraps ErrInvalidManifest.
+func (m Manifest) Validate() error {
+	if strings.TrimSpace(m.Name) == "" {
+		return fmt.Errorf("%w: name must not be empty", ErrInvalidManifest)
+	}
+
+	if !isLocal(m.Source) {
+		return fmt.Errorf("%w: source %q must be inside the package root", ErrInvalidManifest, m.Source)
+	}
+
+	if !isLocal(m.Hooks.Dir) {
+		return fmt.Errorf("%w: hooks %q must be inside the package root", ErrInvalidManifest, m.Hooks.Dir)
+	}
+
+	for key := range m.Hooks.Env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("%w: invalid hook environment variable name %q", ErrInvalidManifest, key)
+		}
+	}
+
+	if m.Hooks.Timeout < 0 {
+		return fmt.Errorf("%w: hook timeout must not be negative", ErrInvalidManifest)
+	}
+
+	for name, timeout := range m.Hooks.Timeouts {
+		if !knownHooks[name] {
+			return fmt.Errorf("%w: timeout set for unknown hook %s", ErrInvalidManifest, name)
+		}
+
+		if timeout < 0 {
+			return fmt.Errorf("%w: timeout for hook %s must not be negative", ErrInvalidManifest, name)
+		}
+	}
+
+	for name, policy := range m.Hooks.OnFailure {
+		if !knownHooks[name] {
+			return fmt.Errorf("%w: failure policy set for unknown hook %s", ErrInvalidManifest, name)
+		}
+
+		if !policy.Valid() {
+			return fmt.Errorf("%w: invalid failure policy %q for hook %s", ErrInvalidManifest, policy, name)
+		}
+	}
+
+	for _, pattern := range m.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("%w: invalid ignore pattern %q", ErrInvalidManifest, pattern)
+		}
+	}
+
+	for _, rule := range m.Conflicts {
+		if _, err := path.Match(rule.Match, ""); err != nil || rule.Match == "" {
+			return fmt.Errorf("%w: invalid conflict pattern %q", ErrInvalidManifest, rule.Match)
+		}
+
+		if !rule.Strategy.Valid() {
+			return fmt.Errorf("%w: invalid conflict strategy %q for %s", ErrInvalidManifest, rule.Strategy, rule.Match)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, section := range m.Targets {
+		if !isLocal(section.Source) {
+			return fmt.Errorf("%w: target source %q must be inside the package root", ErrInvalidManifest, section.Source)
+		}
+
+		name := section.name()
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("%w: invalid target name %q", ErrInvalidManifest, name)
+		}
+
+		if names[name] {
+			return fmt.Errorf("%w: duplicate target %s", ErrInvalidManifest, name)
+		}
+
+		names[name] = true
+	}
+
+	for _, link := range m.Hooks.Link {
+		if _, err := path.Match(link.Match, ""); err != nil || link.Match == "" {
+			return fmt.Errorf("%w: invalid link hook pattern %q", ErrInvalidManifest, link.Match)
+		}
+
+		for _, command := range append(append([]string{}, link.BeforeLink...), link.AfterLink...) {
+			if strings.TrimSpace(command) == "" {
+				return fmt.Errorf("%w: link hook %s has an empty command", ErrInvalidManifest, link.Match)
+			}
+		}
+	}
+
+	for name := range knownHooks {
+		for _, command := range m.Hooks.Commands(name) {
+			if strings.TrimSpace(command) == "" {
+				return fmt.Errorf("%w: hook %s has an empty command", ErrInvalidManifest, name)
+			}
+		}
+	}
+
+	if containsSpace(m.Version) {
+		return fmt.Errorf("%w: version %q must not contain whitespace", ErrInvalidManifest, m.Version)
+	}
+
+	if m.Homepage != "" {
+		u, err := url.Parse(m.Homepage)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: homepage %q must be an http or https URL", ErrInvalidManifest, m.Homepage)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, tag := range m.Tags {
+		if tag == "" || containsSpace(tag) {
+			return fmt.Errorf("%w: tag %q must be non-empty and not contain whitespace", ErrInvalidManifest, tag)
+		}
+
+		if seen[tag] {
+			return fmt.Errorf("%w: duplicate tag %q", ErrInvalidManifest, tag)
+		}
+
+		seen[tag] = true
+	}
+
+	// The maintainer can either be a plain name or an RFC 5322 address such
+	// as "Jane Doe <jane@example.com>".
+	if strings.ContainsAny(m.Maintainer, "<@") {
+		if _, err := mail.ParseAddress(m.Maintainer); err != nil {
+			return fmt.Errorf("%w: maintainer %q is not a valid address", ErrInvalidManifest, m.Maintainer)
+		}
+	}
+
+	return nil
+}
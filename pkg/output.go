@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+// maxLogs is the number of logs that are kept in the logs directory
+const maxLogs = 20
+
+// CreateLog creates a new log file for a single run of Stowaway in the logs
+// directory inside the state directory, which is the directory containing
+// each of the package state directories. Only the most recent logs are kept.
+func CreateLog(state filesystem.Path) (*os.File, error) {
+	dir := state.Join("logs")
+	if err := dir.MkdirAll(0700); err != nil {
+		return nil, err
+	}
+
+	// Log names sort by their creation time
+	logs, err := dir.ReadDir()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(logs)-maxLogs+1; i++ {
+		if err := dir.Join(logs[i].Name()).Remove(); err != nil {
+			return nil, err
+		}
+	}
+
+	name := time.Now().Format("2006-01-02T15-04-05.000000") + ".log"
+	return os.OpenFile(dir.Join(name).String(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// Log is the log of a single run of Stowaway. The log file is only created,
+// with CreateLog, when hook output is first written to it, so that runs that
+// do not run any hooks leave no log behind.
+type Log struct {
+	state filesystem.Path
+
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+// NewLog returns a Log that creates its file in the logs directory inside the
+// state directory.
+func NewLog(state filesystem.Path) *Log {
+	return &Log{state: state}
+}
+
+func (l *Log) Write(data []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil && l.err == nil {
+		l.file, l.err = CreateLog(l.state)
+	}
+
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	return l.file.Write(data)
+}
+
+// Name returns the path of the log file, or an empty string if nothing was
+// logged.
+func (l *Log) Name() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return ""
+	}
+
+	return l.file.Name()
+}
+
+// Close closes the log file if it was created.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
+
+// HookError is returned when a hook fails to run or exits with a non-zero
+// status.
+type HookError struct {
+	Package string
+	Hook    string
+
+	// Command is the path of the hook executable or the inline command
+	Command string
+
+	// ExitCode is the exit status of the hook, or -1 if the hook did not exit
+	// normally, e.g. if it could not be started.
+	ExitCode int
+
+	Err error
+}
+
+func newHookError(pkg, hook, command string, err error) *HookError {
+	exitCode := -1
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	return &HookError{
+		Package:  pkg,
+		Hook:     hook,
+		Command:  command,
+		ExitCode: exitCode,
+		Err:      err,
+	}
+}
+
+func (e *HookError) Error() string {
+	// Global hooks do not belong to a package
+	subject := fmt.Sprintf("global hook %s", e.Hook)
+	if e.Package != "" {
+		subject = fmt.Sprintf("hook %s of package %s", e.Hook, e.Package)
+	}
+
+	switch {
+	case errors.Is(e.Err, context.DeadlineExceeded):
+		return fmt.Sprintf("pkg: %s timed out", subject)
+	case errors.Is(e.Err, context.Canceled):
+		return fmt.Sprintf("pkg: %s was cancelled", subject)
+	}
+
+	if e.ExitCode >= 0 {
+		return fmt.Sprintf("pkg: %s exited with code %d", subject, e.ExitCode)
+	}
+
+	return fmt.Sprintf("pkg: %s failed: %s", subject, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// prefixWriter writes each line written to it to the underlying writer with a
+// prefix. Incomplete lines are buffered until they are completed or the
+// writer is flushed.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i == -1 {
+			break
+		}
+
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return len(data), err
+		}
+
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(data), nil
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// Flush writes any incomplete line followed by a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	line := append(p.buf, '\n')
+	p.buf = nil
+	return p.writeLine(line)
+}
@@ -0,0 +1,135 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// killDelay is how long a hook is given to exit after being signalled before
+// it is killed.
+const killDelay = 5 * time.Second
+
+type signalKey struct{}
+
+// receivedSignal records the signal that cancelled a context created by
+// NotifyContext.
+type receivedSignal struct {
+	mu      sync.Mutex
+	signal  os.Signal
+	signals []os.Signal
+}
+
+// NotifyContext returns a copy of the parent context that is cancelled when
+// one of the given signals is received. Any hooks that are running when the
+// context is cancelled are sent the same signal. Further signals are ignored
+// until stop is called, so that Stowaway is not interrupted while it is
+// changing the package state.
+func NotifyContext(parent context.Context, signals ...os.Signal) (ctx context.Context, stop context.CancelFunc) {
+	received := &receivedSignal{signals: signals}
+	ctx, cancel := context.WithCancel(context.WithValue(parent, signalKey{}, received))
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			received.mu.Lock()
+			received.signal = sig
+			received.mu.Unlock()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// signalFromContext returns the signal that should be forwarded to hooks
+// when the context is cancelled. This is the signal that cancelled the
+// context if it was created by NotifyContext, or SIGTERM otherwise.
+func signalFromContext(ctx context.Context) os.Signal {
+	if received, ok := ctx.Value(signalKey{}).(*receivedSignal); ok {
+		received.mu.Lock()
+		defer received.mu.Unlock()
+
+		if received.signal != nil {
+			return received.signal
+		}
+	}
+
+	return syscall.SIGTERM
+}
+
+// notifies reports whether the context was created by NotifyContext and is
+// cancelled when the signal is received.
+func notifies(ctx context.Context, sig os.Signal) bool {
+	if received, ok := ctx.Value(signalKey{}).(*receivedSignal); ok {
+		for _, s := range received.signals {
+			if s == sig {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// runCommand runs the command in its own process group. When the context is
+// done, the process group is sent the signal from signalFromContext and
+// killed if it has not exited after killDelay. The error from the context is
+// returned in that case. If the command had the terminal and was interrupted
+// from it, the signal is raised in Stowaway as well, and the error from the
+// context is returned once NotifyContext has seen it.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	group := setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		group.release(cmd)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if sig := group.release(cmd); sig != nil {
+			raise(sig)
+
+			if notifies(ctx, sig) {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+		}
+
+		return err
+	case <-ctx.Done():
+	}
+
+	group.signal(cmd, signalFromContext(ctx))
+
+	select {
+	case <-done:
+	case <-time.After(killDelay):
+		group.signal(cmd, syscall.SIGKILL)
+		<-done
+	}
+
+	group.release(cmd)
+	return ctx.Err()
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package pkg
+
+import "os"
+
+// Giving hooks the terminal is not supported on this platform, so hooks always
+// run in a background process group.
+func foregroundTerminal() *os.File {
+	return nil
+}
+
+func setForeground(tty *os.File) {}
@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package pkg
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// foregroundTerminal opens the controlling terminal if Stowaway is in its
+// foreground process group, or returns nil otherwise.
+func foregroundTerminal() *os.File {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 || int(pgrp) != syscall.Getpgrp() {
+		tty.Close()
+		return nil
+	}
+
+	return tty
+}
+
+// setForeground puts Stowaway's process group back in the foreground of the
+// terminal. SIGTTOU is ignored while doing so, as Stowaway is in the
+// background at that point and would otherwise be stopped.
+func setForeground(tty *os.File) {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	id := int32(syscall.Getpgrp())
+	syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&id)))
+}
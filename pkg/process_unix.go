@@ -0,0 +1,80 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processGroup is the process group a hook runs in.
+type processGroup struct {
+	// tty is the controlling terminal the group was put in the foreground
+	// of, if any.
+	tty *os.File
+}
+
+// setProcessGroup puts the command in a new process group, so that the
+// command and any children it spawns can be signalled together. If Stowaway
+// is in the foreground of its controlling terminal, the new group is put in
+// the foreground instead, so that hooks can read from the terminal without
+// being stopped by SIGTTIN. Signals from the terminal, e.g. Ctrl-C, then
+// reach the hook rather than Stowaway, and release passes them on once the
+// hook has exited.
+func setProcessGroup(cmd *exec.Cmd) *processGroup {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Setpgid = true
+
+	group := &processGroup{tty: foregroundTerminal()}
+	if group.tty != nil {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(group.tty.Fd())
+	}
+
+	return group
+}
+
+func (g *processGroup) signal(cmd *exec.Cmd, sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok {
+		syscall.Kill(-cmd.Process.Pid, s)
+	}
+}
+
+// release gives the terminal back to Stowaway once the command has exited.
+// If the command was in the foreground and was killed by a signal from the
+// terminal, that signal is returned so that it can be raised in Stowaway.
+func (g *processGroup) release(cmd *exec.Cmd) os.Signal {
+	if g.tty == nil {
+		return nil
+	}
+
+	defer g.tty.Close()
+	setForeground(g.tty)
+
+	if cmd.ProcessState == nil {
+		return nil
+	}
+
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return nil
+	}
+
+	switch sig := status.Signal(); sig {
+	case syscall.SIGINT, syscall.SIGQUIT:
+		return sig
+	}
+
+	return nil
+}
+
+// raise sends the signal to Stowaway itself.
+func raise(sig os.Signal) {
+	if s, ok := sig.(syscall.Signal); ok {
+		syscall.Kill(os.Getpid(), s)
+	}
+}
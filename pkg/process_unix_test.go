@@ -0,0 +1,32 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyContext(t *testing.T) {
+	ctx, stop := NotifyContext(context.Background(), syscall.SIGUSR1)
+	defer stop()
+
+	require.Equal(t, syscall.SIGTERM, signalFromContext(ctx))
+	require.True(t, notifies(ctx, syscall.SIGUSR1))
+	require.False(t, notifies(ctx, syscall.SIGUSR2))
+	require.False(t, notifies(context.Background(), syscall.SIGUSR1))
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled")
+	}
+
+	require.Equal(t, syscall.SIGUSR1, signalFromContext(ctx))
+}
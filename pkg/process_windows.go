@@ -0,0 +1,24 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process groups are not supported on Windows, so only the command itself is
+// signalled.
+type processGroup struct{}
+
+func setProcessGroup(cmd *exec.Cmd) *processGroup {
+	return &processGroup{}
+}
+
+func (g *processGroup) signal(cmd *exec.Cmd, sig os.Signal) {
+	cmd.Process.Kill()
+}
+
+func (g *processGroup) release(cmd *exec.Cmd) os.Signal {
+	return nil
+}
+
+func raise(sig os.Signal) {}
@@ -0,0 +1,383 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// originFile is the name of the file in the package state directory that
+// records where a remote package was fetched from.
+const originFile = "origin.toml"
+
+var (
+	// ErrInvalidRemote is returned when a remote package URL cannot be
+	// parsed
+	ErrInvalidRemote = errors.New("pkg: invalid remote package")
+
+	// ErrRefNotFound is returned when the ref of a remote package is not in
+	// its repository
+	ErrRefNotFound = errors.New("pkg: ref not found")
+)
+
+// UserCacheDir returns the directory Stowaway caches downloads in, which is
+// $XDG_CACHE_HOME/stowaway, or ~/.cache/stowaway if XDG_CACHE_HOME is not
+// set.
+func UserCacheDir() (filesystem.Path, error) {
+	if dir := os.Getenv("XDG_CACHE_HOME"); filepath.IsAbs(dir) {
+		return filesystem.MakePath(dir, "stowaway"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filesystem.MakePath(home, ".cache", "stowaway"), nil
+}
+
+// Origin records the remote package or archive that an installed package was
+// fetched or extracted from, and the snapshots of packages installed from the
+// store.
+type Origin struct {
+	// URL is the remote package URL, as returned by Remote.String, or the
+	// absolute path of the archive or package directory
+	URL string `toml:"url"`
+
+	// Commit is the commit that was checked out when the package was
+	// installed. It is empty for archives.
+	Commit string `toml:"commit,omitempty"`
+
+	// Checksum is the SHA-256 checksum of the archive the package was
+	// extracted from. It is empty for remote packages.
+	Checksum string `toml:"checksum,omitempty"`
+
+	// Snapshot is the store entry of the snapshot the package was installed
+	// from. It is empty unless the package was installed in store mode.
+	Snapshot string `toml:"snapshot,omitempty"`
+
+	// Previous are the store entries of the snapshots installed before,
+	// most recent first, which the package can be rolled back to
+	Previous []string `toml:"previous,omitempty"`
+}
+
+func encodeOrigin(fsys filesystem.FS, path filesystem.Path, origin *Origin) error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(origin); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(path.String(), w.Bytes(), 0644)
+}
+
+func decodeOrigin(fsys filesystem.FS, path filesystem.Path) (*Origin, error) {
+	exists, err := filesystem.Exists(fsys, path.String())
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	f, err := fsys.Open(path.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var origin Origin
+	if err := toml.NewDecoder(f).Decode(&origin); err != nil {
+		return nil, err
+	}
+
+	return &origin, nil
+}
+
+// Remote is a package in a git repository. It is given as a URL of the
+// repository prefixed with "git+", e.g.
+// git+https://host/team/dotfiles#path=vim&ref=v2, or as a file URL of a
+// repository on disk, e.g. file:///srv/dotfiles.git#path=vim.
+type Remote struct {
+	// Repository is the URL the repository is cloned from
+	Repository string
+
+	// Path is the directory of the package in the repository. The package
+	// is the whole repository if it is empty.
+	Path string
+
+	// Ref is the branch, tag or commit to check out. The default branch of
+	// the repository is checked out if it is empty.
+	Ref string
+}
+
+// IsRemote reports whether the package path is a remote package URL rather
+// than a path on disk.
+func IsRemote(path string) bool {
+	return strings.HasPrefix(path, "git+") || strings.HasPrefix(path, "file://")
+}
+
+// ParseRemote parses a remote package URL.
+func ParseRemote(s string) (*Remote, error) {
+	if !IsRemote(s) {
+		return nil, fmt.Errorf("%w %q: not a git+ or file URL", ErrInvalidRemote, s)
+	}
+
+	u, err := url.Parse(strings.TrimPrefix(s, "git+"))
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %s", ErrInvalidRemote, s, err)
+	}
+
+	params, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %s", ErrInvalidRemote, s, err)
+	}
+
+	remote := &Remote{Path: params.Get("path"), Ref: params.Get("ref")}
+	for key := range params {
+		if key != "path" && key != "ref" {
+			return nil, fmt.Errorf("%w %q: unknown parameter %q", ErrInvalidRemote, s, key)
+		}
+	}
+
+	if remote.Path != "" && (!fs.ValidPath(remote.Path) || remote.Path == ".") {
+		return nil, fmt.Errorf("%w %q: invalid path %q", ErrInvalidRemote, s, remote.Path)
+	}
+
+	// Refs starting with a dash would be taken as options by git
+	if strings.HasPrefix(remote.Ref, "-") {
+		return nil, fmt.Errorf("%w %q: invalid ref %q", ErrInvalidRemote, s, remote.Ref)
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+	remote.Repository = u.String()
+
+	return remote, nil
+}
+
+// String returns the remote package URL.
+func (r *Remote) String() string {
+	s := r.Repository
+	if !strings.HasPrefix(s, "file://") {
+		s = "git+" + s
+	}
+
+	params := url.Values{}
+	if r.Path != "" {
+		params.Set("path", r.Path)
+	}
+
+	if r.Ref != "" {
+		params.Set("ref", r.Ref)
+	}
+
+	if len(params) > 0 {
+		// Slashes are left alone to keep the path readable
+		s += "#" + strings.ReplaceAll(params.Encode(), "%2F", "/")
+	}
+
+	return s
+}
+
+// Checkout returns the directory in the cache that the repository is cloned
+// into. Each repository and ref has its own clone.
+func (r *Remote) Checkout(cache filesystem.Path) filesystem.Path {
+	h := sha256.Sum256([]byte(r.Repository + "#" + r.Ref))
+	return cache.Join("git", hex.EncodeToString(h[:])[:16])
+}
+
+// Dir returns the directory of the package in its clone, which identifies
+// the package. The files of the package are not checked out there, but
+// exported into the store by Export.
+func (r *Remote) Dir(cache filesystem.Path) filesystem.Path {
+	if r.Path == "" {
+		return r.Checkout(cache)
+	}
+
+	return r.Checkout(cache).Join(filepath.FromSlash(r.Path))
+}
+
+// Fetch clones the repository into the cache, or fetches it if it was
+// cloned before, and returns the commit the ref points to. Nothing is
+// checked out, so packages installed from an earlier commit are left alone.
+func (r *Remote) Fetch(ctx context.Context, cache filesystem.Path) (string, error) {
+	checkout := r.Checkout(cache)
+
+	cloned, err := checkout.Join(".git").Exists()
+	if err != nil {
+		return "", err
+	}
+
+	if cloned {
+		if _, err := git(ctx, checkout, "fetch", "--quiet", "--tags", "--force", "--prune", "origin"); err != nil {
+			return "", err
+		}
+
+		if _, err := git(ctx, checkout, "remote", "set-head", "origin", "--auto"); err != nil {
+			return "", err
+		}
+	} else {
+		if err := checkout.Parent().MkdirAll(0755); err != nil {
+			return "", err
+		}
+
+		// Remove whatever was left behind by an interrupted clone
+		if err := checkout.RemoveAll(); err != nil {
+			return "", err
+		}
+
+		if _, err := git(ctx, checkout.Parent(), "clone", "--quiet", "--no-checkout", "--", r.Repository, checkout.String()); err != nil {
+			return "", err
+		}
+	}
+
+	return r.resolve(ctx, checkout)
+}
+
+// Export adds the files of the repository at the commit to the store, unless
+// they were added before, fetching the repository first if the commit is not
+// in its clone. Every commit has an entry of its own, named after a hash of
+// its tree, so installing one commit never changes the files of another. It
+// returns the package root in the store.
+func (r *Remote) Export(ctx context.Context, cache filesystem.Path, store Store, commit string) (filesystem.Path, error) {
+	checkout := r.Checkout(cache)
+	if _, err := git(ctx, checkout, "cat-file", "-e", "--end-of-options", commit+"^{commit}"); err != nil {
+		if _, err := r.Fetch(ctx, cache); err != nil {
+			return "", err
+		}
+	}
+
+	tree, err := git(ctx, checkout, "rev-parse", "--verify", "--quiet", "--end-of-options", commit+"^{tree}")
+	if err != nil {
+		return "", fmt.Errorf("%w: %s in %s", ErrRefNotFound, commit, r.Repository)
+	}
+
+	// The repository is exported into a directory named after it, which is
+	// the name of a package without a manifest at the top of the repository
+	name := path.Base(strings.TrimSuffix(strings.TrimRight(r.Repository, "/"), ".git"))
+	if !fs.ValidPath(name) || name == "." {
+		name = "repository"
+	}
+
+	h := sha256.Sum256([]byte(tree + "/" + name))
+	entry := hex.EncodeToString(h[:])
+
+	_, err = store.Add(entry, func(dir filesystem.Path) error {
+		archive, err := gitOutput(ctx, checkout, "archive", "--format=tar", "--prefix="+name+"/", tree)
+		if err != nil {
+			return err
+		}
+
+		e := &extractor{archive: r.String(), dir: dir, symlinks: map[string]bool{}}
+		return e.tarStream(bytes.NewReader(archive))
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	root := store.Entry(entry).Join(name)
+	if r.Path != "" {
+		root = root.Join(filepath.FromSlash(r.Path))
+	}
+
+	return root, nil
+}
+
+// resolve returns the commit the ref points to in the checkout, preferring
+// branches over tags over commits like git does.
+func (r *Remote) resolve(ctx context.Context, checkout filesystem.Path) (string, error) {
+	candidates := []string{"refs/remotes/origin/HEAD"}
+	if r.Ref != "" {
+		candidates = []string{"refs/remotes/origin/" + r.Ref, "refs/tags/" + r.Ref, r.Ref}
+	}
+
+	for _, candidate := range candidates {
+		commit, err := git(ctx, checkout, "rev-parse", "--verify", "--quiet", "--end-of-options", candidate+"^{commit}")
+		if err == nil {
+			return commit, nil
+		}
+	}
+
+	ref := r.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	return "", fmt.Errorf("%w: %s in %s", ErrRefNotFound, ref, r.Repository)
+}
+
+// Upstream returns the commit the ref currently points to in the repository,
+// without fetching it. It is empty if the ref is a commit, which never
+// changes.
+func (r *Remote) Upstream(ctx context.Context) (string, error) {
+	ref, names := r.Ref, []string{"refs/heads/" + r.Ref, "refs/tags/" + r.Ref + "^{}", "refs/tags/" + r.Ref}
+	if ref == "" {
+		ref, names = "HEAD", []string{"HEAD"}
+	}
+
+	out, err := git(ctx, "", "ls-remote", "--", r.Repository, ref)
+	if err != nil {
+		return "", err
+	}
+
+	commits := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			commits[fields[1]] = fields[0]
+		}
+	}
+
+	// Annotated tags point to the tag object, which is peeled to the
+	// commit in the ^{} entry
+	for _, name := range names {
+		if commit, ok := commits[name]; ok {
+			return commit, nil
+		}
+	}
+
+	return "", nil
+}
+
+// git runs git in dir and returns its output. The error contains what git
+// printed on its standard error.
+func git(ctx context.Context, dir filesystem.Path, args ...string) (string, error) {
+	out, err := gitOutput(ctx, dir, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// gitOutput runs git in dir and returns exactly what it printed on its
+// standard output.
+func gitOutput(ctx context.Context, dir filesystem.Path, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir.String()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// Never wait for credentials on the terminal
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+
+		return nil, fmt.Errorf("pkg: git %s: %s", args[0], message)
+	}
+
+	return stdout.Bytes(), nil
+}
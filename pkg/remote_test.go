@@ -0,0 +1,180 @@
+package pkg
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRemote(t *testing.T) {
+	testCases := []struct {
+		URL      string
+		Expected Remote
+		Err      string
+	}{
+		{
+			URL:      "git+https://host/team/dotfiles#path=vim&ref=v2",
+			Expected: Remote{Repository: "https://host/team/dotfiles", Path: "vim", Ref: "v2"},
+		},
+		{
+			URL:      "git+ssh://git@host/dotfiles.git",
+			Expected: Remote{Repository: "ssh://git@host/dotfiles.git"},
+		},
+		{
+			URL:      "file:///srv/dotfiles.git#path=config/nvim",
+			Expected: Remote{Repository: "file:///srv/dotfiles.git", Path: "config/nvim"},
+		},
+		{URL: "/srv/dotfiles", Err: "not a git+ or file URL"},
+		{URL: "git+https://host/dotfiles#branch=main", Err: `unknown parameter "branch"`},
+		{URL: "git+https://host/dotfiles#path=../etc", Err: `invalid path "../etc"`},
+		{URL: "git+https://host/dotfiles#ref=--upload-pack=x", Err: `invalid ref`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.URL, func(t *testing.T) {
+			remote, err := ParseRemote(testCase.URL)
+			if testCase.Err != "" {
+				require.ErrorIs(t, err, ErrInvalidRemote)
+				require.Contains(t, err.Error(), testCase.Err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testCase.Expected, *remote)
+			require.Equal(t, testCase.URL, remote.String())
+		})
+	}
+}
+
+// gitCommit commits the files, creating the repository if needed, and
+// returns the commit
+func gitCommit(t *testing.T, repo filesystem.Path, files ...string) string {
+	run := func(args ...string) string {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "init.defaultBranch=main"}, args...)
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo.String()
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	require.NoError(t, repo.MkdirAll(0755))
+	run("init", "--quiet")
+
+	for _, file := range files {
+		writeFile(t, repo, file, file, 0644)
+	}
+
+	run("add", "--all")
+	run("commit", "--quiet", "--allow-empty", "--message", "commit")
+	return run("rev-parse", "HEAD")
+}
+
+func TestRemoteFetch(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "remote", []string{"cache/"})
+	defer tmp.RemoveAll()
+
+	store := Store{Dir: tmp.Join("store")}
+
+	repo := tmp.Join("repo")
+	first := gitCommit(t, repo, "vim/.vimrc")
+	cmd := exec.Command("git", "tag", "v1")
+	cmd.Dir = repo.String()
+	require.NoError(t, cmd.Run())
+
+	remote, err := ParseRemote("file://" + repo.String() + "#path=vim")
+	require.NoError(t, err)
+
+	commit, err := remote.Fetch(ctx, tmp.Join("cache"))
+	require.NoError(t, err)
+	require.Equal(t, first, commit)
+
+	root, err := remote.Export(ctx, tmp.Join("cache"), store, commit)
+	require.NoError(t, err)
+	require.Equal(t, "vim", root.Basename())
+	require.FileExists(t, root.Join(".vimrc").String())
+
+	upstream, err := remote.Upstream(ctx)
+	require.NoError(t, err)
+	require.Equal(t, first, upstream)
+
+	// Fetching again exports the new commit into its own entry, leaving
+	// the old one alone
+	second := gitCommit(t, repo, "vim/.gvimrc")
+
+	upstream, err = remote.Upstream(ctx)
+	require.NoError(t, err)
+	require.Equal(t, second, upstream)
+
+	commit, err = remote.Fetch(ctx, tmp.Join("cache"))
+	require.NoError(t, err)
+	require.Equal(t, second, commit)
+
+	updated, err := remote.Export(ctx, tmp.Join("cache"), store, commit)
+	require.NoError(t, err)
+	require.NotEqual(t, root, updated)
+	require.FileExists(t, updated.Join(".gvimrc").String())
+	require.NoFileExists(t, root.Join(".gvimrc").String())
+
+	// Exporting an old commit again uses the same entry
+	again, err := remote.Export(ctx, tmp.Join("cache"), store, first)
+	require.NoError(t, err)
+	require.Equal(t, root, again)
+
+	// Tags and commits are cloned separately
+	tagged := &Remote{Repository: remote.Repository, Path: "vim", Ref: "v1"}
+	require.NotEqual(t, remote.Checkout(tmp.Join("cache")), tagged.Checkout(tmp.Join("cache")))
+
+	commit, err = tagged.Fetch(ctx, tmp.Join("cache"))
+	require.NoError(t, err)
+	require.Equal(t, first, commit)
+
+	// A commit that is not in the clone yet is fetched first
+	pinned := &Remote{Repository: remote.Repository, Ref: first}
+	whole, err := pinned.Export(ctx, tmp.Join("cache"), store, second)
+	require.NoError(t, err)
+	require.Equal(t, "repo", whole.Basename())
+	require.FileExists(t, whole.Join("vim/.gvimrc").String())
+
+	commit, err = pinned.Fetch(ctx, tmp.Join("cache"))
+	require.NoError(t, err)
+	require.Equal(t, first, commit)
+
+	upstream, err = pinned.Upstream(ctx)
+	require.NoError(t, err)
+	require.Empty(t, upstream)
+
+	missing := &Remote{Repository: remote.Repository, Ref: "v9"}
+	_, err = missing.Fetch(ctx, tmp.Join("cache"))
+	require.ErrorIs(t, err, ErrRefNotFound)
+}
+
+func TestReadStatusOrigin(t *testing.T) {
+	tmp := tmpDir(t, "origin", []string{"vim/.vimrc", "home/user/"})
+	defer tmp.RemoveAll()
+
+	origin := &Origin{URL: "git+https://host/dotfiles#path=vim", Commit: "abc1234abc1234"}
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("vim"),
+		Origin: origin,
+	}
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+	require.NoError(t, p.Install())
+
+	status, err := ReadStatus(tmp.Join("data"))
+	require.NoError(t, err)
+	require.Equal(t, origin, status.Origin)
+	require.Equal(t, "installed at abc1234", status.String())
+
+	status.Upstream = "def5678def5678"
+	require.Equal(t, "installed at abc1234, upstream now def5678", status.String())
+}
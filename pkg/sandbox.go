@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSandboxUnsupported is returned when hooks are sandboxed on a platform
+// that does not support it.
+var ErrSandboxUnsupported = errors.New("pkg: hook sandboxing is only supported on Linux")
+
+// ErrNoSandboxHelper is returned when hooks are sandboxed by a program that
+// did not call SandboxHelper, which would start the program itself instead of
+// the sandbox.
+var ErrNoSandboxHelper = errors.New("pkg: the sandbox helper is not set up; SandboxHelper must be called first thing in main")
+
+// sandboxHelperReady is set by SandboxHelper once it has checked that the
+// process is not the sandbox helper, which means the sandbox helper can be
+// started.
+var sandboxHelperReady int32
+
+// sandboxHelperName is the name the sandbox helper is started with. The
+// helper is the current executable, which sets up the sandbox in its own
+// namespaces before executing the hook. See SandboxHelper.
+const sandboxHelperName = "stowaway-sandbox"
+
+// sandboxExitCode is the exit status of the sandbox helper when it could not
+// set up the sandbox.
+const sandboxExitCode = 125
+
+// SandboxError is returned when a hook cannot be run in a sandbox.
+type SandboxError struct {
+	Package string
+	Hook    string
+	Err     error
+}
+
+func (e *SandboxError) Error() string {
+	return fmt.Sprintf("pkg: could not sandbox hook %s of package %s: %s", e.Hook, e.Package, e.Err)
+}
+
+func (e *SandboxError) Unwrap() error {
+	return e.Err
+}
+
+// SandboxHelper sets up the sandbox and executes the hook if the process was
+// started as the sandbox helper, in which case it never returns. Otherwise it
+// returns immediately. Programs that run sandboxed hooks must call it first
+// thing in main, or the hooks fail with ErrNoSandboxHelper.
+func SandboxHelper() {
+	if filepath.Base(os.Args[0]) != sandboxHelperName {
+		atomic.StoreInt32(&sandboxHelperReady, 1)
+		return
+	}
+
+	if err := runSandboxHelper(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", sandboxHelperName, err)
+		os.Exit(sandboxExitCode)
+	}
+
+	os.Exit(0)
+}
+
+// sandboxArgs returns the arguments for the sandbox helper, which are the
+// writable paths followed by "--", the path of the executable and its
+// arguments, starting with argv[0]. Without an executable, the helper only
+// checks that the sandbox can be set up.
+func sandboxArgs(writable []string, path string, args []string) []string {
+	helperArgs := append([]string{sandboxHelperName}, writable...)
+	helperArgs = append(helperArgs, "--")
+	if path != "" {
+		helperArgs = append(helperArgs, path)
+		helperArgs = append(helperArgs, args...)
+	}
+
+	return helperArgs
+}
+
+// parseSandboxArgs splits the arguments of the sandbox helper into the
+// writable paths and the command.
+func parseSandboxArgs(args []string) (writable []string, command []string, err error) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:], nil
+		}
+	}
+
+	return nil, nil, errors.New("missing command")
+}
+
+var (
+	sandboxOnce sync.Once
+	sandboxErr  error
+)
+
+// checkSandbox reports whether hooks can be sandboxed, by starting the
+// sandbox helper without a command. The result is cached.
+func checkSandbox() error {
+	if atomic.LoadInt32(&sandboxHelperReady) == 0 {
+		return ErrNoSandboxHelper
+	}
+
+	sandboxOnce.Do(func() {
+		stderr := bytes.NewBuffer([]byte{})
+		cmd := &exec.Cmd{Stderr: stderr}
+
+		if err := sandboxCommand(cmd, nil); err != nil {
+			sandboxErr = err
+			return
+		}
+
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = errors.New(strings.TrimPrefix(msg, sandboxHelperName+": "))
+			}
+
+			sandboxErr = err
+		}
+	})
+
+	return sandboxErr
+}
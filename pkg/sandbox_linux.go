@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	capSysAdmin = 21
+
+	prCapbsetDrop        = 24
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+
+	// Flags that are locked on mounts from a more privileged namespace and
+	// must be kept when remounting them
+	lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+		syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+)
+
+// sandboxCommand changes the command to start the sandbox helper in new user,
+// mount and network namespaces, which then executes the original command with
+// everything except the writable paths mounted read-only.
+func sandboxCommand(cmd *exec.Cmd, writable []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd.Args = sandboxArgs(writable, cmd.Path, cmd.Args)
+	cmd.Path = exe
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	// The user keeps their own user and group IDs inside the sandbox. The
+	// helper needs CAP_SYS_ADMIN to set up the mounts, which it drops again
+	// before running the hook.
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	if uid != 0 {
+		cmd.SysProcAttr.AmbientCaps = []uintptr{capSysAdmin}
+	}
+
+	return nil
+}
+
+func runSandboxHelper(args []string) error {
+	writable, command, err := parseSandboxArgs(args)
+	if err != nil {
+		return err
+	}
+
+	// Capabilities are per thread, so they must be dropped on the thread
+	// that executes the hook
+	runtime.LockOSThread()
+
+	if err := sandboxMounts(writable); err != nil {
+		return err
+	}
+
+	if len(command) == 0 {
+		return nil
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 {
+		return fmt.Errorf("clearing capabilities: %w", errno)
+	}
+
+	// Root keeps its capabilities in the namespace, so CAP_SYS_ADMIN is
+	// removed altogether to stop the hook from remounting anything
+	if os.Getuid() == 0 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, capSysAdmin, 0); errno != 0 {
+			return fmt.Errorf("dropping capabilities: %w", errno)
+		}
+	}
+
+	return syscall.Exec(command[0], command[1:], os.Environ())
+}
+
+// sandboxMounts makes every mount read-only, except for the writable paths
+// and the devices in /dev. /tmp is replaced with an empty temporary
+// filesystem, unless it contains one of the writable paths.
+func sandboxMounts(writable []string) error {
+	// Stop the changes from propagating back to the parent namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+
+	// The writable paths become mount points of their own, so that they can
+	// be left out when everything else is made read-only
+	for _, path := range writable {
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("mounting %s: %w", path, err)
+		}
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		if mount == "/dev" || strings.HasPrefix(mount, "/dev/") || isWritable(mount, writable) {
+			continue
+		}
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(mount, &stat); err != nil {
+			// Mounts that are hidden by another mount cannot be reached
+			// and do not need to be made read-only
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				continue
+			}
+
+			return fmt.Errorf("reading %s: %w", mount, err)
+		}
+
+		if stat.Flags&syscall.MS_RDONLY != 0 {
+			continue
+		}
+
+		flags := uintptr(stat.Flags)&lockedMountFlags | syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+		if err := syscall.Mount("", mount, "", flags, ""); err != nil {
+			return fmt.Errorf("making %s read-only: %w", mount, err)
+		}
+	}
+
+	if info, err := os.Stat("/tmp"); err == nil && info.IsDir() && !containsWritable("/tmp", writable) {
+		if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+			return fmt.Errorf("mounting /tmp: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// isWritable reports whether the mount point is one of the writable paths or
+// inside one of them.
+func isWritable(mount string, writable []string) bool {
+	for _, path := range writable {
+		if mount == path || strings.HasPrefix(mount, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsWritable reports whether the directory is one of the writable
+// paths, or contains or is inside one of them.
+func containsWritable(dir string, writable []string) bool {
+	for _, path := range writable {
+		if isWritable(path, []string{dir}) {
+			return true
+		}
+	}
+
+	return isWritable(dir, writable)
+}
+
+// mountPoints returns the mount points in the current mount namespace.
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		mounts = append(mounts, unescapeMountPoint(fields[4]))
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPoint decodes the octal escapes used for whitespace and
+// backslashes in /proc/self/mountinfo.
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
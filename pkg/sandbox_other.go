@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pkg
+
+import "os/exec"
+
+func sandboxCommand(cmd *exec.Cmd, writable []string) error {
+	return ErrSandboxUnsupported
+}
+
+func runSandboxHelper(args []string) error {
+	return ErrSandboxUnsupported
+}
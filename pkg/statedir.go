@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+// ErrStateDirExists is returned by MigrateStateDir when both the old and the
+// new state directory exist
+var ErrStateDirExists = errors.New("pkg: package state exists in both state directories")
+
+// PackageID returns the identifier of the package at path, which names its
+// state directory. It is derived from the absolute path of the package.
+func PackageID(path filesystem.Path) string {
+	h := md5.Sum([]byte(path.String()))
+	digest := hex.EncodeToString(h[:])
+	return digest[:6]
+}
+
+// TargetID returns the identifier of the target directory at path, which
+// names its directory in the user's state directory. It is derived from the
+// absolute path of the target directory.
+func TargetID(path filesystem.Path) string {
+	h := md5.Sum([]byte(path.String()))
+	digest := hex.EncodeToString(h[:])
+	return digest[:12]
+}
+
+// DefaultStateDir returns the directory that holds the state of every
+// package installed in the target directory, which is named after the
+// target directory in UserStateDir.
+func DefaultStateDir(target filesystem.Path) (filesystem.Path, error) {
+	dir, err := UserStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return dir.Join(TargetID(target)), nil
+}
+
+// MigrateStateDir moves the package state directory old to dir, and changes
+// the symlinks that point into it, both in the package states and in the
+// target directories of the packages. It returns false without changing
+// anything if there is no state in old.
+func MigrateStateDir(old, dir filesystem.Path) (bool, error) {
+	return migrateStateDir(filesystem.OS, old, dir)
+}
+
+func migrateStateDir(fsys filesystem.FS, old, dir filesystem.Path) (bool, error) {
+	exists, err := filesystem.Exists(fsys, old.String())
+	if err != nil || !exists {
+		return false, err
+	}
+
+	exists, err = filesystem.Exists(fsys, dir.String())
+	if err != nil {
+		return false, err
+	}
+
+	if exists {
+		return false, fmt.Errorf("%w: %s and %s", ErrStateDirExists, old, dir)
+	}
+
+	if err := filesystem.MkdirAll(fsys, dir.Parent().String(), 0755); err != nil {
+		return false, err
+	}
+
+	if err := moveDir(fsys, old, dir); err != nil {
+		return false, err
+	}
+
+	states, err := listStates(fsys, dir)
+	if err != nil {
+		return true, err
+	}
+
+	for _, state := range states {
+		targetStates, err := targetStates(fsys, state)
+		if err != nil {
+			return true, err
+		}
+
+		for _, targetState := range targetStates {
+			if err := relinkState(fsys, targetState, old, dir); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// moveDir renames the directory, or copies it and removes the original if it
+// cannot be renamed, e.g. because it is on another filesystem.
+func moveDir(fsys filesystem.FS, old, dir filesystem.Path) error {
+	if err := fsys.Rename(old.String(), dir.String()); err == nil {
+		return nil
+	}
+
+	err := filesystem.Walk(fsys, old.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return filesystem.MkdirAll(fsys, dir.Join(path).String(), info.Mode().Perm())
+		}
+
+		return copyFile(fsys, old.Join(path), dir.Join(path))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return filesystem.RemoveAll(fsys, old.String())
+}
+
+// relinkState changes the entries in the links directory of a moved package
+// state, and the symlinks in the target directory they record, to point into
+// dir instead of old.
+func relinkState(fsys filesystem.FS, state, old, dir filesystem.Path) error {
+	target, err := fsys.Readlink(state.Join("target").String())
+	if err != nil {
+		return err
+	}
+
+	pkg := localPackage{
+		State:      state,
+		Target:     filesystem.Path(target),
+		SourceLink: state.Join("source"),
+		TargetLink: state.Join("target"),
+		Links:      state.Join("links"),
+		FS:         fsys,
+	}
+
+	err = filesystem.Walk(fsys, pkg.Links.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		entry := pkg.Links.Join(path)
+		if err := relink(fsys, entry, old, dir); err != nil {
+			return err
+		}
+
+		link, err := fsys.Readlink(entry.String())
+		if err != nil {
+			return err
+		}
+
+		name, err := pkg.linkName(filesystem.Path(link))
+		if err != nil {
+			return err
+		}
+
+		return relink(fsys, pkg.Target.Join(filepath.FromSlash(name)), old, dir)
+	})
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// relink changes the symlink at path to point into dir if it points into
+// old. Anything else at path, including nothing, is left alone.
+func relink(fsys filesystem.FS, path, old, dir filesystem.Path) error {
+	info, err := fsys.Lstat(path.String())
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+
+	link, err := fsys.Readlink(path.String())
+	if err != nil {
+		return err
+	}
+
+	prefix := old.String() + string(filepath.Separator)
+	if !strings.HasPrefix(link, prefix) {
+		return nil
+	}
+
+	if err := fsys.Remove(path.String()); err != nil {
+		return err
+	}
+
+	return fsys.Symlink(dir.Join(strings.TrimPrefix(link, prefix)).String(), path.String())
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateStateDir(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "migrate", []string{"bash/home/.bashrc", "bash/config/git/config", "vim/.vimrc", "home/.config/", "state/"})
+		old, dir := tmp.Join("home/.stowaway"), tmp.Join("state/home")
+
+		tfs.writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+			Name:    "bash",
+			Targets: []TargetSection{{Source: "home"}, {Source: "config", Target: ".config"}},
+		})
+
+		for _, name := range []string{"bash", "vim"} {
+			loader := Loader{State: old.Join(name), Source: tmp.Join(name), Target: tmp.Join("home"), FS: tfs.FS}
+			p, err := loader.Load()
+			require.NoError(t, err)
+			require.NoError(t, p.Install())
+		}
+
+		// A file that has taken the place of a symlink is left alone
+		require.NoError(t, tfs.Remove(tmp.Join("home/.vimrc").String()))
+		tfs.writeFile(t, tmp, "home/.vimrc", "mine", 0644)
+
+		migrated, err := migrateStateDir(tfs, old, dir)
+		require.NoError(t, err)
+		require.True(t, migrated)
+		tfs.assertMissing(t, tmp, []string{"home/.stowaway"})
+
+		tfs.assertLinks(t, tmp, Links{
+			"home/.bashrc":                           "state/home/bash/source/.bashrc",
+			"home/.config/git/config":                "state/home/bash/targets/config/source/git/config",
+			"state/home/bash/links/0":                "state/home/bash/target/.bashrc",
+			"state/home/bash/targets/config/links/0": "state/home/bash/targets/config/target/git/config",
+			"state/home/vim/links/0":                 "state/home/vim/target/.vimrc",
+		})
+
+		require.Equal(t, "mine", tfs.readFile(t, tmp.Join("home/.vimrc")))
+
+		status, err := readStatus(tfs, dir.Join("bash"))
+		require.NoError(t, err)
+		require.Empty(t, status.Drifted())
+
+		loader := Loader{State: dir.Join("bash"), Source: tmp.Join("bash"), Target: tmp.Join("home"), FS: tfs.FS}
+		p, err := loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Uninstall())
+		tfs.assertMissing(t, tmp, []string{"home/.bashrc", "home/.config/git"})
+
+		// There is nothing left to migrate
+		migrated, err = migrateStateDir(tfs, old, dir)
+		require.NoError(t, err)
+		require.False(t, migrated)
+
+		require.NoError(t, filesystem.MkdirAll(tfs, old.String(), 0755))
+		_, err = migrateStateDir(tfs, old, dir)
+		require.ErrorIs(t, err, ErrStateDirExists)
+	})
+}
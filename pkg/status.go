@@ -0,0 +1,434 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// installedManifest is the name of the file in the package state directory
+// that holds a copy of the manifest at the time the package was installed.
+const installedManifest = "manifest.toml"
+
+func encodeManifest(fsys filesystem.FS, path filesystem.Path, m *Manifest) error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(m); err != nil {
+		return err
+	}
+
+	return fsys.WriteFile(path.String(), w.Bytes(), 0644)
+}
+
+func decodeManifest(fsys filesystem.FS, path filesystem.Path) (*Manifest, error) {
+	exists, err := filesystem.Exists(fsys, path.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	f, err := fsys.Open(path.String())
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var m Manifest
+	if err := toml.NewDecoder(f).Decode(&m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// ListStates returns the package installation state directories inside the
+// state directory. Other directories, such as the logs directory, are
+// skipped.
+func ListStates(state filesystem.Path) ([]filesystem.Path, error) {
+	return listStates(filesystem.OS, state)
+}
+
+func listStates(fsys filesystem.FS, state filesystem.Path) ([]filesystem.Path, error) {
+	files, err := fsys.ReadDir(state.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var states []filesystem.Path
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		exists, err := filesystem.Exists(fsys, state.Join(file.Name(), "source").String())
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			states = append(states, state.Join(file.Name()))
+		}
+	}
+
+	return states, nil
+}
+
+// Status describes an installed package, comparing what was installed with
+// what is currently in the package source.
+type Status struct {
+	// State is the package installation state directory
+	State filesystem.Path
+
+	// Root is the package root the package was installed from
+	Root filesystem.Path
+
+	// Installed is the manifest recorded at installation time. It is nil for
+	// simple packages.
+	Installed *Manifest
+
+	// Current is the manifest currently in the package root. It is nil for
+	// simple packages, if the package root no longer exists or if the
+	// manifest cannot be loaded.
+	Current *Manifest
+
+	// ManifestErr is the error loading the manifest in the package root,
+	// e.g. because it has become invalid since the package was installed
+	ManifestErr error
+
+	// RootMissing is true if the package root no longer exists
+	RootMissing bool
+
+	// Missing are the symlinks created by the package that have since been
+	// removed from the target directory or replaced by something else
+	Missing []filesystem.Path
+
+	// Shadowed are the symlinks of the package that another package with a
+	// higher priority has created instead. They are not drift.
+	Shadowed []filesystem.Path
+
+	// Broken are the symlinks created by the package whose file has since
+	// been removed from the package source
+	Broken []filesystem.Path
+
+	// Unlinked are the symlinks that would be created for files added to the
+	// package source since it was installed
+	Unlinked []filesystem.Path
+
+	// Origin is the remote package or archive the package was fetched or
+	// extracted from. It is nil for packages installed from a directory.
+	Origin *Origin
+
+	// Upstream is the commit the ref of the remote package currently points
+	// to. ReadStatus does not fetch it, so it is empty unless it is set by
+	// the caller.
+	Upstream string
+}
+
+// Drifted returns every symlink in the target directory that no longer
+// matches the package, or nil if the package has not drifted.
+func (s Status) Drifted() []filesystem.Path {
+	var links []filesystem.Path
+	links = append(links, s.Missing...)
+	links = append(links, s.Broken...)
+	links = append(links, s.Unlinked...)
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i] < links[j]
+	})
+
+	return links
+}
+
+// ReadStatus reads the status of the package installed in the given state
+// directory.
+func ReadStatus(state filesystem.Path) (Status, error) {
+	return readStatus(filesystem.OS, state)
+}
+
+func readStatus(fsys filesystem.FS, state filesystem.Path) (Status, error) {
+	status := Status{State: state}
+
+	root, err := fsys.Readlink(state.Join("root").String())
+	if err != nil {
+		// Packages installed by older versions only have a source link,
+		// which is the package root for simple packages
+		root, err = fsys.Readlink(state.Join("source").String())
+		if err != nil {
+			return status, err
+		}
+	}
+
+	status.Root = filesystem.Path(root)
+
+	status.Installed, err = decodeManifest(fsys, state.Join(installedManifest))
+	if err != nil {
+		return status, err
+	}
+
+	status.Origin, err = decodeOrigin(fsys, state.Join(originFile))
+	if err != nil {
+		return status, err
+	}
+
+	exists, err := filesystem.Exists(fsys, root)
+	if err != nil {
+		return status, err
+	}
+
+	if exists {
+		loader := Loader{State: state, Source: status.Root, FS: fsys}
+		status.Current, status.ManifestErr = loader.LoadManifest()
+	}
+
+	status.RootMissing = !exists
+
+	if err := status.readDrift(fsys); err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// readDrift compares the symlinks recorded in the state directory with the
+// target directory and the package source, for each of the package's target
+// sections.
+func (s *Status) readDrift(fsys filesystem.FS) error {
+	states, err := targetStates(fsys, s.State)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		if err := s.readTargetDrift(fsys, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Status) readTargetDrift(fsys filesystem.FS, state filesystem.Path) error {
+	link, err := fsys.Readlink(state.Join("target").String())
+	if err != nil {
+		return err
+	}
+
+	target := filesystem.Path(link)
+
+	pkg := localPackage{
+		State:      state,
+		Target:     target,
+		SourceLink: state.Join("source"),
+		TargetLink: state.Join("target"),
+		Links:      state.Join("links"),
+		FS:         fsys,
+		Linker:     filesystem.DirLinkerFS(fsys, target.String()),
+		States:     s.State.Parent(),
+	}
+
+	linked := map[filesystem.Path]bool{}
+	err = filesystem.Walk(fsys, pkg.Links.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == "." {
+			return nil
+		}
+
+		link, err := fsys.Readlink(pkg.Links.Join(path).String())
+		if err != nil {
+			return err
+		}
+
+		name, err := pkg.linkName(filesystem.Path(link))
+		if err != nil {
+			return err
+		}
+
+		linked[filesystem.Path(name)] = true
+		abs := target.Join(name)
+
+		if pkg.isShadowed(name) {
+			s.Shadowed = append(s.Shadowed, abs)
+			return nil
+		}
+
+		if !pkg.ownsLink(name) {
+			s.Missing = append(s.Missing, abs)
+			return nil
+		}
+
+		// The symlink points into the package source, which no longer
+		// has the file
+		if _, err := fsys.Stat(abs.String()); os.IsNotExist(err) {
+			s.Broken = append(s.Broken, abs)
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Files that were skipped because something was in their place are not
+	// expected to be linked either
+	conflicts, err := readConflicts(fsys, state)
+	if err != nil {
+		return err
+	}
+
+	for _, conflict := range conflicts {
+		if conflict.Strategy == ConflictSkip {
+			linked[filesystem.Path(conflict.Name)] = true
+		}
+	}
+
+	// The files ignored when the package was installed are the best guess
+	// if the current manifest cannot be loaded
+	manifest := s.Current
+	if s.ManifestErr != nil {
+		manifest = s.Installed
+	}
+
+	err = filesystem.Walk(fsys, pkg.SourceLink.String(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Files ignored by the manifest in the package source are not
+		// expected to be linked
+		if path != "." && manifest.Ignored(path) {
+			return skipIgnored(info)
+		}
+
+		if path != "." && shouldSymlink(info.Mode()) && !linked[filesystem.Path(path)] {
+			s.Unlinked = append(s.Unlinked, target.Join(path))
+		}
+
+		return nil
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Name returns the name of the installed package.
+func (s Status) Name() string {
+	if s.Installed != nil {
+		return s.Installed.Name
+	}
+
+	return s.Root.Basename()
+}
+
+// String summarises the status, e.g. "installed 1.2, source now 1.3, 1 link
+// missing" or "installed at abc1234, upstream now def5678".
+func (s Status) String() string {
+	summary := s.versionString()
+
+	if s.ManifestErr != nil {
+		summary += fmt.Sprintf(", cannot load manifest: %s", s.ManifestErr)
+	}
+
+	if s.Origin != nil && s.Upstream != "" && s.Upstream != s.Origin.Commit {
+		summary += fmt.Sprintf(", upstream now %s", shortCommit(s.Upstream))
+	}
+
+	// Every link is broken when the source is missing
+	if s.RootMissing {
+		return summary
+	}
+
+	drift := []struct {
+		links       []filesystem.Path
+		noun        string
+		description string
+	}{
+		{s.Missing, "link", "missing"},
+		{s.Broken, "link", "broken"},
+		{s.Unlinked, "file", "not linked"},
+		{s.Shadowed, "link", "shadowed"},
+	}
+
+	for _, d := range drift {
+		switch len(d.links) {
+		case 0:
+		case 1:
+			summary += fmt.Sprintf(", 1 %s %s", d.noun, d.description)
+		default:
+			summary += fmt.Sprintf(", %d %ss %s", len(d.links), d.noun, d.description)
+		}
+	}
+
+	return summary
+}
+
+func (s Status) versionString() string {
+	installed := "installed"
+	if s.Installed != nil && s.Installed.Version != "" {
+		installed = fmt.Sprintf("installed %s", s.Installed.Version)
+	}
+
+	if s.Origin != nil && s.Origin.Commit != "" {
+		installed = fmt.Sprintf("%s at %s", installed, shortCommit(s.Origin.Commit))
+	}
+
+	if s.Origin != nil && s.Origin.Checksum != "" {
+		installed = fmt.Sprintf("%s from sha256:%s", installed, shortCommit(s.Origin.Checksum))
+	}
+
+	if s.Origin != nil && s.Origin.Snapshot != "" {
+		installed = fmt.Sprintf("%s from snapshot %s", installed, shortCommit(s.Origin.Snapshot))
+	}
+
+	if s.RootMissing {
+		return fmt.Sprintf("%s, source missing", installed)
+	}
+
+	// The current version is unknown
+	if s.ManifestErr != nil {
+		return installed
+	}
+
+	var installedVersion, currentVersion string
+	if s.Installed != nil {
+		installedVersion = s.Installed.Version
+	}
+
+	if s.Current != nil {
+		currentVersion = s.Current.Version
+	}
+
+	if installedVersion != currentVersion {
+		if currentVersion == "" {
+			return fmt.Sprintf("%s, source now unversioned", installed)
+		}
+
+		return fmt.Sprintf("%s, source now %s", installed, currentVersion)
+	}
+
+	return installed
+}
+
+// shortCommit abbreviates a commit hash like git does
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+
+	return commit
+}
@@ -0,0 +1,442 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+// UserDataDir returns the directory Stowaway keeps its data in, which is
+// $XDG_DATA_HOME/stowaway, or ~/.local/share/stowaway if XDG_DATA_HOME is not
+// set.
+func UserDataDir() (filesystem.Path, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filesystem.MakePath(dir, "stowaway"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filesystem.MakePath(home, ".local", "share", "stowaway"), nil
+}
+
+// DefaultStore returns the user's package store, which is the store
+// directory in UserDataDir.
+func DefaultStore() (Store, error) {
+	dir, err := UserDataDir()
+	if err != nil {
+		return Store{}, err
+	}
+
+	return Store{Dir: dir.Join("store")}, nil
+}
+
+// Store is a directory of package sources that never change once they are
+// added, each named after a hash of its contents. Packages are installed from
+// an entry in the store instead of a directory that may change.
+//
+// The files in an entry are read-only, so that editing a file through the
+// symlink to it in the target directory does not change the entry. The
+// directories are left writable so that entries can be removed.
+//
+// Each entry records the package state directories and saved generations
+// that use it, in the refs directory of the store, so that it is only removed
+// once nothing uses it. Package states in any target directory can use the
+// same store.
+type Store struct {
+	Dir filesystem.Path
+}
+
+// Entry returns the path of the entry with the given name.
+func (s Store) Entry(name string) filesystem.Path {
+	return s.Dir.Join(name)
+}
+
+// Root returns the package root in the entry with the given name, which is
+// its only directory. Entries extracted before archives were extracted into
+// a directory may have the package files at the top instead.
+func (s Store) Root(name string) (filesystem.Path, error) {
+	entry := s.Entry(name)
+	entries, err := entry.ReadDir()
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) == 1 && entries[0].IsDir() {
+		return entry.Join(entries[0].Name()), nil
+	}
+
+	return entry, nil
+}
+
+// EntryOf returns the name of the entry that path is in, or false if path is
+// not in the store.
+func (s Store) EntryOf(path filesystem.Path) (string, bool) {
+	rel, err := filepath.Rel(s.Dir.String(), path.String())
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	name := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	if name == "refs" || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+
+	return name, true
+}
+
+// Add creates the entry with the given name by calling fill with an empty
+// directory to fill, unless the entry exists already. The entry only appears
+// once fill has succeeded, so an interrupted Add leaves nothing behind but a
+// temporary directory.
+func (s Store) Add(name string, fill func(dir filesystem.Path) error) (filesystem.Path, error) {
+	entry := s.Entry(name)
+
+	exists, err := entry.Exists()
+	if err != nil || exists {
+		return entry, err
+	}
+
+	entry, _, err = s.add(".tmp-"+name+"-"+strconv.Itoa(os.Getpid()), func(dir filesystem.Path) (string, error) {
+		return name, fill(dir)
+	})
+
+	return entry, err
+}
+
+// tmpCount numbers the temporary directories of AddNamed
+var tmpCount uint64
+
+// AddNamed is like Add, but the entry is named after what fill returns, e.g.
+// a checksum computed while filling it. If the entry exists already, the
+// directory that fill filled is thrown away. It returns the entry and its
+// name.
+func (s Store) AddNamed(fill func(dir filesystem.Path) (string, error)) (filesystem.Path, string, error) {
+	n := atomic.AddUint64(&tmpCount, 1)
+	return s.add(".tmp-"+strconv.Itoa(os.Getpid())+"-"+strconv.FormatUint(n, 10), fill)
+}
+
+// add fills the temporary directory and renames it to the entry named after
+// what fill returns
+func (s Store) add(tmpName string, fill func(dir filesystem.Path) (string, error)) (filesystem.Path, string, error) {
+	tmp := s.Dir.Join(tmpName)
+	if err := tmp.RemoveAll(); err != nil {
+		return "", "", err
+	}
+
+	if err := tmp.MkdirAll(0755); err != nil {
+		return "", "", err
+	}
+
+	name, err := fill(tmp)
+	if err != nil {
+		tmp.RemoveAll()
+		return "", "", err
+	}
+
+	entry := s.Entry(name)
+	if exists, err := entry.Exists(); err != nil || exists {
+		tmp.RemoveAll()
+		return entry, name, err
+	}
+
+	if err := tmp.Rename(entry); err != nil {
+		tmp.RemoveAll()
+
+		// Another process may have added the same entry in the meantime
+		if exists, _ := entry.Exists(); exists {
+			return entry, name, nil
+		}
+
+		return "", "", err
+	}
+
+	return entry, name, nil
+}
+
+// ref returns the path of the symlink recording that the package state uses
+// the entry
+func (s Store) ref(name string, state filesystem.Path) filesystem.Path {
+	h := sha256.Sum256([]byte(state.String()))
+	return s.Dir.Join("refs", name, hex.EncodeToString(h[:])[:16])
+}
+
+// uses returns the entries that the package state or saved generation uses,
+// which are the entries packages are installed from and the snapshots they
+// can be rolled back to
+func (s Store) uses(holder filesystem.Path) []string {
+	if info, err := holder.Stat(); err == nil && info.Mode().IsRegular() {
+		generation, err := ReadGeneration(holder)
+		if err != nil {
+			return nil
+		}
+
+		var names []string
+		for _, p := range generation.Packages {
+			names = append(names, s.originUses(filesystem.Path(p.Root), p.Origin)...)
+		}
+
+		return names
+	}
+
+	root, _ := holder.Join("root").Readlink()
+	origin, _ := decodeOrigin(filesystem.OS, holder.Join(originFile))
+	return s.originUses(root, origin)
+}
+
+// originUses returns the entries used by a package installed from root
+func (s Store) originUses(root filesystem.Path, origin *Origin) []string {
+	var names []string
+	if name, ok := s.EntryOf(root); ok {
+		names = append(names, name)
+	}
+
+	if origin != nil {
+		names = append(names, origin.Previous...)
+	}
+
+	return names
+}
+
+// Track records which entries the package states or saved generations use,
+// after they have changed. Entries that they used before are removed if
+// nothing uses them anymore.
+func (s Store) Track(states ...filesystem.Path) error {
+	entries, err := s.Dir.Join("refs").ReadDir()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var previous []string
+	for _, entry := range entries {
+		for _, state := range states {
+			exists, err := s.ref(entry.Name(), state).Exists()
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				previous = append(previous, entry.Name())
+				break
+			}
+		}
+	}
+
+	for _, state := range states {
+		for _, name := range s.uses(state) {
+			ref := s.ref(name, state)
+			exists, err := ref.Exists()
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				continue
+			}
+
+			if err := ref.Parent().MkdirAll(0755); err != nil {
+				return err
+			}
+
+			if err := ref.Symlink(state); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.Prune(previous...)
+}
+
+// Prune removes the entries that no package state uses.
+func (s Store) Prune(names ...string) error {
+	for _, name := range names {
+		used, err := s.Used(name)
+		if err != nil {
+			return err
+		}
+
+		if !used {
+			if err := s.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Used reports whether any package state or saved generation uses the entry.
+// Records of the ones that no longer use it are removed.
+func (s Store) Used(name string) (bool, error) {
+	refs := s.Dir.Join("refs", name)
+
+	entries, err := refs.ReadDir()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	used := false
+	for _, entry := range entries {
+		ref := refs.Join(entry.Name())
+		state, err := ref.Readlink()
+		if err != nil {
+			return false, err
+		}
+
+		uses := false
+		for _, entry := range s.uses(state) {
+			uses = uses || entry == name
+		}
+
+		if uses {
+			used = true
+			continue
+		}
+
+		if err := ref.Remove(); err != nil {
+			return false, err
+		}
+	}
+
+	return used, nil
+}
+
+// Remove removes the entry and its records.
+func (s Store) Remove(name string) error {
+	if err := s.Dir.Join("refs", name).RemoveAll(); err != nil {
+		return err
+	}
+
+	return s.Entry(name).RemoveAll()
+}
+
+// GC removes the entries that nothing uses, along with anything
+// left behind by an interrupted Add. It returns the names of the removed
+// entries.
+func (s Store) GC() ([]string, error) {
+	entries, err := s.Dir.ReadDir()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == "refs" {
+			continue
+		}
+
+		if strings.HasPrefix(name, ".tmp-") {
+			if err := s.Dir.Join(name).RemoveAll(); err != nil {
+				return removed, err
+			}
+
+			continue
+		}
+
+		used, err := s.Used(name)
+		if err != nil {
+			return removed, err
+		}
+
+		if !used {
+			if err := s.Remove(name); err != nil {
+				return removed, err
+			}
+
+			removed = append(removed, name)
+		}
+	}
+
+	return removed, nil
+}
+
+// Snapshot copies the package at root into the store, in an entry named after
+// a hash of its files, unless the same files were copied before. Like Pack,
+// it leaves out the files ignored by the package manifest and .git
+// directories, and refuses packages with symlinks that point outside of
+// them. It returns the package root in the store and the name of the
+// entry.
+func (s Store) Snapshot(root filesystem.Path) (filesystem.Path, string, error) {
+	files, err := packFiles(root)
+	if err != nil {
+		return "", "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		var data []byte
+		if file.info.Mode().IsRegular() {
+			data, err = file.read()
+			if err != nil {
+				return "", "", err
+			}
+		}
+
+		fmt.Fprintf(h, "%s\x00%o\x00%s\x00%d\x00", file.name, file.mode(), file.target, len(data))
+		h.Write(data)
+	}
+
+	name := hex.EncodeToString(h.Sum(nil))
+	_, err = s.Add(name, func(dir filesystem.Path) error {
+		return copyFiles(dir, files)
+	})
+
+	if err != nil {
+		return "", "", err
+	}
+
+	snapshot, err := s.Root(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	return snapshot, name, nil
+}
+
+// copyFiles copies the files returned by packFiles into dir
+func copyFiles(dir filesystem.Path, files []packFile) error {
+	for _, file := range files {
+		path := dir.Join(filepath.FromSlash(file.name))
+
+		switch {
+		case file.info.IsDir():
+			if err := path.MkdirAll(0755); err != nil {
+				return err
+			}
+		case file.target != "":
+			if err := path.Symlink(filesystem.Path(filepath.FromSlash(file.target))); err != nil {
+				return err
+			}
+		default:
+			data, err := file.read()
+			if err != nil {
+				return err
+			}
+
+			if err := path.WriteFile(data, fs.FileMode(file.mode())&^0222); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
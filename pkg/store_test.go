@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	tmp := tmpDir(t, "store", []string{"state/a/", "state/b/"})
+	store := Store{Dir: tmp.Join("store")}
+
+	fill := func(dir filesystem.Path) error {
+		return dir.Join("file").WriteFile(nil, 0644)
+	}
+
+	entry, err := store.Add("first", fill)
+	require.NoError(t, err)
+	require.Equal(t, store.Entry("first"), entry)
+	require.FileExists(t, entry.Join("file").String())
+
+	// Entries are only filled once
+	_, err = store.Add("first", func(dir filesystem.Path) error {
+		return errors.New("filled again")
+	})
+	require.NoError(t, err)
+
+	// Failing to fill an entry leaves nothing behind
+	failed := errors.New("failed")
+	_, err = store.Add("second", func(dir filesystem.Path) error {
+		fill(dir)
+		return failed
+	})
+	require.ErrorIs(t, err, failed)
+
+	entries, err := store.Dir.ReadDir()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// Entries can be named once they are filled, and are still only added
+	// once
+	for i := 0; i < 2; i++ {
+		entry, name, err := store.AddNamed(func(dir filesystem.Path) (string, error) {
+			return "named", fill(dir)
+		})
+		require.NoError(t, err)
+		require.Equal(t, "named", name)
+		require.Equal(t, store.Entry("named"), entry)
+	}
+
+	require.NoError(t, store.Prune("named"))
+	entries, err = store.Dir.ReadDir()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	name, ok := store.EntryOf(entry.Join("sub/dir"))
+	require.True(t, ok)
+	require.Equal(t, "first", name)
+
+	for _, path := range []filesystem.Path{store.Dir, store.Dir.Join("refs/first"), tmp} {
+		_, ok := store.EntryOf(path)
+		require.False(t, ok, path)
+	}
+
+	// Entries are kept while any package state uses them
+	a, b := tmp.Join("state/a"), tmp.Join("state/b")
+	require.NoError(t, a.Join("root").Symlink(entry))
+	require.NoError(t, b.Join("root").Symlink(entry.Join("sub")))
+	require.NoError(t, store.Track(a, b))
+
+	require.NoError(t, a.Join("root").Remove())
+	require.NoError(t, store.Track(a))
+	require.DirExists(t, entry.String())
+
+	require.NoError(t, b.RemoveAll())
+	require.NoError(t, store.Track(b))
+	assertMissing(t, store.Dir, []string{"first", "refs/first"})
+
+	// Prune removes entries that were never used
+	_, err = store.Add("unused", fill)
+	require.NoError(t, err)
+	require.NoError(t, store.Prune("unused"))
+	assertMissing(t, store.Dir, []string{"unused"})
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	tmp := tmpDir(t, "snapshot", []string{"state/"})
+	store := Store{Dir: tmp.Join("store")}
+	root := tmp.Join("vim")
+
+	writeFile(t, root, "src/.vimrc", "set nocompatible", 0644)
+	writeFile(t, root, "src/.vimrc.swp", "", 0644)
+	writeFile(t, root, ".git/HEAD", "", 0644)
+	writeManifest(t, root, "stowaway.toml", &Manifest{Name: "vim", Source: "src", Ignore: []string{"*.swp"}})
+	require.NoError(t, root.Join("src/.gvimrc").Symlink(".vimrc"))
+
+	snapshot, name, err := store.Snapshot(root)
+	require.NoError(t, err)
+	require.Equal(t, store.Entry(name).Join("vim"), snapshot)
+	require.FileExists(t, snapshot.Join("src/.vimrc").String())
+	assertMissing(t, snapshot, []string{"src/.vimrc.swp", ".git"})
+
+	target, err := snapshot.Join("src/.gvimrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, filesystem.Path(".vimrc"), target)
+
+	// The files in the snapshot cannot be changed through the package's
+	// symlinks
+	info, err := snapshot.Join("src/.vimrc").Stat()
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0444), info.Mode().Perm())
+
+	// Snapshots of the same files are the same entry
+	_, same, err := store.Snapshot(root)
+	require.NoError(t, err)
+	require.Equal(t, name, same)
+
+	writeFile(t, root, "src/.vimrc", "set compatible", 0644)
+	_, changed, err := store.Snapshot(root)
+	require.NoError(t, err)
+	require.NotEqual(t, name, changed)
+
+	// Previous snapshots in the origin are used as well
+	state := tmp.Join("state")
+	require.NoError(t, state.Join("root").Symlink(store.Entry(changed).Join("vim")))
+	require.NoError(t, encodeOrigin(filesystem.OS, state.Join(originFile), &Origin{URL: root.String(), Snapshot: changed, Previous: []string{name}}))
+	require.NoError(t, store.Track(state))
+
+	removed, err := store.GC()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	require.NoError(t, encodeOrigin(filesystem.OS, state.Join(originFile), &Origin{URL: root.String(), Snapshot: changed}))
+	removed, err = store.GC()
+	require.NoError(t, err)
+	require.Equal(t, []string{name}, removed)
+	require.DirExists(t, store.Entry(changed).String())
+
+	// Symlinks out of the package would point elsewhere in the snapshot
+	require.NoError(t, root.Join("src/.bashrc").Symlink(tmp.Join("bashrc")))
+	_, _, err = store.Snapshot(root)
+	require.ErrorIs(t, err, ErrEscapingSymlink)
+}
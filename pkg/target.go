@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+)
+
+// ErrInvalidTarget is returned when the target of a target section cannot be
+// expanded
+var ErrInvalidTarget = errors.New("pkg: invalid target")
+
+// targetsDir is the name of the directory in the package state directory
+// that holds the state of each target section after the first.
+const targetsDir = "targets"
+
+// TargetSection links the files in a directory inside the package root into
+// a target directory of their own. The target can start with ~ for the home
+// directory and refer to environment variables, e.g. $XDG_CONFIG_HOME. A
+// relative target is relative to the target directory the package is
+// installed into, and an empty target is that directory itself.
+type TargetSection struct {
+	// Name identifies the section in the package state. It defaults to
+	// Source.
+	Name   string `toml:"name,omitempty" json:"name,omitempty"`
+	Source string `toml:"source" json:"source"`
+	Target string `toml:"target,omitempty" json:"target,omitempty"`
+}
+
+func (t TargetSection) name() string {
+	if t.Name == "" {
+		return t.Source
+	}
+
+	return t.Name
+}
+
+// targets returns the target sections of the manifest, which is nil for
+// simple packages
+func (m *Manifest) targets() []TargetSection {
+	if m == nil {
+		return nil
+	}
+
+	return m.Targets
+}
+
+// xdgDefaults are the directories the XDG base directory specification uses
+// when their variable is not set, relative to the home directory
+var xdgDefaults = map[string]string{
+	"XDG_CONFIG_HOME": "~/.config",
+	"XDG_DATA_HOME":   "~/.local/share",
+	"XDG_STATE_HOME":  "~/.local/state",
+	"XDG_CACHE_HOME":  "~/.cache",
+}
+
+// ExpandTarget returns the absolute path of the target of a target section
+// for a package installed into the target directory base. The XDG base
+// directory variables default to the directories of the specification.
+func ExpandTarget(target string, base filesystem.Path) (filesystem.Path, error) {
+	var unset []string
+	expanded := os.Expand(target, func(key string) string {
+		value := os.Getenv(key)
+		if value == "" {
+			value = xdgDefaults[key]
+		}
+
+		if value == "" {
+			unset = append(unset, key)
+		}
+
+		return value
+	})
+
+	// An unset variable would otherwise silently link the files into the
+	// wrong directory
+	if len(unset) > 0 {
+		return "", fmt.Errorf("%w: %s is not set in %q", ErrInvalidTarget, unset[0], target)
+	}
+
+	if expanded == "~" || strings.HasPrefix(expanded, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+
+		expanded = filepath.Join(home, expanded[1:])
+	}
+
+	if !filepath.IsAbs(expanded) {
+		return base.Join(expanded), nil
+	}
+
+	return filesystem.Path(filepath.Clean(expanded)), nil
+}
+
+// targetState returns the state directory of the target section with the
+// given name, inside the package state directory.
+func targetState(state filesystem.Path, name string) filesystem.Path {
+	return state.Join(targetsDir, name)
+}
+
+// TargetStates returns the state directory of every target the package
+// installed in the state directory has symlinks in. The package state
+// directory itself comes first, followed by the state directories of the
+// other target sections.
+func TargetStates(state filesystem.Path) ([]filesystem.Path, error) {
+	return targetStates(filesystem.OS, state)
+}
+
+func targetStates(fsys filesystem.FS, state filesystem.Path) ([]filesystem.Path, error) {
+	states := []filesystem.Path{state}
+
+	dir := state.Join(targetsDir)
+	exists, err := filesystem.Exists(fsys, dir.String())
+	if err != nil || !exists {
+		return states, err
+	}
+
+	others, err := listStates(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(states, others...), nil
+}
+
+// parts returns the package itself followed by the packages for its other
+// target sections.
+func (pkg localPackage) parts() []localPackage {
+	return append([]localPackage{pkg}, pkg.Targets...)
+}
+
+// part returns the package for the target section whose files in source are
+// linked into target, with its state in the given directory.
+func (pkg localPackage) part(state, source, target filesystem.Path) localPackage {
+	part := pkg
+	part.State = state
+	part.Source = source
+	part.Target = target
+	part.SourceLink = state.Join("source")
+	part.TargetLink = state.Join("target")
+	part.RootLink = state.Join("root")
+	part.Links = state.Join("links")
+	part.Linker = pkg.linker(target)
+	part.Targets = nil
+	return part
+}
+
+// linker returns the linker for the target directory, which is the
+// package's own linker if the directory is the package's target directory.
+func (pkg localPackage) linker(target filesystem.Path) filesystem.Linker {
+	if target == pkg.Target && pkg.Linker != nil {
+		return pkg.Linker
+	}
+
+	return filesystem.DirLinkerFS(pkg.fs(), target.String())
+}
+
+// installedParts returns the package followed by the packages for the other
+// target sections, with the sources and targets recorded in its state. These
+// are the sections that were installed, which may not be the ones in the
+// current manifest.
+func (pkg localPackage) installedParts() ([]localPackage, error) {
+	fsys := pkg.fs()
+	states, err := targetStates(fsys, pkg.State)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]localPackage, 0, len(states))
+	for i, state := range states {
+		source, err := fsys.Readlink(state.Join("source").String())
+		if err == nil {
+			var target string
+			target, err = fsys.Readlink(state.Join("target").String())
+			if err == nil {
+				parts = append(parts, pkg.part(state, filesystem.Path(source), filesystem.Path(target)))
+				continue
+			}
+		}
+
+		// The package state is only partly created if installing the
+		// package was interrupted
+		if i == 0 && os.IsNotExist(err) {
+			parts = append(parts, pkg)
+			continue
+		}
+
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// linkPart returns the part of the package whose target directory contains
+// the symlink, along with the path of the symlink relative to that
+// directory. If target directories are nested, the innermost one is used.
+func (pkg localPackage) linkPart(link filesystem.Path) (localPackage, string, error) {
+	var found *localPackage
+	var name string
+	for _, part := range pkg.parts() {
+		rel, err := filepath.Rel(part.Target.String(), link.String())
+		if err != nil || !isLocal(rel) {
+			continue
+		}
+
+		if found == nil || len(part.Target) > len(found.Target) {
+			part := part
+			found, name = &part, rel
+		}
+	}
+
+	if found != nil {
+		return *found, name, nil
+	}
+
+	rel, err := filepath.Rel(pkg.Target.String(), link.String())
+	return pkg, rel, err
+}
@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandTarget(t *testing.T) {
+	t.Setenv("HOME", "/home/jane")
+	t.Setenv("XDG_CONFIG_HOME", "/home/jane/.config")
+	t.Setenv("EMPTY", "")
+
+	base := filesystem.Path("/srv")
+	testCases := []struct {
+		Target   string
+		Expected filesystem.Path
+	}{
+		{"", "/srv"},
+		{"etc", "/srv/etc"},
+		{"/etc", "/etc"},
+		{"~", "/home/jane"},
+		{"~/.local/bin", "/home/jane/.local/bin"},
+		{"$XDG_CONFIG_HOME", "/home/jane/.config"},
+		{"${XDG_CONFIG_HOME}/git", "/home/jane/.config/git"},
+	}
+
+	for _, testCase := range testCases {
+		target, err := ExpandTarget(testCase.Target, base)
+		require.NoError(t, err)
+		require.Equal(t, testCase.Expected, target, testCase.Target)
+	}
+
+	_, err := ExpandTarget("$EMPTY/git", base)
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// The XDG base directories have defaults
+	t.Setenv("XDG_CONFIG_HOME", "")
+	target, err := ExpandTarget("$XDG_CONFIG_HOME/git", base)
+	require.NoError(t, err)
+	require.Equal(t, filesystem.Path("/home/jane/.config/git"), target)
+}
+
+func TestInstallTargets(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "targets", []string{"bash/home/.bashrc", "bash/config/git/config", "bash/config/git/ignore", "home/", "xdg/", "state/"})
+		t.Setenv("XDG_CONFIG_HOME", tmp.Join("xdg").String())
+
+		tfs.writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+			Name: "bash",
+			Targets: []TargetSection{
+				{Source: "home"},
+				{Source: "config", Target: "$XDG_CONFIG_HOME"},
+			},
+		})
+
+		loader := Loader{State: tmp.Join("state/bash"), Source: tmp.Join("bash"), Target: tmp.Join("home"), FS: tfs.FS}
+		p, err := loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Install())
+
+		tfs.assertLinks(t, tmp, Links{
+			"home/.bashrc":                      "state/bash/source/.bashrc",
+			"xdg/git/config":                    "state/bash/targets/config/source/git/config",
+			"xdg/git/ignore":                    "state/bash/targets/config/source/git/ignore",
+			"state/bash/targets/config/links/0": "state/bash/targets/config/target/git/config",
+		})
+
+		links, err := p.TargetLinks()
+		require.NoError(t, err)
+		require.Equal(t, []filesystem.Path{tmp.Join("home/.bashrc"), tmp.Join("xdg/git/config"), tmp.Join("xdg/git/ignore")}, links)
+
+		status, err := readStatus(tfs, loader.State)
+		require.NoError(t, err)
+		require.Empty(t, status.Drifted())
+
+		require.NoError(t, tfs.Remove(tmp.Join("xdg/git/ignore").String()))
+		status, err = readStatus(tfs, loader.State)
+		require.NoError(t, err)
+		require.Equal(t, []filesystem.Path{tmp.Join("xdg/git/ignore")}, status.Missing)
+
+		// Another package cannot link the same file into the other target
+		tfs.writeFile(t, tmp, "git/.config/git/config", "", 0644)
+		other := Loader{State: tmp.Join("state/git"), Source: tmp.Join("git"), Target: tmp.Join("home"), FS: tfs.FS}
+		tfs.writeManifest(t, tmp, "git/stowaway.toml", &Manifest{
+			Name:    "git",
+			Targets: []TargetSection{{Source: ".config", Target: tmp.Join("xdg").String()}},
+		})
+
+		o, err := other.Load()
+		require.NoError(t, err)
+		require.Equal(t, &CollisionError{Name: "git/config", Package: "git", Other: "bash"}, o.Install())
+
+		// The targets recorded in the state are uninstalled, even if the
+		// manifest no longer has them
+		tfs.writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{Name: "bash", Targets: []TargetSection{{Source: "home"}}})
+		p, err = loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Uninstall())
+		tfs.assertMissing(t, tmp, []string{"home/.bashrc", "xdg/git", "state/bash"})
+	})
+}
+
+func TestInstallTargetsUnset(t *testing.T) {
+	forEachFS(t, func(t *testing.T, tfs testFS) {
+		tmp := tfs.tmpDir(t, "targets_unset", []string{"bash/home/.bashrc", "bash/config/git/config", "home/", "xdg/", "state/"})
+		t.Setenv("DOTFILES_CONFIG", tmp.Join("xdg").String())
+
+		tfs.writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+			Name: "bash",
+			Targets: []TargetSection{
+				{Source: "config", Target: "$DOTFILES_CONFIG"},
+				{Source: "home"},
+			},
+		})
+
+		loader := Loader{State: tmp.Join("state/bash"), Source: tmp.Join("bash"), Target: tmp.Join("home"), FS: tfs.FS}
+		p, err := loader.Load()
+		require.NoError(t, err)
+		require.NoError(t, p.Install())
+
+		// A target that cannot be expanded anymore does not stop the package
+		// from being uninstalled from the targets it was installed into
+		t.Setenv("DOTFILES_CONFIG", "")
+		p, err = loader.Load()
+		require.NoError(t, err)
+
+		links, err := p.TargetLinks()
+		require.NoError(t, err)
+		require.Equal(t, []filesystem.Path{tmp.Join("home/.bashrc"), tmp.Join("xdg/git/config")}, links)
+
+		results, err := Stow(context.Background(), StowOptions{Delete: true}, p)
+		require.NoError(t, err)
+		require.NoError(t, results[0].Err)
+		tfs.assertMissing(t, tmp, []string{"home/.bashrc", "xdg/git", "state/bash"})
+
+		// Installing needs every target
+		_, err = p.SourceLinks()
+		require.ErrorIs(t, err, ErrInvalidTarget)
+		require.ErrorIs(t, p.Install(), ErrInvalidTarget)
+		tfs.assertMissing(t, tmp, []string{"home/.bashrc", "state/bash"})
+	})
+}
@@ -0,0 +1,392 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// UserStateDir returns the directory Stowaway keeps its own state in, which
+// is $XDG_STATE_HOME/stowaway, or ~/.local/state/stowaway if XDG_STATE_HOME
+// is not set.
+func UserStateDir() (filesystem.Path, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filesystem.MakePath(dir, "stowaway"), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filesystem.MakePath(home, ".local", "state", "stowaway"), nil
+}
+
+// TrustStorePath returns the location of the user's trust store.
+func TrustStorePath() (filesystem.Path, error) {
+	dir, err := UserStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	return dir.Join("trust.toml"), nil
+}
+
+// TrustStore records the hooks the user has approved. Each hook is
+// identified by the SHA-256 digest of everything that is run for it, so a
+// hook that changes must be approved again.
+type TrustStore struct {
+	// Path is the location the store is saved to
+	Path filesystem.Path `toml:"-"`
+
+	// Hooks maps the source of each package to the digests of its approved
+	// hooks, by hook name. See UntrustedHook.Source.
+	Hooks map[string]map[string]string `toml:"hooks"`
+}
+
+// LoadTrustStore reads the trust store at path. The store is empty if the
+// file does not exist.
+func LoadTrustStore(path filesystem.Path) (*TrustStore, error) {
+	store := &TrustStore{Path: path, Hooks: map[string]map[string]string{}}
+
+	exists, err := path.Exists()
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return store, nil
+	}
+
+	f, err := path.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	if err := toml.NewDecoder(f).DisallowUnknownFields().Decode(store); err != nil {
+		return nil, newManifestError(path, err)
+	}
+
+	if store.Hooks == nil {
+		store.Hooks = map[string]map[string]string{}
+	}
+
+	return store, nil
+}
+
+// Save writes the store to its path.
+func (s *TrustStore) Save() error {
+	w := bytes.NewBuffer([]byte{})
+	if err := toml.NewEncoder(w).Encode(s); err != nil {
+		return err
+	}
+
+	if err := s.Path.Parent().MkdirAll(0700); err != nil {
+		return err
+	}
+
+	return s.Path.WriteFile(w.Bytes(), 0600)
+}
+
+// Trusted reports whether the hook of the package from source with the given
+// digest has been approved. The second result is true if a different version
+// of the hook was approved.
+func (s *TrustStore) Trusted(source, hook, digest string) (trusted bool, changed bool) {
+	approved, ok := s.Hooks[source][hook]
+	if !ok {
+		return false, false
+	}
+
+	return approved == digest, approved != digest
+}
+
+// Trust approves the hook of the package from source with the given digest.
+func (s *TrustStore) Trust(source, hook, digest string) {
+	if s.Hooks[source] == nil {
+		s.Hooks[source] = map[string]string{}
+	}
+
+	s.Hooks[source][hook] = digest
+}
+
+// UntrustedHook describes a hook that has not been approved, or has changed
+// since it was approved.
+type UntrustedHook struct {
+	// Package is the name of the package the hook belongs to, or "" for the
+	// global hooks of a repository configuration file
+	Package string
+
+	// Root is the package root, or the path of the configuration file
+	Root filesystem.Path
+
+	// Source identifies the package in the trust store. It is the URL of
+	// remote packages and archives, and the package directory otherwise,
+	// which stay the same when the package is copied into the store.
+	Source string
+
+	Hook   string
+	Digest string
+
+	// Commands are the path of the hook executable and the inline commands
+	// that would be run
+	Commands []string
+
+	// Changed is true if a different version of the hook was approved
+	Changed bool
+}
+
+// UntrustedHookError is returned when a hook is not run because it has not
+// been approved.
+type UntrustedHookError struct {
+	UntrustedHook
+}
+
+// Owner describes what the hook belongs to, e.g. "package bash".
+func (h UntrustedHook) Owner() string {
+	if h.Package == "" {
+		return "configuration " + h.Root.String()
+	}
+
+	return "package " + h.Package
+}
+
+func (e *UntrustedHookError) Error() string {
+	if e.Changed {
+		return fmt.Sprintf("pkg: hook %s of %s has changed since it was trusted", e.Hook, e.Owner())
+	}
+
+	return fmt.Sprintf("pkg: hook %s of %s is not trusted", e.Hook, e.Owner())
+}
+
+// hookDigest returns the SHA-256 digest of everything that is run for the
+// named hook, or "" if the package has no such hook. This is the hook
+// executable, its inline commands and the environment of the hooks. Link
+// hooks include every [[hooks.link]] table and its patterns.
+func hookDigest(root filesystem.Path, m *Manifest, name string) (string, error) {
+	h := sha256.New()
+	empty := true
+
+	executable := root.Join(m.Hooks.Dir, name)
+	exists, err := executable.Exists()
+	if err != nil {
+		return "", err
+	}
+
+	if exists {
+		f, err := executable.Open()
+		if err != nil {
+			return "", err
+		}
+
+		defer f.Close()
+
+		fmt.Fprint(h, "file\x00")
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+
+		fmt.Fprint(h, "\x00")
+		empty = false
+	}
+
+	for _, command := range m.Hooks.Commands(name) {
+		fmt.Fprintf(h, "command\x00%s\x00", command)
+		empty = false
+	}
+
+	for _, link := range m.Hooks.Link {
+		for _, command := range link.commands(name) {
+			fmt.Fprintf(h, "link\x00%s\x00%s\x00", link.Match, command)
+			empty = false
+		}
+	}
+
+	if empty {
+		return "", nil
+	}
+
+	// The environment changes what the commands do, so a hook must be
+	// approved again when it changes
+	keys := make([]string, 0, len(m.Hooks.Env))
+	for key := range m.Hooks.Env {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(h, "env\x00%s=%s\x00", key, m.Hooks.Env[key])
+	}
+
+	if m.Hooks.CleanEnv {
+		fmt.Fprint(h, "clean_env\x00")
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HookDigests returns the digest of each hook of the package, by hook name.
+// Simple packages have no hooks.
+func (l Loader) HookDigests() (map[string]string, error) {
+	m, err := l.LoadManifest()
+	if err != nil || m == nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(knownHooks))
+	for name := range knownHooks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	digests := map[string]string{}
+	for _, name := range names {
+		digest, err := hookDigest(l.Source, m, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if digest != "" {
+			digests[name] = digest
+		}
+	}
+
+	return digests, nil
+}
+
+// checkTrust returns an UntrustedHookError if the hook is neither in the
+// trust store nor approved by the ApproveHook function in the hook context.
+// Approved hooks are saved to the trust store.
+func (pkg localPackage) checkTrust(name string, commands []string, hc HookContext) error {
+	if hc.Trust == nil {
+		return nil
+	}
+
+	digest, err := hookDigest(pkg.PackageRoot, pkg.Manifest, name)
+	if err != nil {
+		return err
+	}
+
+	source, err := pkg.trustSource()
+	if err != nil {
+		return err
+	}
+
+	return hc.checkTrust(UntrustedHook{
+		Package:  pkg.Name(),
+		Root:     pkg.PackageRoot,
+		Source:   source,
+		Hook:     name,
+		Digest:   digest,
+		Commands: commands,
+	})
+}
+
+// TrustChecker is implemented by packages whose hooks must be trusted before
+// they run. Stow checks every hook a package would run before changing
+// anything, so that a hook that is not trusted cannot leave the package
+// half stowed.
+type TrustChecker interface {
+	// CheckTrust returns an UntrustedHookError for the first of the named
+	// hooks that is neither trusted nor approved, like RunHookIfExists.
+	CheckTrust(hooks []string, hc HookContext) error
+}
+
+// CheckTrust implements TrustChecker. Link hooks are described by the
+// commands of every [[hooks.link]] table, whichever symlinks they match.
+func (pkg localPackage) CheckTrust(hooks []string, hc HookContext) error {
+	if pkg.Manifest == nil || hc.Trust == nil {
+		return nil
+	}
+
+	for _, name := range hooks {
+		var descriptions []string
+
+		executable := pkg.PackageRoot.Join(pkg.Manifest.Hooks.Dir, name)
+		exists, err := executable.Exists()
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			descriptions = append(descriptions, executable.String())
+		}
+
+		descriptions = append(descriptions, pkg.Manifest.Hooks.Commands(name)...)
+		for _, link := range pkg.Manifest.Hooks.Link {
+			descriptions = append(descriptions, link.commands(name)...)
+		}
+
+		if len(descriptions) == 0 {
+			continue
+		}
+
+		if err := pkg.checkTrust(name, descriptions, hc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trustSource returns the source the package's hooks are trusted for. The
+// origin is read from the package state if the package was not fetched,
+// extracted or copied just now.
+func (pkg localPackage) trustSource() (string, error) {
+	origin := pkg.Origin
+	if origin == nil {
+		var err error
+		origin, err = decodeOrigin(pkg.fs(), pkg.State.Join(originFile))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if origin != nil {
+		return origin.URL, nil
+	}
+
+	return pkg.PackageRoot.String(), nil
+}
+
+// checkTrust returns an UntrustedHookError if the hook with the digest is
+// neither in the trust store nor approved by ApproveHook. Approved hooks are
+// saved to the trust store. Every hook is trusted if there is no store.
+func (hc HookContext) checkTrust(hook UntrustedHook) error {
+	if hc.Trust == nil {
+		return nil
+	}
+
+	trusted, changed := hc.Trust.Trusted(hook.Source, hook.Hook, hook.Digest)
+	if trusted {
+		return nil
+	}
+
+	hook.Changed = changed
+	if hc.ApproveHook == nil {
+		return &UntrustedHookError{hook}
+	}
+
+	approved, err := hc.ApproveHook(hook)
+	if err != nil {
+		return err
+	}
+
+	if !approved {
+		return &UntrustedHookError{hook}
+	}
+
+	hc.Trust.Trust(hook.Source, hook.Hook, hook.Digest)
+	return hc.Trust.Save()
+}
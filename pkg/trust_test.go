@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserStateDir(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/state")
+	dir, err := UserStateDir()
+	require.NoError(t, err)
+	require.Equal(t, "/state/stowaway", dir.String())
+
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/user")
+	dir, err = UserStateDir()
+	require.NoError(t, err)
+	require.Equal(t, "/home/user/.local/state/stowaway", dir.String())
+}
+
+func TestRunHookTrust(t *testing.T) {
+	tmp := tmpDir(t, "trust", []string{"bash/src/", "home/user/"})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{AfterInstall: []string{"touch $STOWAWAY_TARGET/ran"}},
+	})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	store, err := LoadTrustStore(tmp.Join("state/trust.toml"))
+	require.NoError(t, err)
+
+	hc := HookContext{Operation: OperationInstall, Trust: store}
+	err = p.RunHookIfExists(context.Background(), HookAfterInstall, hc)
+
+	var untrusted *UntrustedHookError
+	require.ErrorAs(t, err, &untrusted)
+	require.False(t, untrusted.Changed)
+	require.Equal(t, []string{"touch $STOWAWAY_TARGET/ran"}, untrusted.Commands)
+	require.Equal(t, "pkg: hook after_install of package bash is not trusted", err.Error())
+	assertMissing(t, tmp, []string{"home/user/ran"})
+
+	// Approved hooks are saved to the store
+	asked := 0
+	hc.ApproveHook = func(hook UntrustedHook) (bool, error) {
+		asked++
+		return true, nil
+	}
+
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc))
+	require.NoError(t, p.RunHookIfExists(context.Background(), HookAfterInstall, hc))
+	require.Equal(t, 1, asked)
+
+	saved, err := LoadTrustStore(tmp.Join("state/trust.toml"))
+	require.NoError(t, err)
+
+	digests, err := loader.HookDigests()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{HookAfterInstall: saved.Hooks[tmp.Join("bash").String()][HookAfterInstall]}, digests)
+
+	// Changing the hook requires it to be approved again
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{AfterInstall: []string{"rm -rf $STOWAWAY_TARGET"}},
+	})
+
+	p, err = loader.Load()
+	require.NoError(t, err)
+
+	hc.ApproveHook = func(hook UntrustedHook) (bool, error) {
+		require.True(t, hook.Changed)
+		return false, nil
+	}
+
+	err = p.RunHookIfExists(context.Background(), HookAfterInstall, hc)
+	require.ErrorAs(t, err, &untrusted)
+	require.Equal(t, "pkg: hook after_install of package bash has changed since it was trusted", err.Error())
+}
+
+func TestStowTrust(t *testing.T) {
+	tmp := tmpDir(t, "trust_stow", []string{"bash/src/.bashrc", "home/user/"})
+	defer tmp.RemoveAll()
+
+	writeManifest(t, tmp, "bash/stowaway.toml", &Manifest{
+		Hooks: Hooks{
+			BeforeInstall: []string{"touch $STOWAWAY_TARGET/before"},
+			AfterInstall:  []string{"touch $STOWAWAY_TARGET/after"},
+		},
+	})
+
+	loader := Loader{
+		State:  tmp.Join("data"),
+		Target: tmp.Join("home/user"),
+		Source: tmp.Join("bash"),
+	}
+
+	p, err := loader.Load()
+	require.NoError(t, err)
+
+	store, err := LoadTrustStore(tmp.Join("state/trust.toml"))
+	require.NoError(t, err)
+
+	digest, err := hookDigest(tmp.Join("bash"), p.(*localPackage).Manifest, HookBeforeInstall)
+	require.NoError(t, err)
+	store.Trust(tmp.Join("bash").String(), HookBeforeInstall, digest)
+
+	// Nothing is changed when a hook that runs later is not trusted
+	results, err := Stow(context.Background(), StowOptions{Trust: store}, p)
+	require.ErrorIs(t, err, ErrStowFailed)
+
+	var untrusted *UntrustedHookError
+	require.ErrorAs(t, results[0].Err, &untrusted)
+	require.Equal(t, HookAfterInstall, untrusted.Hook)
+	assertMissing(t, tmp, []string{"home/user/.bashrc", "home/user/before", "data"})
+}
+
+func TestHookDigestEnv(t *testing.T) {
+	tmp := tmpDir(t, "trust_env", []string{"bash/"})
+	defer tmp.RemoveAll()
+
+	m := &Manifest{Hooks: Hooks{AfterInstall: []string{"echo $GREETING"}}}
+	digest, err := hookDigest(tmp.Join("bash"), m, HookAfterInstall)
+	require.NoError(t, err)
+
+	m.Hooks.Env = map[string]string{"GREETING": "hello", "PATH": "/bin"}
+	withEnv, err := hookDigest(tmp.Join("bash"), m, HookAfterInstall)
+	require.NoError(t, err)
+	require.NotEqual(t, digest, withEnv)
+
+	m.Hooks.Env["PATH"] = "/tmp"
+	changed, err := hookDigest(tmp.Join("bash"), m, HookAfterInstall)
+	require.NoError(t, err)
+	require.NotEqual(t, withEnv, changed)
+
+	m.Hooks.CleanEnv = true
+	clean, err := hookDigest(tmp.Join("bash"), m, HookAfterInstall)
+	require.NoError(t, err)
+	require.NotEqual(t, changed, clean)
+
+	// The environment alone is not a hook
+	digest, err = hookDigest(tmp.Join("bash"), m, HookBeforeInstall)
+	require.NoError(t, err)
+	require.Empty(t, digest)
+}
@@ -0,0 +1,1301 @@
+// Package stowaway is the library behind the stowaway command. It installs
+// and uninstalls packages in a target directory in the same way as the
+// command, so that other programs can embed Stowaway.
+package stowaway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+)
+
+// StateDirName is the name of the directory in the target directory that
+// held the state of every package installed there, before the state was
+// moved into the user's state directory. See Client.MigrateState.
+const StateDirName = ".stowaway"
+
+var (
+	// ErrNoPackages is returned when an operation that needs packages is
+	// given none
+	ErrNoPackages = errors.New("stowaway: no packages given")
+
+	// ErrFailed is returned by Install and Uninstall when at least one
+	// package failed. The results say which ones.
+	ErrFailed = pkg.ErrStowFailed
+
+	// ErrNoRemotePackages is returned by Update when it is given no packages
+	// and no remote packages are installed
+	ErrNoRemotePackages = errors.New("stowaway: no remote packages are installed")
+
+	// ErrNoSnapshot is returned by Rollback for a package that has no
+	// snapshot to roll back to
+	ErrNoSnapshot = errors.New("stowaway: no previous snapshot")
+)
+
+// PackageError is returned when a package cannot be loaded, e.g. because its
+// manifest is invalid.
+type PackageError struct {
+	Path filesystem.Path
+	Err  error
+}
+
+func (e *PackageError) Error() string {
+	return fmt.Sprintf("stowaway: package %s: %s", e.Path, e.Err)
+}
+
+func (e *PackageError) Unwrap() error {
+	return e.Err
+}
+
+// PackageID returns the identifier of the package at path, which names its
+// state directory. It is derived from the absolute path of the package.
+func PackageID(path filesystem.Path) string {
+	return pkg.PackageID(path)
+}
+
+// Client installs and uninstalls packages in a target directory.
+type Client struct {
+	// Target is the directory that symlinks are created in
+	Target filesystem.Path
+
+	// Dir is the directory relative package paths are resolved against. It
+	// defaults to the working directory.
+	Dir filesystem.Path
+
+	// CacheDir is the directory remote packages are fetched into. It
+	// defaults to the user's cache directory.
+	CacheDir filesystem.Path
+
+	// StoreDir is the directory package archives are extracted into. It
+	// defaults to the store in the user's data directory.
+	StoreDir filesystem.Path
+
+	// AllowedSigners is the allowed signers file that package archives must
+	// be signed by, see pkg.Archive. It defaults to the user's allowed
+	// signers file if it exists, see pkg.AllowedSignersPath. Archives do not
+	// need to be signed if there is none.
+	AllowedSigners filesystem.Path
+
+	// State is the directory that holds the state of every package
+	// installed in the target directory. It defaults to the directory for
+	// the target directory in the user's state directory. See
+	// pkg.DefaultStateDir.
+	State filesystem.Path
+}
+
+// Abs resolves the package path against the client's directory.
+func (c *Client) Abs(path string) (filesystem.Path, error) {
+	if filepath.IsAbs(path) {
+		return filesystem.MakePath(filepath.Clean(path)), nil
+	}
+
+	dir := c.Dir
+	if dir == "" {
+		pwd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+
+		dir = filesystem.MakePath(pwd)
+	}
+
+	return dir.Join(path), nil
+}
+
+// StateDir returns the directory that holds the state of every installed
+// package, as well as the logs. Without a home directory to find the user's
+// state directory in, the state is kept in the target directory.
+func (c *Client) StateDir() filesystem.Path {
+	if c.State != "" {
+		return c.State
+	}
+
+	dir, err := pkg.DefaultStateDir(c.Target)
+	if err != nil {
+		return c.Target.Join(StateDirName)
+	}
+
+	return dir
+}
+
+// MigrateState moves the state of the packages installed in the target
+// directory by older versions of Stowaway out of the target directory and
+// into the state directory. It returns false if there was nothing to move.
+func (c *Client) MigrateState() (bool, error) {
+	old := c.Target.Join(StateDirName)
+	if old == c.StateDir() {
+		return false, nil
+	}
+
+	migrated, err := pkg.MigrateStateDir(old, c.StateDir())
+	if err != nil || !migrated {
+		return migrated, err
+	}
+
+	// The store records the package states and generations using its
+	// entries by their paths, which have changed
+	states, err := pkg.ListStates(c.StateDir())
+	if err != nil {
+		return true, err
+	}
+
+	generations, err := c.Generations()
+	if err != nil {
+		return true, err
+	}
+
+	for _, generation := range generations {
+		states = append(states, pkg.GenerationPath(c.GenerationsDir(), generation.Number))
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return true, err
+	}
+
+	return true, store.Track(states...)
+}
+
+// PackageState returns the state directory of the package at the absolute
+// path.
+func (c *Client) PackageState(path filesystem.Path) filesystem.Path {
+	return c.StateDir().Join(PackageID(path))
+}
+
+func (c *Client) cacheDir() (filesystem.Path, error) {
+	if c.CacheDir != "" {
+		return c.CacheDir, nil
+	}
+
+	return pkg.UserCacheDir()
+}
+
+func (c *Client) store() (pkg.Store, error) {
+	if c.StoreDir != "" {
+		return pkg.Store{Dir: c.StoreDir}, nil
+	}
+
+	return pkg.DefaultStore()
+}
+
+func (c *Client) allowedSigners() (filesystem.Path, error) {
+	if c.AllowedSigners != "" {
+		return c.AllowedSigners, nil
+	}
+
+	path, err := pkg.AllowedSignersPath()
+	if err != nil {
+		return "", nil
+	}
+
+	if exists, err := path.Exists(); err != nil || !exists {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// source is where a package is loaded from
+type source struct {
+	// dir is the package directory that was given, whose repository
+	// configuration file applies to the package
+	dir filesystem.Path
+
+	// root is the package root, which is in the store for archives and
+	// snapshots
+	root filesystem.Path
+
+	// state is the package state directory
+	state filesystem.Path
+
+	// origin is the remote package, archive or snapshot the package came
+	// from, if it was fetched, extracted or copied
+	origin *pkg.Origin
+}
+
+// resolve returns where the package at path is loaded from. If fetch is set,
+// remote packages are fetched into the cache and exported into the store and
+// archives are extracted into the store first, and their origin is returned
+// as well. Otherwise packages installed from the store are loaded from the
+// store entry they were installed from.
+func (c *Client) resolve(ctx context.Context, path string, fetch bool) (source, error) {
+	if pkg.IsArchive(path) {
+		return c.resolveArchive(path, fetch)
+	}
+
+	if pkg.IsRemote(path) {
+		return c.resolveRemote(ctx, path, fetch)
+	}
+
+	abs, err := c.Abs(path)
+	if err != nil {
+		return source{}, err
+	}
+
+	src := source{dir: abs, root: abs, state: c.PackageState(abs)}
+
+	if !fetch {
+		root, err := c.storedRoot(src.state)
+		if err != nil {
+			return source{}, err
+		}
+
+		if root != "" {
+			src.root = root
+		}
+	}
+
+	return src, nil
+}
+
+// resolveRemote resolves a remote package. Its state directory is named
+// after the package's directory in the clone of the repository, while the
+// package itself is installed from the files of the fetched commit, which
+// are exported into the store. The package keeps using the entry of the
+// commit it was installed from until another commit has been installed.
+func (c *Client) resolveRemote(ctx context.Context, path string, fetch bool) (source, error) {
+	remote, err := pkg.ParseRemote(path)
+	if err != nil {
+		return source{}, err
+	}
+
+	cache, err := c.cacheDir()
+	if err != nil {
+		return source{}, err
+	}
+
+	dir := remote.Dir(cache)
+	src := source{dir: dir, root: dir, state: c.PackageState(dir)}
+
+	if !fetch {
+		root, err := c.storedRoot(src.state)
+		if err != nil {
+			return source{}, err
+		}
+
+		if root != "" {
+			src.dir, src.root = root, root
+		}
+
+		return src, nil
+	}
+
+	commit, err := remote.Fetch(ctx, cache)
+	if err != nil {
+		return source{}, &PackageError{Path: filesystem.Path(path), Err: err}
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return source{}, err
+	}
+
+	root, err := remote.Export(ctx, cache, store, commit)
+	if err != nil {
+		return source{}, &PackageError{Path: filesystem.Path(path), Err: err}
+	}
+
+	src.dir, src.root = root, root
+	src.origin = &pkg.Origin{URL: remote.String(), Commit: commit}
+	return src, nil
+}
+
+// storedRoot returns the package root in the store that the package state
+// was installed from, or an empty path if it was not installed from the
+// store.
+func (c *Client) storedRoot(state filesystem.Path) (filesystem.Path, error) {
+	root, err := state.Join("root").Readlink()
+	if err != nil {
+		return "", nil
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := store.EntryOf(root); !ok {
+		return "", nil
+	}
+
+	return root, nil
+}
+
+// resolveArchive resolves a package archive. Its state directory is named
+// after the archive, so that extracting a new version of the archive
+// replaces the package installed from the old one.
+func (c *Client) resolveArchive(path string, fetch bool) (source, error) {
+	archive, err := pkg.ParseArchive(path)
+	if err != nil {
+		return source{}, err
+	}
+
+	abs, err := c.Abs(archive.Path)
+	if err != nil {
+		return source{}, err
+	}
+
+	archive.Path = abs.String()
+	src := source{state: c.PackageState(abs)}
+
+	if !fetch {
+		src.root, err = c.storedRoot(src.state)
+		if err != nil {
+			return source{}, err
+		}
+
+		if src.root == "" {
+			return source{}, &PackageError{Path: abs, Err: pkg.ErrPackageNotInstalled}
+		}
+
+		src.dir = src.root
+		return src, nil
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return source{}, err
+	}
+
+	archive.AllowedSigners, err = c.allowedSigners()
+	if err != nil {
+		return source{}, err
+	}
+
+	var checksum string
+	src.root, checksum, err = archive.Extract(store)
+	if err != nil {
+		return source{}, &PackageError{Path: abs, Err: err}
+	}
+
+	src.dir = src.root
+	src.origin = &pkg.Origin{URL: abs.String(), Checksum: checksum}
+	return src, nil
+}
+
+// maxPrevious is the number of earlier snapshots of a package that are kept
+// in the store so that it can be rolled back
+const maxPrevious = 5
+
+// snapshot copies the package into the store, so that it is installed from
+// the snapshot instead of the package directory. The snapshot the package is
+// currently installed from is kept as the previous one.
+func (c *Client) snapshot(src source) (source, error) {
+	store, err := c.store()
+	if err != nil {
+		return source{}, err
+	}
+
+	root, name, err := store.Snapshot(src.dir)
+	if err != nil {
+		return source{}, &PackageError{Path: src.dir, Err: err}
+	}
+
+	origin := pkg.Origin{URL: src.dir.String()}
+	if src.origin != nil {
+		origin = *src.origin
+	}
+
+	origin.Snapshot = name
+	origin.Previous = nil
+
+	status, err := pkg.ReadStatus(src.state)
+	if err == nil && status.Origin != nil && status.Origin.Snapshot != "" {
+		previous := append([]string{status.Origin.Snapshot}, status.Origin.Previous...)
+		for _, entry := range previous {
+			if entry != name && len(origin.Previous) < maxPrevious {
+				origin.Previous = append(origin.Previous, entry)
+			}
+		}
+	}
+
+	src.root = root
+	src.origin = &origin
+	return src, nil
+}
+
+// Load loads the packages at the given paths. Remote packages are fetched
+// into the cache and exported into the store, and archives are extracted into
+// the store. Entries that are not installed afterwards are removed from the
+// store by GC.
+func (c *Client) Load(ctx context.Context, paths ...string) ([]pkg.Package, error) {
+	sources, err := c.resolveAll(ctx, true, false, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.load(sources, Options{}, false)
+}
+
+// PackageHooks are the hooks of a package and of its repository
+// configuration, which must be trusted before they run.
+type PackageHooks struct {
+	// Source identifies the package in the trust store. See
+	// pkg.UntrustedHook.
+	Source string
+
+	// Digests are the digests of the package's hooks, by hook name
+	Digests map[string]string
+
+	// Config is the repository configuration of the package, or nil if
+	// there is none
+	Config *pkg.Config
+}
+
+// Hooks returns the hooks of the package at path. Remote packages are fetched
+// and archives are extracted first, like Load does.
+func (c *Client) Hooks(ctx context.Context, path string) (PackageHooks, error) {
+	src, err := c.resolve(ctx, path, true)
+	if err != nil {
+		return PackageHooks{}, err
+	}
+
+	hooks := PackageHooks{Source: src.dir.String()}
+	if src.origin != nil {
+		hooks.Source = src.origin.URL
+	}
+
+	loader := pkg.Loader{Source: src.root}
+	hooks.Digests, err = loader.HookDigests()
+	if err != nil {
+		return PackageHooks{}, &PackageError{Path: src.root, Err: err}
+	}
+
+	hooks.Config, err = pkg.LoadConfig(src.dir.Parent().Join(pkg.RepositoryConfigName))
+	if err != nil {
+		return PackageHooks{}, err
+	}
+
+	return hooks, nil
+}
+
+// resolveAll resolves the packages at the given paths, taking a snapshot of
+// each package directory if snapshot is set.
+func (c *Client) resolveAll(ctx context.Context, fetch, snapshot bool, paths []string) ([]source, error) {
+	var sources []source
+	for _, path := range paths {
+		src, err := c.resolve(ctx, path, fetch)
+		if err != nil {
+			return nil, err
+		}
+
+		if snapshot && !pkg.IsArchive(path) {
+			src, err = c.snapshot(src)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// load loads the packages from where they were resolved. If delete is set,
+// the packages are only loaded to be uninstalled.
+func (c *Client) load(sources []source, options Options, delete bool) ([]pkg.Package, error) {
+	var packages []pkg.Package
+	for _, src := range sources {
+		loader := pkg.Loader{
+			State:       src.state,
+			Source:      src.root,
+			Target:      c.Target,
+			Origin:      src.origin,
+			Conflict:    options.Conflict,
+			AskConflict: options.AskConflict,
+			Backups:     c.BackupsDir(),
+			Uninstall:   delete,
+		}
+
+		p, err := loader.Load()
+		if err != nil {
+			return nil, &PackageError{Path: src.root, Err: err}
+		}
+
+		packages = append(packages, p)
+	}
+
+	return packages, nil
+}
+
+// track records which store entries the packages use now, removing the
+// entries that are no longer used, including the ones that were extracted or
+// copied but not installed.
+func (c *Client) track(sources []source) error {
+	store, err := c.store()
+	if err != nil {
+		return err
+	}
+
+	var states []filesystem.Path
+	var entries []string
+	for _, src := range sources {
+		states = append(states, src.state)
+		if name, ok := store.EntryOf(src.root); ok {
+			entries = append(entries, name)
+		}
+	}
+
+	if err := store.Track(states...); err != nil {
+		return err
+	}
+
+	return store.Prune(entries...)
+}
+
+// discard removes the store entries the sources were resolved to that no
+// package state uses, without recording anything in the store
+func (c *Client) discard(sources []source) error {
+	store, err := c.store()
+	if err != nil {
+		return err
+	}
+
+	var entries []string
+	for _, src := range sources {
+		if name, ok := store.EntryOf(src.root); ok {
+			entries = append(entries, name)
+		}
+	}
+
+	return store.Prune(entries...)
+}
+
+// Options control how packages are installed and uninstalled.
+type Options struct {
+	// DryRun skips making any changes to the target directory. Hooks are
+	// not run either.
+	DryRun bool
+
+	// Output receives a description of each change made and each hook run
+	// during a dry run
+	Output io.Writer
+
+	// HookOutput receives the output of every hook
+	HookOutput io.Writer
+
+	// HookFailure is the failure policy for hooks without one in their
+	// manifest
+	HookFailure Policy
+
+	// Sandbox runs hooks in a sandbox. See pkg.HookContext. The sandbox is
+	// set up by starting the current executable as a helper, so programs
+	// that set it must call SandboxHelper first thing in main. Hooks fail
+	// with pkg.ErrNoSandboxHelper otherwise, or run without a sandbox if
+	// AllowUnsandboxed is set.
+	Sandbox          bool
+	AllowUnsandboxed bool
+
+	// Trust is the store of approved hooks. It defaults to the user's trust
+	// store. Hooks that are not in it fail, unless ApproveHook approves them
+	// or TrustAll is set.
+	Trust       *TrustStore
+	ApproveHook func(UntrustedHook) (bool, error)
+	TrustAll    bool
+
+	// Store installs packages in store mode, from a snapshot of the package
+	// copied into the store, so that changing the package directory does not
+	// change the installed package until it is installed again
+	Store bool
+
+	// Conflict is the strategy for files in the target directory that are
+	// in the way of the symlinks, unless the package manifest has a conflict
+	// rule for them. It defaults to pkg.ConflictFail. Files replaced with
+	// pkg.ConflictBackup are moved into the backups directory, and put back
+	// when the package is uninstalled. AskConflict is asked for the strategy
+	// for the files whose strategy is pkg.ConflictAsk.
+	Conflict    ConflictStrategy
+	AskConflict func(UnresolvedConflict) (ConflictStrategy, error)
+}
+
+// Install installs the packages at the given paths, reinstalling any that
+// are already installed. Remote packages are fetched first, and archives are
+// extracted into the store, where they are kept while they are installed or
+// in a generation.
+// The global hooks from the user's configuration file and the repository
+// configuration files are run as well. The result for each package is
+// returned, along with ErrFailed if any of them failed.
+func (c *Client) Install(ctx context.Context, options Options, paths ...string) ([]Result, error) {
+	return c.stow(ctx, options, false, paths)
+}
+
+// Uninstall uninstalls the packages at the given paths, like Install.
+// Remote packages and archives are uninstalled from the store entry they were
+// installed from without fetching them, which is removed afterwards unless a
+// package or generation uses it.
+func (c *Client) Uninstall(ctx context.Context, options Options, paths ...string) ([]Result, error) {
+	return c.stow(ctx, options, true, paths)
+}
+
+func (c *Client) stow(ctx context.Context, options Options, delete bool, paths []string) ([]Result, error) {
+	if len(paths) == 0 {
+		return nil, ErrNoPackages
+	}
+
+	sources, err := c.resolveAll(ctx, !delete, options.Store && !delete, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := c.stowSources(ctx, options, delete, sources)
+	return c.record(options, results, err)
+}
+
+func (c *Client) stowSources(ctx context.Context, options Options, delete bool, sources []source) ([]Result, error) {
+	packages, err := c.load(sources, options, delete)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []filesystem.Path
+	for _, src := range sources {
+		dirs = append(dirs, src.dir)
+	}
+
+	configs, err := pkg.LoadConfigs(dirs...)
+	if err != nil {
+		return nil, err
+	}
+
+	stowOptions := pkg.StowOptions{
+		Delete:           delete,
+		DryRun:           options.DryRun,
+		Output:           options.Output,
+		HookOutput:       options.HookOutput,
+		HookFailure:      options.HookFailure,
+		Configs:          configs,
+		Sandbox:          options.Sandbox,
+		AllowUnsandboxed: options.AllowUnsandboxed,
+	}
+
+	if !options.TrustAll {
+		stowOptions.Trust = options.Trust
+		if stowOptions.Trust == nil {
+			path, err := pkg.TrustStorePath()
+			if err != nil {
+				return nil, err
+			}
+
+			stowOptions.Trust, err = pkg.LoadTrustStore(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		stowOptions.ApproveHook = options.ApproveHook
+	}
+
+	results, err := pkg.Stow(ctx, stowOptions, packages...)
+	if err := c.track(sources); err != nil {
+		return results, err
+	}
+
+	return results, err
+}
+
+// maxGenerations is the number of generations that are kept in the state
+// directory
+const maxGenerations = 10
+
+// GenerationsDir returns the directory in the state directory that holds
+// the generations of the target directory.
+func (c *Client) GenerationsDir() filesystem.Path {
+	return c.StateDir().Join("generations")
+}
+
+// Generations returns the generations of the target directory, oldest first.
+// A generation is recorded each time packages are installed, uninstalled or
+// rolled back successfully, and the most recent ones are kept.
+func (c *Client) Generations() ([]pkg.Generation, error) {
+	return pkg.ReadGenerations(c.GenerationsDir())
+}
+
+// record records a generation if the operation succeeded and was not a dry
+// run. It returns the results and error of the operation otherwise.
+func (c *Client) record(options Options, results []Result, err error) ([]Result, error) {
+	if err != nil || options.DryRun {
+		return results, err
+	}
+
+	states, err := pkg.ListStates(c.StateDir())
+	if err != nil && !os.IsNotExist(err) {
+		return results, err
+	}
+
+	generation, err := pkg.NewGeneration(c.Target, states)
+	if err != nil {
+		return results, err
+	}
+
+	generations, err := c.Generations()
+	if err != nil {
+		return results, err
+	}
+
+	generation.Number = 1
+	if len(generations) > 0 {
+		generation.Number = generations[len(generations)-1].Number + 1
+	}
+
+	if err := pkg.WriteGeneration(c.GenerationsDir(), generation); err != nil {
+		return results, err
+	}
+
+	// The oldest generations are removed, along with the store entries
+	// that only they used
+	changed := []filesystem.Path{pkg.GenerationPath(c.GenerationsDir(), generation.Number)}
+	for len(generations) >= maxGenerations {
+		path := pkg.GenerationPath(c.GenerationsDir(), generations[0].Number)
+		if err := path.Remove(); err != nil {
+			return results, err
+		}
+
+		changed = append(changed, path)
+		generations = generations[1:]
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return results, err
+	}
+
+	return results, store.Track(changed...)
+}
+
+// RestoreGeneration returns the target directory to the generation with the
+// given number, or to the generation before the most recent one if it is
+// zero. Packages that are not in the generation are uninstalled, and the
+// packages in it are reinstalled from the package roots they were installed
+// from, with remote packages checked out at the commit they were installed
+// at. A new generation is recorded afterwards, like for Install.
+func (c *Client) RestoreGeneration(ctx context.Context, options Options, number int) ([]Result, error) {
+	generations, err := c.Generations()
+	if err != nil {
+		return nil, err
+	}
+
+	if number == 0 {
+		if len(generations) < 2 {
+			return nil, fmt.Errorf("%w: no generation before the current one", pkg.ErrGenerationNotFound)
+		}
+
+		number = generations[len(generations)-2].Number
+	}
+
+	var generation *pkg.Generation
+	for i := range generations {
+		if generations[i].Number == number {
+			generation = &generations[i]
+		}
+	}
+
+	if generation == nil {
+		return nil, fmt.Errorf("%w: %d", pkg.ErrGenerationNotFound, number)
+	}
+
+	var install []source
+	keep := map[string]bool{}
+	for _, p := range generation.Packages {
+		src, err := c.restoreSource(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+
+		install = append(install, src)
+		keep[p.State] = true
+	}
+
+	installed, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var uninstall []source
+	for _, p := range installed {
+		if keep[p.State.Basename()] {
+			continue
+		}
+
+		status, err := pkg.ReadStatus(p.State)
+		if err != nil {
+			return nil, err
+		}
+
+		uninstall = append(uninstall, source{dir: status.Root, root: status.Root, state: p.State})
+	}
+
+	var results []Result
+	if len(uninstall) > 0 {
+		results, err = c.stowSources(ctx, options, true, uninstall)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	if len(install) > 0 {
+		installResults, err := c.stowSources(ctx, options, false, install)
+		results = append(results, installResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	return c.record(options, results, nil)
+}
+
+// restoreSource returns where the package in a generation is reinstalled
+// from
+func (c *Client) restoreSource(ctx context.Context, p pkg.GenerationPackage) (source, error) {
+	root := filesystem.Path(p.Root)
+	src := source{dir: root, root: root, state: c.StateDir().Join(p.State), origin: p.Origin}
+
+	store, err := c.store()
+	if err != nil {
+		return source{}, err
+	}
+
+	// Remote packages that were installed from a checkout in the cache are
+	// exported into the store at the commit instead
+	_, stored := store.EntryOf(root)
+	if p.Origin != nil && p.Origin.Commit != "" && pkg.IsRemote(p.Origin.URL) && !stored {
+		remote, err := pkg.ParseRemote(p.Origin.URL)
+		if err != nil {
+			return source{}, err
+		}
+
+		cache, err := c.cacheDir()
+		if err != nil {
+			return source{}, err
+		}
+
+		root, err = remote.Export(ctx, cache, store, p.Origin.Commit)
+		if err != nil {
+			return source{}, &PackageError{Path: src.root, Err: err}
+		}
+
+		src.dir, src.root = root, root
+	}
+
+	exists, err := root.Exists()
+	if err != nil {
+		return source{}, err
+	}
+
+	if !exists {
+		return source{}, &PackageError{Path: root, Err: fs.ErrNotExist}
+	}
+
+	return src, nil
+}
+
+// Installed is a package installed in the target directory.
+type Installed struct {
+	// State is the package state directory
+	State filesystem.Path
+
+	// Source is the directory the symlinks point into
+	Source filesystem.Path
+}
+
+// List returns the packages installed in the target directory, sorted by
+// their source.
+func (c *Client) List() ([]Installed, error) {
+	states, err := pkg.ListStates(c.StateDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var installed []Installed
+	for _, state := range states {
+		source, err := state.Join("source").Readlink()
+		if err != nil {
+			return nil, err
+		}
+
+		installed = append(installed, Installed{State: state, Source: source})
+	}
+
+	sort.Slice(installed, func(i, j int) bool {
+		return installed[i].Source < installed[j].Source
+	})
+
+	return installed, nil
+}
+
+// Status returns the status of each package installed in the target
+// directory, in the same order as List. The upstream commit of each remote
+// package is looked up in its repository, and left empty if the repository
+// cannot be reached.
+func (c *Client) Status(ctx context.Context) ([]pkg.Status, error) {
+	installed, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]pkg.Status, len(installed))
+	for i, p := range installed {
+		statuses[i], err = pkg.ReadStatus(p.State)
+		if err != nil {
+			return nil, err
+		}
+
+		if origin := statuses[i].Origin; origin != nil && pkg.IsRemote(origin.URL) {
+			remote, err := pkg.ParseRemote(origin.URL)
+			if err != nil {
+				return nil, err
+			}
+
+			statuses[i].Upstream, _ = remote.Upstream(ctx)
+		}
+	}
+
+	return statuses, nil
+}
+
+// Update fetches the remote packages with the given URLs and reinstalls
+// them, like Install. If no URLs are given, every remote package installed in
+// the target directory is updated.
+func (c *Client) Update(ctx context.Context, options Options, urls ...string) ([]Result, error) {
+	if len(urls) == 0 {
+		installed, err := c.List()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range installed {
+			status, err := pkg.ReadStatus(p.State)
+			if err != nil {
+				return nil, err
+			}
+
+			if status.Origin != nil && pkg.IsRemote(status.Origin.URL) {
+				urls = append(urls, status.Origin.URL)
+			}
+		}
+
+		if len(urls) == 0 {
+			return nil, ErrNoRemotePackages
+		}
+	}
+
+	return c.Install(ctx, options, urls...)
+}
+
+// Rollback reinstalls the packages at the given paths from the snapshot they
+// were installed from before they were last installed in store mode, like
+// Install. The package directory is not used, so a package can be rolled
+// back after it has been changed.
+func (c *Client) Rollback(ctx context.Context, options Options, paths ...string) ([]Result, error) {
+	if len(paths) == 0 {
+		return nil, ErrNoPackages
+	}
+
+	store, err := c.store()
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []source
+	for _, path := range paths {
+		src, err := c.resolve(ctx, path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		status, err := pkg.ReadStatus(src.state)
+		if err != nil {
+			return nil, &PackageError{Path: src.dir, Err: pkg.ErrPackageNotInstalled}
+		}
+
+		if status.Origin == nil || len(status.Origin.Previous) == 0 {
+			return nil, &PackageError{Path: src.dir, Err: ErrNoSnapshot}
+		}
+
+		origin := *status.Origin
+		origin.Snapshot, origin.Previous = origin.Previous[0], origin.Previous[1:]
+
+		src.root, err = store.Root(origin.Snapshot)
+		if err != nil {
+			return nil, &PackageError{Path: src.dir, Err: err}
+		}
+
+		src.origin = &origin
+		sources = append(sources, src)
+	}
+
+	results, err := c.stowSources(ctx, options, false, sources)
+	return c.record(options, results, err)
+}
+
+// GC removes the entries from the store that no installed package uses, in
+// any target directory, and returns their names. Entries are normally
+// removed when the packages using them are uninstalled, but not when their
+// target directory or package state is removed by other means.
+func (c *Client) GC() ([]string, error) {
+	store, err := c.store()
+	if err != nil {
+		return nil, err
+	}
+
+	return store.GC()
+}
+
+// BackupsDir returns the directory in the state directory that holds the
+// files replaced by installing packages with pkg.ConflictBackup.
+func (c *Client) BackupsDir() filesystem.Path {
+	return c.StateDir().Join(pkg.BackupsDirName)
+}
+
+// Backup is a file replaced by installing a package.
+type Backup struct {
+	pkg.Backup
+
+	// Package is the installed package that restores the backup when it is
+	// uninstalled. It is nil if no installed package does, e.g. because
+	// something else had taken the file's place when the package was
+	// uninstalled.
+	Package *Installed
+
+	// Target is the directory the file is restored into. It is the target
+	// directory unless the backup belongs to another target section of the
+	// package.
+	Target filesystem.Path
+
+	// state is the state directory of the target section of the package
+	// that restores the backup
+	state filesystem.Path
+}
+
+// Backups returns every backup in the target directory, oldest first.
+func (c *Client) Backups() ([]Backup, error) {
+	installed, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[pkg.Backup]Backup{}
+	for i := range installed {
+		states, err := pkg.TargetStates(installed[i].State)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, state := range states {
+			target, err := state.Join("target").Readlink()
+			if err != nil {
+				return nil, err
+			}
+
+			backups, err := pkg.ReadBackups(state)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, backup := range backups {
+				owners[backup] = Backup{Backup: backup, Package: &installed[i], Target: target, state: state}
+			}
+		}
+	}
+
+	found, err := pkg.ListBackups(c.BackupsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, len(found))
+	for i, backup := range found {
+		owner, ok := owners[backup]
+		if !ok {
+			owner = Backup{Backup: backup, Target: c.Target}
+		}
+
+		backups[i] = owner
+	}
+
+	return backups, nil
+}
+
+// RestoreBackup puts the files in the backup with the given ID back into the
+// target directory, or only the ones with the given names relative to the
+// target directory. Nothing may be in their place. The restored files are
+// returned, even if restoring another one failed.
+func (c *Client) RestoreBackup(id string, names ...string) ([]pkg.Backup, error) {
+	backups, err := c.Backups()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []Backup
+	for _, backup := range backups {
+		if backup.ID == id {
+			selected = append(selected, backup)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("%w: %s", pkg.ErrBackupNotFound, id)
+	}
+
+	if len(names) > 0 {
+		byName := map[string]Backup{}
+		for _, backup := range selected {
+			byName[backup.Name] = backup
+		}
+
+		selected = nil
+		for _, name := range names {
+			backup, ok := byName[filepath.ToSlash(filepath.Clean(name))]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", pkg.ErrBackupNotFound, pkg.Backup{ID: id, Name: name})
+			}
+
+			selected = append(selected, backup)
+		}
+	}
+
+	var restored []pkg.Backup
+	for _, backup := range selected {
+		if err := pkg.RestoreBackup(c.BackupsDir(), backup.Target, backup.Backup); err != nil {
+			return restored, err
+		}
+
+		if err := c.forgetBackup(backup); err != nil {
+			return restored, err
+		}
+
+		restored = append(restored, backup.Backup)
+	}
+
+	return restored, nil
+}
+
+// forgetBackup removes the backup from the package that would restore it.
+func (c *Client) forgetBackup(backup Backup) error {
+	if backup.Package == nil {
+		return nil
+	}
+
+	recorded, err := pkg.ReadBackups(backup.state)
+	if err != nil {
+		return err
+	}
+
+	var kept []pkg.Backup
+	for _, b := range recorded {
+		if b != backup.Backup {
+			kept = append(kept, b)
+		}
+	}
+
+	return pkg.WriteBackups(backup.state, kept)
+}
+
+// PruneBackups deletes the backups that no installed package restores when
+// it is uninstalled, and returns them.
+func (c *Client) PruneBackups() ([]pkg.Backup, error) {
+	backups, err := c.Backups()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []pkg.Backup
+	for _, backup := range backups {
+		if backup.Package != nil {
+			continue
+		}
+
+		if err := pkg.RemoveBackup(c.BackupsDir(), backup.Backup); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, backup.Backup)
+	}
+
+	return removed, nil
+}
+
+// Plan describes what installing or uninstalling a package would change.
+type Plan struct {
+	Package pkg.Package
+
+	// Installed is true if the package is currently installed
+	Installed bool
+
+	// Remove are the symlinks that would be removed, because the package is
+	// installed
+	Remove []filesystem.Path
+
+	// Create are the symlinks that would be created. It is empty when
+	// uninstalling.
+	Create []filesystem.Path
+}
+
+// Plan returns what installing the packages at the given paths would change,
+// or uninstalling them if delete is set, without changing the target
+// directory or running any hooks. Remote packages are fetched when
+// installing, and archives are extracted, but they are removed from the store
+// again unless a package uses them already.
+func (c *Client) Plan(ctx context.Context, delete bool, paths ...string) ([]Plan, error) {
+	if len(paths) == 0 {
+		return nil, ErrNoPackages
+	}
+
+	sources, err := c.resolveAll(ctx, !delete, false, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	plans, err := c.plan(sources, delete)
+	if discardErr := c.discard(sources); discardErr != nil && err == nil {
+		return nil, discardErr
+	}
+
+	return plans, err
+}
+
+// plan returns what stowing the sources would change
+func (c *Client) plan(sources []source, delete bool) ([]Plan, error) {
+	packages, err := c.load(sources, Options{}, delete)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := make([]Plan, len(packages))
+	for i, p := range packages {
+		plans[i].Package = p
+
+		plans[i].Installed, err = p.Installed()
+		if err != nil {
+			return nil, err
+		}
+
+		if plans[i].Installed {
+			plans[i].Remove, err = p.TargetLinks()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !delete {
+			plans[i].Create, err = p.SourceLinks()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plans, nil
+}
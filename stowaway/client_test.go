@@ -0,0 +1,600 @@
+package stowaway
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+func tmpDir(t *testing.T, paths ...string) filesystem.Path {
+	dir := filesystem.MakePath(t.TempDir())
+
+	for _, path := range paths {
+		full := dir.Join(path)
+		if path[len(path)-1] == '/' {
+			require.NoError(t, full.MkdirAll(0755))
+			continue
+		}
+
+		require.NoError(t, full.Parent().MkdirAll(0755))
+		require.NoError(t, full.WriteFile([]byte{}, 0644))
+	}
+
+	t.Setenv("XDG_STATE_HOME", dir.Join("state").String())
+	t.Setenv("XDG_CONFIG_HOME", dir.Join("config").String())
+	t.Setenv("XDG_CACHE_HOME", dir.Join("cache").String())
+	t.Setenv("XDG_DATA_HOME", dir.Join("data").String())
+
+	return dir
+}
+
+func TestPackageID(t *testing.T) {
+	require.Equal(t, "37bc12", PackageID("/home/me/stowaway/examples/bash"))
+}
+
+func TestClient(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/git/.gitconfig", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp.Join("dotfiles")}
+
+	ctx := context.Background()
+	_, err := client.Install(ctx, Options{})
+	require.ErrorIs(t, err, ErrNoPackages)
+
+	installed, err := client.List()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+
+	plans, err := client.Plan(ctx, false, "bash")
+	require.NoError(t, err)
+	require.Len(t, plans, 1)
+	require.False(t, plans[0].Installed)
+	require.Empty(t, plans[0].Remove)
+	require.Equal(t, []filesystem.Path{tmp.Join("home/.bashrc")}, plans[0].Create)
+
+	results, err := client.Install(context.Background(), Options{}, "git", tmp.Join("dotfiles/bash").String())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "git", results[0].Package.Name())
+
+	link, err := tmp.Join("home/.bashrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, client.PackageState(tmp.Join("dotfiles/bash")).Join("source/.bashrc"), link)
+
+	installed, err = client.List()
+	require.NoError(t, err)
+	require.Equal(t, []Installed{
+		{State: client.PackageState(tmp.Join("dotfiles/bash")), Source: tmp.Join("dotfiles/bash")},
+		{State: client.PackageState(tmp.Join("dotfiles/git")), Source: tmp.Join("dotfiles/git")},
+	}, installed)
+
+	statuses, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	require.Equal(t, "bash", statuses[0].Name())
+	require.Equal(t, "installed", statuses[0].String())
+
+	plans, err = client.Plan(ctx, true, "bash")
+	require.NoError(t, err)
+	require.True(t, plans[0].Installed)
+	require.Equal(t, []filesystem.Path{tmp.Join("home/.bashrc")}, plans[0].Remove)
+	require.Empty(t, plans[0].Create)
+
+	_, err = client.Uninstall(context.Background(), Options{}, "bash", "git")
+	require.NoError(t, err)
+
+	installed, err = client.List()
+	require.NoError(t, err)
+	require.Empty(t, installed)
+}
+
+func TestClientErrors(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp.Join("dotfiles")}
+
+	manifest := "name = \"bash\"\n[hooks]\nafter_install = [\"true\"]\n"
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte(manifest), 0644))
+
+	// Hooks that are not trusted fail, like they do in the command
+	results, err := client.Install(context.Background(), Options{}, "bash")
+	require.ErrorIs(t, err, ErrFailed)
+
+	var untrusted *pkg.UntrustedHookError
+	require.ErrorAs(t, results[0].Err, &untrusted)
+
+	_, err = client.Install(context.Background(), Options{TrustAll: true}, "bash")
+	require.NoError(t, err)
+
+	// Hooks cannot be sandboxed without the sandbox helper, which the tests
+	// do not set up
+	results, err = client.Install(context.Background(), Options{TrustAll: true, Sandbox: true}, "bash")
+	require.ErrorIs(t, err, ErrFailed)
+	require.ErrorIs(t, results[0].Err, pkg.ErrNoSandboxHelper)
+
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte("name = 1\n"), 0644))
+
+	_, err = client.Install(context.Background(), Options{}, "bash")
+	var packageErr *PackageError
+	require.ErrorAs(t, err, &packageErr)
+	require.Equal(t, tmp.Join("dotfiles/bash"), packageErr.Path)
+	require.ErrorIs(t, err, pkg.ErrInvalidManifest)
+}
+
+func gitCommit(t *testing.T, repo filesystem.Path, files ...string) {
+	require.NoError(t, repo.MkdirAll(0755))
+
+	for _, file := range files {
+		require.NoError(t, repo.Join(file).Parent().MkdirAll(0755))
+		require.NoError(t, repo.Join(file).WriteFile([]byte(file), 0644))
+	}
+
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "--all"}, {"commit", "--quiet", "--message", "commit"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo.String()
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+}
+
+func TestClientRemote(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "home/")
+	client := &Client{Target: tmp.Join("home")}
+
+	_, err := client.Update(ctx, Options{})
+	require.ErrorIs(t, err, ErrNoRemotePackages)
+
+	gitCommit(t, tmp.Join("repo"), "vim/.vimrc")
+	url := "file://" + tmp.Join("repo").String() + "#path=vim"
+
+	_, err = client.Install(ctx, Options{}, url)
+	require.NoError(t, err)
+
+	remote, err := pkg.ParseRemote(url)
+	require.NoError(t, err)
+	source := remote.Dir(tmp.Join("cache/stowaway"))
+
+	link, err := tmp.Join("home/.vimrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, client.PackageState(source).Join("source/.vimrc"), link)
+
+	// The package is installed from the files of the commit in the store
+	store, err := client.store()
+	require.NoError(t, err)
+
+	root, err := client.PackageState(source).Join("root").Readlink()
+	require.NoError(t, err)
+	_, stored := store.EntryOf(root)
+	require.True(t, stored)
+
+	statuses, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	require.Equal(t, url, statuses[0].Origin.URL)
+	require.Equal(t, statuses[0].Origin.Commit, statuses[0].Upstream)
+	installed := statuses[0].Origin.Commit
+
+	// New commits are reported until the package is updated
+	gitCommit(t, tmp.Join("repo"), "vim/.gvimrc")
+
+	statuses, err = client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, installed, statuses[0].Origin.Commit)
+	require.NotEqual(t, installed, statuses[0].Upstream)
+	require.Contains(t, statuses[0].String(), "upstream now")
+
+	_, err = client.Update(ctx, Options{})
+	require.NoError(t, err)
+
+	_, err = tmp.Join("home/.gvimrc").Readlink()
+	require.NoError(t, err)
+
+	// The files of the commit installed before are kept for its generation
+	require.FileExists(t, root.Join(".vimrc").String())
+	require.NoFileExists(t, root.Join(".gvimrc").String())
+
+	statuses, err = client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, statuses[0].Upstream, statuses[0].Origin.Commit)
+	require.NotContains(t, statuses[0].String(), "upstream now")
+
+	// Uninstalling does not need the repository
+	require.NoError(t, tmp.Join("repo").RemoveAll())
+	_, err = client.Uninstall(ctx, Options{}, url)
+	require.NoError(t, err)
+
+	exists, err := tmp.Join("home/.vimrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestClientArchive(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "dotfiles/vim/.vimrc", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp}
+
+	checksum, err := pkg.Pack(tmp.Join("dotfiles/vim"), tmp.Join("vim.tar.gz"))
+	require.NoError(t, err)
+
+	// The source can go away once the archive is installed
+	require.NoError(t, tmp.Join("dotfiles").RemoveAll())
+
+	_, err = client.Install(ctx, Options{}, "vim.tar.gz")
+	require.NoError(t, err)
+
+	store := pkg.Store{Dir: tmp.Join("data/stowaway/store")}
+	state := client.PackageState(tmp.Join("vim.tar.gz"))
+
+	link, err := tmp.Join("home/.vimrc").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, state.Join("source/.vimrc"), link)
+
+	source, err := state.Join("source").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, store.Entry(checksum).Join("vim"), source)
+
+	statuses, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	require.Equal(t, "installed from sha256:"+checksum[:7], statuses[0].String())
+
+	// Archives are not updated
+	_, err = client.Update(ctx, Options{})
+	require.ErrorIs(t, err, ErrNoRemotePackages)
+
+	// Installing a changed archive replaces the package and its entry
+	for _, name := range []string{".vimrc", ".gvimrc"} {
+		require.NoError(t, tmp.Join("dotfiles/vim").MkdirAll(0755))
+		require.NoError(t, tmp.Join("dotfiles/vim", name).WriteFile([]byte(name), 0644))
+	}
+
+	changed, err := pkg.Pack(tmp.Join("dotfiles/vim"), tmp.Join("vim.tar.gz"))
+	require.NoError(t, err)
+
+	_, err = client.Install(ctx, Options{}, "vim.tar.gz#sha256="+changed)
+	require.NoError(t, err)
+	require.DirExists(t, store.Entry(changed).String())
+
+	// The old entry is kept for the generation it was installed in
+	require.DirExists(t, store.Entry(checksum).String())
+
+	// The archive is not needed to uninstall it
+	require.NoError(t, tmp.Join("vim.tar.gz").Remove())
+	_, err = client.Uninstall(ctx, Options{}, "vim.tar.gz")
+	require.NoError(t, err)
+
+	exists, err := tmp.Join("home/.gvimrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = client.Uninstall(ctx, Options{}, "vim.tar.gz")
+	require.ErrorIs(t, err, pkg.ErrPackageNotInstalled)
+
+	// Entries are removed once no generation uses them either
+	require.NoError(t, client.GenerationsDir().RemoveAll())
+	removed, err := client.GC()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{checksum, changed}, removed)
+
+	// Nothing is kept for a plan or a failed checksum
+	_, err = pkg.Pack(tmp.Join("dotfiles/vim"), tmp.Join("vim.tar.gz"))
+	require.NoError(t, err)
+
+	_, err = client.Plan(ctx, false, "vim.tar.gz")
+	require.NoError(t, err)
+
+	refs, err := store.Dir.Join("refs").ReadDir()
+	require.True(t, err == nil || os.IsNotExist(err), err)
+	require.Empty(t, refs)
+
+	_, err = client.Install(ctx, Options{}, "vim.tar.gz#sha256="+checksum)
+	require.ErrorIs(t, err, pkg.ErrChecksumMismatch)
+
+	entries, err := store.Dir.ReadDir()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.Equal(t, "refs", entry.Name())
+	}
+
+	// Archives must be signed once the user has allowed signers
+	signers, err := pkg.AllowedSignersPath()
+	require.NoError(t, err)
+	require.NoError(t, signers.Parent().MkdirAll(0755))
+	require.NoError(t, signers.WriteFile(nil, 0644))
+
+	_, err = client.Install(ctx, Options{}, "vim.tar.gz")
+	require.ErrorIs(t, err, pkg.ErrInvalidSignature)
+}
+
+func TestClientStore(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp}
+
+	write := func(contents string) {
+		require.NoError(t, tmp.Join("vim").MkdirAll(0755))
+		require.NoError(t, tmp.Join("vim/.vimrc").WriteFile([]byte(contents), 0644))
+	}
+
+	read := func() string {
+		data, err := os.ReadFile(tmp.Join("home/.vimrc").String())
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	write("first")
+	_, err := client.Install(ctx, Options{Store: true}, "vim")
+	require.NoError(t, err)
+
+	// Changing the package does not change what is installed
+	write("second")
+	require.Equal(t, "first", read())
+
+	_, err = client.Rollback(ctx, Options{}, "vim")
+	require.ErrorIs(t, err, ErrNoSnapshot)
+
+	_, err = client.Install(ctx, Options{Store: true}, "vim")
+	require.NoError(t, err)
+	require.Equal(t, "second", read())
+
+	statuses, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	require.Len(t, statuses[0].Origin.Previous, 1)
+	require.Contains(t, statuses[0].String(), "installed from snapshot")
+
+	_, err = client.Rollback(ctx, Options{}, "vim")
+	require.NoError(t, err)
+	require.Equal(t, "first", read())
+
+	_, err = client.Rollback(ctx, Options{}, "vim")
+	require.ErrorIs(t, err, ErrNoSnapshot)
+
+	// Snapshots are kept after the package is uninstalled while the
+	// generations use them
+	_, err = client.Uninstall(ctx, Options{}, "vim")
+	require.NoError(t, err)
+
+	removed, err := client.GC()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	_, err = client.RestoreGeneration(ctx, Options{}, 0)
+	require.NoError(t, err)
+	require.Equal(t, "first", read())
+
+	// GC removes them once the package state and generations are gone
+	require.NoError(t, client.StateDir().RemoveAll())
+
+	removed, err = client.GC()
+	require.NoError(t, err)
+	require.Len(t, removed, 2)
+}
+
+func TestClientGenerations(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "home/")
+	client := &Client{Target: tmp.Join("home")}
+
+	gitCommit(t, tmp.Join("repo"), "vim/.vimrc")
+	url := "file://" + tmp.Join("repo").String() + "#path=vim"
+
+	_, err := client.Install(ctx, Options{}, url)
+	require.NoError(t, err)
+
+	_, err = client.RestoreGeneration(ctx, Options{}, 0)
+	require.ErrorIs(t, err, pkg.ErrGenerationNotFound)
+
+	gitCommit(t, tmp.Join("repo"), "vim/.gvimrc")
+	_, err = client.Update(ctx, Options{})
+	require.NoError(t, err)
+
+	// Dry runs and failures are not recorded
+	_, err = client.Install(ctx, Options{DryRun: true}, url)
+	require.NoError(t, err)
+
+	_, err = client.Uninstall(ctx, Options{}, tmp.Join("missing").String())
+	require.Error(t, err)
+
+	generations, err := client.Generations()
+	require.NoError(t, err)
+	require.Len(t, generations, 2)
+	require.Equal(t, []string{".gvimrc", ".vimrc"}, generations[1].Packages[0].Links)
+	require.NotEqual(t, generations[0].Packages[0].Origin.Commit, generations[1].Packages[0].Origin.Commit)
+
+	// Restoring the first generation checks out its commit again
+	_, err = client.RestoreGeneration(ctx, Options{}, 1)
+	require.NoError(t, err)
+
+	exists, err := tmp.Join("home/.gvimrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	statuses, err := client.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, generations[0].Packages[0].Origin.Commit, statuses[0].Origin.Commit)
+
+	generations, err = client.Generations()
+	require.NoError(t, err)
+	require.Len(t, generations, 3)
+
+	// Only the most recent generations are kept
+	for i := 0; i < maxGenerations; i++ {
+		if i%2 == 0 {
+			_, err = client.Uninstall(ctx, Options{}, url)
+		} else {
+			_, err = client.RestoreGeneration(ctx, Options{}, 0)
+		}
+
+		require.NoError(t, err)
+	}
+
+	generations, err = client.Generations()
+	require.NoError(t, err)
+	require.Len(t, generations, maxGenerations)
+	require.Equal(t, 3+maxGenerations, generations[len(generations)-1].Number)
+}
+
+func TestClientGenerationsInvalidManifest(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "dotfiles/bash/src/.bashrc", "dotfiles/vim/.vimrc", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp.Join("dotfiles")}
+
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte("name = \"shell\"\n"), 0644))
+	_, err := client.Install(ctx, Options{}, "bash", "vim")
+	require.NoError(t, err)
+
+	// Generations come from the package state, so a manifest broken since
+	// the package was installed does not fail other packages
+	require.NoError(t, tmp.Join("dotfiles/bash/stowaway.toml").WriteFile([]byte("name = \"shell\"\nbad = 1\n"), 0644))
+	_, err = client.Uninstall(ctx, Options{}, "vim")
+	require.NoError(t, err)
+
+	generations, err := client.Generations()
+	require.NoError(t, err)
+	require.Len(t, generations, 2)
+	require.Len(t, generations[1].Packages, 1)
+	require.Equal(t, "shell", generations[1].Packages[0].Name)
+	require.Equal(t, tmp.Join("dotfiles/bash").String(), generations[1].Packages[0].Root)
+	require.Equal(t, []string{".bashrc"}, generations[1].Packages[0].Links)
+
+	// The package is uninstalled with the manifest it was installed with
+	_, err = client.Install(ctx, Options{}, "bash")
+	require.ErrorIs(t, err, pkg.ErrInvalidManifest)
+	_, err = client.Uninstall(ctx, Options{}, "bash")
+	require.NoError(t, err)
+
+	exists, err := tmp.Join("home/.bashrc").Exists()
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestClientBackups(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.bashrc", "dotfiles/bash/.profile", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp.Join("dotfiles")}
+	ctx := context.Background()
+
+	require.NoError(t, tmp.Join("home/.bashrc").WriteFile([]byte("original"), 0644))
+	require.NoError(t, tmp.Join("home/.profile").WriteFile([]byte("original"), 0644))
+
+	_, err := client.Install(ctx, Options{}, "bash")
+	require.ErrorIs(t, err, ErrFailed)
+
+	_, err = client.Install(ctx, Options{Conflict: pkg.ConflictBackup}, "bash")
+	require.NoError(t, err)
+
+	backups, err := client.Backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	require.Equal(t, ".bashrc", backups[0].Name)
+	require.Equal(t, tmp.Join("dotfiles/bash"), backups[0].Package.Source)
+
+	// Backups that an installed package restores are not pruned, and cannot
+	// be restored while its symlinks are in the way
+	removed, err := client.PruneBackups()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	_, err = client.RestoreBackup(backups[0].ID, ".bashrc")
+	require.ErrorIs(t, err, pkg.ErrBackupConflict)
+
+	_, err = client.RestoreBackup("missing")
+	require.ErrorIs(t, err, pkg.ErrBackupNotFound)
+
+	// A backup that is restored by hand is forgotten by the package
+	require.NoError(t, tmp.Join("home/.profile").Remove())
+	restored, err := client.RestoreBackup(backups[0].ID, ".profile")
+	require.NoError(t, err)
+	require.Equal(t, []pkg.Backup{backups[1].Backup}, restored)
+
+	recorded, err := pkg.ReadBackups(client.PackageState(tmp.Join("dotfiles/bash")))
+	require.NoError(t, err)
+	require.Equal(t, []pkg.Backup{backups[0].Backup}, recorded)
+
+	// Backups that no package restores are pruned
+	require.NoError(t, client.PackageState(tmp.Join("dotfiles/bash")).Join("backups.toml").Remove())
+	removed, err = client.PruneBackups()
+	require.NoError(t, err)
+	require.Equal(t, []pkg.Backup{backups[0].Backup}, removed)
+
+	backups, err = client.Backups()
+	require.NoError(t, err)
+	require.Empty(t, backups)
+
+	contents, err := os.ReadFile(tmp.Join("home/.profile").String())
+	require.NoError(t, err)
+	require.Equal(t, "original", string(contents))
+}
+
+func TestClientCollisions(t *testing.T) {
+	tmp := tmpDir(t, "dotfiles/bash/.profile", "dotfiles/zsh/.profile", "dotfiles/work/src/.profile", "home/")
+	client := &Client{Target: tmp.Join("home"), Dir: tmp.Join("dotfiles")}
+	ctx := context.Background()
+
+	require.NoError(t, tmp.Join("dotfiles/work/stowaway.toml").WriteFile([]byte("name = \"work\"\npriority = 1\n"), 0644))
+
+	_, err := client.Install(ctx, Options{}, "bash")
+	require.NoError(t, err)
+
+	// Packages that collide are reported by name, even with --force
+	results, err := client.Install(ctx, Options{Conflict: pkg.ConflictOverwrite}, "zsh")
+	require.ErrorIs(t, err, ErrFailed)
+	require.ErrorIs(t, results[0].Err, pkg.ErrCollision)
+	require.EqualError(t, results[0].Err, "pkg: package zsh and package bash both link .profile (give one of them a higher priority to shadow the other)")
+
+	_, err = client.Install(ctx, Options{}, "work")
+	require.NoError(t, err)
+
+	link, err := tmp.Join("home/.profile").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, client.PackageState(tmp.Join("dotfiles/work")).Join("source/.profile"), link)
+
+	_, err = client.Uninstall(ctx, Options{}, "work")
+	require.NoError(t, err)
+
+	link, err = tmp.Join("home/.profile").Readlink()
+	require.NoError(t, err)
+	require.Equal(t, client.PackageState(tmp.Join("dotfiles/bash")).Join("source/.profile"), link)
+}
+
+func TestClientMigrateState(t *testing.T) {
+	ctx := context.Background()
+	tmp := tmpDir(t, "vim/.vimrc", "home/")
+
+	// Older versions kept the state in the target directory
+	legacy := &Client{Target: tmp.Join("home"), Dir: tmp, State: tmp.Join("home", StateDirName)}
+	_, err := legacy.Install(ctx, Options{Store: true}, "vim")
+	require.NoError(t, err)
+
+	client := &Client{Target: tmp.Join("home"), Dir: tmp}
+	migrated, err := client.MigrateState()
+	require.NoError(t, err)
+	require.True(t, migrated)
+
+	installed, err := client.List()
+	require.NoError(t, err)
+	require.Len(t, installed, 1)
+
+	generations, err := client.Generations()
+	require.NoError(t, err)
+	require.Len(t, generations, 1)
+
+	// The store knows the package is still installed
+	removed, err := client.GC()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	_, err = client.Uninstall(ctx, Options{}, "vim")
+	require.NoError(t, err)
+
+	_, err = tmp.Join("home/.vimrc").Readlink()
+	require.True(t, os.IsNotExist(err))
+
+	migrated, err = client.MigrateState()
+	require.NoError(t, err)
+	require.False(t, migrated)
+}
@@ -0,0 +1,58 @@
+package stowaway
+
+import (
+	"github.com/jamesbehr/stowaway/filesystem"
+	"github.com/jamesbehr/stowaway/pkg"
+)
+
+// The types and constants from package pkg that are part of the Client API,
+// so that programs embedding Stowaway do not need to import pkg for them.
+type (
+	// Result is the outcome of installing or uninstalling one package
+	Result = pkg.Result
+
+	// Policy is what happens when a hook fails
+	Policy = pkg.Policy
+
+	// TrustStore is the store of approved hooks
+	TrustStore = pkg.TrustStore
+
+	// UntrustedHook is a hook that is not in the trust store, or has
+	// changed since it was approved
+	UntrustedHook = pkg.UntrustedHook
+
+	// ConflictStrategy is what happens to a file in the target directory
+	// that is in the way of a symlink
+	ConflictStrategy = pkg.ConflictStrategy
+
+	// UnresolvedConflict is a file in the way of a symlink whose strategy
+	// is ConflictAsk
+	UnresolvedConflict = pkg.UnresolvedConflict
+)
+
+const (
+	PolicyFail     = pkg.PolicyFail
+	PolicyWarn     = pkg.PolicyWarn
+	PolicyRollback = pkg.PolicyRollback
+)
+
+const (
+	ConflictFail      = pkg.ConflictFail
+	ConflictSkip      = pkg.ConflictSkip
+	ConflictBackup    = pkg.ConflictBackup
+	ConflictOverwrite = pkg.ConflictOverwrite
+	ConflictAdopt     = pkg.ConflictAdopt
+	ConflictAsk       = pkg.ConflictAsk
+)
+
+// LoadTrustStore reads the trust store at path. The store is empty if the
+// file does not exist.
+func LoadTrustStore(path filesystem.Path) (*TrustStore, error) {
+	return pkg.LoadTrustStore(path)
+}
+
+// SandboxHelper must be called first thing in main by programs that set
+// Options.Sandbox, see pkg.SandboxHelper.
+func SandboxHelper() {
+	pkg.SandboxHelper()
+}